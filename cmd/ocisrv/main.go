@@ -115,7 +115,7 @@ func unmarshalRegistry(dec *jsontext.Decoder, rp *registry, opts json.Options) e
 		return fmt.Errorf("no registry type found for kind %q", kind.Kind)
 	}
 	r := reflect.New(t)
-	if err := json.Unmarshal(data, r.Interface()); err != nil {
+	if err := json.Unmarshal(data, r.Interface(), opts); err != nil {
 		return err
 	}
 	*rp = r.Elem().Interface().(registry)
@@ -19,6 +19,7 @@ import (
 	"reflect"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/jcarter3/oci"
 	"github.com/jcarter3/oci/ociclient"
@@ -26,6 +27,7 @@ import (
 	"github.com/jcarter3/oci/ocifilter"
 	"github.com/jcarter3/oci/ocimem"
 	"github.com/jcarter3/oci/ociunify"
+	"github.com/jcarter3/oci/ociupload"
 )
 
 var kindToRegistryType = make(map[string]reflect.Type)
@@ -36,6 +38,8 @@ func init() {
 		selectRegistry{},
 		readOnlyRegistry{},
 		immutableRegistry{},
+		trustedRegistry{},
+		validateRegistry{},
 		unifyRegistry{},
 		memRegistry{},
 		debugRegistry{},
@@ -101,7 +105,9 @@ func (r readOnlyRegistry) new() (oci.Interface, error) {
 }
 
 type immutableRegistry struct {
-	Registry registry `json:"registry"`
+	Registry      registry         `json:"registry"`
+	ImmutableTags []*regexp.Regexp `json:"immutableTags,omitempty"`
+	MutableTags   []*regexp.Regexp `json:"mutableTags,omitempty"`
 }
 
 func (r immutableRegistry) new() (oci.Interface, error) {
@@ -109,33 +115,167 @@ func (r immutableRegistry) new() (oci.Interface, error) {
 	if err != nil {
 		return nil, err
 	}
-	return ocifilter.Immutable(r1), nil
+	if len(r.ImmutableTags) == 0 && len(r.MutableTags) == 0 {
+		return ocifilter.Immutable(r1), nil
+	}
+	return ocifilter.ImmutableWithPolicy(r1, &ocifilter.ImmutablePolicy{
+		ImmutableTags: r.ImmutableTags,
+		MutableTags:   r.MutableTags,
+	}), nil
+}
+
+type trustedRegistry struct {
+	Registry      registry `json:"registry"`
+	ArtifactTypes []string `json:"artifactTypes,omitempty"`
+	Index         string   `json:"index,omitempty"`
+}
+
+var trustIndexModes = map[string]ocifilter.IndexTrust{
+	"":                ocifilter.TrustIndex,
+	"index":           ocifilter.TrustIndex,
+	"children":        ocifilter.TrustChildren,
+	"indexOrChildren": ocifilter.TrustIndexOrChildren,
+}
+
+func (r trustedRegistry) new() (oci.Interface, error) {
+	r1, err := r.Registry.new()
+	if err != nil {
+		return nil, err
+	}
+	mode, ok := trustIndexModes[r.Index]
+	if !ok {
+		return nil, fmt.Errorf("unknown index trust mode %q", r.Index)
+	}
+	return ocifilter.Trusted(r1, &ocifilter.TrustPolicy{
+		ArtifactTypes: r.ArtifactTypes,
+		Index:         mode,
+	}), nil
+}
+
+type validateRegistry struct {
+	Registry           registry `json:"registry"`
+	ManifestMediaTypes []string `json:"manifestMediaTypes,omitempty"`
+	ConfigMediaTypes   []string `json:"configMediaTypes,omitempty"`
+	LayerMediaTypes    []string `json:"layerMediaTypes,omitempty"`
+	MaxManifestSize    int64    `json:"maxManifestSize,omitempty"`
+}
+
+func (r validateRegistry) new() (oci.Interface, error) {
+	r1, err := r.Registry.new()
+	if err != nil {
+		return nil, err
+	}
+	return ocifilter.ValidateManifests(r1, &ocifilter.ManifestPolicy{
+		ManifestMediaTypes: r.ManifestMediaTypes,
+		ConfigMediaTypes:   r.ConfigMediaTypes,
+		LayerMediaTypes:    r.LayerMediaTypes,
+		MaxSize:            r.MaxManifestSize,
+	}), nil
 }
 
 type unifyRegistry struct {
-	Registries []registry `json:"registries"`
-	// TODO options
+	// Registries holds backends with the target role.
+	Registries           []registry     `json:"registries,omitempty"`
+	Backends             []unifyBackend `json:"backends,omitempty"`
+	ReadPolicy           string         `json:"readPolicy,omitempty"`
+	WritePolicy          string         `json:"writePolicy,omitempty"`
+	TagConflictPolicy    string         `json:"tagConflictPolicy,omitempty"`
+	PartialFailurePolicy string         `json:"partialFailurePolicy,omitempty"`
 }
 
+type unifyBackend struct {
+	Registry registry `json:"registry"`
+	Role     string   `json:"role,omitempty"`
+}
+
+var (
+	unifyRoles = map[string]ociunify.Role{
+		"":         ociunify.RoleTarget,
+		"target":   ociunify.RoleTarget,
+		"fallback": ociunify.RoleFallback,
+		"mirror":   ociunify.RoleMirror,
+	}
+	unifyReadPolicies = map[string]ociunify.ReadPolicy{
+		"":           ociunify.ReadSequential,
+		"sequential": ociunify.ReadSequential,
+		"concurrent": ociunify.ReadConcurrent,
+	}
+	unifyWritePolicies = map[string]ociunify.WritePolicy{
+		"":             ociunify.WriteAll,
+		"all":          ociunify.WriteAll,
+		"primaryOnly":  ociunify.WritePrimaryOnly,
+		"firstSuccess": ociunify.WriteFirstSuccess,
+	}
+	unifyTagConflictPolicies = map[string]ociunify.TagConflictPolicy{
+		"":          ociunify.TagConflictError,
+		"error":     ociunify.TagConflictError,
+		"firstWins": ociunify.TagConflictFirstWins,
+		"omit":      ociunify.TagConflictOmit,
+	}
+	unifyPartialFailurePolicies = map[string]ociunify.PartialFailurePolicy{
+		"":         ociunify.PartialFailureError,
+		"error":    ociunify.PartialFailureError,
+		"tolerate": ociunify.PartialFailureTolerate,
+	}
+)
+
 func (r unifyRegistry) new() (oci.Interface, error) {
-	if len(r.Registries) != 2 {
-		return nil, fmt.Errorf("can currently unify exactly two registries only")
+	backends := make([]unifyBackend, 0, len(r.Registries)+len(r.Backends))
+	for _, r1 := range r.Registries {
+		backends = append(backends, unifyBackend{Registry: r1})
+	}
+	backends = append(backends, r.Backends...)
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("no registries to unify")
+	}
+	var opts ociunify.Options
+	var ok bool
+	if opts.ReadPolicy, ok = unifyReadPolicies[r.ReadPolicy]; !ok {
+		return nil, fmt.Errorf("unknown read policy %q", r.ReadPolicy)
 	}
-	r1 := make([]oci.Interface, len(r.Registries))
-	for i := range r.Registries {
-		ri, err := r.Registries[i].new()
+	if opts.WritePolicy, ok = unifyWritePolicies[r.WritePolicy]; !ok {
+		return nil, fmt.Errorf("unknown write policy %q", r.WritePolicy)
+	}
+	if opts.TagConflictPolicy, ok = unifyTagConflictPolicies[r.TagConflictPolicy]; !ok {
+		return nil, fmt.Errorf("unknown tag conflict policy %q", r.TagConflictPolicy)
+	}
+	if opts.PartialFailurePolicy, ok = unifyPartialFailurePolicies[r.PartialFailurePolicy]; !ok {
+		return nil, fmt.Errorf("unknown partial failure policy %q", r.PartialFailurePolicy)
+	}
+	r1 := make([]ociunify.Backend, len(backends))
+	for i, b := range backends {
+		role, ok := unifyRoles[b.Role]
+		if !ok {
+			return nil, fmt.Errorf("unknown role %q", b.Role)
+		}
+		ri, err := b.Registry.new()
 		if err != nil {
 			return nil, err
 		}
-		r1[i] = ri
+		r1[i] = ociunify.Backend{
+			Registry: ri,
+			Role:     role,
+		}
 	}
-	return ociunify.New(r1[0], r1[1], nil), nil
+	return ociunify.NewN(r1, &opts), nil
 }
 
-type memRegistry struct{}
+type memRegistry struct {
+	UploadTTL string `json:"uploadTTL,omitempty"`
+}
 
 func (r memRegistry) new() (oci.Interface, error) {
-	return ocimem.New(), nil
+	cfg := ocimem.Config{
+		UploadTTL: ociupload.DefaultTTL,
+	}
+	if r.UploadTTL != "" {
+		ttl, err := time.ParseDuration(r.UploadTTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid uploadTTL: %v", err)
+		}
+		cfg.UploadTTL = ttl
+	}
+	return ocimem.NewWithConfig(&cfg), nil
 }
 
 type debugRegistry struct {
@@ -37,15 +37,77 @@ import "regexp"
 #immutable: {
 	kind:      "immutable"
 	registry!: #registry
+
+	// immutableTags holds patterns of tags that can't be changed
+	// once pushed. If it's absent, all tags are immutable.
+	immutableTags?: [...regexp.Valid]
+
+	// mutableTags holds patterns of tags that can be changed
+	// even when they match immutableTags.
+	mutableTags?: [...regexp.Valid]
+}
+
+#trusted: {
+	kind:      "trusted"
+	registry!: #registry
+
+	// artifactTypes holds the artifact types of referrers,
+	// such as signatures, that a manifest must have
+	// to be served. If it's absent, any referrer will do.
+	artifactTypes?: [...string]
+
+	// index determines whether an image index must itself
+	// have a referrer, or whether each of its children must.
+	index?: "index" | "children" | "indexOrChildren"
+}
+
+#validate: {
+	kind:      "validate"
+	registry!: #registry
+
+	// The media type lists hold the media types allowed in
+	// pushed manifests. An entry ending in "*" allows any
+	// media type with that prefix. Absent lists allow the
+	// standard manifest types and any config or layer type.
+	manifestMediaTypes?: [...string]
+	configMediaTypes?:   [...string]
+	layerMediaTypes?:    [...string]
+
+	// maxManifestSize holds the maximum size of a manifest
+	// in bytes; it defaults to 4MiB. A negative value
+	// means no limit.
+	maxManifestSize?: int
 }
 
 #unify: {
 	kind: "unify"
-	registries!: [#registry, #registry]
+
+	// registries holds registries that are both read
+	// from and written to. It's a shorthand for
+	// backends with the "target" role.
+	registries?: [...#registry]
+
+	// backends holds registries with explicit roles.
+	backends?: [...#unifyBackend]
+
+	readPolicy?:        "sequential" | "concurrent"
+	writePolicy?:       "all" | "primaryOnly" | "firstSuccess"
+	tagConflictPolicy?: "error" | "firstWins" | "omit"
+
+	partialFailurePolicy?: "error" | "tolerate"
+}
+
+#unifyBackend: {
+	registry!: #registry
+	role?:     "target" | "fallback" | "mirror"
 }
 
 #mem: {
 	kind: "mem"
+	// uploadTTL holds how long a chunked upload can be
+	// inactive before it's abandoned, as a Go duration
+	// string. A negative duration means never.
+	uploadTTL?: string
 }
 
 #debug: {
@@ -57,6 +119,8 @@ import "regexp"
 	#select |
 	#readOnly |
 	#immutable |
+	#trusted |
+	#validate |
 	#unify |
 	#mem |
 	#debug
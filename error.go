@@ -21,6 +21,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
 )
 
@@ -40,6 +41,7 @@ var errorStatuses = map[string]int{
 	ErrUnsupported.Code():         http.StatusBadRequest,
 	ErrTooManyRequests.Code():     http.StatusTooManyRequests,
 	ErrRangeInvalid.Code():        http.StatusRequestedRangeNotSatisfiable,
+	ErrPreconditionFailed.Code():  http.StatusPreconditionFailed,
 }
 
 // WireErrors is the JSON format used for error responses in
@@ -171,6 +173,10 @@ type HTTPError interface {
 // Both response and body may be nil.
 //
 // A shallow copy is made of the response.
+//
+// For a 429 (Too Many Requests) response, the rate-limit state
+// reported in the response headers is attached to the error;
+// see [RateLimitFromError].
 func NewHTTPError(err error, statusCode int, response *http.Response, body []byte) HTTPError {
 	herr := &httpError{
 		underlying: err,
@@ -180,6 +186,15 @@ func NewHTTPError(err error, statusCode int, response *http.Response, body []byt
 		herr.response = ref(*response)
 		herr.response.Body = nil
 		herr.body = body
+		if statusCode == http.StatusTooManyRequests {
+			rl, _ := ParseRateLimit(response.Header, time.Now())
+			if rl.Remaining < 0 {
+				// The response tells us that the quota is used up
+				// even if the headers don't.
+				rl.Remaining = 0
+			}
+			herr.rateLimit = &rl
+		}
 	}
 	return herr
 }
@@ -189,6 +204,7 @@ type httpError struct {
 	statusCode int
 	response   *http.Response
 	body       []byte
+	rateLimit  *RateLimitStatus
 }
 
 // Unwrap implements the [errors] Unwrap interface.
@@ -202,6 +218,8 @@ func (e *httpError) Is(err error) bool {
 	switch e.statusCode {
 	case http.StatusRequestedRangeNotSatisfiable:
 		return err == ErrRangeInvalid
+	case http.StatusPreconditionFailed:
+		return err == ErrPreconditionFailed
 	}
 	return false
 }
@@ -233,6 +251,15 @@ func (e *httpError) ResponseBody() []byte {
 	return e.body
 }
 
+// RateLimitStatus returns the rate-limit state attached to the error.
+// It's used by [RateLimitFromError].
+func (e *httpError) RateLimitStatus() (RateLimitStatus, bool) {
+	if e.rateLimit == nil {
+		return RateLimitStatus{}, false
+	}
+	return *e.rateLimit, true
+}
+
 // WriteError marshals the given error as JSON using [MarshalError] and
 // then writes it to w. It returns the error returned from w.Write.
 func WriteError(w http.ResponseWriter, err error) error {
@@ -341,6 +368,15 @@ var (
 	// but does not assign any error code to it.
 	// We borrowed RANGE_INVALID from the Docker registry implementation, a de facto standard.
 	ErrRangeInvalid = NewError("invalid content range", "RANGE_INVALID", nil)
+
+	// ErrPreconditionFailed is returned when a conditional tag update,
+	// such as one made with [PushManifestParameters.IfTagDigest] or
+	// an If-Match header, fails because the tag doesn't refer to
+	// the expected manifest.
+	// ociserver relies on this error to return 412 HTTP status codes.
+	//
+	// Like ErrRangeInvalid, it has no error code in the spec.
+	ErrPreconditionFailed = NewError("precondition failed", "PRECONDITION_FAILED", nil)
 )
 
 func appendHTTPStatusPrefix(buf []byte, statusCode int) []byte {
@@ -149,6 +149,16 @@ type Reader interface {
 type PushManifestParameters struct {
 	Digest Digest
 	Tags   []string
+
+	// IfTagDigest, if non-empty, makes the push conditional on the
+	// single tag in Tags currently referring to the manifest with
+	// this digest, so that a tag can be moved without racing against
+	// other updates to it. If the tag doesn't exist or refers to a
+	// different manifest, PushManifest fails with [ErrPreconditionFailed].
+	//
+	// Implementations that cannot make the check atomically with
+	// the update fail with [ErrUnsupported].
+	IfTagDigest Digest
 }
 
 // Writer defines registry actions that write to blobs, manifests and tags.
@@ -204,6 +214,8 @@ type Writer interface {
 	// PushManifest pushes a manifest with the given media type and contents.
 	//
 	// It returns a descriptor suitable for accessing the manfiest.
+	// Errors:
+	// - ErrPreconditionFailed when params.IfTagDigest doesn't match the tag.
 	PushManifest(ctx context.Context, repo string, contents []byte, mediaType string, params *PushManifestParameters) (Descriptor, error)
 }
 
@@ -0,0 +1,175 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ocimanifest extracts the references held in manifests,
+// for use by packages that walk the content of a registry.
+package ocimanifest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jcarter3/oci"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Docker manifest media types, which are understood
+// alongside their OCI counterparts.
+const (
+	MediaTypeDockerManifest      = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList  = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerSchema1       = "application/vnd.docker.distribution.manifest.v1+json"
+	MediaTypeDockerSchema1Signed = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+
+	MediaTypeDockerForeignLayer   = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+	MediaTypeDockerForeignLayerV2 = "application/vnd.docker.image.rootfs.foreign.diff.tar"
+)
+
+// IsIndex reports whether mediaType is that of an
+// OCI image index or a Docker manifest list.
+func IsIndex(mediaType string) bool {
+	return mediaType == ocispec.MediaTypeImageIndex || mediaType == MediaTypeDockerManifestList
+}
+
+// Refs holds the references held in a manifest.
+type Refs struct {
+	// Blobs holds the config and layers of an image manifest,
+	// other than foreign layers, which are stored outside the
+	// registry. Docker schema1 manifests record only the digests
+	// of their layers, so those descriptors have a Size of -1.
+	Blobs []oci.Descriptor
+
+	// Manifests holds the entries of an index.
+	Manifests []oci.Descriptor
+
+	// Subject holds the subject of the manifest, if any.
+	Subject *oci.Descriptor
+}
+
+// Parse returns the references held in a manifest with the given
+// media type and content. If mediaType is empty, the mediaType
+// field in the content is used. Manifests with unknown media
+// types hold no references.
+func Parse(mediaType string, data []byte) (Refs, error) {
+	if mediaType == "" {
+		var m struct {
+			MediaType string `json:"mediaType"`
+		}
+		if err := json.Unmarshal(data, &m); err != nil {
+			return Refs{}, err
+		}
+		mediaType = m.MediaType
+	}
+	switch mediaType {
+	case ocispec.MediaTypeImageManifest, MediaTypeDockerManifest:
+		var m oci.Manifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return Refs{}, err
+		}
+		refs := Refs{
+			Blobs:   []oci.Descriptor{m.Config},
+			Subject: m.Subject,
+		}
+		for _, layer := range m.Layers {
+			if layer.MediaType != MediaTypeDockerForeignLayer && layer.MediaType != MediaTypeDockerForeignLayerV2 {
+				refs.Blobs = append(refs.Blobs, layer)
+			}
+		}
+		return refs, nil
+	case ocispec.MediaTypeImageIndex, MediaTypeDockerManifestList:
+		var index ocispec.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return Refs{}, err
+		}
+		return Refs{
+			Manifests: index.Manifests,
+			Subject:   index.Subject,
+		}, nil
+	case MediaTypeDockerSchema1, MediaTypeDockerSchema1Signed:
+		var m struct {
+			FSLayers []struct {
+				BlobSum oci.Digest `json:"blobSum"`
+			} `json:"fsLayers"`
+		}
+		if err := json.Unmarshal(data, &m); err != nil {
+			return Refs{}, err
+		}
+		var refs Refs
+		for _, layer := range m.FSLayers {
+			refs.Blobs = append(refs.Blobs, oci.Descriptor{
+				Digest: layer.BlobSum,
+				Size:   -1,
+			})
+		}
+		return refs, nil
+	}
+	return Refs{}, nil
+}
+
+// Get reads the manifest with the given digest from r
+// and returns its descriptor and the references it holds.
+func Get(ctx context.Context, r oci.Interface, repo string, dgst oci.Digest) (oci.Descriptor, Refs, error) {
+	rd, err := r.GetManifest(ctx, repo, dgst)
+	if err != nil {
+		return oci.Descriptor{}, Refs{}, err
+	}
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		return oci.Descriptor{}, Refs{}, fmt.Errorf("cannot read manifest %s in %s: %w", dgst, repo, err)
+	}
+	desc := rd.Descriptor()
+	refs, err := Parse(desc.MediaType, data)
+	if err != nil {
+		return oci.Descriptor{}, Refs{}, fmt.Errorf("invalid manifest %s in %s: %v", dgst, repo, err)
+	}
+	return desc, refs, nil
+}
+
+// Reachable returns the set of manifests in repo reachable from the
+// given roots, including the roots themselves, by following the
+// entries of indexes. Manifests that aren't present in the
+// registry are included but not followed.
+func Reachable(ctx context.Context, r oci.Interface, repo string, roots []oci.Digest) (map[oci.Digest]bool, error) {
+	reachable := make(map[oci.Digest]bool)
+	var walk func(dgst oci.Digest) error
+	walk = func(dgst oci.Digest) error {
+		if reachable[dgst] {
+			return nil
+		}
+		reachable[dgst] = true
+		_, refs, err := Get(ctx, r, repo, dgst)
+		if err != nil {
+			if errors.Is(err, oci.ErrManifestUnknown) {
+				return nil
+			}
+			return err
+		}
+		for _, m := range refs.Manifests {
+			if err := walk(m.Digest); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, dgst := range roots {
+		if err := walk(dgst); err != nil {
+			return nil, err
+		}
+	}
+	return reachable, nil
+}
@@ -0,0 +1,65 @@
+package ocimanifest
+
+import (
+	"testing"
+
+	"github.com/jcarter3/oci"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	d1 = digest.FromString("one")
+	d2 = digest.FromString("two")
+	d3 = digest.FromString("three")
+)
+
+var parseTests = []struct {
+	testName  string
+	mediaType string
+	data      string
+	want      Refs
+}{{
+	testName:  "OCIManifest",
+	mediaType: "application/vnd.oci.image.manifest.v1+json",
+	data:      `{"config": {"digest": "` + string(d1) + `", "size": 1}, "layers": [{"digest": "` + string(d2) + `", "size": 2}], "subject": {"digest": "` + string(d3) + `", "size": 3}}`,
+	want: Refs{
+		Blobs:   []oci.Descriptor{{Digest: d1, Size: 1}, {Digest: d2, Size: 2}},
+		Subject: &oci.Descriptor{Digest: d3, Size: 3},
+	},
+}, {
+	testName:  "DockerManifestWithForeignLayer",
+	mediaType: MediaTypeDockerManifest,
+	data:      `{"config": {"digest": "` + string(d1) + `", "size": 1}, "layers": [{"mediaType": "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip", "digest": "` + string(d2) + `", "size": 2}, {"digest": "` + string(d3) + `", "size": 3}]}`,
+	want: Refs{
+		Blobs: []oci.Descriptor{{Digest: d1, Size: 1}, {Digest: d3, Size: 3}},
+	},
+}, {
+	testName:  "DockerManifestListFromContent",
+	mediaType: "",
+	data:      `{"mediaType": "` + MediaTypeDockerManifestList + `", "manifests": [{"digest": "` + string(d1) + `", "size": 1}]}`,
+	want: Refs{
+		Manifests: []oci.Descriptor{{Digest: d1, Size: 1}},
+	},
+}, {
+	testName:  "DockerSchema1",
+	mediaType: MediaTypeDockerSchema1Signed,
+	data:      `{"fsLayers": [{"blobSum": "` + string(d1) + `"}, {"blobSum": "` + string(d2) + `"}]}`,
+	want: Refs{
+		Blobs: []oci.Descriptor{{Digest: d1, Size: -1}, {Digest: d2, Size: -1}},
+	},
+}, {
+	testName:  "Unknown",
+	mediaType: "application/unknown",
+	data:      `{"layers": [{"digest": "` + string(d1) + `", "size": 1}]}`,
+}}
+
+func TestParse(t *testing.T) {
+	for _, test := range parseTests {
+		t.Run(test.testName, func(t *testing.T) {
+			refs, err := Parse(test.mediaType, []byte(test.data))
+			require.NoError(t, err)
+			require.Equal(t, test.want, refs)
+		})
+	}
+}
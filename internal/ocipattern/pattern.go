@@ -0,0 +1,48 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ocipattern holds helpers for the regular expressions
+// used by policies to match tag and repository names.
+package ocipattern
+
+import "regexp"
+
+// Anchored returns a copy of re that matches only the whole string.
+func Anchored(re *regexp.Regexp) *regexp.Regexp {
+	return regexp.MustCompile(`^(?:` + re.String() + `)$`)
+}
+
+// AnchoredAll returns copies of the given regular expressions
+// that match only the whole string. It returns nil if res is empty.
+func AnchoredAll(res []*regexp.Regexp) []*regexp.Regexp {
+	if len(res) == 0 {
+		return nil
+	}
+	anchored := make([]*regexp.Regexp, len(res))
+	for i, re := range res {
+		anchored[i] = Anchored(re)
+	}
+	return anchored
+}
+
+// MatchAny reports whether any of the given
+// regular expressions matches s.
+func MatchAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
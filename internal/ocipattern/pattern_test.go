@@ -0,0 +1,22 @@
+package ocipattern
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnchoredAll(t *testing.T) {
+	res := AnchoredAll([]*regexp.Regexp{
+		regexp.MustCompile(`v[0-9]+`),
+		regexp.MustCompile(`a|b`),
+	})
+	require.True(t, MatchAny(res, "v1"))
+	require.False(t, MatchAny(res, "v1-rc1"))
+	require.False(t, MatchAny(res, "xv1"))
+	// The alternation is grouped before it's anchored.
+	require.True(t, MatchAny(res, "b"))
+	require.False(t, MatchAny(res, "ab"))
+	require.Nil(t, AnchoredAll(nil))
+}
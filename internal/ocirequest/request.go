@@ -185,6 +185,35 @@ const (
 	ReqCatalogList
 )
 
+var kindNames = []string{
+	ReqPing:               "Ping",
+	ReqBlobGet:            "BlobGet",
+	ReqBlobHead:           "BlobHead",
+	ReqBlobDelete:         "BlobDelete",
+	ReqBlobStartUpload:    "BlobStartUpload",
+	ReqBlobUploadBlob:     "BlobUploadBlob",
+	ReqBlobMount:          "BlobMount",
+	ReqBlobUploadInfo:     "BlobUploadInfo",
+	ReqBlobUploadChunk:    "BlobUploadChunk",
+	ReqBlobCompleteUpload: "BlobCompleteUpload",
+	ReqManifestGet:        "ManifestGet",
+	ReqManifestHead:       "ManifestHead",
+	ReqManifestPut:        "ManifestPut",
+	ReqManifestDelete:     "ManifestDelete",
+	ReqTagsList:           "TagsList",
+	ReqReferrersList:      "ReferrersList",
+	ReqCatalogList:        "CatalogList",
+}
+
+// String returns the name of the request kind without
+// the "Req" prefix, for example "BlobGet".
+func (k Kind) String() string {
+	if k >= 0 && int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
 // Parse parses the given HTTP method and URL as an OCI registry request.
 // It understands the endpoints described in the [distribution spec].
 //
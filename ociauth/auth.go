@@ -15,6 +15,7 @@ import (
 	"time"
 
 	oci "github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/ocitrace"
 )
 
 // TODO decide on a good value for this.
@@ -383,7 +384,14 @@ func (r *registry) acquireAccessToken(ctx context.Context, requiredScope, wantSc
 	return accessToken, nil
 }
 
-func (r *registry) acquireToken(ctx context.Context, scope Scope) (*wireToken, error) {
+func (r *registry) acquireToken(ctx context.Context, scope Scope) (_ *wireToken, _err error) {
+	ctx, span := ocitrace.Start(ctx, "ociauth.AcquireToken",
+		ocitrace.String("ociauth.registry", r.host),
+		ocitrace.String("ociauth.scope", scope.String()),
+	)
+	defer func() {
+		ocitrace.End(span, _err)
+	}()
 	realm := r.wwwAuthenticate.params["realm"]
 	if realm == "" {
 		return nil, fmt.Errorf("malformed Www-Authenticate header (missing realm)")
@@ -477,6 +485,7 @@ func (r *registry) doTokenRequest(req *http.Request) (*wireToken, error) {
 	client := &http.Client{
 		Transport: r.transport,
 	}
+	ocitrace.Inject(req.Context(), req.Header)
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
@@ -17,18 +17,19 @@
 package ociclient
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"slices"
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/jcarter3/oci"
 	"github.com/opencontainers/go-digest"
@@ -36,13 +37,11 @@ import (
 
 	"github.com/jcarter3/oci/internal/ocirequest"
 	"github.com/jcarter3/oci/ociauth"
+	"github.com/jcarter3/oci/ocidebug"
 	"github.com/jcarter3/oci/ociref"
+	"github.com/jcarter3/oci/ocitrace"
 )
 
-// debug enables logging.
-// TODO this should be configurable in the API.
-const debug = false
-
 // Options holds configuration for creating a new OCI registry client.
 type Options struct {
 	// DebugID is used to prefix any log messages printed by the client.
@@ -61,6 +60,48 @@ type Options struct {
 
 	// Specifies a user agent string to use when making requests. Defaults to "jcarter3/oci"
 	UserAgent string
+
+	// Logger, if non-nil, is used to log each HTTP request made
+	// by the client at [slog.LevelDebug], or [slog.LevelWarn]
+	// if it fails. Credentials in headers are redacted.
+	// Any request ID attached to the context with
+	// [ocidebug.ContextWithRequestID] is included in the records.
+	Logger *slog.Logger
+
+	// Tracer, if non-nil, is used to start a span for each operation
+	// made by the client; see [ocitrace.New]. Token acquisitions
+	// made by [ociauth] are reported as child spans.
+	//
+	// Whether or not Tracer is set, the trace context of
+	// any active span is propagated to the registry in the
+	// traceparent header.
+	Tracer ocitrace.Tracer
+
+	// RateLimits, if non-nil, is updated with the rate-limit state
+	// reported by the registry in the headers of each response, such
+	// as the RateLimit-Limit and RateLimit-Remaining headers sent by
+	// Docker Hub. It may be shared between clients to observe the
+	// quota for several hosts.
+	//
+	// Regardless of this option, the state reported in a 429 (Too
+	// Many Requests) response is available from the returned
+	// error with [oci.RateLimitFromError].
+	RateLimits *RateLimits
+
+	// WaitForRateLimit causes the client to wait before making a
+	// request when the most recent response showed that the quota
+	// was exhausted, until it's expected to have been replenished
+	// (see [oci.RateLimitStatus.ReplenishedAt]) or the context is done.
+	WaitForRateLimit bool
+
+	// ConditionalTagUpdates specifies that the registry honours
+	// the If-Match header on manifest pushes, checking it
+	// atomically with the update, as [github.com/jcarter3/oci/ociserver]
+	// does. Only then is [oci.PushManifestParameters.IfTagDigest]
+	// supported: registries that ignore the header would update
+	// the tag unconditionally, so by default pushes that use it
+	// fail with [oci.ErrUnsupported].
+	ConditionalTagUpdates bool
 }
 
 // See https://github.com/google/go-containerregistry/issues/1091
@@ -99,15 +140,30 @@ func New(host string, opts0 *Options) (oci.Interface, error) {
 	if opts.Insecure {
 		u.Scheme = "http"
 	}
-	return &client{
+	if opts.WaitForRateLimit && opts.RateLimits == nil {
+		opts.RateLimits = new(RateLimits)
+	}
+	c := &client{
 		httpHost:   host,
 		httpScheme: u.Scheme,
 		httpClient: &http.Client{
 			Transport: opts.Transport,
 		},
-		userAgent: opts.UserAgent,
-		debugID:   opts.DebugID,
-	}, nil
+		userAgent:        opts.UserAgent,
+		debugID:          opts.DebugID,
+		logger:           opts.Logger,
+		rateLimits:       opts.RateLimits,
+		waitForRateLimit: opts.WaitForRateLimit,
+		conditionalTags:  opts.ConditionalTagUpdates,
+	}
+	if opts.Tracer != nil {
+		return &tracedClient{
+			Interface: ocitrace.New(c, opts.Tracer),
+			c:         c,
+			t:         opts.Tracer,
+		}, nil
+	}
+	return c, nil
 }
 
 type client struct {
@@ -117,7 +173,12 @@ type client struct {
 	httpClient   *http.Client
 	userAgent    string
 	debugID      string
+	logger       *slog.Logger
 	listPageSize int
+
+	rateLimits       *RateLimits
+	waitForRateLimit bool
+	conditionalTags  bool
 }
 
 type descriptorRequired byte
@@ -281,6 +342,7 @@ func (c *client) do(req *http.Request, okStatuses ...int) (*http.Response, error
 		req.URL.Host = c.httpHost
 	}
 	req.Header.Set("User-Agent", c.userAgent)
+	ocitrace.Inject(req.Context(), req.Header)
 
 	if req.Body != nil {
 		// Ensure that the body isn't consumed until the
@@ -290,33 +352,26 @@ func (c *client) do(req *http.Request, okStatuses ...int) (*http.Response, error
 		// when pushing blobs.
 		req.Header.Set("Expect", "100-continue")
 	}
-	var buf bytes.Buffer
-	if debug {
-		fmt.Fprintf(&buf, "client.Do: %s %s {{\n", req.Method, req.URL)
-		fmt.Fprintf(&buf, "\tBODY: %#v\n", req.Body)
-		for k, v := range req.Header {
-			fmt.Fprintf(&buf, "\t%s: %q\n", k, v)
+	if c.waitForRateLimit {
+		if err := c.rateLimits.wait(req.Context(), c.httpHost); err != nil {
+			return nil, err
 		}
-		c.logf("%s", buf.Bytes())
 	}
+	start := time.Now()
+	resp, err := c.roundTrip(req, okStatuses)
+	if c.logger != nil {
+		c.log(req, resp, time.Since(start), err)
+	}
+	return resp, err
+}
+
+func (c *client) roundTrip(req *http.Request, okStatuses []int) (*http.Response, error) {
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("cannot do HTTP request: %w", err)
 	}
-	if debug {
-		buf.Reset()
-		fmt.Fprintf(&buf, "} -> %s {\n", resp.Status)
-		for k, v := range resp.Header {
-			fmt.Fprintf(&buf, "\t%s: %q\n", k, v)
-		}
-		data, _ := io.ReadAll(resp.Body)
-		if len(data) > 0 {
-			fmt.Fprintf(&buf, "\tBODY: %q\n", data)
-		}
-		fmt.Fprintf(&buf, "}}\n")
-		resp.Body.Close()
-		resp.Body = io.NopCloser(bytes.NewReader(data))
-		c.logf("%s", buf.Bytes())
+	if c.rateLimits != nil {
+		c.rateLimits.record(c.httpHost, resp)
 	}
 	if len(okStatuses) == 0 && resp.StatusCode == http.StatusOK {
 		return resp, nil
@@ -331,8 +386,41 @@ func (c *client) do(req *http.Request, okStatuses ...int) (*http.Response, error
 	return nil, unexpectedStatusError(resp.StatusCode)
 }
 
-func (c *client) logf(f string, a ...any) {
-	log.Printf("ociclient %s: %s", c.debugID, fmt.Sprintf(f, a...))
+// log logs the outcome of an HTTP request to c.logger.
+// The response will be nil if the request failed.
+func (c *client) log(req *http.Request, resp *http.Response, d time.Duration, err error) {
+	ctx := req.Context()
+	level := slog.LevelDebug
+	if err != nil {
+		level = slog.LevelWarn
+	}
+	if !c.logger.Enabled(ctx, level) {
+		return
+	}
+	attrs := make([]slog.Attr, 0, 10)
+	if id := ocidebug.RequestIDFromContext(ctx); id != "" {
+		attrs = append(attrs, slog.String(ocidebug.KeyRequestID, id))
+	}
+	attrs = append(attrs,
+		slog.String("client", c.debugID),
+		slog.String("http_method", req.Method),
+		slog.String("url", req.URL.Redacted()),
+		slog.Duration(ocidebug.KeyDuration, d),
+		slog.Any("request_header", ocidebug.RedactHeader(req.Header)),
+	)
+	if resp != nil {
+		attrs = append(attrs,
+			slog.Int("status", resp.StatusCode),
+			slog.Any("response_header", ocidebug.RedactHeader(resp.Header)),
+		)
+	} else {
+		var herr oci.HTTPError
+		if errors.As(err, &herr) {
+			attrs = append(attrs, slog.Int("status", herr.StatusCode()))
+		}
+	}
+	attrs = append(attrs, ocidebug.ErrorAttrs(err)...)
+	c.logger.LogAttrs(ctx, level, "ociclient request", attrs...)
 }
 
 func locationFromResponse(resp *http.Response) (*url.URL, error) {
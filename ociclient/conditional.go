@@ -0,0 +1,198 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/internal/ocirequest"
+	"github.com/jcarter3/oci/ocitrace"
+)
+
+// ResolveTagIfChanged is like r.ResolveTag except that it also reports
+// whether the tag has changed from referring to the manifest with the
+// digest known, for example when revalidating a cached tag. If the
+// tag is unchanged, it returns false and a zero descriptor.
+//
+// When r was returned by [New], the registry is asked to make the
+// comparison by sending an If-None-Match header. For other
+// registries, the tag is resolved as usual and the digests compared.
+func ResolveTagIfChanged(ctx context.Context, r oci.Interface, repo, tag string, known oci.Digest) (oci.Descriptor, bool, error) {
+	if c, ok := r.(conditionalReader); ok {
+		return c.resolveTagIfChanged(ctx, repo, tag, known)
+	}
+	desc, err := r.ResolveTag(ctx, repo, tag)
+	if err != nil {
+		return oci.Descriptor{}, false, err
+	}
+	if desc.Digest == known {
+		return oci.Descriptor{}, false, nil
+	}
+	return desc, true, nil
+}
+
+// GetTagIfChanged is like [ResolveTagIfChanged] but returns the
+// content of the manifest when the tag has changed. If the tag
+// is unchanged, it returns a nil reader and false, and
+// when r was returned by [New] no content is transferred.
+func GetTagIfChanged(ctx context.Context, r oci.Interface, repo, tag string, known oci.Digest) (oci.BlobReader, bool, error) {
+	if c, ok := r.(conditionalReader); ok {
+		return c.getTagIfChanged(ctx, repo, tag, known)
+	}
+	rd, err := r.GetTag(ctx, repo, tag)
+	if err != nil {
+		return nil, false, err
+	}
+	if rd.Descriptor().Digest == known {
+		rd.Close()
+		return nil, false, nil
+	}
+	return rd, true, nil
+}
+
+// conditionalReader is implemented by the registries returned by [New].
+type conditionalReader interface {
+	resolveTagIfChanged(ctx context.Context, repo, tag string, known oci.Digest) (oci.Descriptor, bool, error)
+	getTagIfChanged(ctx context.Context, repo, tag string, known oci.Digest) (oci.BlobReader, bool, error)
+}
+
+// tracedClient is returned by [New] when tracing is enabled.
+// It keeps the conditional methods of the client available,
+// tracing them in the same way as the other methods.
+type tracedClient struct {
+	oci.Interface
+	c *client
+	t ocitrace.Tracer
+}
+
+func (c *tracedClient) start(ctx context.Context, method, repo, tag string, known oci.Digest) (context.Context, ocitrace.Span) {
+	return ocitrace.Start(ocitrace.ContextWithTracer(ctx, c.t), "oci."+method,
+		ocitrace.String(ocitrace.KeyRepo, repo),
+		ocitrace.String(ocitrace.KeyTag, tag),
+		ocitrace.String("oci.known_digest", string(known)),
+	)
+}
+
+func (c *tracedClient) resolveTagIfChanged(ctx context.Context, repo, tag string, known oci.Digest) (oci.Descriptor, bool, error) {
+	ctx, span := c.start(ctx, "ResolveTagIfChanged", repo, tag, known)
+	desc, changed, err := c.c.resolveTagIfChanged(ctx, repo, tag, known)
+	endConditional(span, desc, changed, err)
+	return desc, changed, err
+}
+
+func (c *tracedClient) getTagIfChanged(ctx context.Context, repo, tag string, known oci.Digest) (oci.BlobReader, bool, error) {
+	ctx, span := c.start(ctx, "GetTagIfChanged", repo, tag, known)
+	rd, changed, err := c.c.getTagIfChanged(ctx, repo, tag, known)
+	var desc oci.Descriptor
+	if changed {
+		desc = rd.Descriptor()
+	}
+	endConditional(span, desc, changed, err)
+	return rd, changed, err
+}
+
+func endConditional(span ocitrace.Span, desc oci.Descriptor, changed bool, err error) {
+	if err == nil {
+		span.SetAttributes(ocitrace.String("oci.changed", strconv.FormatBool(changed)))
+		if changed {
+			span.SetAttributes(
+				ocitrace.String(ocitrace.KeyDigest, string(desc.Digest)),
+				ocitrace.Int64(ocitrace.KeySize, desc.Size),
+			)
+		}
+	}
+	ocitrace.End(span, err)
+}
+
+var (
+	_ conditionalReader = (*client)(nil)
+	_ conditionalReader = (*tracedClient)(nil)
+)
+
+func (c *client) resolveTagIfChanged(ctx context.Context, repo, tag string, known oci.Digest) (oci.Descriptor, bool, error) {
+	rreq := &ocirequest.Request{
+		Kind: ocirequest.ReqManifestHead,
+		Repo: repo,
+		Tag:  tag,
+	}
+	resp, err := c.doConditionalRequest(ctx, rreq, known)
+	if err != nil || resp == nil {
+		return oci.Descriptor{}, false, err
+	}
+	resp.Body.Close()
+	desc, err := descriptorFromResponse(resp, "", requireSize|requireDigest)
+	if err != nil {
+		return oci.Descriptor{}, false, fmt.Errorf("invalid descriptor in response: %v", err)
+	}
+	if desc.Digest == known {
+		// The registry ignored If-None-Match.
+		return oci.Descriptor{}, false, nil
+	}
+	return desc, true, nil
+}
+
+func (c *client) getTagIfChanged(ctx context.Context, repo, tag string, known oci.Digest) (oci.BlobReader, bool, error) {
+	rreq := &ocirequest.Request{
+		Kind: ocirequest.ReqManifestGet,
+		Repo: repo,
+		Tag:  tag,
+	}
+	resp, err := c.doConditionalRequest(ctx, rreq, known)
+	if err != nil || resp == nil {
+		return nil, false, err
+	}
+	rd, err := c.readResponse(ctx, rreq, resp)
+	if err != nil {
+		return nil, false, err
+	}
+	if rd.Descriptor().Digest == known {
+		// The registry ignored If-None-Match.
+		rd.Close()
+		return nil, false, nil
+	}
+	return rd, true, nil
+}
+
+// doConditionalRequest is like doRequest for a manifest request
+// but sends an If-None-Match header holding the entity tag for
+// the known digest. It returns a nil response if the registry
+// responds with 304 (Not Modified).
+func (c *client) doConditionalRequest(ctx context.Context, rreq *ocirequest.Request, known oci.Digest) (*http.Response, error) {
+	req, err := newRequest(ctx, rreq, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header["Accept"] = knownManifestMediaTypes
+	req.Header.Set("If-None-Match", etag(known))
+	resp, err := c.do(req, http.StatusOK, http.StatusNotModified)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		return nil, nil
+	}
+	return resp, nil
+}
+
+// etag returns the entity tag used by registries such as
+// [github.com/jcarter3/oci/ociserver] for content with the given digest.
+func etag(dig oci.Digest) string {
+	return `"` + string(dig) + `"`
+}
@@ -0,0 +1,190 @@
+package ociclient_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jcarter3/oci"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jcarter3/oci/ociclient"
+	"github.com/jcarter3/oci/ocimem"
+	"github.com/jcarter3/oci/ociserver"
+	"github.com/jcarter3/oci/ocitrace"
+)
+
+func TestTagIfChanged(t *testing.T) {
+	ctx := context.Background()
+	var (
+		mu       sync.Mutex
+		statuses []int
+	)
+	h := ociserver.New(ocimem.New(), nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("If-None-Match") == "" {
+			h.ServeHTTP(w, req)
+			return
+		}
+		// Record the status before the response is sent
+		// so that the client can't observe it first.
+		h.ServeHTTP(&statusRecorder{w, func(status int) {
+			mu.Lock()
+			defer mu.Unlock()
+			statuses = append(statuses, status)
+		}}, req)
+	}))
+	t.Cleanup(srv.Close)
+
+	recorder := ocitrace.NewRecorder()
+	for _, opts := range []*ociclient.Options{nil, {Tracer: recorder}} {
+		client := mustNewOCIClient(srv.URL, opts)
+		config := pushScratchConfig(t, client, "foo")
+		m1 := pushManifest(t, client, "foo", "latest", &oci.Manifest{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    withMediaType(config, "application/one"),
+		}, ocispec.MediaTypeImageManifest)
+
+		mu.Lock()
+		statuses = nil
+		mu.Unlock()
+		desc, changed, err := ociclient.ResolveTagIfChanged(ctx, client, "foo", "latest", m1.Digest)
+		require.NoError(t, err)
+		require.False(t, changed)
+		require.Zero(t, desc)
+
+		rd, changed, err := ociclient.GetTagIfChanged(ctx, client, "foo", "latest", m1.Digest)
+		require.NoError(t, err)
+		require.False(t, changed)
+		require.Nil(t, rd)
+
+		m2 := pushManifest(t, client, "foo", "latest", &oci.Manifest{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    withMediaType(config, "application/two"),
+		}, ocispec.MediaTypeImageManifest)
+
+		desc, changed, err = ociclient.ResolveTagIfChanged(ctx, client, "foo", "latest", m1.Digest)
+		require.NoError(t, err)
+		require.True(t, changed)
+		require.Equal(t, m2.Digest, desc.Digest)
+
+		rd, changed, err = ociclient.GetTagIfChanged(ctx, client, "foo", "latest", m1.Digest)
+		require.NoError(t, err)
+		require.True(t, changed)
+		data, err := io.ReadAll(rd)
+		require.NoError(t, err)
+		rd.Close()
+		require.Equal(t, m2.Digest, rd.Descriptor().Digest)
+		require.Equal(t, m2.Size, int64(len(data)))
+
+		_, _, err = ociclient.ResolveTagIfChanged(ctx, client, "foo", "nope", m1.Digest)
+		require.ErrorIs(t, err, oci.ErrNameUnknown)
+
+		// The registry was asked to make the comparison each time.
+		mu.Lock()
+		require.Equal(t, []int{304, 304, 200, 200, 404}, statuses)
+		mu.Unlock()
+	}
+
+	// The conditional calls are traced like any other.
+	var changed []any
+	for _, span := range recorder.Spans() {
+		switch span.Name {
+		case "oci.ResolveTagIfChanged", "oci.GetTagIfChanged":
+			require.Equal(t, "foo", span.Attr(ocitrace.KeyRepo))
+			require.False(t, span.End.IsZero())
+			changed = append(changed, span.Attr("oci.changed"))
+		}
+	}
+	require.Equal(t, []any{"false", "false", "true", "true", nil}, changed)
+}
+
+func TestTagIfChangedOtherRegistry(t *testing.T) {
+	ctx := context.Background()
+	r := ocimem.New()
+	config := withMediaType(oci.Descriptor{
+		Digest: digest.FromString("{}"),
+		Size:   2,
+	}, ocispec.MediaTypeImageConfig)
+	_, err := r.PushBlob(ctx, "foo", config, strings.NewReader("{}"))
+	require.NoError(t, err)
+	m := pushManifest(t, r, "foo", "latest", &oci.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+	}, ocispec.MediaTypeImageManifest)
+
+	_, changed, err := ociclient.ResolveTagIfChanged(ctx, r, "foo", "latest", m.Digest)
+	require.NoError(t, err)
+	require.False(t, changed)
+
+	rd, changed, err := ociclient.GetTagIfChanged(ctx, r, "foo", "latest", "sha256:0000000000000000000000000000000000000000000000000000000000000000")
+	require.NoError(t, err)
+	require.True(t, changed)
+	require.Equal(t, m.Digest, rd.Descriptor().Digest)
+	rd.Close()
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	record func(status int)
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.record(status)
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func TestPushManifestIfTagDigest(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(ociserver.New(ocimem.New(), nil))
+	t.Cleanup(srv.Close)
+	client := mustNewOCIClient(srv.URL, &ociclient.Options{
+		ConditionalTagUpdates: true,
+	})
+
+	config := pushScratchConfig(t, client, "foo")
+	m1 := pushManifest(t, client, "foo", "stable", &oci.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    withMediaType(config, "application/one"),
+	}, ocispec.MediaTypeImageManifest)
+	data, err := json.Marshal(&oci.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    withMediaType(config, "application/two"),
+	})
+	require.NoError(t, err)
+	push := func(ifTagDigest oci.Digest) error {
+		_, err := client.PushManifest(ctx, "foo", data, ocispec.MediaTypeImageManifest, &oci.PushManifestParameters{
+			Tags:        []string{"stable"},
+			IfTagDigest: ifTagDigest,
+		})
+		return err
+	}
+
+	err = push(digest.FromString("other"))
+	require.ErrorIs(t, err, oci.ErrPreconditionFailed)
+	require.ErrorContains(t, err, "refers to "+string(m1.Digest))
+
+	require.NoError(t, push(m1.Digest))
+	desc, err := client.ResolveTag(ctx, "foo", "stable")
+	require.NoError(t, err)
+	require.Equal(t, digest.FromBytes(data), desc.Digest)
+
+	// The tag has moved on, so the same update fails now.
+	require.ErrorIs(t, push(m1.Digest), oci.ErrPreconditionFailed)
+
+	// Without the option, the client can't rely on
+	// the registry to make the check.
+	client = mustNewOCIClient(srv.URL, nil)
+	err = push(desc.Digest)
+	require.ErrorIs(t, err, oci.ErrUnsupported)
+	desc1, err := client.ResolveTag(ctx, "foo", "stable")
+	require.NoError(t, err)
+	require.Equal(t, desc.Digest, desc1.Digest)
+}
@@ -0,0 +1,103 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jcarter3/oci"
+)
+
+// RateLimits records the most recent rate-limit state
+// reported by each registry host. See [Options.RateLimits].
+//
+// The zero value is ready to use. It's safe to use concurrently,
+// and may be shared between clients.
+type RateLimits struct {
+	mu    sync.Mutex
+	hosts map[string]oci.RateLimitStatus
+}
+
+// Get returns the most recent rate-limit state reported by
+// the given host. It reports false if none has been seen.
+func (l *RateLimits) Get(host string) (oci.RateLimitStatus, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rl, ok := l.hosts[host]
+	return rl, ok
+}
+
+// Hosts returns all the hosts for which rate-limit
+// state has been seen, in sorted order.
+func (l *RateLimits) Hosts() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	hosts := make([]string, 0, len(l.hosts))
+	for host := range l.hosts {
+		hosts = append(hosts, host)
+	}
+	slices.Sort(hosts)
+	return hosts
+}
+
+// record records any rate-limit state in resp as the latest for host.
+func (l *RateLimits) record(host string, resp *http.Response) {
+	rl, ok := oci.ParseRateLimit(resp.Header, time.Now())
+	if !ok {
+		return
+	}
+	if resp.StatusCode == http.StatusTooManyRequests && rl.Remaining < 0 {
+		rl.Remaining = 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.hosts == nil {
+		l.hosts = make(map[string]oci.RateLimitStatus)
+	}
+	if prev, ok := l.hosts[host]; ok && prev.Time.After(rl.Time) {
+		// A concurrent request has already recorded later state.
+		return
+	}
+	l.hosts[host] = rl
+}
+
+// wait waits until the quota for host is expected to have been
+// replenished, if the most recent state shows that it's exhausted.
+func (l *RateLimits) wait(ctx context.Context, host string) error {
+	rl, ok := l.Get(host)
+	if !ok || !rl.Exhausted() {
+		return nil
+	}
+	t := rl.ReplenishedAt()
+	if t.IsZero() {
+		return nil
+	}
+	d := time.Until(t)
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
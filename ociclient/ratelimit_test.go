@@ -0,0 +1,121 @@
+package ociclient
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/ocimem"
+	"github.com/jcarter3/oci/ociserver"
+	"github.com/jcarter3/oci/ocitest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitsRecorded(t *testing.T) {
+	ctx := context.Background()
+	host := newRateLimitedServer(t, ociserver.RateLimit{Requests: 3, Window: time.Hour})
+	var limits RateLimits
+	r, err := New(host, &Options{
+		Insecure:   true,
+		RateLimits: &limits,
+	})
+	require.NoError(t, err)
+
+	_, ok := limits.Get(host)
+	require.False(t, ok)
+	for _, remaining := range []int{2, 1, 0} {
+		rd, err := r.GetTag(ctx, "foo", "v1")
+		require.NoError(t, err)
+		rd.Close()
+		rl, ok := limits.Get(host)
+		require.True(t, ok)
+		require.Equal(t, 3, rl.Limit)
+		require.Equal(t, remaining, rl.Remaining)
+		require.Equal(t, time.Hour, rl.Window)
+	}
+	require.Equal(t, []string{host}, limits.Hosts())
+
+	_, err = r.GetTag(ctx, "foo", "v1")
+	require.ErrorIs(t, err, oci.ErrTooManyRequests)
+	rl, ok := oci.RateLimitFromError(err)
+	require.True(t, ok)
+	require.Equal(t, 0, rl.Remaining)
+	require.Equal(t, 20*time.Minute, rl.RetryAfter)
+
+	rl, ok = limits.Get(host)
+	require.True(t, ok)
+	require.Equal(t, 20*time.Minute, rl.RetryAfter)
+}
+
+func TestRateLimitFromErrorWithoutRateLimits(t *testing.T) {
+	host := newRateLimitedServer(t, ociserver.RateLimit{Requests: 1, Window: time.Minute})
+	r, err := New(host, &Options{
+		Insecure: true,
+	})
+	require.NoError(t, err)
+	rd, err := r.GetTag(context.Background(), "foo", "v1")
+	require.NoError(t, err)
+	rd.Close()
+	_, err = r.GetTag(context.Background(), "foo", "v1")
+	rl, ok := oci.RateLimitFromError(err)
+	require.True(t, ok)
+	require.Equal(t, 1, rl.Limit)
+	require.Equal(t, time.Minute, rl.RetryAfter)
+}
+
+func TestWaitForRateLimit(t *testing.T) {
+	ctx := context.Background()
+	host := newRateLimitedServer(t, ociserver.RateLimit{Requests: 1, Window: time.Second})
+	r, err := New(host, &Options{
+		Insecure:         true,
+		WaitForRateLimit: true,
+	})
+	require.NoError(t, err)
+	rd, err := r.GetTag(ctx, "foo", "v1")
+	require.NoError(t, err)
+	rd.Close()
+
+	// The quota is exhausted, so the next request waits
+	// until it's replenished rather than failing.
+	t0 := time.Now()
+	rd, err = r.GetTag(ctx, "foo", "v1")
+	require.NoError(t, err)
+	rd.Close()
+	require.GreaterOrEqual(t, time.Since(t0), 900*time.Millisecond)
+
+	// The wait is abandoned when the context is done.
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = r.GetTag(ctx, "foo", "v1")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+// newRateLimitedServer returns the host of a server holding the
+// manifest foo:v1, which applies the given limit to manifest GETs.
+func newRateLimitedServer(t *testing.T, limit ociserver.RateLimit) string {
+	r := ocimem.New()
+	ocitest.NewRegistry(t, r).MustPushContent(ocitest.RegistryContent{
+		"foo": {
+			Blobs: map[string]string{"scratch": "{}"},
+			Manifests: map[string]oci.Manifest{
+				"m": {
+					MediaType: ocispec.MediaTypeImageManifest,
+					Config:    oci.Descriptor{Digest: "scratch"},
+				},
+			},
+			Tags: map[string]string{"v1": "m"},
+		},
+	})
+	srv := httptest.NewServer(ociserver.New(r, &ociserver.Options{
+		RateLimiter: ociserver.NewRateLimiter(ociserver.RateLimit{}, map[string]ociserver.RateLimit{
+			"ManifestGet": limit,
+		}),
+	}))
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+	return u.Host
+}
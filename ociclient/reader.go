@@ -132,11 +132,17 @@ func (c *client) GetTag(ctx context.Context, repo string, tagName string) (oci.B
 // a digest when doing a GET on a tag.
 const inMemThreshold = 128 * 1024
 
-func (c *client) read(ctx context.Context, rreq *ocirequest.Request) (_ oci.BlobReader, _err error) {
+func (c *client) read(ctx context.Context, rreq *ocirequest.Request) (oci.BlobReader, error) {
 	resp, err := c.doRequest(ctx, rreq)
 	if err != nil {
 		return nil, err
 	}
+	return c.readResponse(ctx, rreq, resp)
+}
+
+// readResponse returns a reader for the content in
+// resp, which holds the response to rreq.
+func (c *client) readResponse(ctx context.Context, rreq *ocirequest.Request, resp *http.Response) (_ oci.BlobReader, _err error) {
 	defer closeOnError(&_err, resp.Body)
 	desc, err := descriptorFromResponse(resp, oci.Digest(rreq.Digest), requireSize)
 	if err != nil {
@@ -56,6 +56,28 @@ func (c *client) PushManifest(ctx context.Context, repo string, contents []byte,
 		tags = params.Tags
 	}
 
+	if params != nil && params.IfTagDigest != "" {
+		// The registry is trusted to make the check atomically.
+		// One that doesn't support If-Match would update the
+		// tag unconditionally, so it must be asked for.
+		if !c.conditionalTags {
+			return oci.Descriptor{}, fmt.Errorf("%w: IfTagDigest requires Options.ConditionalTagUpdates", oci.ErrUnsupported)
+		}
+		if len(tags) != 1 {
+			return oci.Descriptor{}, fmt.Errorf("%w: IfTagDigest requires exactly one tag", oci.ErrUnsupported)
+		}
+		rreq := &ocirequest.Request{
+			Kind:   ocirequest.ReqManifestPut,
+			Repo:   repo,
+			Tag:    tags[0],
+			Digest: string(desc.Digest),
+		}
+		if _, err := c.putManifest(ctx, rreq, desc, params.IfTagDigest); err != nil {
+			return oci.Descriptor{}, err
+		}
+		return desc, nil
+	}
+
 	// If there are no tags, push once by digest.
 	// If there are tags, push once per tag (all referencing the same contents).
 	if len(tags) == 0 {
@@ -64,7 +86,7 @@ func (c *client) PushManifest(ctx context.Context, repo string, contents []byte,
 			Repo:   repo,
 			Digest: string(desc.Digest),
 		}
-		_, err := c.putManifest(ctx, rreq, desc)
+		_, err := c.putManifest(ctx, rreq, desc, "")
 		return desc, err
 	} else {
 		rreq := &ocirequest.Request{
@@ -73,7 +95,7 @@ func (c *client) PushManifest(ctx context.Context, repo string, contents []byte,
 			Tags:   tags,
 			Digest: string(desc.Digest),
 		}
-		createdTags, err := c.putManifest(ctx, rreq, desc)
+		createdTags, err := c.putManifest(ctx, rreq, desc, "")
 		if err != nil || len(createdTags) != len(tags) {
 			// bulk send failed, fallback to sending one at a time
 			for _, tag := range tags {
@@ -83,7 +105,7 @@ func (c *client) PushManifest(ctx context.Context, repo string, contents []byte,
 					Tag:    tag,
 					Digest: string(desc.Digest),
 				}
-				_, err = c.putManifest(ctx, rreq, desc)
+				_, err = c.putManifest(ctx, rreq, desc, "")
 				if err != nil {
 					return oci.Descriptor{}, fmt.Errorf("creating tag %s failed: %w", tag, err)
 				}
@@ -93,12 +115,18 @@ func (c *client) PushManifest(ctx context.Context, repo string, contents []byte,
 	return desc, nil
 }
 
-func (c *client) putManifest(ctx context.Context, rreq *ocirequest.Request, desc oci.Descriptor) ([]string, error) {
+// putManifest makes the manifest PUT request rreq. If ifTagDigest
+// is non-empty, the request is conditional on the tag referring to
+// the manifest with that digest.
+func (c *client) putManifest(ctx context.Context, rreq *ocirequest.Request, desc oci.Descriptor, ifTagDigest oci.Digest) ([]string, error) {
 	req, err := newRequest(ctx, rreq, bytes.NewReader(desc.Data))
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", desc.MediaType)
+	if ifTagDigest != "" {
+		req.Header.Set("If-Match", etag(ifTagDigest))
+	}
 	req.ContentLength = desc.Size
 	resp, err := c.do(req, http.StatusCreated)
 	if err != nil {
@@ -14,6 +14,10 @@
 
 // Package ocidebug is an OCI registry wrapper that prints log messages
 // on registry operations.
+//
+// [New] prints free-form messages using a printf-style function;
+// [NewLogger] logs structured records using [log/slog], tagged
+// with any request ID attached by [ContextWithRequestID].
 package ocidebug
 
 import (
@@ -0,0 +1,446 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocidebug
+
+import (
+	"context"
+	"errors"
+	"io"
+	"iter"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jcarter3/oci"
+)
+
+// Attribute keys used in structured log records.
+const (
+	KeyRequestID = "request_id"
+	KeyMethod    = "method"
+	KeyRepo      = "repo"
+	KeyDigest    = "digest"
+	KeyTag       = "tag"
+	KeyDuration  = "duration"
+	KeyBytes     = "bytes"
+	KeyError     = "error"
+	KeyErrorCode = "error_code"
+)
+
+// redactedHeaders holds the HTTP headers whose values
+// are never logged.
+var redactedHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"Proxy-Authorization",
+	"Set-Cookie",
+}
+
+type requestIDKey struct{}
+
+// ContextWithRequestID returns ctx annotated with the given request ID.
+// The ID is included in all structured log records made with that context,
+// which makes it possible to correlate a server request with the
+// backend calls that it triggers. The [github.com/jcarter3/oci/ociserver]
+// package attaches an ID to the context of each request it serves.
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns any request ID associated with the context
+// by [ContextWithRequestID].
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// RedactHeader returns a copy of h with the values of any
+// headers that might hold credentials, such as Authorization,
+// replaced. The authorization scheme is retained.
+func RedactHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for _, k := range redactedHeaders {
+		vs := h.Values(k)
+		if len(vs) == 0 {
+			continue
+		}
+		h.Del(k)
+		for _, v := range vs {
+			scheme, _, ok := strings.Cut(v, " ")
+			if k == "Authorization" || k == "Proxy-Authorization" {
+				if ok {
+					h.Add(k, scheme+" REDACTED")
+					continue
+				}
+			}
+			h.Add(k, "REDACTED")
+		}
+	}
+	return h
+}
+
+// ErrorAttrs returns the attributes used to describe err
+// in a log record: the error message and its
+// [oci.Error] code if it has one. It returns nil if err is nil.
+func ErrorAttrs(err error) []slog.Attr {
+	if err == nil {
+		return nil
+	}
+	attrs := []slog.Attr{slog.String(KeyError, err.Error())}
+	var ociErr oci.Error
+	if errors.As(err, &ociErr) && ociErr.Code() != "" {
+		attrs = append(attrs, slog.String(KeyErrorCode, ociErr.Code()))
+	}
+	return attrs
+}
+
+// NewLogger returns a new [oci.Interface] that wraps r and logs all
+// operations as structured records using logger. Each
+// record includes the method name, any repository, digest and tag
+// involved, the duration of the call, and the error and
+// error code if it failed. Successful calls are logged at
+// [slog.LevelDebug] and failed calls at [slog.LevelWarn].
+//
+// If logger is nil, [slog.Default] is used.
+func NewLogger(r oci.Interface, logger *slog.Logger) oci.Interface {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &slogger{
+		logger: logger,
+		r:      r,
+	}
+}
+
+type slogger struct {
+	logger *slog.Logger
+	r      oci.Interface
+	*oci.Funcs
+}
+
+// start returns a function that logs a call to the given method
+// with the given attributes when it completes. Any extra attributes
+// passed to the returned function are only included when
+// the call succeeds.
+func (r *slogger) start(ctx context.Context, method string, attrs ...slog.Attr) func(err error, extra ...slog.Attr) {
+	start := time.Now()
+	return func(err error, extra ...slog.Attr) {
+		if err == nil {
+			attrs = append(attrs, extra...)
+		}
+		r.log(ctx, method, time.Since(start), err, attrs...)
+	}
+}
+
+func (r *slogger) log(ctx context.Context, method string, d time.Duration, err error, attrs ...slog.Attr) {
+	level := slog.LevelDebug
+	if err != nil {
+		level = slog.LevelWarn
+	}
+	if !r.logger.Enabled(ctx, level) {
+		return
+	}
+	all := make([]slog.Attr, 0, len(attrs)+5)
+	if id := RequestIDFromContext(ctx); id != "" {
+		all = append(all, slog.String(KeyRequestID, id))
+	}
+	all = append(all, slog.String(KeyMethod, method))
+	all = append(all, attrs...)
+	all = append(all, slog.Duration(KeyDuration, d))
+	all = append(all, ErrorAttrs(err)...)
+	r.logger.LogAttrs(ctx, level, "oci "+method, all...)
+}
+
+func repoAttr(repo string) slog.Attr {
+	return slog.String(KeyRepo, repo)
+}
+
+func digestAttr(dig oci.Digest) slog.Attr {
+	return slog.String(KeyDigest, string(dig))
+}
+
+func tagAttr(tag string) slog.Attr {
+	return slog.String(KeyTag, tag)
+}
+
+func descAttrs(desc oci.Descriptor) []slog.Attr {
+	return []slog.Attr{
+		digestAttr(desc.Digest),
+		slog.Int64(KeyBytes, desc.Size),
+	}
+}
+
+func (r *slogger) DeleteBlob(ctx context.Context, repoName string, digest oci.Digest) error {
+	done := r.start(ctx, "DeleteBlob", repoAttr(repoName), digestAttr(digest))
+	err := r.r.DeleteBlob(ctx, repoName, digest)
+	done(err)
+	return err
+}
+
+func (r *slogger) DeleteManifest(ctx context.Context, repoName string, digest oci.Digest) error {
+	done := r.start(ctx, "DeleteManifest", repoAttr(repoName), digestAttr(digest))
+	err := r.r.DeleteManifest(ctx, repoName, digest)
+	done(err)
+	return err
+}
+
+func (r *slogger) DeleteTag(ctx context.Context, repoName string, tagName string) error {
+	done := r.start(ctx, "DeleteTag", repoAttr(repoName), tagAttr(tagName))
+	err := r.r.DeleteTag(ctx, repoName, tagName)
+	done(err)
+	return err
+}
+
+func (r *slogger) GetBlob(ctx context.Context, repoName string, dig oci.Digest) (oci.BlobReader, error) {
+	done := r.start(ctx, "GetBlob", repoAttr(repoName), digestAttr(dig))
+	rd, err := r.r.GetBlob(ctx, repoName, dig)
+	done(err)
+	return r.blobReader(ctx, rd, "GetBlob", repoName), err
+}
+
+func (r *slogger) GetBlobRange(ctx context.Context, repoName string, dig oci.Digest, o0, o1 int64) (oci.BlobReader, error) {
+	done := r.start(ctx, "GetBlobRange", repoAttr(repoName), digestAttr(dig), slog.Int64("offset0", o0), slog.Int64("offset1", o1))
+	rd, err := r.r.GetBlobRange(ctx, repoName, dig, o0, o1)
+	done(err)
+	return r.blobReader(ctx, rd, "GetBlobRange", repoName), err
+}
+
+func (r *slogger) GetManifest(ctx context.Context, repoName string, dig oci.Digest) (oci.BlobReader, error) {
+	done := r.start(ctx, "GetManifest", repoAttr(repoName), digestAttr(dig))
+	rd, err := r.r.GetManifest(ctx, repoName, dig)
+	done(err)
+	return r.blobReader(ctx, rd, "GetManifest", repoName), err
+}
+
+func (r *slogger) GetTag(ctx context.Context, repoName string, tagName string) (oci.BlobReader, error) {
+	done := r.start(ctx, "GetTag", repoAttr(repoName), tagAttr(tagName))
+	rd, err := r.r.GetTag(ctx, repoName, tagName)
+	done(err)
+	return r.blobReader(ctx, rd, "GetTag", repoName), err
+}
+
+func (r *slogger) MountBlob(ctx context.Context, fromRepo, toRepo string, dig oci.Digest) (oci.Descriptor, error) {
+	done := r.start(ctx, "MountBlob", slog.String("from_repo", fromRepo), repoAttr(toRepo), digestAttr(dig))
+	desc, err := r.r.MountBlob(ctx, fromRepo, toRepo, dig)
+	done(err)
+	return desc, err
+}
+
+func (r *slogger) PushBlob(ctx context.Context, repoName string, desc oci.Descriptor, content io.Reader) (oci.Descriptor, error) {
+	done := r.start(ctx, "PushBlob", append([]slog.Attr{repoAttr(repoName)}, descAttrs(desc)...)...)
+	desc, err := r.r.PushBlob(ctx, repoName, desc, content)
+	done(err)
+	return desc, err
+}
+
+func (r *slogger) PushBlobChunked(ctx context.Context, repoName string, chunkSize int) (oci.BlobWriter, error) {
+	done := r.start(ctx, "PushBlobChunked", repoAttr(repoName), slog.Int("chunk_size", chunkSize))
+	w, err := r.r.PushBlobChunked(ctx, repoName, chunkSize)
+	done(err)
+	return r.blobWriter(ctx, w, repoName), err
+}
+
+func (r *slogger) PushBlobChunkedResume(ctx context.Context, repoName, id string, offset int64, chunkSize int) (oci.BlobWriter, error) {
+	done := r.start(ctx, "PushBlobChunkedResume", repoAttr(repoName), slog.Int64("offset", offset), slog.Int("chunk_size", chunkSize))
+	w, err := r.r.PushBlobChunkedResume(ctx, repoName, id, offset, chunkSize)
+	done(err)
+	return r.blobWriter(ctx, w, repoName), err
+}
+
+func (r *slogger) PushManifest(ctx context.Context, repoName string, data []byte, mediaType string, params *oci.PushManifestParameters) (oci.Descriptor, error) {
+	attrs := []slog.Attr{
+		repoAttr(repoName),
+		slog.String("media_type", mediaType),
+		slog.Int(KeyBytes, len(data)),
+	}
+	if params != nil && len(params.Tags) > 0 {
+		attrs = append(attrs, slog.Any("tags", params.Tags))
+	}
+	done := r.start(ctx, "PushManifest", attrs...)
+	desc, err := r.r.PushManifest(ctx, repoName, data, mediaType, params)
+	done(err, digestAttr(desc.Digest))
+	return desc, err
+}
+
+func (r *slogger) Referrers(ctx context.Context, repoName string, digest oci.Digest, params *oci.ReferrersParameters) iter.Seq2[oci.Descriptor, error] {
+	attrs := []slog.Attr{repoAttr(repoName), digestAttr(digest)}
+	if params != nil && params.ArtifactType != "" {
+		attrs = append(attrs, slog.String("artifact_type", params.ArtifactType))
+	}
+	return slogIter(r, ctx, "Referrers", attrs, r.r.Referrers(ctx, repoName, digest, params))
+}
+
+func (r *slogger) Repositories(ctx context.Context, startAfter string) iter.Seq2[string, error] {
+	return slogIter(r, ctx, "Repositories", []slog.Attr{slog.String("start_after", startAfter)}, r.r.Repositories(ctx, startAfter))
+}
+
+func (r *slogger) Tags(ctx context.Context, repoName string, params *oci.TagsParameters) iter.Seq2[string, error] {
+	attrs := []slog.Attr{repoAttr(repoName)}
+	if params != nil {
+		attrs = append(attrs, slog.String("start_after", params.StartAfter), slog.Int("limit", params.Limit))
+	}
+	return slogIter(r, ctx, "Tags", attrs, r.r.Tags(ctx, repoName, params))
+}
+
+func (r *slogger) ResolveBlob(ctx context.Context, repoName string, digest oci.Digest) (oci.Descriptor, error) {
+	done := r.start(ctx, "ResolveBlob", repoAttr(repoName), digestAttr(digest))
+	desc, err := r.r.ResolveBlob(ctx, repoName, digest)
+	done(err, slog.Int64(KeyBytes, desc.Size))
+	return desc, err
+}
+
+func (r *slogger) ResolveManifest(ctx context.Context, repoName string, digest oci.Digest) (oci.Descriptor, error) {
+	done := r.start(ctx, "ResolveManifest", repoAttr(repoName), digestAttr(digest))
+	desc, err := r.r.ResolveManifest(ctx, repoName, digest)
+	done(err, slog.Int64(KeyBytes, desc.Size))
+	return desc, err
+}
+
+func (r *slogger) ResolveTag(ctx context.Context, repoName string, tagName string) (oci.Descriptor, error) {
+	done := r.start(ctx, "ResolveTag", repoAttr(repoName), tagAttr(tagName))
+	desc, err := r.r.ResolveTag(ctx, repoName, tagName)
+	done(err, digestAttr(desc.Digest), slog.Int64(KeyBytes, desc.Size))
+	return desc, err
+}
+
+func (r *slogger) blobReader(ctx context.Context, rd oci.BlobReader, method, repo string) oci.BlobReader {
+	if rd == nil {
+		return nil
+	}
+	return &slogBlobReader{
+		BlobReader: rd,
+		r:          r,
+		ctx:        ctx,
+		method:     method,
+		repo:       repo,
+		start:      time.Now(),
+	}
+}
+
+func (r *slogger) blobWriter(ctx context.Context, w oci.BlobWriter, repo string) oci.BlobWriter {
+	if w == nil {
+		return nil
+	}
+	return &slogBlobWriter{
+		BlobWriter: w,
+		r:          r,
+		ctx:        ctx,
+		repo:       repo,
+	}
+}
+
+// slogBlobReader logs the number of bytes read
+// when the reader is closed.
+type slogBlobReader struct {
+	oci.BlobReader
+	r      *slogger
+	ctx    context.Context
+	method string
+	repo   string
+	start  time.Time
+	n      int64
+	err    error
+}
+
+func (rd *slogBlobReader) Read(buf []byte) (int, error) {
+	n, err := rd.BlobReader.Read(buf)
+	rd.n += int64(n)
+	if err != nil && err != io.EOF {
+		rd.err = err
+	}
+	return n, err
+}
+
+func (rd *slogBlobReader) Close() error {
+	err := rd.BlobReader.Close()
+	rd.r.log(rd.ctx, "BlobReader.Close", time.Since(rd.start), cmpErr(rd.err, err),
+		slog.String("call", rd.method),
+		repoAttr(rd.repo),
+		digestAttr(rd.Descriptor().Digest),
+		slog.Int64(KeyBytes, rd.n),
+	)
+	return err
+}
+
+type slogBlobWriter struct {
+	oci.BlobWriter
+	r    *slogger
+	ctx  context.Context
+	repo string
+	n    int64
+}
+
+func (w *slogBlobWriter) Write(buf []byte) (int, error) {
+	n, err := w.BlobWriter.Write(buf)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *slogBlobWriter) Close() error {
+	start := time.Now()
+	err := w.BlobWriter.Close()
+	w.r.log(w.ctx, "BlobWriter.Close", time.Since(start), err, repoAttr(w.repo), slog.Int64(KeyBytes, w.n))
+	return err
+}
+
+func (w *slogBlobWriter) Commit(digest oci.Digest) (oci.Descriptor, error) {
+	start := time.Now()
+	desc, err := w.BlobWriter.Commit(digest)
+	w.r.log(w.ctx, "BlobWriter.Commit", time.Since(start), err, repoAttr(w.repo), digestAttr(digest), slog.Int64(KeyBytes, w.n))
+	return desc, err
+}
+
+func (w *slogBlobWriter) Cancel() error {
+	start := time.Now()
+	err := w.BlobWriter.Cancel()
+	w.r.log(w.ctx, "BlobWriter.Cancel", time.Since(start), err, repoAttr(w.repo), slog.Int64(KeyBytes, w.n))
+	return err
+}
+
+// slogIter returns an iterator that logs a call to the given method
+// when iteration over it completes. The logged duration covers
+// the iteration only, not the time before it starts.
+func slogIter[T any](r *slogger, ctx context.Context, method string, attrs []slog.Attr, it iter.Seq2[T, error]) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		done := r.start(ctx, method, slices.Clip(attrs)...)
+		n := 0
+		var _err error
+		defer func() {
+			done(_err, slog.Int("count", n))
+		}()
+		for item, err := range it {
+			if err != nil {
+				_err = err
+				yield(*new(T), err)
+				return
+			}
+			if !yield(item, nil) {
+				return
+			}
+			n++
+		}
+	}
+}
+
+func cmpErr(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package ocidebug_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/ociclient"
+	"github.com/jcarter3/oci/ocidebug"
+	"github.com/jcarter3/oci/ocimem"
+	"github.com/jcarter3/oci/ociserver"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoggerCorrelatesRequests(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	srv := httptest.NewServer(ociserver.New(ocidebug.NewLogger(ocimem.New(), logger), &ociserver.Options{
+		Logger:  logger,
+		DebugID: "srv",
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	client, err := ociclient.New(u.Host, &ociclient.Options{
+		Insecure: true,
+		Logger:   logger,
+	})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	content := "hello"
+	_, err = client.PushBlob(ctx, "foo", oci.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest.FromString(content),
+		Size:      int64(len(content)),
+	}, strings.NewReader(content))
+	require.NoError(t, err)
+	_, err = client.ResolveTag(ctx, "foo", "nope")
+	require.Error(t, err)
+
+	records := logRecords(t, &buf)
+	byMsg := make(map[string][]map[string]any)
+	for _, rec := range records {
+		byMsg[rec["msg"].(string)] = append(byMsg[rec["msg"].(string)], rec)
+	}
+	require.NotEmpty(t, byMsg["ociclient request"])
+	require.NotEmpty(t, byMsg["ociserver request"])
+
+	// The backend call made for each server request is tagged
+	// with the same request ID.
+	var serverResolve map[string]any
+	for _, rec := range byMsg["ociserver request"] {
+		require.True(t, strings.HasPrefix(rec["request_id"].(string), "srv-"))
+		if rec["kind"] == "ManifestHead" {
+			serverResolve = rec
+		}
+	}
+	require.NotNil(t, serverResolve)
+	require.Equal(t, "foo", serverResolve["repo"])
+	require.Equal(t, "nope", serverResolve["tag"])
+	require.Equal(t, float64(http.StatusNotFound), serverResolve["status"])
+	require.Equal(t, "MANIFEST_UNKNOWN", serverResolve["error_code"])
+
+	backendResolve := byMsg["oci ResolveTag"]
+	require.Len(t, backendResolve, 1)
+	require.Equal(t, serverResolve["request_id"], backendResolve[0]["request_id"])
+	require.Equal(t, "WARN", backendResolve[0]["level"])
+	require.Equal(t, "MANIFEST_UNKNOWN", backendResolve[0]["error_code"])
+
+	// The client uploads blobs with a POST followed by a PUT.
+	backendPush := byMsg["oci BlobWriter.Commit"]
+	require.Len(t, backendPush, 1)
+	require.Equal(t, float64(len(content)), backendPush[0]["bytes"])
+	require.Equal(t, string(digest.FromString(content)), backendPush[0]["digest"])
+}
+
+func TestServerUsesRequestIDHeader(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	srv := httptest.NewServer(ociserver.New(ocidebug.NewLogger(ocimem.New(), logger), &ociserver.Options{
+		Logger: logger,
+	}))
+	defer srv.Close()
+	get := func(requestID string) []map[string]any {
+		req, err := http.NewRequest("GET", srv.URL+"/v2/foo/tags/list", nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Request-Id", requestID)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		records := logRecords(t, &buf)
+		require.Len(t, records, 2)
+		return records
+	}
+	for _, rec := range get("abc.123_x-y") {
+		require.Equal(t, "abc.123_x-y", rec["request_id"])
+	}
+
+	// IDs that could be used to forge log entries are replaced.
+	for _, id := range []string{`abc" level=ERROR msg="forged`, "a b", strings.Repeat("x", 129)} {
+		for _, rec := range get(id) {
+			require.NotEqual(t, id, rec["request_id"])
+			require.Regexp(t, `^ociserver[0-9]+-[0-9]+$`, rec["request_id"])
+		}
+	}
+}
+
+func TestLoggerTimesIterationOnly(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	r := ocidebug.NewLogger(ocimem.New(), logger)
+	tags := r.Tags(context.Background(), "foo", nil)
+	time.Sleep(100 * time.Millisecond)
+	for range tags {
+	}
+	for range tags {
+	}
+	records := logRecords(t, &buf)
+	require.Len(t, records, 2)
+	for _, rec := range records {
+		require.Equal(t, "oci Tags", rec["msg"])
+		require.Less(t, time.Duration(rec["duration"].(float64)), 100*time.Millisecond)
+	}
+}
+
+func TestRedactHeader(t *testing.T) {
+	h := http.Header{
+		"Authorization": {"Bearer sometoken"},
+		"Cookie":        {"session=secret"},
+		"Accept":        {"application/json"},
+	}
+	got := ocidebug.RedactHeader(h)
+	require.Equal(t, http.Header{
+		"Authorization": {"Bearer REDACTED"},
+		"Cookie":        {"REDACTED"},
+		"Accept":        {"application/json"},
+	}, got)
+	// The original is unchanged.
+	require.Equal(t, "Bearer sometoken", h.Get("Authorization"))
+}
+
+func logRecords(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Logf("log:\n%s", buf.String())
+	var records []map[string]any
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var rec map[string]any
+		require.NoError(t, dec.Decode(&rec))
+		records = append(records, rec)
+	}
+	return records
+}
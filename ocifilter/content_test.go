@@ -0,0 +1,45 @@
+package ocifilter
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/jcarter3/oci"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// pushBlob pushes a blob holding content to repo.
+func pushBlob(t *testing.T, r oci.Interface, repo, content string) {
+	_, err := r.PushBlob(context.Background(), repo, blobDesc(content), strings.NewReader(content))
+	require.NoError(t, err)
+}
+
+// blobDesc returns the descriptor of a blob holding content.
+func blobDesc(content string) oci.Descriptor {
+	return oci.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest.FromString(content),
+		Size:      int64(len(content)),
+	}
+}
+
+// imageManifest returns an image manifest with the blob "{}" as
+// its config, made distinct by the given annotation.
+func imageManifest(t *testing.T, annotation string) []byte {
+	data, err := json.Marshal(oci.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    blobDesc("{}"),
+		Layers:    []oci.Descriptor{},
+		Annotations: map[string]string{
+			"test": annotation,
+		},
+	})
+	require.NoError(t, err)
+	return data
+}
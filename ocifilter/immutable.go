@@ -19,28 +19,100 @@ package ocifilter
 import (
 	"context"
 	"fmt"
+	"regexp"
 
 	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/internal/ocimanifest"
+	"github.com/jcarter3/oci/internal/ocipattern"
 	"github.com/opencontainers/go-digest"
 )
 
 // Immutable returns a registry wrap r but only allows content to be
 // added but not changed once added: nothing can be deleted and tags
 // can't be changed.
+//
+// It's equivalent to ImmutableWithPolicy(r, nil).
 func Immutable(r oci.Interface) oci.Interface {
-	return immutable{r}
+	return ImmutableWithPolicy(r, nil)
+}
+
+// ImmutablePolicy determines which tags are treated as immutable
+// by [ImmutableWithPolicy].
+//
+// Patterns must match the whole tag: for example,
+// `v[0-9]+\.[0-9]+\.[0-9]+` matches "v1.2.3" but not "v1.2.3-rc1".
+type ImmutablePolicy struct {
+	// ImmutableTags holds the patterns of tags that are immutable.
+	// If it's empty, all tags are immutable except
+	// those matching MutableTags.
+	ImmutableTags []*regexp.Regexp
+
+	// MutableTags holds the patterns of tags that remain
+	// mutable even when they match ImmutableTags.
+	MutableTags []*regexp.Regexp
+
+	// Exempt, if non-nil, is called for each operation that the
+	// policy would restrict. If it returns true, the operation is
+	// passed through unchecked. It can be used, for example, to
+	// allow an administrator identity found in the context to
+	// change anything.
+	Exempt func(ctx context.Context, repo string) bool
+}
+
+// ImmutableWithPolicy is like [Immutable] except that the policy
+// p determines which tags can't be changed or deleted. A nil p
+// makes all tags immutable.
+//
+// Blobs can never be deleted. When p leaves some tags mutable, a
+// manifest can be deleted as long as no immutable tag refers to it,
+// directly or by way of an index; otherwise manifests can't be
+// deleted either.
+func ImmutableWithPolicy(r oci.Interface, p *ImmutablePolicy) oci.Interface {
+	im := &immutable{
+		Interface: r,
+	}
+	if p != nil {
+		im.immutableTags = ocipattern.AnchoredAll(p.ImmutableTags)
+		im.mutableTags = ocipattern.AnchoredAll(p.MutableTags)
+		im.exempt = p.Exempt
+	}
+	return im
 }
 
 type immutable struct {
 	oci.Interface
+	immutableTags []*regexp.Regexp
+	mutableTags   []*regexp.Regexp
+	exempt        func(ctx context.Context, repo string) bool
+}
+
+// isImmutable reports whether the given tag is immutable.
+func (r *immutable) isImmutable(tag string) bool {
+	if ocipattern.MatchAny(r.mutableTags, tag) {
+		return false
+	}
+	return len(r.immutableTags) == 0 || ocipattern.MatchAny(r.immutableTags, tag)
+}
+
+// allTagsImmutable reports whether every tag is immutable.
+func (r *immutable) allTagsImmutable() bool {
+	return len(r.immutableTags) == 0 && len(r.mutableTags) == 0
+}
+
+func (r *immutable) isExempt(ctx context.Context, repo string) bool {
+	return r.exempt != nil && r.exempt(ctx, repo)
 }
 
-func (r immutable) PushManifest(ctx context.Context, repo string, contents []byte, mediaType string, params *oci.PushManifestParameters) (oci.Descriptor, error) {
+func (r *immutable) PushManifest(ctx context.Context, repo string, contents []byte, mediaType string, params *oci.PushManifestParameters) (oci.Descriptor, error) {
 	var tags []string
 	if params != nil {
-		tags = params.Tags
+		for _, tag := range params.Tags {
+			if r.isImmutable(tag) {
+				tags = append(tags, tag)
+			}
+		}
 	}
-	if len(tags) == 0 {
+	if len(tags) == 0 || r.isExempt(ctx, repo) {
 		return r.Interface.PushManifest(ctx, repo, contents, mediaType, params)
 	}
 	var dig oci.Digest
@@ -56,7 +128,7 @@ func (r immutable) PushManifest(ctx context.Context, repo string, contents []byt
 				// We're trying to push exactly the same content. That's OK.
 				continue
 			}
-			return oci.Descriptor{}, fmt.Errorf("this store is immutable: %w", oci.ErrDenied)
+			return oci.Descriptor{}, fmt.Errorf("tag %q is immutable: %w", tag, oci.ErrDenied)
 		}
 	}
 	desc, err := r.Interface.PushManifest(ctx, repo, contents, mediaType, params)
@@ -73,20 +145,56 @@ func (r immutable) PushManifest(ctx context.Context, repo string, contents []byt
 		}
 		if tagDesc.Digest != dig {
 			// We lost the race.
-			return oci.Descriptor{}, fmt.Errorf("this store is immutable: %w", oci.ErrDenied)
+			return oci.Descriptor{}, fmt.Errorf("tag %q is immutable: %w", tag, oci.ErrDenied)
 		}
 	}
 	return desc, nil
 }
 
-func (r immutable) DeleteBlob(ctx context.Context, repo string, digest oci.Digest) error {
+func (r *immutable) DeleteBlob(ctx context.Context, repo string, digest oci.Digest) error {
+	if r.isExempt(ctx, repo) {
+		return r.Interface.DeleteBlob(ctx, repo, digest)
+	}
 	return oci.ErrDenied
 }
 
-func (r immutable) DeleteManifest(ctx context.Context, repo string, digest oci.Digest) error {
-	return oci.ErrDenied
+func (r *immutable) DeleteManifest(ctx context.Context, repo string, digest oci.Digest) error {
+	if r.isExempt(ctx, repo) {
+		return r.Interface.DeleteManifest(ctx, repo, digest)
+	}
+	if r.allTagsImmutable() {
+		return oci.ErrDenied
+	}
+	// Deleting a manifest that's part of an index would break the
+	// index, so look at the children of each immutable tag too.
+	for tag, err := range r.Interface.Tags(ctx, repo, nil) {
+		if err != nil {
+			return err
+		}
+		if !r.isImmutable(tag) {
+			continue
+		}
+		desc, err := r.Interface.ResolveTag(ctx, repo, tag)
+		if err != nil {
+			return err
+		}
+		if desc.Digest == digest {
+			return fmt.Errorf("manifest is referred to by immutable tag %q: %w", tag, oci.ErrDenied)
+		}
+		reachable, err := ocimanifest.Reachable(ctx, r.Interface, repo, []oci.Digest{desc.Digest})
+		if err != nil {
+			return err
+		}
+		if reachable[digest] {
+			return fmt.Errorf("manifest is part of index referred to by immutable tag %q: %w", tag, oci.ErrDenied)
+		}
+	}
+	return r.Interface.DeleteManifest(ctx, repo, digest)
 }
 
-func (r immutable) DeleteTag(ctx context.Context, repo string, name string) error {
-	return oci.ErrDenied
+func (r *immutable) DeleteTag(ctx context.Context, repo string, name string) error {
+	if r.isImmutable(name) && !r.isExempt(ctx, repo) {
+		return oci.ErrDenied
+	}
+	return r.Interface.DeleteTag(ctx, repo, name)
 }
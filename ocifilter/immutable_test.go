@@ -0,0 +1,158 @@
+package ocifilter
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/ocimem"
+	"github.com/jcarter3/oci/ocitest"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImmutable(t *testing.T) {
+	ctx := context.Background()
+	r := Immutable(ocimem.New())
+	pushBlob(t, r, "foo", "{}")
+	m1 := imageManifest(t, "1")
+	m2 := imageManifest(t, "2")
+	pushImmutableManifest(t, r, "foo", m1, "latest")
+	// Pushing the same content again is fine.
+	pushImmutableManifest(t, r, "foo", m1, "latest")
+	_, err := r.PushManifest(ctx, "foo", m2, ocispec.MediaTypeImageManifest, &oci.PushManifestParameters{
+		Tags: []string{"latest"},
+	})
+	require.ErrorIs(t, err, oci.ErrDenied)
+	require.ErrorIs(t, r.DeleteTag(ctx, "foo", "latest"), oci.ErrDenied)
+	require.ErrorIs(t, r.DeleteManifest(ctx, "foo", digest.FromBytes(m1)), oci.ErrDenied)
+	require.ErrorIs(t, r.DeleteBlob(ctx, "foo", digest.FromString("{}")), oci.ErrDenied)
+}
+
+func TestImmutableWithPolicy(t *testing.T) {
+	ctx := context.Background()
+	r := ImmutableWithPolicy(ocimem.New(), &ImmutablePolicy{
+		ImmutableTags: []*regexp.Regexp{regexp.MustCompile(`v[0-9]+\.[0-9]+\.[0-9]+`)},
+		MutableTags:   []*regexp.Regexp{regexp.MustCompile(`v0\..*`)},
+	})
+	pushBlob(t, r, "foo", "{}")
+	m1 := imageManifest(t, "1")
+	m2 := imageManifest(t, "2")
+	m3 := imageManifest(t, "3")
+	pushImmutableManifest(t, r, "foo", m1, "v1.2.3", "latest", "v1.2.3-rc1", "v0.1.0")
+
+	// Only tags matching the pattern as a whole, and
+	// not matching the mutable pattern, are immutable.
+	pushImmutableManifest(t, r, "foo", m2, "latest", "v1.2.3-rc1", "v0.1.0")
+	_, err := r.PushManifest(ctx, "foo", m2, ocispec.MediaTypeImageManifest, &oci.PushManifestParameters{
+		Tags: []string{"latest", "v1.2.3"},
+	})
+	require.ErrorIs(t, err, oci.ErrDenied)
+	desc, err := r.ResolveTag(ctx, "foo", "v1.2.3")
+	require.NoError(t, err)
+	require.Equal(t, digest.FromBytes(m1), desc.Digest)
+
+	// Mutable tags can be deleted, immutable ones can't.
+	require.NoError(t, r.DeleteTag(ctx, "foo", "latest"))
+	require.ErrorIs(t, r.DeleteTag(ctx, "foo", "v1.2.3"), oci.ErrDenied)
+
+	// A manifest can be deleted unless an immutable tag refers to it.
+	require.ErrorIs(t, r.DeleteManifest(ctx, "foo", digest.FromBytes(m1)), oci.ErrDenied)
+	pushImmutableManifest(t, r, "foo", m3)
+	require.NoError(t, r.DeleteManifest(ctx, "foo", digest.FromBytes(m3)))
+
+	// Blobs can never be deleted.
+	require.ErrorIs(t, r.DeleteBlob(ctx, "foo", digest.FromString("{}")), oci.ErrDenied)
+}
+
+func TestImmutableProtectsIndexChildren(t *testing.T) {
+	ctx := context.Background()
+	backend := ocimem.New()
+	content := ocitest.NewRegistry(t, backend).MustPushContent(ocitest.RegistryContent{
+		"foo": {
+			Blobs: map[string]string{
+				"config": "{}",
+			},
+			Manifests: map[string]oci.Manifest{
+				"amd64": {
+					MediaType: ocispec.MediaTypeImageManifest,
+					Config:    oci.Descriptor{Digest: "config"},
+				},
+				"arm64": {
+					MediaType: ocispec.MediaTypeImageManifest,
+					Config:    oci.Descriptor{Digest: "config"},
+					Annotations: map[string]string{
+						"arch": "arm64",
+					},
+				},
+				"other": {
+					MediaType: ocispec.MediaTypeImageManifest,
+					Config:    oci.Descriptor{Digest: "config"},
+					Annotations: map[string]string{
+						"other": "true",
+					},
+				},
+			},
+			Indexes: map[string]ocispec.Index{
+				"inner": {
+					MediaType: ocispec.MediaTypeImageIndex,
+					Manifests: []oci.Descriptor{{Digest: "arm64"}},
+				},
+				"outer": {
+					MediaType: ocispec.MediaTypeImageIndex,
+					Manifests: []oci.Descriptor{{Digest: "amd64"}, {Digest: "inner"}},
+				},
+			},
+			Tags: map[string]string{
+				"v1.0.0": "outer",
+				"latest": "other",
+			},
+		},
+	})["foo"]
+	r := ImmutableWithPolicy(backend, &ImmutablePolicy{
+		ImmutableTags: []*regexp.Regexp{regexp.MustCompile(`v.*`)},
+	})
+	// Children of the index under the immutable tag can't be
+	// deleted, however deeply nested they are.
+	for _, id := range []string{"outer", "amd64", "inner", "arm64"} {
+		err := r.DeleteManifest(ctx, "foo", content.Manifests[id].Digest)
+		require.ErrorIs(t, err, oci.ErrDenied, "manifest %s", id)
+	}
+	require.NoError(t, r.DeleteManifest(ctx, "foo", content.Manifests["other"].Digest))
+}
+
+type adminKey struct{}
+
+func TestImmutableExempt(t *testing.T) {
+	r := ImmutableWithPolicy(ocimem.New(), &ImmutablePolicy{
+		Exempt: func(ctx context.Context, repo string) bool {
+			return ctx.Value(adminKey{}) != nil
+		},
+	})
+	ctx := context.Background()
+	adminCtx := context.WithValue(ctx, adminKey{}, true)
+	pushBlob(t, r, "foo", "{}")
+	m1 := imageManifest(t, "1")
+	m2 := imageManifest(t, "2")
+	pushImmutableManifest(t, r, "foo", m1, "latest")
+	_, err := r.PushManifest(ctx, "foo", m2, ocispec.MediaTypeImageManifest, &oci.PushManifestParameters{
+		Tags: []string{"latest"},
+	})
+	require.ErrorIs(t, err, oci.ErrDenied)
+	_, err = r.PushManifest(adminCtx, "foo", m2, ocispec.MediaTypeImageManifest, &oci.PushManifestParameters{
+		Tags: []string{"latest"},
+	})
+	require.NoError(t, err)
+	require.ErrorIs(t, r.DeleteTag(ctx, "foo", "latest"), oci.ErrDenied)
+	require.NoError(t, r.DeleteTag(adminCtx, "foo", "latest"))
+	require.NoError(t, r.DeleteManifest(adminCtx, "foo", digest.FromBytes(m1)))
+}
+
+func pushImmutableManifest(t *testing.T, r oci.Interface, repo string, contents []byte, tags ...string) {
+	_, err := r.PushManifest(context.Background(), repo, contents, ocispec.MediaTypeImageManifest, &oci.PushManifestParameters{
+		Tags: tags,
+	})
+	require.NoError(t, err)
+}
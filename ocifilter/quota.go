@@ -0,0 +1,611 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocifilter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/internal/ocimanifest"
+)
+
+// QuotaLimit holds a set of limits on the repositories
+// matched by a prefix. Zero-valued limits are not enforced.
+type QuotaLimit struct {
+	// Prefix holds the repositories that the limit applies to: a
+	// repository matches if it's equal to Prefix or is inside it
+	// (for example, "team-a" matches "team-a/app"). An empty
+	// Prefix matches all repositories.
+	Prefix string
+
+	// PerRepository causes MaxBlobBytes to apply to each matching
+	// repository individually rather than to all of them in total.
+	PerRepository bool
+
+	// MaxBlobBytes holds the maximum number of bytes of blob content.
+	// A blob present in several repositories counts once
+	// for each of them.
+	MaxBlobBytes int64
+
+	// MaxTags holds the maximum number of tags in each
+	// matching repository.
+	MaxTags int
+
+	// MaxManifestSize holds the maximum size of
+	// a single manifest.
+	MaxManifestSize int64
+}
+
+func (l *QuotaLimit) matches(repo string) bool {
+	return l.Prefix == "" || repo == l.Prefix || strings.HasPrefix(repo, l.Prefix+"/")
+}
+
+// Quota kinds, as found in [QuotaDetail.Quota].
+const (
+	QuotaBlobBytes    = "blobBytes"
+	QuotaTags         = "tags"
+	QuotaManifestSize = "manifestSize"
+)
+
+// QuotaDetail holds the detail of an [oci.ErrDenied] error returned
+// when a quota would be exceeded. It's marshaled as JSON into
+// the error's detail.
+type QuotaDetail struct {
+	// Quota holds the kind of quota, for example [QuotaBlobBytes].
+	Quota string `json:"quota"`
+
+	// Prefix holds the prefix of the [QuotaLimit] that would be exceeded.
+	Prefix string `json:"prefix"`
+
+	// Repository holds the repository that was pushed to.
+	Repository string `json:"repository"`
+
+	// Limit holds the value of the limit.
+	Limit int64 `json:"limit"`
+
+	// Usage holds the usage before the push.
+	Usage int64 `json:"usage"`
+
+	// Requested holds the amount that the push would add.
+	Requested int64 `json:"requested"`
+}
+
+func (d *QuotaDetail) error() error {
+	detail, _ := json.Marshal(d)
+	msg := fmt.Sprintf("%s quota exceeded for %q: usage %d + %d > limit %d", d.Quota, d.Repository, d.Usage, d.Requested, d.Limit)
+	return oci.NewError(msg, oci.ErrDenied.Code(), detail)
+}
+
+// QuotaUsage holds the usage counted against quotas.
+type QuotaUsage struct {
+	BlobBytes int64
+	Tags      int
+}
+
+// QuotaRegistry is a registry that enforces quotas. See [Quota].
+type QuotaRegistry struct {
+	oci.Interface
+	limits []QuotaLimit
+
+	mu    sync.Mutex
+	repos map[string]*repoUsage
+	// pending holds the usage of pushes that are in progress,
+	// so that concurrent pushes can't jointly exceed a quota.
+	// Repositories with no pushes in progress have no entry.
+	pending map[string]*QuotaUsage
+	// limitBytes holds the number of blob bytes counted against
+	// each of the limits in total, including pending pushes.
+	limitBytes []int64
+}
+
+type repoUsage struct {
+	blobs map[oci.Digest]int64
+	tags  map[string]bool
+	// blobBytes holds the total size of blobs.
+	blobBytes int64
+}
+
+func newRepoUsage() *repoUsage {
+	return &repoUsage{
+		blobs: make(map[oci.Digest]int64),
+		tags:  make(map[string]bool),
+	}
+}
+
+// Quota returns a wrapper for r that enforces the given limits.
+// Pushes that would exceed a limit fail with an [oci.ErrDenied]
+// error with a [QuotaDetail] in its detail: that includes
+// PushBlob, the Commit of a chunked upload, MountBlob, and
+// PushManifest.
+//
+// Usage is counted as content is pushed and deleted through the
+// returned registry: every blob pushed counts until it's deleted,
+// whether or not a manifest refers to it. Usage starts empty: call
+// [QuotaRegistry.Rebuild] to account for content already in r.
+func Quota(r oci.Interface, limits []QuotaLimit) *QuotaRegistry {
+	return &QuotaRegistry{
+		Interface:  r,
+		limits:     limits,
+		repos:      make(map[string]*repoUsage),
+		pending:    make(map[string]*QuotaUsage),
+		limitBytes: make([]int64, len(limits)),
+	}
+}
+
+// Usage returns the usage of a single repository.
+func (q *QuotaRegistry) Usage(repo string) QuotaUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.repos[repo].usage()
+}
+
+// PrefixUsage returns the total usage of all the repositories
+// matching prefix, as for [QuotaLimit.Prefix].
+func (q *QuotaRegistry) PrefixUsage(prefix string) QuotaUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	l := QuotaLimit{Prefix: prefix}
+	var total QuotaUsage
+	for repo, u := range q.repos {
+		if l.matches(repo) {
+			total.BlobBytes += u.blobBytes
+			total.Tags += len(u.tags)
+		}
+	}
+	return total
+}
+
+func (u *repoUsage) usage() QuotaUsage {
+	if u == nil {
+		return QuotaUsage{}
+	}
+	return QuotaUsage{
+		BlobBytes: u.blobBytes,
+		Tags:      len(u.tags),
+	}
+}
+
+// Rebuild recomputes all usage from the content of the underlying
+// registry.
+//
+// Usage counts every blob in a repository, whether or not any manifest
+// refers to it, as it does when blobs are pushed. The underlying
+// registry can't list its blobs, so Rebuild finds them by walking the
+// manifests reachable from each tag, including the children of indexes
+// and any referrers, and keeps any blobs already counted that are still
+// present. Blobs that are neither reachable nor already counted, such
+// as blobs pushed other than through q that no manifest refers to,
+// can't be found, and so aren't counted.
+//
+// Pushes made while Rebuild is running might not be counted,
+// so it's best called when the registry is quiescent.
+func (q *QuotaRegistry) Rebuild(ctx context.Context) error {
+	q.mu.Lock()
+	counted := make(map[string]map[oci.Digest]int64)
+	for repo, u := range q.repos {
+		counted[repo] = maps.Clone(u.blobs)
+	}
+	q.mu.Unlock()
+
+	repos := make(map[string]*repoUsage)
+	for repo, err := range q.Interface.Repositories(ctx, "") {
+		if err != nil {
+			return fmt.Errorf("cannot list repositories: %w", err)
+		}
+		u := newRepoUsage()
+		visited := make(map[oci.Digest]bool)
+		for tag, err := range q.Interface.Tags(ctx, repo, nil) {
+			if err != nil {
+				return fmt.Errorf("cannot list tags in %s: %w", repo, err)
+			}
+			u.tags[tag] = true
+			desc, err := q.Interface.ResolveTag(ctx, repo, tag)
+			if err != nil {
+				return fmt.Errorf("cannot resolve %s:%s: %w", repo, tag, err)
+			}
+			if err := q.walkManifest(ctx, repo, desc.Digest, u, visited); err != nil {
+				return err
+			}
+		}
+		for dgst, size := range counted[repo] {
+			if _, ok := u.blobs[dgst]; ok {
+				continue
+			}
+			if _, err := q.Interface.ResolveBlob(ctx, repo, dgst); err == nil {
+				u.blobs[dgst] = size
+			} else if !errors.Is(err, oci.ErrBlobUnknown) && !errors.Is(err, oci.ErrNameUnknown) {
+				return fmt.Errorf("cannot resolve blob %s in %s: %w", dgst, repo, err)
+			}
+		}
+		for _, size := range u.blobs {
+			u.blobBytes += size
+		}
+		repos[repo] = u
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.repos = repos
+	clear(q.limitBytes)
+	for repo, u := range repos {
+		q.addLimitBytes(repo, u.blobBytes)
+	}
+	for repo, p := range q.pending {
+		q.addLimitBytes(repo, p.BlobBytes)
+	}
+	return nil
+}
+
+// walkManifest adds the blobs referred to by the given manifest,
+// its children and its referrers to u.
+func (q *QuotaRegistry) walkManifest(ctx context.Context, repo string, dgst oci.Digest, u *repoUsage, visited map[oci.Digest]bool) error {
+	if visited[dgst] {
+		return nil
+	}
+	visited[dgst] = true
+	_, refs, err := ocimanifest.Get(ctx, q.Interface, repo, dgst)
+	if err != nil {
+		return fmt.Errorf("cannot get manifest %s in %s: %w", dgst, repo, err)
+	}
+	for _, blob := range refs.Blobs {
+		if _, ok := u.blobs[blob.Digest]; ok {
+			continue
+		}
+		if blob.Size < 0 {
+			// Docker schema1 manifests don't record blob sizes.
+			desc, err := q.Interface.ResolveBlob(ctx, repo, blob.Digest)
+			if err != nil {
+				return fmt.Errorf("cannot resolve blob %s in %s: %w", blob.Digest, repo, err)
+			}
+			blob.Size = desc.Size
+		}
+		u.blobs[blob.Digest] = blob.Size
+	}
+	for _, m := range refs.Manifests {
+		if err := q.walkManifest(ctx, repo, m.Digest, u, visited); err != nil {
+			return err
+		}
+	}
+	for desc, err := range q.Interface.Referrers(ctx, repo, dgst, nil) {
+		if err != nil {
+			if errors.Is(err, oci.ErrUnsupported) {
+				break
+			}
+			return fmt.Errorf("cannot list referrers of %s in %s: %w", dgst, repo, err)
+		}
+		if err := q.walkManifest(ctx, repo, desc.Digest, u, visited); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// repo returns the usage for repo, creating it if needed.
+// It's called with q.mu held.
+func (q *QuotaRegistry) repo(repo string) *repoUsage {
+	u := q.repos[repo]
+	if u == nil {
+		u = newRepoUsage()
+		q.repos[repo] = u
+	}
+	return u
+}
+
+// addLimitBytes adds n blob bytes in repo to the totals
+// of the limits that match it. It's called with q.mu held.
+func (q *QuotaRegistry) addLimitBytes(repo string, n int64) {
+	for i := range q.limits {
+		if q.limits[i].matches(repo) {
+			q.limitBytes[i] += n
+		}
+	}
+}
+
+// setBlob records that repo holds a blob of the given size.
+// It's called with q.mu held.
+func (q *QuotaRegistry) setBlob(repo string, dgst oci.Digest, size int64) {
+	u := q.repo(repo)
+	n := size - u.blobs[dgst]
+	u.blobs[dgst] = size
+	u.blobBytes += n
+	q.addLimitBytes(repo, n)
+}
+
+// deleteBlob records that repo no longer holds a blob.
+// It's called with q.mu held.
+func (q *QuotaRegistry) deleteBlob(repo string, dgst oci.Digest) {
+	u := q.repos[repo]
+	if u == nil {
+		return
+	}
+	if size, ok := u.blobs[dgst]; ok {
+		delete(u.blobs, dgst)
+		u.blobBytes -= size
+		q.addLimitBytes(repo, -size)
+	}
+}
+
+// addPending adds to the usage of pushes in progress to repo.
+// It's called with q.mu held.
+func (q *QuotaRegistry) addPending(repo string, blobBytes int64, tags int) {
+	p := q.pending[repo]
+	if p == nil {
+		p = &QuotaUsage{}
+		q.pending[repo] = p
+	}
+	p.BlobBytes += blobBytes
+	p.Tags += tags
+	q.addLimitBytes(repo, blobBytes)
+	if *p == (QuotaUsage{}) {
+		delete(q.pending, repo)
+	}
+}
+
+// blobBytesFor returns the number of blob bytes counted against
+// the limit with index i when pushing to repo, including pending
+// pushes. It's called with q.mu held.
+func (q *QuotaRegistry) blobBytesFor(i int, repo string) int64 {
+	if !q.limits[i].PerRepository {
+		return q.limitBytes[i]
+	}
+	n := q.repos[repo].usage().BlobBytes
+	if p := q.pending[repo]; p != nil {
+		n += p.BlobBytes
+	}
+	return n
+}
+
+// reserveBlob checks that adding a blob of the given size to repo
+// wouldn't exceed any quota, and records it as pending. The returned
+// function must be called when the push has completed, with the
+// pushed descriptor if it succeeded.
+func (q *QuotaRegistry) reserveBlob(repo string, dgst oci.Digest, size int64) (func(desc *oci.Descriptor), error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if u := q.repos[repo]; u != nil && dgst != "" {
+		if _, ok := u.blobs[dgst]; ok {
+			// The blob is already counted.
+			return func(*oci.Descriptor) {}, nil
+		}
+	}
+	for i := range q.limits {
+		l := &q.limits[i]
+		if l.MaxBlobBytes <= 0 || !l.matches(repo) {
+			continue
+		}
+		usage := q.blobBytesFor(i, repo)
+		if usage+size > l.MaxBlobBytes {
+			return nil, (&QuotaDetail{
+				Quota:      QuotaBlobBytes,
+				Prefix:     l.Prefix,
+				Repository: repo,
+				Limit:      l.MaxBlobBytes,
+				Usage:      usage,
+				Requested:  size,
+			}).error()
+		}
+	}
+	q.addPending(repo, size, 0)
+	return func(desc *oci.Descriptor) {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.addPending(repo, -size, 0)
+		if desc != nil {
+			q.setBlob(repo, desc.Digest, desc.Size)
+		}
+	}, nil
+}
+
+// reserveManifest checks that pushing a manifest of the given size
+// with the given tags to repo wouldn't exceed any quota, and records
+// any new tags as pending. The returned function must be called when
+// the push has completed, reporting whether it succeeded.
+func (q *QuotaRegistry) reserveManifest(repo string, size int64, tags []string) (func(ok bool), error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var newTags []string
+	u := q.repos[repo]
+	for _, tag := range tags {
+		if (u == nil || !u.tags[tag]) && !slices.Contains(newTags, tag) {
+			newTags = append(newTags, tag)
+		}
+	}
+	for i := range q.limits {
+		l := &q.limits[i]
+		if !l.matches(repo) {
+			continue
+		}
+		if l.MaxManifestSize > 0 && size > l.MaxManifestSize {
+			return nil, (&QuotaDetail{
+				Quota:      QuotaManifestSize,
+				Prefix:     l.Prefix,
+				Repository: repo,
+				Limit:      l.MaxManifestSize,
+				Requested:  size,
+			}).error()
+		}
+		if l.MaxTags > 0 && len(newTags) > 0 {
+			usage := len(u.tagsOrNil())
+			if p := q.pending[repo]; p != nil {
+				usage += p.Tags
+			}
+			if usage+len(newTags) > l.MaxTags {
+				return nil, (&QuotaDetail{
+					Quota:      QuotaTags,
+					Prefix:     l.Prefix,
+					Repository: repo,
+					Limit:      int64(l.MaxTags),
+					Usage:      int64(usage),
+					Requested:  int64(len(newTags)),
+				}).error()
+			}
+		}
+	}
+	q.addPending(repo, 0, len(newTags))
+	return func(ok bool) {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.addPending(repo, 0, -len(newTags))
+		if ok {
+			u := q.repo(repo)
+			for _, tag := range newTags {
+				u.tags[tag] = true
+			}
+		}
+	}, nil
+}
+
+func (u *repoUsage) tagsOrNil() map[string]bool {
+	if u == nil {
+		return nil
+	}
+	return u.tags
+}
+
+func (q *QuotaRegistry) PushBlob(ctx context.Context, repo string, desc oci.Descriptor, r io.Reader) (oci.Descriptor, error) {
+	done, err := q.reserveBlob(repo, desc.Digest, desc.Size)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	desc, err = q.Interface.PushBlob(ctx, repo, desc, r)
+	if err != nil {
+		done(nil)
+		return oci.Descriptor{}, err
+	}
+	done(&desc)
+	return desc, nil
+}
+
+func (q *QuotaRegistry) PushBlobChunked(ctx context.Context, repo string, chunkSize int) (oci.BlobWriter, error) {
+	w, err := q.Interface.PushBlobChunked(ctx, repo, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	return &quotaBlobWriter{BlobWriter: w, q: q, repo: repo}, nil
+}
+
+func (q *QuotaRegistry) PushBlobChunkedResume(ctx context.Context, repo, id string, offset int64, chunkSize int) (oci.BlobWriter, error) {
+	w, err := q.Interface.PushBlobChunkedResume(ctx, repo, id, offset, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	return &quotaBlobWriter{BlobWriter: w, q: q, repo: repo}, nil
+}
+
+func (q *QuotaRegistry) MountBlob(ctx context.Context, fromRepo, toRepo string, dgst oci.Digest) (oci.Descriptor, error) {
+	desc, err := q.Interface.ResolveBlob(ctx, fromRepo, dgst)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	done, err := q.reserveBlob(toRepo, dgst, desc.Size)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	desc, err = q.Interface.MountBlob(ctx, fromRepo, toRepo, dgst)
+	if err != nil {
+		done(nil)
+		return oci.Descriptor{}, err
+	}
+	done(&desc)
+	return desc, nil
+}
+
+func (q *QuotaRegistry) PushManifest(ctx context.Context, repo string, contents []byte, mediaType string, params *oci.PushManifestParameters) (oci.Descriptor, error) {
+	var tags []string
+	if params != nil {
+		tags = params.Tags
+	}
+	done, err := q.reserveManifest(repo, int64(len(contents)), tags)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	desc, err := q.Interface.PushManifest(ctx, repo, contents, mediaType, params)
+	done(err == nil)
+	return desc, err
+}
+
+func (q *QuotaRegistry) DeleteBlob(ctx context.Context, repo string, dgst oci.Digest) error {
+	if err := q.Interface.DeleteBlob(ctx, repo, dgst); err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.deleteBlob(repo, dgst)
+	return nil
+}
+
+func (q *QuotaRegistry) DeleteTag(ctx context.Context, repo string, tag string) error {
+	if err := q.Interface.DeleteTag(ctx, repo, tag); err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if u := q.repos[repo]; u != nil {
+		delete(u.tags, tag)
+	}
+	return nil
+}
+
+func (q *QuotaRegistry) DeleteManifest(ctx context.Context, repo string, dgst oci.Digest) error {
+	if err := q.Interface.DeleteManifest(ctx, repo, dgst); err != nil {
+		return err
+	}
+	// Deleting a manifest might also delete the tags that refer to
+	// it, so count the remaining tags again.
+	tags := make(map[string]bool)
+	for tag, err := range q.Interface.Tags(ctx, repo, nil) {
+		if err != nil {
+			// The repository might have gone away altogether.
+			tags = nil
+			break
+		}
+		tags[tag] = true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if u := q.repos[repo]; u != nil && tags != nil {
+		u.tags = tags
+	}
+	return nil
+}
+
+// quotaBlobWriter checks the quota when a chunked upload is committed.
+type quotaBlobWriter struct {
+	oci.BlobWriter
+	q    *QuotaRegistry
+	repo string
+}
+
+func (w *quotaBlobWriter) Commit(dgst oci.Digest) (oci.Descriptor, error) {
+	done, err := w.q.reserveBlob(w.repo, dgst, w.BlobWriter.Size())
+	if err != nil {
+		w.BlobWriter.Cancel()
+		return oci.Descriptor{}, err
+	}
+	desc, err := w.BlobWriter.Commit(dgst)
+	if err != nil {
+		done(nil)
+		return oci.Descriptor{}, err
+	}
+	done(&desc)
+	return desc, nil
+}
@@ -0,0 +1,294 @@
+package ocifilter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/internal/ocimanifest"
+	"github.com/jcarter3/oci/ocimem"
+	"github.com/jcarter3/oci/ocitest"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotaBlobBytesPerRepository(t *testing.T) {
+	ctx := context.Background()
+	r := Quota(ocimem.New(), []QuotaLimit{{
+		Prefix:        "team-a",
+		PerRepository: true,
+		MaxBlobBytes:  100,
+	}})
+	blob1 := strings.Repeat("a", 60)
+	blob2 := strings.Repeat("b", 60)
+
+	pushBlob(t, r, "team-a/x", blob1)
+	// Pushing the same blob again doesn't use any more quota.
+	pushBlob(t, r, "team-a/x", blob1)
+	_, err := r.PushBlob(ctx, "team-a/x", blobDesc(blob2), strings.NewReader(blob2))
+	requireQuotaError(t, err, QuotaDetail{
+		Quota:      QuotaBlobBytes,
+		Prefix:     "team-a",
+		Repository: "team-a/x",
+		Limit:      100,
+		Usage:      60,
+		Requested:  60,
+	})
+
+	// Each repository has its own quota, and other
+	// repositories aren't limited.
+	pushBlob(t, r, "team-a/y", blob2)
+	pushBlob(t, r, "team-b", blob1)
+	pushBlob(t, r, "team-b", blob2)
+	require.Equal(t, QuotaUsage{BlobBytes: 60}, r.Usage("team-a/x"))
+	require.Equal(t, QuotaUsage{BlobBytes: 120}, r.PrefixUsage("team-a"))
+
+	// Deleting a blob frees its quota.
+	require.NoError(t, r.DeleteBlob(ctx, "team-a/x", digest.FromString(blob1)))
+	pushBlob(t, r, "team-a/x", blob2)
+}
+
+func TestQuotaBlobBytesPrefix(t *testing.T) {
+	ctx := context.Background()
+	r := Quota(ocimem.New(), []QuotaLimit{{
+		Prefix:       "team-a",
+		MaxBlobBytes: 100,
+	}})
+	blob1 := strings.Repeat("a", 60)
+	blob2 := strings.Repeat("b", 60)
+	pushBlob(t, r, "team-a/x", blob1)
+	_, err := r.PushBlob(ctx, "team-a/y", blobDesc(blob2), strings.NewReader(blob2))
+	requireQuotaError(t, err, QuotaDetail{
+		Quota:      QuotaBlobBytes,
+		Prefix:     "team-a",
+		Repository: "team-a/y",
+		Limit:      100,
+		Usage:      60,
+		Requested:  60,
+	})
+	// "team-ab" isn't inside "team-a".
+	pushBlob(t, r, "team-ab", blob2)
+
+	// Mounting a blob counts against the quota too.
+	_, err = r.MountBlob(ctx, "team-ab", "team-a/y", digest.FromString(blob2))
+	require.ErrorIs(t, err, oci.ErrDenied)
+}
+
+func TestQuotaRunningTotals(t *testing.T) {
+	ctx := context.Background()
+	r := Quota(ocimem.New(), []QuotaLimit{{
+		Prefix:       "team-a",
+		MaxBlobBytes: 100,
+	}, {
+		MaxBlobBytes: 150,
+	}})
+	blob1 := strings.Repeat("a", 60)
+	blob2 := strings.Repeat("b", 30)
+	pushBlob(t, r, "team-a/x", blob1)
+	pushBlob(t, r, "team-a/y", blob2)
+	pushBlob(t, r, "team-b", blob2)
+	_, err := r.PushBlob(ctx, "team-a/y", blobDesc(blob1), strings.NewReader(blob1))
+	require.ErrorIs(t, err, oci.ErrDenied)
+	// A push that fails in the underlying registry
+	// releases its reservation.
+	_, err = r.PushBlob(ctx, "team-b", blobDesc(blob1), strings.NewReader(blob2))
+	require.Error(t, err)
+	require.NoError(t, r.DeleteBlob(ctx, "team-a/y", digest.FromString(blob2)))
+
+	requireTotals := func() {
+		t.Helper()
+		require.Empty(t, r.pending)
+		require.Equal(t, []int64{
+			r.PrefixUsage("team-a").BlobBytes,
+			r.PrefixUsage("").BlobBytes,
+		}, r.limitBytes)
+	}
+	requireTotals()
+	require.Equal(t, []int64{60, 90}, r.limitBytes)
+	require.NoError(t, r.Rebuild(ctx))
+	requireTotals()
+	require.Equal(t, []int64{60, 90}, r.limitBytes)
+}
+
+func TestQuotaChunkedCommit(t *testing.T) {
+	ctx := context.Background()
+	backend := ocimem.New()
+	r := Quota(backend, []QuotaLimit{{
+		MaxBlobBytes: 100,
+	}})
+	pushBlob(t, r, "foo", strings.Repeat("a", 60))
+
+	blob := strings.Repeat("b", 60)
+	w, err := r.PushBlobChunked(ctx, "foo", 0)
+	require.NoError(t, err)
+	_, err = w.Write([]byte(blob))
+	require.NoError(t, err)
+	_, err = w.Commit(digest.FromString(blob))
+	require.ErrorIs(t, err, oci.ErrDenied)
+	_, err = backend.ResolveBlob(ctx, "foo", digest.FromString(blob))
+	require.ErrorIs(t, err, oci.ErrBlobUnknown)
+
+	blob = strings.Repeat("c", 40)
+	w, err = r.PushBlobChunked(ctx, "foo", 0)
+	require.NoError(t, err)
+	_, err = w.Write([]byte(blob))
+	require.NoError(t, err)
+	_, err = w.Commit(digest.FromString(blob))
+	require.NoError(t, err)
+	require.Equal(t, QuotaUsage{BlobBytes: 100}, r.Usage("foo"))
+}
+
+func TestQuotaManifests(t *testing.T) {
+	ctx := context.Background()
+	r := Quota(ocimem.New(), []QuotaLimit{{
+		MaxTags:         2,
+		MaxManifestSize: 500,
+	}})
+	pushBlob(t, r, "foo", "{}")
+	m1 := imageManifest(t, "one")
+	m2 := imageManifest(t, "two")
+
+	_, err := r.PushManifest(ctx, "foo", m1, ocispec.MediaTypeImageManifest, &oci.PushManifestParameters{
+		Tags: []string{"a", "b"},
+	})
+	require.NoError(t, err)
+	// Moving an existing tag doesn't need any more quota.
+	_, err = r.PushManifest(ctx, "foo", m2, ocispec.MediaTypeImageManifest, &oci.PushManifestParameters{
+		Tags: []string{"b"},
+	})
+	require.NoError(t, err)
+	_, err = r.PushManifest(ctx, "foo", m2, ocispec.MediaTypeImageManifest, &oci.PushManifestParameters{
+		Tags: []string{"c"},
+	})
+	requireQuotaError(t, err, QuotaDetail{
+		Quota:      QuotaTags,
+		Repository: "foo",
+		Limit:      2,
+		Usage:      2,
+		Requested:  1,
+	})
+	require.NoError(t, r.DeleteTag(ctx, "foo", "a"))
+	_, err = r.PushManifest(ctx, "foo", m2, ocispec.MediaTypeImageManifest, &oci.PushManifestParameters{
+		Tags: []string{"c"},
+	})
+	require.NoError(t, err)
+
+	big := imageManifest(t, strings.Repeat("x", 500))
+	_, err = r.PushManifest(ctx, "foo", big, ocispec.MediaTypeImageManifest, nil)
+	requireQuotaError(t, err, QuotaDetail{
+		Quota:      QuotaManifestSize,
+		Repository: "foo",
+		Limit:      500,
+		Requested:  int64(len(big)),
+	})
+}
+
+func TestQuotaRebuild(t *testing.T) {
+	ctx := context.Background()
+	backend := ocimem.New()
+	ocitest.NewRegistry(t, backend).MustPushContent(ocitest.RegistryContent{
+		"team-a/x": {
+			Blobs: map[string]string{
+				"config": "{}",
+				"layer1": strings.Repeat("a", 40),
+				"layer2": strings.Repeat("b", 50),
+			},
+			Manifests: map[string]oci.Manifest{
+				"m1": {
+					MediaType: ocispec.MediaTypeImageManifest,
+					Config:    oci.Descriptor{Digest: "config"},
+					Layers:    []oci.Descriptor{{Digest: "layer1"}},
+				},
+				"m2": {
+					MediaType: ocispec.MediaTypeImageManifest,
+					Config:    oci.Descriptor{Digest: "config"},
+					Layers:    []oci.Descriptor{{Digest: "layer1"}, {Digest: "layer2"}},
+				},
+			},
+			Tags: map[string]string{
+				"v1": "m1",
+				"v2": "m2",
+			},
+		},
+	})
+	r := Quota(backend, []QuotaLimit{{
+		Prefix:       "team-a",
+		MaxBlobBytes: 100,
+	}})
+	require.Equal(t, QuotaUsage{}, r.Usage("team-a/x"))
+	require.NoError(t, r.Rebuild(ctx))
+	require.Equal(t, QuotaUsage{BlobBytes: 2 + 40 + 50, Tags: 2}, r.Usage("team-a/x"))
+
+	_, err := r.PushBlob(ctx, "team-a/x", blobDesc("0123456789"), strings.NewReader("0123456789"))
+	require.ErrorIs(t, err, oci.ErrDenied)
+}
+
+func TestQuotaRebuildDockerAndUntagged(t *testing.T) {
+	ctx := context.Background()
+	backend := ocimem.New()
+	ocitest.NewRegistry(t, backend).MustPushContent(ocitest.RegistryContent{
+		"foo": {
+			Blobs: map[string]string{
+				"config":    "{}",
+				"layer1":    strings.Repeat("a", 10),
+				"layer2":    strings.Repeat("b", 20),
+				"sigconfig": "[]",
+				"sig":       strings.Repeat("c", 30),
+			},
+			Manifests: map[string]oci.Manifest{
+				"amd64": {
+					MediaType: ocimanifest.MediaTypeDockerManifest,
+					Config:    oci.Descriptor{Digest: "config"},
+					Layers:    []oci.Descriptor{{Digest: "layer1"}},
+				},
+				"arm64": {
+					MediaType: ocimanifest.MediaTypeDockerManifest,
+					Config:    oci.Descriptor{Digest: "config"},
+					Layers:    []oci.Descriptor{{Digest: "layer2"}},
+				},
+				"signature": {
+					MediaType: ocispec.MediaTypeImageManifest,
+					Config:    oci.Descriptor{Digest: "sigconfig"},
+					Layers:    []oci.Descriptor{{Digest: "sig"}},
+					Subject:   &oci.Descriptor{Digest: "list"},
+				},
+			},
+			Indexes: map[string]ocispec.Index{
+				"list": {
+					MediaType: ocimanifest.MediaTypeDockerManifestList,
+					Manifests: []oci.Descriptor{{Digest: "amd64"}, {Digest: "arm64"}},
+				},
+			},
+			Tags: map[string]string{
+				"latest": "list",
+			},
+		},
+	})
+	r := Quota(backend, nil)
+	// A blob that nothing refers to yet still counts,
+	// both when it's pushed and after a rebuild.
+	pushBlob(t, r, "foo", strings.Repeat("d", 40))
+	require.Equal(t, QuotaUsage{BlobBytes: 40}, r.Usage("foo"))
+
+	require.NoError(t, r.Rebuild(ctx))
+	require.Equal(t, QuotaUsage{BlobBytes: 2 + 10 + 20 + 2 + 30 + 40, Tags: 1}, r.Usage("foo"))
+
+	// Once it's deleted, it's no longer counted.
+	require.NoError(t, backend.DeleteBlob(ctx, "foo", digest.FromString(strings.Repeat("d", 40))))
+	require.NoError(t, r.Rebuild(ctx))
+	require.Equal(t, QuotaUsage{BlobBytes: 2 + 10 + 20 + 2 + 30, Tags: 1}, r.Usage("foo"))
+}
+
+func requireQuotaError(t *testing.T, err error, want QuotaDetail) {
+	require.ErrorIs(t, err, oci.ErrDenied)
+	var ociErr oci.Error
+	require.True(t, errors.As(err, &ociErr))
+	var got QuotaDetail
+	require.NoError(t, json.NewDecoder(bytes.NewReader(ociErr.Detail())).Decode(&got))
+	require.Equal(t, want, got)
+}
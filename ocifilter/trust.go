@@ -0,0 +1,411 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocifilter
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/internal/ocimanifest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// maxReferrerSize bounds the size of the manifests
+	// and blobs read when verifying referrers.
+	maxReferrerSize = 4 << 20
+
+	// maxTrustedChildren bounds the number of child manifests
+	// remembered as trusted by way of their index.
+	maxTrustedChildren = 10000
+)
+
+// IndexTrust determines how [Trusted] treats image indexes.
+type IndexTrust int
+
+const (
+	// TrustIndex requires the index itself to have a verified
+	// referrer. Its child manifests are then trusted when read
+	// after the index, without needing referrers of their own.
+	//
+	// This relies on remembering which children have been seen in
+	// verified indexes, which is best-effort: the record is held in
+	// memory and bounded in size, so a child can be denied if it's
+	// read long after its index, and it isn't revoked when the
+	// index's referrers are removed.
+	TrustIndex IndexTrust = iota
+
+	// TrustChildren requires every child manifest of an
+	// index to have a verified referrer.
+	TrustChildren
+
+	// TrustIndexOrChildren accepts an index if either it or
+	// every one of its child manifests has a verified referrer.
+	TrustIndexOrChildren
+)
+
+// TrustPolicy determines which manifests can be read
+// through a registry returned by [Trusted].
+type TrustPolicy struct {
+	// ArtifactTypes holds the artifact types of referrers that
+	// can vouch for a manifest, for example
+	// "application/vnd.dev.cosign.artifact.sig.v1+json" or
+	// "application/vnd.cncf.notary.signature".
+	// If it's empty, referrers of any type are considered.
+	ArtifactTypes []string
+
+	// Verify, if non-nil, is called for each candidate referrer.
+	// A manifest is trusted when Verify returns nil for any one
+	// of its referrers. If Verify is nil, the presence of a
+	// referrer with a matching artifact type is enough.
+	//
+	// Either way, the referrer manifest is read and must
+	// name the manifest being read as its subject, so a
+	// forged referrers listing isn't enough on its own.
+	Verify func(ctx context.Context, ref *TrustReferrer) error
+
+	// Index determines how image indexes are checked.
+	Index IndexTrust
+
+	// Exempt, if non-nil, is called for each read. If it
+	// returns true, the read is passed through unchecked.
+	Exempt func(ctx context.Context, repo string) bool
+}
+
+// TrustReferrer holds a referrer being verified by [TrustPolicy.Verify].
+type TrustReferrer struct {
+	// Repo holds the repository containing the subject and referrer.
+	Repo string
+
+	// Subject holds the descriptor of the manifest being read.
+	Subject oci.Descriptor
+
+	// Descriptor holds the descriptor of the referrer
+	// as returned by [oci.Lister.Referrers].
+	Descriptor oci.Descriptor
+
+	// Manifest holds the referrer manifest, and
+	// ManifestData its raw contents.
+	Manifest     oci.Manifest
+	ManifestData []byte
+
+	// Blobs holds the contents of each of Manifest.Layers.
+	Blobs [][]byte
+}
+
+// Trusted returns a registry that wraps r and only allows a
+// manifest to be read if it has a referrer (for example a
+// signature or attestation) accepted by the policy p.
+// Reads of other manifests fail with [oci.ErrDenied].
+//
+// The check applies to GetManifest, GetTag, ResolveManifest
+// and ResolveTag. Blobs and listings are not restricted.
+// A nil p accepts any manifest that has at least one referrer.
+func Trusted(r oci.Interface, p *TrustPolicy) oci.Interface {
+	var p1 TrustPolicy
+	if p != nil {
+		p1 = *p
+	}
+	return &trusted{
+		Interface: r,
+		p:         p1,
+		children:  make(map[string]bool),
+	}
+}
+
+type trusted struct {
+	oci.Interface
+	p TrustPolicy
+
+	// children holds the "repo@digest" keys of child manifests
+	// of indexes that have been verified under TrustIndex.
+	mu       sync.Mutex
+	children map[string]bool
+}
+
+func (r *trusted) GetManifest(ctx context.Context, repo string, digest oci.Digest) (oci.BlobReader, error) {
+	rd, err := r.Interface.GetManifest(ctx, repo, digest)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.check(ctx, repo, rd.Descriptor()); err != nil {
+		rd.Close()
+		return nil, err
+	}
+	return rd, nil
+}
+
+func (r *trusted) GetTag(ctx context.Context, repo string, tagName string) (oci.BlobReader, error) {
+	rd, err := r.Interface.GetTag(ctx, repo, tagName)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.check(ctx, repo, rd.Descriptor()); err != nil {
+		rd.Close()
+		return nil, err
+	}
+	return rd, nil
+}
+
+func (r *trusted) ResolveManifest(ctx context.Context, repo string, digest oci.Digest) (oci.Descriptor, error) {
+	desc, err := r.Interface.ResolveManifest(ctx, repo, digest)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	if err := r.check(ctx, repo, desc); err != nil {
+		return oci.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+func (r *trusted) ResolveTag(ctx context.Context, repo string, tagName string) (oci.Descriptor, error) {
+	desc, err := r.Interface.ResolveTag(ctx, repo, tagName)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	if err := r.check(ctx, repo, desc); err != nil {
+		return oci.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// check returns an error if the manifest with the given
+// descriptor isn't trusted.
+func (r *trusted) check(ctx context.Context, repo string, desc oci.Descriptor) error {
+	if r.p.Exempt != nil && r.p.Exempt(ctx, repo) {
+		return nil
+	}
+	if r.isTrustedChild(repo, desc.Digest) {
+		return nil
+	}
+	if !ocimanifest.IsIndex(desc.MediaType) {
+		return r.checkReferrers(ctx, repo, desc)
+	}
+	switch r.p.Index {
+	case TrustIndex:
+		if err := r.checkReferrers(ctx, repo, desc); err != nil {
+			return err
+		}
+		children, err := r.indexChildren(ctx, repo, desc)
+		if err != nil {
+			return err
+		}
+		r.addTrustedChildren(repo, children)
+		return nil
+	case TrustChildren:
+		return r.checkChildren(ctx, repo, desc)
+	case TrustIndexOrChildren:
+		err := r.checkReferrers(ctx, repo, desc)
+		if err == nil {
+			children, err := r.indexChildren(ctx, repo, desc)
+			if err != nil {
+				return err
+			}
+			r.addTrustedChildren(repo, children)
+			return nil
+		}
+		return r.checkChildren(ctx, repo, desc)
+	}
+	return fmt.Errorf("unknown index trust mode %d", r.p.Index)
+}
+
+// checkChildren checks each child manifest of the given index.
+func (r *trusted) checkChildren(ctx context.Context, repo string, index oci.Descriptor) error {
+	children, err := r.indexChildren(ctx, repo, index)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		// Attestation manifests added by BuildKit aren't images
+		// in their own right and aren't usually signed.
+		if child.Annotations["vnd.docker.reference.type"] == "attestation-manifest" {
+			continue
+		}
+		if err := r.check(ctx, repo, child); err != nil {
+			return fmt.Errorf("child of index %s: %w", index.Digest, err)
+		}
+	}
+	return nil
+}
+
+// checkReferrers checks that subject has a referrer accepted by the policy.
+func (r *trusted) checkReferrers(ctx context.Context, repo string, subject oci.Descriptor) error {
+	var params *oci.ReferrersParameters
+	if len(r.p.ArtifactTypes) == 1 {
+		params = &oci.ReferrersParameters{
+			ArtifactType: r.p.ArtifactTypes[0],
+		}
+	}
+	var verifyErr error
+	for desc, err := range r.Interface.Referrers(ctx, repo, subject.Digest, params) {
+		if err != nil {
+			return fmt.Errorf("cannot list referrers of %s: %w", subject.Digest, err)
+		}
+		if len(r.p.ArtifactTypes) > 0 && !slices.Contains(r.p.ArtifactTypes, desc.ArtifactType) {
+			continue
+		}
+		ref, err := r.fetchReferrer(ctx, repo, subject, desc)
+		if err == nil && r.p.Verify != nil {
+			err = r.p.Verify(ctx, ref)
+		}
+		if err == nil {
+			return nil
+		}
+		if verifyErr == nil {
+			verifyErr = err
+		}
+	}
+	what := "referrer"
+	if len(r.p.ArtifactTypes) > 0 {
+		what = "referrer of type " + strings.Join(r.p.ArtifactTypes, " or ")
+	}
+	if verifyErr != nil {
+		return fmt.Errorf("manifest %s has no verified %s (%v): %w", subject.Digest, what, verifyErr, oci.ErrDenied)
+	}
+	return fmt.Errorf("manifest %s has no %s: %w", subject.Digest, what, oci.ErrDenied)
+}
+
+// fetchReferrer reads the referrer manifest with the given
+// descriptor, checking that it refers to subject, and,
+// if there's a Verify function, the blobs it refers to.
+func (r *trusted) fetchReferrer(ctx context.Context, repo string, subject, desc oci.Descriptor) (*TrustReferrer, error) {
+	rd, err := r.Interface.GetManifest(ctx, repo, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	data, err := readVerified(rd, desc)
+	rd.Close()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read referrer manifest %s: %w", desc.Digest, err)
+	}
+	ref := &TrustReferrer{
+		Repo:         repo,
+		Subject:      subject,
+		Descriptor:   desc,
+		ManifestData: data,
+	}
+	if err := json.Unmarshal(data, &ref.Manifest); err != nil {
+		return nil, fmt.Errorf("invalid referrer manifest %s: %v", desc.Digest, err)
+	}
+	if ref.Manifest.Subject == nil || ref.Manifest.Subject.Digest != subject.Digest {
+		return nil, fmt.Errorf("referrer manifest %s does not refer to %s", desc.Digest, subject.Digest)
+	}
+	if len(r.p.ArtifactTypes) > 0 {
+		artifactType := cmp.Or(ref.Manifest.ArtifactType, ref.Manifest.Config.MediaType)
+		if !slices.Contains(r.p.ArtifactTypes, artifactType) {
+			return nil, fmt.Errorf("referrer manifest %s has unexpected artifact type %q", desc.Digest, artifactType)
+		}
+	}
+	if r.p.Verify == nil {
+		return ref, nil
+	}
+	for _, layer := range ref.Manifest.Layers {
+		rd, err := r.Interface.GetBlob(ctx, repo, layer.Digest)
+		if err != nil {
+			return nil, err
+		}
+		blob, err := readVerified(rd, layer)
+		rd.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot read referrer blob %s: %w", layer.Digest, err)
+		}
+		ref.Blobs = append(ref.Blobs, blob)
+	}
+	return ref, nil
+}
+
+// readVerified reads the content with the given descriptor from rd,
+// checking its size and digest. Content larger than maxReferrerSize
+// is rejected rather than truncated.
+func readVerified(rd io.Reader, desc oci.Descriptor) ([]byte, error) {
+	if desc.Size > maxReferrerSize {
+		return nil, fmt.Errorf("content is too large (%d bytes)", desc.Size)
+	}
+	data, err := io.ReadAll(io.LimitReader(rd, maxReferrerSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxReferrerSize {
+		return nil, fmt.Errorf("content is larger than %d bytes", maxReferrerSize)
+	}
+	if desc.Size > 0 && int64(len(data)) != desc.Size {
+		return nil, fmt.Errorf("content has size %d; want %d", len(data), desc.Size)
+	}
+	if desc.Digest == "" {
+		return data, nil
+	}
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid digest %q: %v", desc.Digest, err)
+	}
+	if dgst := desc.Digest.Algorithm().FromBytes(data); dgst != desc.Digest {
+		return nil, fmt.Errorf("content has digest %s; want %s", dgst, desc.Digest)
+	}
+	return data, nil
+}
+
+// indexChildren returns the child manifests of the given index.
+func (r *trusted) indexChildren(ctx context.Context, repo string, index oci.Descriptor) ([]oci.Descriptor, error) {
+	data, err := r.readManifest(ctx, repo, index.Digest)
+	if err != nil {
+		return nil, err
+	}
+	var idx ocispec.Index
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("invalid index %s in %s: %v", index.Digest, repo, err)
+	}
+	return idx.Manifests, nil
+}
+
+// readManifest reads a manifest directly from the
+// underlying registry, bypassing the trust check.
+func (r *trusted) readManifest(ctx context.Context, repo string, digest oci.Digest) ([]byte, error) {
+	rd, err := r.Interface.GetManifest(ctx, repo, digest)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	data, err := readVerified(rd, oci.Descriptor{Digest: digest})
+	if err != nil {
+		return nil, fmt.Errorf("cannot read manifest %s in %s: %w", digest, repo, err)
+	}
+	return data, nil
+}
+
+func (r *trusted) isTrustedChild(repo string, digest oci.Digest) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.children[repo+"@"+string(digest)]
+}
+
+func (r *trusted) addTrustedChildren(repo string, children []oci.Descriptor) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.children)+len(children) > maxTrustedChildren {
+		// Start afresh rather than track usage. Children forgotten
+		// this way are denied until their index is read again,
+		// which clients that have already read it won't do.
+		clear(r.children)
+	}
+	for _, child := range children {
+		r.children[repo+"@"+string(child.Digest)] = true
+	}
+}
@@ -0,0 +1,327 @@
+package ocifilter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"iter"
+	"testing"
+
+	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/ocimem"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	cosignType   = "application/vnd.dev.cosign.artifact.sig.v1+json"
+	notationType = "application/vnd.cncf.notary.signature"
+)
+
+func TestTrusted(t *testing.T) {
+	ctx := context.Background()
+	mem := ocimem.New()
+	signed := pushTrustImage(t, mem, "signed", "v1")
+	pushTrustImage(t, mem, "unsigned", "v2")
+	badlySigned := pushTrustImage(t, mem, "badly-signed", "v3")
+	otherType := pushTrustImage(t, mem, "other-type", "v4")
+	signTrustManifest(t, mem, signed, cosignType, "")
+	signTrustManifest(t, mem, badlySigned, cosignType, "forged")
+	signTrustManifest(t, mem, otherType, notationType, "")
+
+	r := Trusted(mem, &TrustPolicy{
+		ArtifactTypes: []string{cosignType},
+		Verify:        verifyTrustPayload,
+	})
+	rd, err := r.GetTag(ctx, "foo", "v1")
+	require.NoError(t, err)
+	require.Equal(t, signed.Digest, rd.Descriptor().Digest)
+	rd.Close()
+	desc, err := r.ResolveManifest(ctx, "foo", signed.Digest)
+	require.NoError(t, err)
+	require.Equal(t, signed.Digest, desc.Digest)
+
+	_, err = r.ResolveTag(ctx, "foo", "v2")
+	require.ErrorIs(t, err, oci.ErrDenied)
+	require.ErrorContains(t, err, "has no referrer of type "+cosignType)
+	_, err = r.GetTag(ctx, "foo", "v3")
+	require.ErrorIs(t, err, oci.ErrDenied)
+	require.ErrorContains(t, err, "bad signature")
+	_, err = r.GetManifest(ctx, "foo", otherType.Digest)
+	require.ErrorIs(t, err, oci.ErrDenied)
+
+	// Without a Verify function, any referrer of
+	// one of the given types is enough.
+	r = Trusted(mem, &TrustPolicy{
+		ArtifactTypes: []string{cosignType, notationType},
+	})
+	for _, tag := range []string{"v1", "v3", "v4"} {
+		_, err := r.ResolveTag(ctx, "foo", tag)
+		require.NoError(t, err, "%s", tag)
+	}
+	_, err = r.ResolveTag(ctx, "foo", "v2")
+	require.ErrorIs(t, err, oci.ErrDenied)
+
+	// Exempt reads aren't checked.
+	r = Trusted(mem, &TrustPolicy{
+		ArtifactTypes: []string{cosignType},
+		Exempt: func(ctx context.Context, repo string) bool {
+			return true
+		},
+	})
+	_, err = r.ResolveTag(ctx, "foo", "v2")
+	require.NoError(t, err)
+}
+
+func TestTrustedIndex(t *testing.T) {
+	ctx := context.Background()
+	mem := ocimem.New()
+	child1 := pushTrustImage(t, mem, "child1")
+	child2 := pushTrustImage(t, mem, "child2")
+	child3 := pushTrustImage(t, mem, "child3")
+	attestation := pushTrustImage(t, mem, "attestation")
+	attestation.Annotations = map[string]string{
+		"vnd.docker.reference.type": "attestation-manifest",
+	}
+	signTrustManifest(t, mem, child1, cosignType, "")
+	signTrustManifest(t, mem, child3, cosignType, "")
+	// A signed index with an unsigned child.
+	signedIndex := pushTrustIndex(t, mem, "signed", child1, child2)
+	signTrustManifest(t, mem, signedIndex, cosignType, "")
+	// An unsigned index with signed children.
+	pushTrustIndex(t, mem, "unsigned", child1, child3, attestation)
+
+	policy := func(mode IndexTrust) *TrustPolicy {
+		return &TrustPolicy{
+			ArtifactTypes: []string{cosignType},
+			Verify:        verifyTrustPayload,
+			Index:         mode,
+		}
+	}
+	tests := []struct {
+		name     string
+		mode     IndexTrust
+		signed   bool
+		unsigned bool
+	}{
+		{"TrustIndex", TrustIndex, true, false},
+		{"TrustChildren", TrustChildren, false, true},
+		{"TrustIndexOrChildren", TrustIndexOrChildren, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := Trusted(mem, policy(test.mode))
+			_, err := r.ResolveTag(ctx, "foo", "signed")
+			requireTrusted(t, err, test.signed)
+			_, err = r.ResolveTag(ctx, "foo", "unsigned")
+			requireTrusted(t, err, test.unsigned)
+		})
+	}
+
+	// With TrustIndex, an unsigned child can only be
+	// read once its index has been read.
+	r := Trusted(mem, policy(TrustIndex))
+	_, err := r.GetManifest(ctx, "foo", child2.Digest)
+	require.ErrorIs(t, err, oci.ErrDenied)
+	rd, err := r.GetTag(ctx, "foo", "signed")
+	require.NoError(t, err)
+	rd.Close()
+	rd, err = r.GetManifest(ctx, "foo", child2.Digest)
+	require.NoError(t, err)
+	rd.Close()
+}
+
+func TestTrustedChecksReferrerContent(t *testing.T) {
+	ctx := context.Background()
+	mem := ocimem.New()
+	pushTrustImage(t, mem, "unsigned", "v1")
+	signed := pushTrustImage(t, mem, "signed", "v2")
+	forged := pushTrustImage(t, mem, "forged", "v3")
+	signTrustManifest(t, mem, signed, cosignType, "")
+	signTrustManifest(t, mem, forged, cosignType, "forged")
+	var signature oci.Descriptor
+	for desc, err := range mem.Referrers(ctx, "foo", signed.Digest, nil) {
+		require.NoError(t, err)
+		signature = desc
+	}
+
+	// A listing that claims a referrer of another
+	// manifest isn't enough, even without Verify.
+	r := Trusted(&forgedTrustRegistry{
+		Interface: mem,
+		referrers: []oci.Descriptor{signature},
+	}, &TrustPolicy{
+		ArtifactTypes: []string{cosignType},
+	})
+	_, err := r.ResolveTag(ctx, "foo", "v1")
+	require.ErrorIs(t, err, oci.ErrDenied)
+	require.ErrorContains(t, err, "does not refer to")
+	_, err = r.ResolveTag(ctx, "foo", "v2")
+	require.NoError(t, err)
+
+	// Blobs that don't match their digest are rejected
+	// before they get to Verify.
+	r = Trusted(&forgedTrustRegistry{
+		Interface: mem,
+		blobs: map[oci.Digest]string{
+			digest.FromString("forged"): "signature for " + string(forged.Digest),
+		},
+	}, &TrustPolicy{
+		ArtifactTypes: []string{cosignType},
+		Verify:        verifyTrustPayload,
+	})
+	_, err = r.ResolveTag(ctx, "foo", "v3")
+	require.ErrorIs(t, err, oci.ErrDenied)
+	require.ErrorContains(t, err, "cannot read referrer blob")
+}
+
+func TestTrustedSHA512Content(t *testing.T) {
+	ctx := context.Background()
+	// ocimem only stores content with sha256 digests,
+	// so the payload is served by sha512BlobRegistry.
+	mem := ocimem.NewWithConfig(&ocimem.Config{LaxChildReferences: true})
+	subject := pushTrustImage(t, mem, "signed", "v1")
+	payload := "signature for " + string(subject.Digest)
+	payloadDesc := oci.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest.SHA512.FromString(payload),
+		Size:      int64(len(payload)),
+	}
+	data, err := json.Marshal(oci.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: cosignType,
+		Config:       blobDesc("{}"),
+		Layers:       []oci.Descriptor{payloadDesc},
+		Subject:      &subject,
+	})
+	require.NoError(t, err)
+	_, err = mem.PushManifest(ctx, "foo", data, ocispec.MediaTypeImageManifest, nil)
+	require.NoError(t, err)
+
+	r := Trusted(&sha512BlobRegistry{
+		Interface: mem,
+		blobs: map[oci.Digest]string{
+			payloadDesc.Digest: payload,
+		},
+	}, &TrustPolicy{
+		ArtifactTypes: []string{cosignType},
+		Verify:        verifyTrustPayload,
+	})
+	_, err = r.ResolveTag(ctx, "foo", "v1")
+	require.NoError(t, err)
+}
+
+func requireTrusted(t *testing.T, err error, want bool) {
+	if want {
+		require.NoError(t, err)
+	} else {
+		require.ErrorIs(t, err, oci.ErrDenied)
+	}
+}
+
+// verifyTrustPayload checks that the referrer's single blob
+// holds the payload written by signTrustManifest.
+func verifyTrustPayload(ctx context.Context, ref *TrustReferrer) error {
+	if len(ref.Blobs) != 1 || string(ref.Blobs[0]) != "signature for "+string(ref.Subject.Digest) {
+		return errors.New("bad signature")
+	}
+	return nil
+}
+
+// pushTrustImage pushes an image manifest distinguished
+// by the given annotation and returns its descriptor.
+func pushTrustImage(t *testing.T, r oci.Interface, annotation string, tags ...string) oci.Descriptor {
+	pushBlob(t, r, "foo", "{}")
+	desc, err := r.PushManifest(context.Background(), "foo", imageManifest(t, annotation), ocispec.MediaTypeImageManifest, &oci.PushManifestParameters{
+		Tags: tags,
+	})
+	require.NoError(t, err)
+	return desc
+}
+
+func pushTrustIndex(t *testing.T, r oci.Interface, tag string, children ...oci.Descriptor) oci.Descriptor {
+	data, err := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: children,
+	})
+	require.NoError(t, err)
+	desc, err := r.PushManifest(context.Background(), "foo", data, ocispec.MediaTypeImageIndex, &oci.PushManifestParameters{
+		Tags: []string{tag},
+	})
+	require.NoError(t, err)
+	return desc
+}
+
+// signTrustManifest pushes a referrer of subject with the given
+// artifact type. Its blob holds a payload that verifyTrustPayload
+// accepts unless forged is non-empty.
+func signTrustManifest(t *testing.T, r oci.Interface, subject oci.Descriptor, artifactType, forged string) {
+	payload := "signature for " + string(subject.Digest)
+	if forged != "" {
+		payload = forged
+	}
+	pushBlob(t, r, "foo", "{}")
+	pushBlob(t, r, "foo", payload)
+	data, err := json.Marshal(oci.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: artifactType,
+		Config:       blobDesc("{}"),
+		Layers:       []oci.Descriptor{blobDesc(payload)},
+		Subject:      &subject,
+	})
+	require.NoError(t, err)
+	_, err = r.PushManifest(context.Background(), "foo", data, ocispec.MediaTypeImageManifest, nil)
+	require.NoError(t, err)
+}
+
+// forgedTrustRegistry wraps a registry to return the given
+// referrers for every manifest, if there are any, and
+// to replace the content of the given blobs.
+type forgedTrustRegistry struct {
+	oci.Interface
+	referrers []oci.Descriptor
+	blobs     map[oci.Digest]string
+}
+
+func (r *forgedTrustRegistry) Referrers(ctx context.Context, repo string, digest oci.Digest, params *oci.ReferrersParameters) iter.Seq2[oci.Descriptor, error] {
+	if r.referrers != nil {
+		return oci.SliceSeq(r.referrers)
+	}
+	return r.Interface.Referrers(ctx, repo, digest, params)
+}
+
+func (r *forgedTrustRegistry) GetBlob(ctx context.Context, repo string, digest oci.Digest) (oci.BlobReader, error) {
+	content, ok := r.blobs[digest]
+	if !ok {
+		return r.Interface.GetBlob(ctx, repo, digest)
+	}
+	desc, err := r.Interface.ResolveBlob(ctx, repo, digest)
+	if err != nil {
+		return nil, err
+	}
+	return ocimem.NewBytesReader([]byte(content), desc), nil
+}
+
+// sha512BlobRegistry wraps a registry to hold
+// the given blobs as well as its own.
+type sha512BlobRegistry struct {
+	oci.Interface
+	blobs map[oci.Digest]string
+}
+
+func (r *sha512BlobRegistry) GetBlob(ctx context.Context, repo string, digest oci.Digest) (oci.BlobReader, error) {
+	content, ok := r.blobs[digest]
+	if !ok {
+		return r.Interface.GetBlob(ctx, repo, digest)
+	}
+	return ocimem.NewBytesReader([]byte(content), oci.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest,
+		Size:      int64(len(content)),
+	}), nil
+}
@@ -0,0 +1,270 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocifilter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/internal/ocimanifest"
+	"github.com/jcarter3/oci/ociref"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// DefaultMaxManifestSize holds the default maximum manifest size
+// used by [ManifestPolicy]. It's the size that the distribution
+// spec recommends registries should accept at minimum.
+const DefaultMaxManifestSize = 4 << 20
+
+// DefaultManifestMediaTypes holds the manifest media
+// types allowed by default by [ManifestPolicy].
+var DefaultManifestMediaTypes = []string{
+	ocispec.MediaTypeImageManifest,
+	ocispec.MediaTypeImageIndex,
+	ocimanifest.MediaTypeDockerManifest,
+	ocimanifest.MediaTypeDockerManifestList,
+}
+
+// ManifestPolicy determines which manifests can be pushed to
+// a registry returned by [ValidateManifests]. Its [ManifestPolicy.Check]
+// method can also be used directly, for example as the
+// ValidateManifest option of [github.com/jcarter3/oci/ociserver].
+//
+// Media type lists can contain entries ending in "*", which allow
+// any media type with the preceding prefix; for example
+// "application/vnd.oci.image.layer.v1.tar*" allows both compressed
+// and uncompressed OCI layers.
+type ManifestPolicy struct {
+	// ManifestMediaTypes holds the media types allowed for
+	// manifests, including those referred to by an index. If
+	// it's empty, DefaultManifestMediaTypes is used.
+	ManifestMediaTypes []string
+
+	// ConfigMediaTypes holds the media types allowed for the
+	// config of an image manifest. If it's empty, any
+	// media type is allowed.
+	ConfigMediaTypes []string
+
+	// LayerMediaTypes holds the media types allowed for
+	// layers of an image manifest. If it's empty, any
+	// media type is allowed.
+	LayerMediaTypes []string
+
+	// MaxSize holds the maximum size of a manifest in bytes.
+	// If it's zero, DefaultMaxManifestSize is used; if it's
+	// negative, there's no limit.
+	MaxSize int64
+}
+
+// ValidateManifests returns a registry that wraps r and checks each
+// manifest pushed to it against the policy p, failing with an error
+// that wraps [oci.ErrManifestInvalid] when the manifest doesn't
+// conform. A nil p is equivalent to a pointer to the zero policy.
+func ValidateManifests(r oci.Interface, p *ManifestPolicy) oci.Interface {
+	if p == nil {
+		p = new(ManifestPolicy)
+	}
+	return &validated{
+		Interface: r,
+		p:         p,
+	}
+}
+
+type validated struct {
+	oci.Interface
+	p *ManifestPolicy
+}
+
+func (r *validated) PushManifest(ctx context.Context, repo string, contents []byte, mediaType string, params *oci.PushManifestParameters) (oci.Descriptor, error) {
+	if err := r.p.Check(mediaType, contents); err != nil {
+		return oci.Descriptor{}, err
+	}
+	return r.Interface.PushManifest(ctx, repo, contents, mediaType, params)
+}
+
+// manifestFields holds the fields of image manifests and
+// indexes that are checked by [ManifestPolicy.Check].
+type manifestFields struct {
+	SchemaVersion *int               `json:"schemaVersion"`
+	MediaType     string             `json:"mediaType"`
+	Config        *json.RawMessage   `json:"config"`
+	Layers        *[]json.RawMessage `json:"layers"`
+	Manifests     *[]json.RawMessage `json:"manifests"`
+	Subject       *json.RawMessage   `json:"subject"`
+}
+
+// Check checks that a manifest with the given media type (as
+// given by the Content-Type of a push) and contents conforms to
+// the policy. The error, if any, wraps [oci.ErrManifestInvalid].
+//
+// As well as checking media types and size, Check checks that
+// image manifests and indexes are structurally valid according
+// to the OCI image spec and that their mediaType field, if
+// present, matches mediaType. Manifests of other allowed media
+// types need only be valid JSON.
+func (p *ManifestPolicy) Check(mediaType string, data []byte) error {
+	maxSize := p.MaxSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxManifestSize
+	}
+	if maxSize > 0 && int64(len(data)) > maxSize {
+		return manifestInvalid("manifest size %d exceeds limit of %d bytes", len(data), maxSize)
+	}
+	if !p.manifestTypeAllowed(mediaType) {
+		return manifestInvalid("manifest media type %q not allowed", mediaType)
+	}
+	var m manifestFields
+	if err := json.Unmarshal(data, &m); err != nil {
+		return manifestInvalid("invalid JSON: %v", err)
+	}
+	if m.MediaType != "" && m.MediaType != mediaType {
+		return manifestInvalid("mediaType field %q does not match content type %q", m.MediaType, mediaType)
+	}
+	switch mediaType {
+	case ocispec.MediaTypeImageManifest, ocimanifest.MediaTypeDockerManifest:
+		return p.checkImageManifest(&m)
+	case ocispec.MediaTypeImageIndex, ocimanifest.MediaTypeDockerManifestList:
+		return p.checkIndex(&m)
+	}
+	return nil
+}
+
+func (p *ManifestPolicy) checkImageManifest(m *manifestFields) error {
+	if err := checkSchemaVersion(m); err != nil {
+		return err
+	}
+	if m.Manifests != nil {
+		return manifestInvalid("image manifest must not contain manifests")
+	}
+	if m.Config == nil {
+		return manifestInvalid("missing config")
+	}
+	config, err := parseDescriptor(*m.Config, "config")
+	if err != nil {
+		return err
+	}
+	if !typeAllowed(p.ConfigMediaTypes, config.MediaType) {
+		return manifestInvalid("config media type %q not allowed", config.MediaType)
+	}
+	if m.Layers == nil {
+		return manifestInvalid("missing layers")
+	}
+	for i, data := range *m.Layers {
+		layer, err := parseDescriptor(data, fmt.Sprintf("layers[%d]", i))
+		if err != nil {
+			return err
+		}
+		if !typeAllowed(p.LayerMediaTypes, layer.MediaType) {
+			return manifestInvalid("layer media type %q not allowed", layer.MediaType)
+		}
+	}
+	return checkSubject(m)
+}
+
+func (p *ManifestPolicy) checkIndex(m *manifestFields) error {
+	if err := checkSchemaVersion(m); err != nil {
+		return err
+	}
+	if m.Config != nil || m.Layers != nil {
+		return manifestInvalid("index must not contain config or layers")
+	}
+	if m.Manifests == nil {
+		return manifestInvalid("missing manifests")
+	}
+	for i, data := range *m.Manifests {
+		child, err := parseDescriptor(data, fmt.Sprintf("manifests[%d]", i))
+		if err != nil {
+			return err
+		}
+		if !p.manifestTypeAllowed(child.MediaType) {
+			return manifestInvalid("manifest media type %q not allowed in manifests[%d]", child.MediaType, i)
+		}
+	}
+	return checkSubject(m)
+}
+
+func checkSchemaVersion(m *manifestFields) error {
+	if m.SchemaVersion == nil || *m.SchemaVersion != 2 {
+		return manifestInvalid("schemaVersion must be 2")
+	}
+	return nil
+}
+
+func checkSubject(m *manifestFields) error {
+	if m.Subject == nil {
+		return nil
+	}
+	_, err := parseDescriptor(*m.Subject, "subject")
+	return err
+}
+
+// parseDescriptor parses and checks the descriptor in data.
+// The name is used in error messages.
+func parseDescriptor(data json.RawMessage, name string) (oci.Descriptor, error) {
+	var desc oci.Descriptor
+	if err := json.Unmarshal(data, &desc); err != nil {
+		return oci.Descriptor{}, manifestInvalid("invalid %s: %v", name, err)
+	}
+	if !isValidMediaType(desc.MediaType) {
+		return oci.Descriptor{}, manifestInvalid("invalid media type %q in %s", desc.MediaType, name)
+	}
+	if !ociref.IsValidDigest(string(desc.Digest)) {
+		return oci.Descriptor{}, manifestInvalid("invalid digest %q in %s", desc.Digest, name)
+	}
+	if desc.Size < 0 {
+		return oci.Descriptor{}, manifestInvalid("negative size in %s", name)
+	}
+	return desc, nil
+}
+
+// isValidMediaType reports whether s looks like a media type
+// as defined by RFC 6838: a type and subtype separated by a slash.
+func isValidMediaType(s string) bool {
+	typ, subtype, ok := strings.Cut(s, "/")
+	return ok && typ != "" && subtype != "" && !strings.ContainsAny(s, " \t;,") && !strings.Contains(subtype, "/")
+}
+
+func (p *ManifestPolicy) manifestTypeAllowed(mediaType string) bool {
+	allowed := p.ManifestMediaTypes
+	if len(allowed) == 0 {
+		allowed = DefaultManifestMediaTypes
+	}
+	return typeAllowed(allowed, mediaType)
+}
+
+// typeAllowed reports whether mediaType is in the allowlist,
+// which allows everything when empty.
+func typeAllowed(allowed []string, mediaType string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, t := range allowed {
+		if prefix, ok := strings.CutSuffix(t, "*"); ok {
+			if strings.HasPrefix(mediaType, prefix) {
+				return true
+			}
+		} else if t == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+func manifestInvalid(f string, a ...any) error {
+	return fmt.Errorf("%w: %s", oci.ErrManifestInvalid, fmt.Sprintf(f, a...))
+}
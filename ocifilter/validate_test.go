@@ -0,0 +1,178 @@
+package ocifilter
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/ocimem"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	validConfig = `{"mediaType": "application/vnd.oci.image.config.v1+json", "digest": "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a", "size": 2}`
+	validLayer  = `{"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", "size": 5}`
+	validChild  = `{"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", "size": 5}`
+)
+
+var manifestPolicyTests = []struct {
+	testName  string
+	policy    ManifestPolicy
+	mediaType string
+	data      string
+	wantError string
+}{{
+	testName:  "ImageManifest",
+	mediaType: ocispec.MediaTypeImageManifest,
+	data:      `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json", "config": ` + validConfig + `, "layers": [` + validLayer + `]}`,
+}, {
+	testName:  "ImageManifestWithoutMediaType",
+	mediaType: ocispec.MediaTypeImageManifest,
+	data:      `{"schemaVersion": 2, "config": ` + validConfig + `, "layers": []}`,
+}, {
+	testName:  "Index",
+	mediaType: ocispec.MediaTypeImageIndex,
+	data:      `{"schemaVersion": 2, "manifests": [` + validChild + `]}`,
+}, {
+	testName:  "DockerManifest",
+	mediaType: "application/vnd.docker.distribution.manifest.v2+json",
+	data:      `{"schemaVersion": 2, "mediaType": "application/vnd.docker.distribution.manifest.v2+json", "config": ` + validConfig + `, "layers": [` + validLayer + `]}`,
+}, {
+	testName:  "MediaTypeNotAllowed",
+	mediaType: "application/vnd.example+json",
+	data:      `{}`,
+	wantError: `manifest media type "application/vnd.example+json" not allowed`,
+}, {
+	testName: "ExtraMediaTypeAllowed",
+	policy: ManifestPolicy{
+		ManifestMediaTypes: []string{"application/vnd.example+json"},
+	},
+	mediaType: "application/vnd.example+json",
+	data:      `{}`,
+}, {
+	testName:  "MediaTypeMismatch",
+	mediaType: ocispec.MediaTypeImageManifest,
+	data:      `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.index.v1+json", "manifests": []}`,
+	wantError: `mediaType field "application/vnd.oci.image.index.v1+json" does not match content type "application/vnd.oci.image.manifest.v1+json"`,
+}, {
+	testName:  "InvalidJSON",
+	mediaType: ocispec.MediaTypeImageManifest,
+	data:      `{"schemaVersion": 2,`,
+	wantError: "invalid JSON",
+}, {
+	testName:  "WrongSchemaVersion",
+	mediaType: ocispec.MediaTypeImageManifest,
+	data:      `{"schemaVersion": 1, "config": ` + validConfig + `, "layers": []}`,
+	wantError: "schemaVersion must be 2",
+}, {
+	testName:  "MissingConfig",
+	mediaType: ocispec.MediaTypeImageManifest,
+	data:      `{"schemaVersion": 2, "layers": []}`,
+	wantError: "missing config",
+}, {
+	testName:  "MissingLayers",
+	mediaType: ocispec.MediaTypeImageManifest,
+	data:      `{"schemaVersion": 2, "config": ` + validConfig + `}`,
+	wantError: "missing layers",
+}, {
+	testName:  "InvalidLayerDigest",
+	mediaType: ocispec.MediaTypeImageManifest,
+	data:      `{"schemaVersion": 2, "config": ` + validConfig + `, "layers": [{"mediaType": "application/octet-stream", "digest": "sha256:bad", "size": 1}]}`,
+	wantError: `invalid digest "sha256:bad" in layers[0]`,
+}, {
+	testName:  "InvalidConfigMediaType",
+	mediaType: ocispec.MediaTypeImageManifest,
+	data:      `{"schemaVersion": 2, "config": {"mediaType": "nonsense", "digest": "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a", "size": 2}, "layers": []}`,
+	wantError: `invalid media type "nonsense" in config`,
+}, {
+	testName:  "NegativeSize",
+	mediaType: ocispec.MediaTypeImageIndex,
+	data:      `{"schemaVersion": 2, "manifests": [{"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a", "size": -1}]}`,
+	wantError: "negative size in manifests[0]",
+}, {
+	testName:  "IndexWithLayers",
+	mediaType: ocispec.MediaTypeImageIndex,
+	data:      `{"schemaVersion": 2, "manifests": [], "layers": []}`,
+	wantError: "index must not contain config or layers",
+}, {
+	testName:  "IndexChildNotAllowed",
+	mediaType: ocispec.MediaTypeImageIndex,
+	data:      `{"schemaVersion": 2, "manifests": [{"mediaType": "application/vnd.example+json", "digest": "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a", "size": 2}]}`,
+	wantError: `manifest media type "application/vnd.example+json" not allowed in manifests[0]`,
+}, {
+	testName:  "InvalidSubject",
+	mediaType: ocispec.MediaTypeImageManifest,
+	data:      `{"schemaVersion": 2, "config": ` + validConfig + `, "layers": [], "subject": {"mediaType": "application/vnd.oci.image.manifest.v1+json"}}`,
+	wantError: `invalid digest "" in subject`,
+}, {
+	testName: "LayerTypeAllowedByPrefix",
+	policy: ManifestPolicy{
+		ConfigMediaTypes: []string{ocispec.MediaTypeImageConfig},
+		LayerMediaTypes:  []string{"application/vnd.oci.image.layer.v1.tar*"},
+	},
+	mediaType: ocispec.MediaTypeImageManifest,
+	data:      `{"schemaVersion": 2, "config": ` + validConfig + `, "layers": [` + validLayer + `]}`,
+}, {
+	testName: "LayerTypeNotAllowed",
+	policy: ManifestPolicy{
+		LayerMediaTypes: []string{"application/vnd.oci.image.layer.v1.tar+zstd"},
+	},
+	mediaType: ocispec.MediaTypeImageManifest,
+	data:      `{"schemaVersion": 2, "config": ` + validConfig + `, "layers": [` + validLayer + `]}`,
+	wantError: `layer media type "application/vnd.oci.image.layer.v1.tar+gzip" not allowed`,
+}, {
+	testName: "ConfigTypeNotAllowed",
+	policy: ManifestPolicy{
+		ConfigMediaTypes: []string{"application/vnd.example.config+json"},
+	},
+	mediaType: ocispec.MediaTypeImageManifest,
+	data:      `{"schemaVersion": 2, "config": ` + validConfig + `, "layers": []}`,
+	wantError: `config media type "application/vnd.oci.image.config.v1+json" not allowed`,
+}, {
+	testName: "TooLarge",
+	policy: ManifestPolicy{
+		MaxSize: 10,
+	},
+	mediaType: ocispec.MediaTypeImageIndex,
+	data:      `{"schemaVersion": 2, "manifests": []}`,
+	wantError: "manifest size 37 exceeds limit of 10 bytes",
+}, {
+	testName:  "TooLargeByDefault",
+	mediaType: ocispec.MediaTypeImageIndex,
+	data:      `{"schemaVersion": 2, "manifests": [], "annotations": {"x": "` + strings.Repeat("x", DefaultMaxManifestSize) + `"}}`,
+	wantError: "exceeds limit of 4194304 bytes",
+}, {
+	testName: "NoSizeLimit",
+	policy: ManifestPolicy{
+		MaxSize: -1,
+	},
+	mediaType: ocispec.MediaTypeImageIndex,
+	data:      `{"schemaVersion": 2, "manifests": [], "annotations": {"x": "` + strings.Repeat("x", DefaultMaxManifestSize) + `"}}`,
+}}
+
+func TestManifestPolicy(t *testing.T) {
+	for _, test := range manifestPolicyTests {
+		t.Run(test.testName, func(t *testing.T) {
+			err := test.policy.Check(test.mediaType, []byte(test.data))
+			if test.wantError == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, oci.ErrManifestInvalid)
+			require.ErrorContains(t, err, test.wantError)
+		})
+	}
+}
+
+func TestValidateManifests(t *testing.T) {
+	ctx := context.Background()
+	r := ValidateManifests(ocimem.New(), nil)
+	_, err := r.PushManifest(ctx, "foo", []byte(`{}`), "application/octet-stream", nil)
+	require.ErrorIs(t, err, oci.ErrManifestInvalid)
+
+	pushBlob(t, r, "foo", "{}")
+	_, err = r.PushManifest(ctx, "foo", imageManifest(t, "ok"), ocispec.MediaTypeImageManifest, nil)
+	require.NoError(t, err)
+}
@@ -9,36 +9,108 @@ import (
 	"time"
 
 	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/ocitrace"
 	"github.com/opencontainers/go-digest"
 )
 
-// Tuning constants for the adaptive parallel download pipeline.
+// Default tuning values for the adaptive parallel download pipeline.
+// See [DownloadOptions] for details.
 const (
-	// probeSize is the size of the initial probe request used to measure
-	// throughput and derive an optimal chunk size.
-	probeSize int64 = 4 * 1024 * 1024 // 4 MB
-
-	// targetChunkDuration is the ideal wall-clock time for a single chunk
-	// download. Chunks are sized so that, at the observed bandwidth, each
-	// one takes approximately this long. Short enough to get good
-	// parallelism; long enough to amortise per-request overhead.
-	targetChunkDuration = 2 * time.Second
-
-	// minChunkSize / maxChunkSize clamp the adaptive chunk size so we
-	// never create absurdly small or large requests.
-	minChunkSize int64 = 4 * 1024 * 1024   // 4 MB
-	maxChunkSize int64 = 256 * 1024 * 1024 // 256 MB
-
-	// maxConcurrent is the number of parallel range-request goroutines.
-	// This is also the prefetch depth: while the consumer reads chunk N,
-	// chunks N+1 … N+maxConcurrent are already downloading.
-	maxConcurrent = 6
-
-	// maxRetries is the number of times a single chunk download is
-	// retried before the whole operation is failed.
-	maxRetries = 3
+	defaultProbeSize           int64 = 4 * 1024 * 1024 // 4 MB
+	defaultTargetChunkDuration       = 2 * time.Second
+	defaultMinChunkSize        int64 = 4 * 1024 * 1024   // 4 MB
+	defaultMaxChunkSize        int64 = 256 * 1024 * 1024 // 256 MB
+	defaultMaxConcurrent             = 6
+	defaultMaxRetries                = 3
 )
 
+// DownloadOptions holds options for [DownloadLargeBlobWithOptions]
+// and [DownloadLargeBlobTo]. The zero value of any field
+// selects its default.
+type DownloadOptions struct {
+	// MaxConcurrent holds the number of parallel range requests.
+	// For DownloadLargeBlobWithOptions this is also the prefetch depth: while the
+	// consumer reads chunk N, chunks N+1 … N+MaxConcurrent are already
+	// downloading. The default is 6.
+	MaxConcurrent int
+
+	// ProbeSize holds the size of the initial probe request used to
+	// measure throughput and derive an optimal chunk size.
+	// Blobs no larger than this are downloaded with a single request.
+	// The default is 4 MB.
+	ProbeSize int64
+
+	// TargetChunkDuration holds the ideal wall-clock time for a single
+	// chunk download. Chunks are sized so that, at the observed
+	// bandwidth, each one takes approximately this long. Short enough
+	// to get good parallelism; long enough to amortise per-request
+	// overhead. The default is 2s.
+	TargetChunkDuration time.Duration
+
+	// MinChunkSize and MaxChunkSize clamp the adaptive chunk size so
+	// we never create absurdly small or large requests.
+	// The defaults are 4 MB and 256 MB.
+	MinChunkSize int64
+	MaxChunkSize int64
+
+	// MaxRetries holds the number of times a single chunk download is
+	// attempted before the whole operation is failed. The default is 3.
+	MaxRetries int
+
+	// Progress, if non-nil, is called each time a chunk completes
+	// with the number of bytes downloaded so far and the total
+	// size of the blob. Calls are never made concurrently.
+	Progress func(done, total int64)
+}
+
+// withDefaults returns a copy of opts with all zero fields
+// set to their defaults. It accepts a nil opts.
+func (opts *DownloadOptions) withDefaults() DownloadOptions {
+	var o DownloadOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.MaxConcurrent <= 0 {
+		o.MaxConcurrent = defaultMaxConcurrent
+	}
+	if o.ProbeSize <= 0 {
+		o.ProbeSize = defaultProbeSize
+	}
+	if o.TargetChunkDuration <= 0 {
+		o.TargetChunkDuration = defaultTargetChunkDuration
+	}
+	if o.MinChunkSize <= 0 {
+		o.MinChunkSize = defaultMinChunkSize
+	}
+	if o.MaxChunkSize <= 0 {
+		o.MaxChunkSize = defaultMaxChunkSize
+	}
+	if o.MaxChunkSize < o.MinChunkSize {
+		o.MaxChunkSize = o.MinChunkSize
+	}
+	if o.MaxRetries <= 0 {
+		o.MaxRetries = defaultMaxRetries
+	}
+	return o
+}
+
+// progress returns a function that adds to the number of bytes
+// downloaded and reports it to opts.Progress. It's safe
+// to call concurrently.
+func (opts *DownloadOptions) progress(total int64) func(n int64) {
+	if opts.Progress == nil {
+		return func(int64) {}
+	}
+	var mu sync.Mutex
+	var done int64
+	return func(n int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		done += n
+		opts.Progress(done, total)
+	}
+}
+
 // DownloadLargeBlob downloads a blob using multiple concurrent HTTP range
 // requests to saturate the available bandwidth. It returns a BlobReader
 // whose Read calls yield the bytes in the correct order with full digest
@@ -51,34 +123,47 @@ const (
 //  4. Launches a pipeline of concurrent fetchers that prefetch chunks into
 //     an ordered cache so the next chunks are always ready when the caller
 //     reads.
+//
+// Up to 6 chunks are held in memory at once; use
+// [DownloadLargeBlobTo] to avoid that when downloading to a file.
 func DownloadLargeBlob(ctx context.Context, reg oci.Interface, repo string, dgst oci.Digest) (oci.BlobReader, error) {
+	return DownloadLargeBlobWithOptions(ctx, reg, repo, dgst, nil)
+}
+
+// DownloadLargeBlobWithOptions is like [DownloadLargeBlob] but
+// allows the download to be tuned and its progress reported.
+// Up to opts.MaxConcurrent chunks are held in memory at once.
+// A nil opts is equivalent to a pointer to zero DownloadOptions.
+func DownloadLargeBlobWithOptions(ctx context.Context, reg oci.Interface, repo string, dgst oci.Digest, opts *DownloadOptions) (oci.BlobReader, error) {
+	o := opts.withDefaults()
 	desc, err := reg.ResolveBlob(ctx, repo, dgst)
 	if err != nil {
 		return nil, fmt.Errorf("failed to resolve blob: %w", err)
 	}
+	progress := o.progress(desc.Size)
 
 	// Trivial blobs: just do a single GET.
-	if desc.Size <= probeSize {
-		return downloadSingle(ctx, reg, repo, dgst, desc)
+	if desc.Size <= o.ProbeSize {
+		return downloadSingle(ctx, reg, repo, dgst, desc, &o, progress)
 	}
 
 	// --- Phase 1: bandwidth probe -------------------------------------------
-	probeEnd := probeSize
+	probeEnd := o.ProbeSize
 	if probeEnd > desc.Size {
 		probeEnd = desc.Size
 	}
-	probeData, elapsed, err := timedRangeGet(ctx, reg, repo, dgst, 0, probeEnd)
+	probeData, elapsed, err := timedRangeGet(ctx, reg, repo, dgst, 0, probeEnd, &o)
 	if err != nil {
 		return nil, fmt.Errorf("bandwidth probe failed: %w", err)
 	}
 
 	// --- Phase 2: compute optimal chunk size --------------------------------
-	chunkSize := deriveChunkSize(int64(len(probeData)), elapsed)
+	chunkSize := deriveChunkSize(int64(len(probeData)), elapsed, &o)
 
 	// --- Phase 3: launch pipeline -------------------------------------------
 	pr, pw := io.Pipe()
 
-	go runPipeline(ctx, reg, repo, dgst, desc.Size, chunkSize, probeData, pw)
+	go runPipeline(ctx, reg, repo, dgst, desc.Size, chunkSize, probeData, pw, &o, progress)
 
 	return &blobReader{
 		r:        pr,
@@ -89,19 +174,19 @@ func DownloadLargeBlob(ctx context.Context, reg oci.Interface, repo string, dgst
 }
 
 // deriveChunkSize returns a chunk size (clamped) that should make each range
-// request take roughly targetChunkDuration at the observed bandwidth.
-func deriveChunkSize(probeBytes int64, elapsed time.Duration) int64 {
+// request take roughly opts.TargetChunkDuration at the observed bandwidth.
+func deriveChunkSize(probeBytes int64, elapsed time.Duration, opts *DownloadOptions) int64 {
 	if elapsed <= 0 {
-		return maxChunkSize
+		return opts.MaxChunkSize
 	}
 	bytesPerSec := float64(probeBytes) / elapsed.Seconds()
-	cs := int64(bytesPerSec * targetChunkDuration.Seconds())
+	cs := int64(bytesPerSec * opts.TargetChunkDuration.Seconds())
 
-	if cs < minChunkSize {
-		cs = minChunkSize
+	if cs < opts.MinChunkSize {
+		cs = opts.MinChunkSize
 	}
-	if cs > maxChunkSize {
-		cs = maxChunkSize
+	if cs > opts.MaxChunkSize {
+		cs = opts.MaxChunkSize
 	}
 	return cs
 }
@@ -110,19 +195,33 @@ func deriveChunkSize(probeBytes int64, elapsed time.Duration) int64 {
 // duration of the transfer (excluding connection setup overhead as much as
 // possible by timing from first byte read to completion, but in practice we
 // time the whole call for simplicity).
-func timedRangeGet(ctx context.Context, reg oci.Interface, repo string, dgst oci.Digest, start, end int64) ([]byte, time.Duration, error) {
+func timedRangeGet(ctx context.Context, reg oci.Interface, repo string, dgst oci.Digest, start, end int64, opts *DownloadOptions) ([]byte, time.Duration, error) {
 	t0 := time.Now()
-	data, err := fetchRange(ctx, reg, repo, dgst, start, end)
+	data, err := fetchRange(ctx, reg, repo, dgst, start, end, opts)
 	return data, time.Since(t0), err
 }
 
-// fetchRange downloads [start, end) from the registry with up to maxRetries
-// attempts. It returns the raw bytes.
-func fetchRange(ctx context.Context, reg oci.Interface, repo string, dgst oci.Digest, start, end int64) ([]byte, error) {
+// fetchRange downloads [start, end) from the registry with up to
+// opts.MaxRetries attempts. It returns the raw bytes.
+//
+// Each call is reported as a span using any tracer
+// attached to the context with [ocitrace.ContextWithTracer].
+func fetchRange(ctx context.Context, reg oci.Interface, repo string, dgst oci.Digest, start, end int64, opts *DownloadOptions) (_ []byte, _err error) {
+	ctx, span := ocitrace.Start(ctx, "ocilarge.FetchRange",
+		ocitrace.String(ocitrace.KeyRepo, repo),
+		ocitrace.String(ocitrace.KeyDigest, string(dgst)),
+		ocitrace.Int64("oci.range.start", start),
+		ocitrace.Int64("oci.range.end", end),
+	)
+	attempts := 0
+	defer func() {
+		span.SetAttributes(ocitrace.Int("ocilarge.attempts", attempts))
+		ocitrace.End(span, _err)
+	}()
 	size := end - start
 	var lastErr error
-	for attempt := range maxRetries {
-		_ = attempt
+	for range opts.MaxRetries {
+		attempts++
 		br, err := reg.GetBlobRange(ctx, repo, dgst, start, end)
 		if err != nil {
 			lastErr = err
@@ -144,7 +243,25 @@ func fetchRange(ctx context.Context, reg oci.Interface, repo string, dgst oci.Di
 		}
 		return data, nil
 	}
-	return nil, fmt.Errorf("failed after %d attempts: %w", maxRetries, lastErr)
+	return nil, fmt.Errorf("failed after %d attempts: %w", opts.MaxRetries, lastErr)
+}
+
+// byteRange holds the half-open byte range [start, end).
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+// splitRanges splits [start, end) into consecutive ranges
+// of at most chunkSize bytes.
+func splitRanges(start, end, chunkSize int64) []byteRange {
+	var ranges []byteRange
+	for start < end {
+		rend := min(start+chunkSize, end)
+		ranges = append(ranges, byteRange{start: start, end: rend})
+		start = rend
+	}
+	return ranges
 }
 
 // chunkResult holds the downloaded data for a single chunk.
@@ -156,7 +273,7 @@ type chunkResult struct {
 // runPipeline orchestrates the concurrent download and feeds the pipe writer
 // with bytes in the correct order. It always closes pw (with or without error).
 //
-// Memory is bounded: at most maxConcurrent chunks are ever in flight or
+// Memory is bounded: at most opts.MaxConcurrent chunks are ever in flight or
 // buffered at a time. A sliding window of fetcher goroutines advances as
 // the writer drains each chunk, so completed data is written to the pipe
 // (and freed) as soon as possible.
@@ -169,7 +286,10 @@ func runPipeline(
 	chunkSize int64,
 	probeData []byte,
 	pw *io.PipeWriter,
+	opts *DownloadOptions,
+	progress func(n int64),
 ) {
+	maxConcurrent := opts.MaxConcurrent
 	defer pw.Close()
 
 	// Probe data may cover more than one "chunk" if chunkSize < probeSize,
@@ -181,6 +301,7 @@ func runPipeline(
 		pw.CloseWithError(err)
 		return
 	}
+	progress(probeLen)
 
 	// If the probe covered the whole blob, we're done.
 	if probeLen >= totalSize {
@@ -188,21 +309,7 @@ func runPipeline(
 	}
 
 	// Build the list of remaining byte-ranges to fetch.
-	type rangeSpec struct {
-		start int64
-		end   int64
-	}
-
-	var chunks []rangeSpec
-	offset := probeLen
-	for offset < totalSize {
-		end := offset + chunkSize
-		if end > totalSize {
-			end = totalSize
-		}
-		chunks = append(chunks, rangeSpec{start: offset, end: end})
-		offset = end
-	}
+	chunks := splitRanges(probeLen, totalSize, chunkSize)
 	numChunks := len(chunks)
 
 	// Sliding window: we keep exactly maxConcurrent result channels alive
@@ -223,7 +330,7 @@ func runPipeline(
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			data, err := fetchRange(ctx, reg, repo, dgst, chunks[i].start, chunks[i].end)
+			data, err := fetchRange(ctx, reg, repo, dgst, chunks[i].start, chunks[i].end, opts)
 			ch <- chunkResult{data: data, err: err}
 		}()
 	}
@@ -264,6 +371,7 @@ func runPipeline(
 			wg.Wait()
 			return
 		}
+		progress(int64(len(cr.data)))
 		cr.data = nil
 
 		// Advance the window: launch the next fetcher if there is one.
@@ -277,11 +385,12 @@ func runPipeline(
 }
 
 // downloadSingle handles small blobs that fit in a single request.
-func downloadSingle(ctx context.Context, reg oci.Interface, repo string, dgst oci.Digest, desc oci.Descriptor) (oci.BlobReader, error) {
-	data, err := fetchRange(ctx, reg, repo, dgst, 0, desc.Size)
+func downloadSingle(ctx context.Context, reg oci.Interface, repo string, dgst oci.Digest, desc oci.Descriptor, opts *DownloadOptions, progress func(n int64)) (oci.BlobReader, error) {
+	data, err := fetchRange(ctx, reg, repo, dgst, 0, desc.Size, opts)
 	if err != nil {
 		return nil, err
 	}
+	progress(int64(len(data)))
 	pr, pw := io.Pipe()
 	go func() {
 		_, writeErr := pw.Write(data)
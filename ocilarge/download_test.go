@@ -0,0 +1,305 @@
+package ocilarge_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/ocilarge"
+	"github.com/jcarter3/oci/ocimem"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+var smallChunks = &ocilarge.DownloadOptions{
+	MaxConcurrent: 3,
+	ProbeSize:     1024,
+	MinChunkSize:  1024,
+	MaxChunkSize:  4096,
+}
+
+func TestDownloadLargeBlobWithOptions(t *testing.T) {
+	ctx := context.Background()
+	r, data, dg := pushRandomBlob(t, 50*1024)
+
+	opts := *smallChunks
+	var progress []int64
+	opts.Progress = func(done, total int64) {
+		require.Equal(t, int64(len(data)), total)
+		progress = append(progress, done)
+	}
+	rd, err := ocilarge.DownloadLargeBlobWithOptions(ctx, r, "foo", dg, &opts)
+	require.NoError(t, err)
+	got, err := io.ReadAll(rd)
+	require.NoError(t, err)
+	require.NoError(t, rd.Close())
+	require.Equal(t, data, got)
+
+	// There's one call for the probe and at least one per 4KiB chunk.
+	require.GreaterOrEqual(t, len(progress), 1+(len(data)-1024)/4096)
+	require.Equal(t, int64(len(data)), progress[len(progress)-1])
+}
+
+func TestDownloadLargeBlobToFile(t *testing.T) {
+	ctx := context.Background()
+	r, data, dg := pushRandomBlob(t, 50*1024)
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "blob"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	opts := *smallChunks
+	var mu sync.Mutex
+	var last int64
+	opts.Progress = func(done, total int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		require.Greater(t, done, last)
+		last = done
+	}
+	desc, err := ocilarge.DownloadLargeBlobTo(ctx, r, "foo", dg, f, &opts)
+	require.NoError(t, err)
+	require.Equal(t, dg, desc.Digest)
+	require.Equal(t, int64(len(data)), last)
+
+	got, err := os.ReadFile(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+}
+
+func TestDownloadLargeBlobToSmallBlob(t *testing.T) {
+	r, data, dg := pushRandomBlob(t, 100)
+	var w writerAt
+	_, err := ocilarge.DownloadLargeBlobTo(context.Background(), r, "foo", dg, &w, smallChunks)
+	require.NoError(t, err)
+	require.Equal(t, data, w.buf)
+}
+
+func TestDownloadLargeBlobToResumesFailedChunk(t *testing.T) {
+	r, data, dg := pushRandomBlob(t, 20*1024)
+	flaky := &flakyRegistry{Interface: r}
+	// Each range request returns only part of the range, so
+	// every chunk needs more than one attempt.
+	flaky.truncate = 1500
+
+	var w writerAt
+	_, err := ocilarge.DownloadLargeBlobTo(context.Background(), flaky, "foo", dg, &w, &ocilarge.DownloadOptions{
+		ProbeSize:    1024,
+		MinChunkSize: 2048,
+		MaxChunkSize: 2048,
+	})
+	require.NoError(t, err)
+	require.Equal(t, data, w.buf)
+}
+
+func TestDownloadLargeBlobToFailure(t *testing.T) {
+	r, _, dg := pushRandomBlob(t, 20*1024)
+	flaky := &flakyRegistry{Interface: r}
+	flaky.failAfter = 2
+
+	var w writerAt
+	_, err := ocilarge.DownloadLargeBlobTo(context.Background(), flaky, "foo", dg, &w, smallChunks)
+	require.ErrorIs(t, err, errFlaky)
+	require.ErrorContains(t, err, "failed after 3 attempts")
+}
+
+func TestDownloadLargeBlobToDigestMismatch(t *testing.T) {
+	r, _, dg := pushRandomBlob(t, 20*1024)
+	flaky := &flakyRegistry{Interface: r}
+	flaky.corrupt = true
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "blob"))
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = ocilarge.DownloadLargeBlobTo(context.Background(), flaky, "foo", dg, f, smallChunks)
+	require.ErrorContains(t, err, "digest mismatch after download")
+
+	// The content is verified even when it can't be read back.
+	var w writerAt
+	_, err = ocilarge.DownloadLargeBlobTo(context.Background(), flaky, "foo", dg, &w, smallChunks)
+	require.ErrorContains(t, err, "digest mismatch after download")
+}
+
+func TestDownloadLargeBlobToOutOfOrder(t *testing.T) {
+	r, data, dg := pushRandomBlob(t, 64*1024)
+	// The first chunk after the probe is slow, so the other
+	// chunks arrive ahead of it.
+	slow := &slowRegistry{Interface: r, offset: 1024}
+	for _, opts := range []*ocilarge.DownloadOptions{
+		smallChunks,
+		{ProbeSize: 1024, MinChunkSize: 1024, MaxChunkSize: 1024, MaxConcurrent: 2},
+	} {
+		var w writerAt
+		_, err := ocilarge.DownloadLargeBlobTo(context.Background(), slow, "foo", dg, &w, opts)
+		require.NoError(t, err)
+		require.Equal(t, data, w.buf)
+
+		f, err := os.Create(filepath.Join(t.TempDir(), "blob"))
+		require.NoError(t, err)
+		_, err = ocilarge.DownloadLargeBlobTo(context.Background(), slow, "foo", dg, f, opts)
+		f.Close()
+		require.NoError(t, err)
+	}
+}
+
+func TestDownloadLargeBlobToLimitsHeldContent(t *testing.T) {
+	const chunkSize = 10 * 1024 * 1024
+	r, data, dg := pushRandomBlob(t, 1024+3*chunkSize)
+	counting := &concurrencyRegistry{Interface: r}
+	opts := &ocilarge.DownloadOptions{
+		ProbeSize:     1024,
+		MinChunkSize:  chunkSize,
+		MaxChunkSize:  chunkSize,
+		MaxConcurrent: 3,
+	}
+
+	// Chunks too large to be held in memory while waiting
+	// to be hashed are downloaded one at a time.
+	var w writerAt
+	_, err := ocilarge.DownloadLargeBlobTo(context.Background(), counting, "foo", dg, &w, opts)
+	require.NoError(t, err)
+	require.Equal(t, data, w.buf)
+	require.Equal(t, 1, counting.max)
+
+	// There's no such limit when the content can be read back.
+	counting.max = 0
+	f, err := os.Create(filepath.Join(t.TempDir(), "blob"))
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = ocilarge.DownloadLargeBlobTo(context.Background(), counting, "foo", dg, f, opts)
+	require.NoError(t, err)
+	require.Greater(t, counting.max, 1)
+}
+
+// concurrencyRegistry wraps a registry to record the largest
+// number of range reads started at the same time.
+type concurrencyRegistry struct {
+	oci.Interface
+
+	mu      sync.Mutex
+	current int
+	max     int
+}
+
+func (r *concurrencyRegistry) GetBlobRange(ctx context.Context, repo string, dg oci.Digest, o0, o1 int64) (oci.BlobReader, error) {
+	r.mu.Lock()
+	r.current++
+	r.max = max(r.max, r.current)
+	r.mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	r.mu.Lock()
+	r.current--
+	r.mu.Unlock()
+	return r.Interface.GetBlobRange(ctx, repo, dg, o0, o1)
+}
+
+// slowRegistry wraps a registry to delay
+// range reads starting at a given offset.
+type slowRegistry struct {
+	oci.Interface
+	offset int64
+}
+
+func (r *slowRegistry) GetBlobRange(ctx context.Context, repo string, dg oci.Digest, o0, o1 int64) (oci.BlobReader, error) {
+	if o0 == r.offset {
+		time.Sleep(20 * time.Millisecond)
+	}
+	return r.Interface.GetBlobRange(ctx, repo, dg, o0, o1)
+}
+
+var errFlaky = errors.New("flaky registry failure")
+
+// flakyRegistry wraps a registry to make GetBlobRange misbehave.
+type flakyRegistry struct {
+	oci.Interface
+
+	// truncate causes range reads to return
+	// at most this many bytes.
+	truncate int64
+	// failAfter causes all range reads after this
+	// many to fail.
+	failAfter int
+	// corrupt causes the first byte of every range
+	// read to be changed.
+	corrupt bool
+
+	mu    sync.Mutex
+	count int
+}
+
+func (r *flakyRegistry) GetBlobRange(ctx context.Context, repo string, dg oci.Digest, o0, o1 int64) (oci.BlobReader, error) {
+	r.mu.Lock()
+	r.count++
+	count := r.count
+	r.mu.Unlock()
+	if r.failAfter > 0 && count > r.failAfter {
+		return nil, errFlaky
+	}
+	rd, err := r.Interface.GetBlobRange(ctx, repo, dg, o0, o1)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(rd)
+	rd.Close()
+	if err != nil {
+		return nil, err
+	}
+	if r.truncate > 0 && int64(len(data)) > r.truncate {
+		data = data[:r.truncate]
+	}
+	if r.corrupt && len(data) > 0 {
+		data[0]++
+	}
+	return &bytesBlobReader{Reader: bytes.NewReader(data), desc: rd.Descriptor()}, nil
+}
+
+type bytesBlobReader struct {
+	*bytes.Reader
+	desc oci.Descriptor
+}
+
+func (r *bytesBlobReader) Descriptor() oci.Descriptor {
+	return r.desc
+}
+
+func (r *bytesBlobReader) Close() error {
+	return nil
+}
+
+// writerAt implements io.WriterAt but not io.ReaderAt.
+type writerAt struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (w *writerAt) WriteAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if end := off + int64(len(p)); end > int64(len(w.buf)) {
+		w.buf = append(w.buf, make([]byte, end-int64(len(w.buf)))...)
+	}
+	copy(w.buf[off:], p)
+	return len(p), nil
+}
+
+func pushRandomBlob(t *testing.T, size int) (oci.Interface, []byte, oci.Digest) {
+	r := ocimem.New()
+	data := make([]byte, size)
+	rand.Read(data)
+	dg := digest.FromBytes(data)
+	_, err := r.PushBlob(context.Background(), "foo", oci.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    dg,
+		Size:      int64(size),
+	}, bytes.NewReader(data))
+	require.NoError(t, err)
+	return r, data, dg
+}
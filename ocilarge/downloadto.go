@@ -0,0 +1,337 @@
+package ocilarge
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/ocitrace"
+	"github.com/opencontainers/go-digest"
+)
+
+// maxHeldBytes holds the most content that [DownloadLargeBlobTo]
+// keeps in memory while waiting for it to be hashed.
+const maxHeldBytes int64 = 8 * 1024 * 1024 // 8 MB
+
+// DownloadLargeBlobTo downloads a blob like [DownloadLargeBlob], but
+// writes each chunk directly to its offset in w as it arrives rather
+// than passing it through an ordered in-memory cache. A chunk that
+// fails part way through is retried from where it left off.
+//
+// The digest of the content is computed as it's written and checked
+// once the download is complete. Chunks that arrive ahead of those
+// before them can't be hashed straight away. If w also implements
+// [io.ReaderAt], as [*os.File] does, they're read back from w when
+// their turn comes, so memory use doesn't grow with the chunk size
+// or concurrency. Otherwise they're held in memory until then, and
+// a chunk isn't started while that could mean holding more than
+// 8 MB: chunks larger than that are downloaded one at a time.
+//
+// It returns the descriptor of the blob.
+// A nil opts is equivalent to a pointer to zero DownloadOptions.
+func DownloadLargeBlobTo(ctx context.Context, reg oci.Interface, repo string, dgst oci.Digest, w io.WriterAt, opts *DownloadOptions) (oci.Descriptor, error) {
+	o := opts.withDefaults()
+	desc, err := reg.ResolveBlob(ctx, repo, dgst)
+	if err != nil {
+		return oci.Descriptor{}, fmt.Errorf("failed to resolve blob: %w", err)
+	}
+	progress := o.progress(desc.Size)
+	hw := newHashingWriterAt(w, desc.Digest.Algorithm())
+
+	// The probe doubles as the download of the whole blob
+	// when it's small.
+	probeEnd := min(o.ProbeSize, desc.Size)
+	t0 := time.Now()
+	if err := fetchRangeTo(ctx, reg, repo, dgst, hw, byteRange{0, probeEnd}, &o); err != nil {
+		return oci.Descriptor{}, fmt.Errorf("bandwidth probe failed: %w", err)
+	}
+	progress(probeEnd)
+	if probeEnd < desc.Size {
+		chunkSize := deriveChunkSize(probeEnd, time.Since(t0), &o)
+		chunks := splitRanges(probeEnd, desc.Size, chunkSize)
+		var wait func(ctx context.Context, i int) error
+		if hw.ra == nil {
+			// Don't get so far ahead of the hashed content that
+			// too much would need to be held in memory. The next
+			// chunk to be hashed can always start, as its content
+			// is hashed as it's written.
+			wait = func(ctx context.Context, i int) error {
+				r := chunks[i]
+				return hw.waitHashed(ctx, min(r.start, r.end-maxHeldBytes))
+			}
+		}
+		err := fetchRangesTo(ctx, reg, repo, dgst, hw, chunks, &o, wait, func(r byteRange) {
+			progress(r.end - r.start)
+		})
+		if err != nil {
+			return oci.Descriptor{}, err
+		}
+	}
+	if err := hw.verify(desc); err != nil {
+		return oci.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// fetchRangesTo downloads all the given ranges to w, using up to
+// opts.MaxConcurrent concurrent requests. It calls done after each range
+// has been written; done may be called concurrently. If wait is
+// non-nil, it's called with the index of each range before the
+// range is started, and can block to hold back the download.
+//
+// The first error encountered cancels all other requests.
+func fetchRangesTo(
+	ctx context.Context,
+	reg oci.Interface,
+	repo string,
+	dgst oci.Digest,
+	w io.WriterAt,
+	ranges []byteRange,
+	opts *DownloadOptions,
+	wait func(ctx context.Context, i int) error,
+	done func(r byteRange),
+) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	next := make(chan byteRange)
+	var wg sync.WaitGroup
+	for range min(opts.MaxConcurrent, len(ranges)) {
+		wg.Go(func() {
+			for r := range next {
+				if err := fetchRangeTo(ctx, reg, repo, dgst, w, r, opts); err != nil {
+					cancel(fmt.Errorf("chunk (offset %d): %w", r.start, err))
+					return
+				}
+				done(r)
+			}
+		})
+	}
+feed:
+	for i, r := range ranges {
+		if wait != nil {
+			if err := wait(ctx, i); err != nil {
+				cancel(err)
+				break
+			}
+		}
+		select {
+		case next <- r:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return nil
+}
+
+// fetchRangeTo downloads r from the registry to the same range in w,
+// with up to opts.MaxRetries attempts. Each attempt after the first
+// continues from where the previous one stopped.
+//
+// Each call is reported as a span using any tracer
+// attached to the context with [ocitrace.ContextWithTracer].
+func fetchRangeTo(ctx context.Context, reg oci.Interface, repo string, dgst oci.Digest, w io.WriterAt, r byteRange, opts *DownloadOptions) (_err error) {
+	ctx, span := ocitrace.Start(ctx, "ocilarge.FetchRange",
+		ocitrace.String(ocitrace.KeyRepo, repo),
+		ocitrace.String(ocitrace.KeyDigest, string(dgst)),
+		ocitrace.Int64("oci.range.start", r.start),
+		ocitrace.Int64("oci.range.end", r.end),
+	)
+	attempts := 0
+	defer func() {
+		span.SetAttributes(ocitrace.Int("ocilarge.attempts", attempts))
+		ocitrace.End(span, _err)
+	}()
+	offset := r.start
+	var lastErr error
+	for range opts.MaxRetries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		attempts++
+		br, err := reg.GetBlobRange(ctx, repo, dgst, offset, r.end)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		n, err := io.Copy(io.NewOffsetWriter(w, offset), io.LimitReader(br, r.end-offset))
+		br.Close()
+		offset += n
+		if offset == r.end {
+			return nil
+		}
+		if err == nil {
+			err = fmt.Errorf("short read: got %d bytes, want %d", offset-r.start, r.end-r.start)
+		}
+		lastErr = err
+	}
+	return fmt.Errorf("failed after %d attempts: %w", opts.MaxRetries, lastErr)
+}
+
+// hashingWriterAt writes to an [io.WriterAt] and computes
+// the digest of the content as it's written, in order.
+// Writes made ahead of the content hashed so far are held
+// until the gap before them has been filled: only their
+// extent is recorded when the content can be read back
+// from the underlying writer, and a copy is kept otherwise.
+//
+// Hashing happens without holding the lock, so that it
+// doesn't hold up concurrent writes; only one write
+// at a time does the hashing.
+type hashingWriterAt struct {
+	w  io.WriterAt
+	ra io.ReaderAt // nil when w can't be read back
+
+	// h is only used by the write that set hashing.
+	h hash.Hash
+
+	mu      sync.Mutex
+	alg     digest.Algorithm
+	hashed  int64
+	hashing bool
+	pending map[int64]pendingWrite
+	err     error
+	// changed is closed and replaced when hashed increases
+	// or err is set.
+	changed chan struct{}
+}
+
+// pendingWrite holds a write that's yet to be hashed.
+type pendingWrite struct {
+	end  int64
+	data []byte // nil when the content is to be read back
+}
+
+func newHashingWriterAt(w io.WriterAt, alg digest.Algorithm) *hashingWriterAt {
+	ra, _ := w.(io.ReaderAt)
+	return &hashingWriterAt{
+		w:       w,
+		ra:      ra,
+		alg:     alg,
+		h:       alg.Hash(),
+		pending: make(map[int64]pendingWrite),
+		changed: make(chan struct{}),
+	}
+}
+
+// WriteAt implements [io.WriterAt].
+func (hw *hashingWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	n, err := hw.w.WriteAt(p, off)
+	if n > 0 {
+		hw.add(p[:n], off)
+	}
+	return n, err
+}
+
+// add records that p has been written at off, and
+// hashes as much content as is now contiguous unless
+// another write is already doing so.
+func (hw *hashingWriterAt) add(p []byte, off int64) {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	if hw.err != nil {
+		return
+	}
+	end := off + int64(len(p))
+	if _, ok := hw.pending[off]; ok || off < hw.hashed {
+		hw.err = fmt.Errorf("overlapping write at offset %d", off)
+		return
+	}
+	pw := pendingWrite{end: end}
+	if off == hw.hashed && !hw.hashing {
+		// p can be hashed directly.
+		pw.data = p
+	} else if hw.ra == nil {
+		pw.data = bytes.Clone(p)
+	}
+	hw.pending[off] = pw
+	if hw.hashing {
+		return
+	}
+	hw.hashing = true
+	defer func() {
+		hw.hashing = false
+	}()
+	for hw.err == nil {
+		pw, ok := hw.pending[hw.hashed]
+		if !ok {
+			break
+		}
+		delete(hw.pending, hw.hashed)
+		start := hw.hashed
+		hw.mu.Unlock()
+		var err error
+		if pw.data != nil {
+			hw.h.Write(pw.data)
+		} else if _, err = io.Copy(hw.h, io.NewSectionReader(hw.ra, start, pw.end-start)); err != nil {
+			err = fmt.Errorf("cannot read back downloaded content: %w", err)
+		}
+		hw.mu.Lock()
+		if err != nil {
+			hw.err = err
+		} else {
+			hw.hashed = pw.end
+		}
+		close(hw.changed)
+		hw.changed = make(chan struct{})
+	}
+}
+
+// waitHashed waits until all the content before off
+// has been hashed.
+func (hw *hashingWriterAt) waitHashed(ctx context.Context, off int64) error {
+	for {
+		hw.mu.Lock()
+		hashed, err, changed := hw.hashed, hw.err, hw.changed
+		hw.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if hashed >= off {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	}
+}
+
+// verify checks that the content written matches desc.
+func (hw *hashingWriterAt) verify(desc oci.Descriptor) error {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	if hw.err != nil {
+		return hw.err
+	}
+	if hw.hashed != desc.Size {
+		return fmt.Errorf("incomplete download: got %d contiguous bytes, want %d", hw.hashed, desc.Size)
+	}
+	if got := digest.NewDigest(hw.alg, hw.h); got != desc.Digest {
+		return fmt.Errorf("digest mismatch after download (got %s, want %s)", got, desc.Digest)
+	}
+	return nil
+}
+
+// verifyContent checks that the content of r matches desc.
+func verifyContent(r io.ReaderAt, desc oci.Descriptor) error {
+	h := desc.Digest.Algorithm().Hash()
+	if _, err := io.Copy(h, io.NewSectionReader(r, 0, desc.Size)); err != nil {
+		return fmt.Errorf("cannot read back downloaded content: %w", err)
+	}
+	if got := digest.NewDigest(desc.Digest.Algorithm(), h); got != desc.Digest {
+		return fmt.Errorf("digest mismatch after download (got %s, want %s)", got, desc.Digest)
+	}
+	return nil
+}
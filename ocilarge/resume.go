@@ -0,0 +1,254 @@
+package ocilarge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jcarter3/oci"
+)
+
+// Suffixes of the files used by [DownloadLargeBlobToFile]
+// to record an in-progress download.
+const (
+	PartialSuffix    = ".partial"
+	CheckpointSuffix = ".checkpoint"
+)
+
+// DownloadLargeBlobToFile downloads a blob to the file at path, in a way
+// that can be resumed if the process is interrupted.
+//
+// The content is written to path+[PartialSuffix] using the same
+// concurrent range requests as [DownloadLargeBlobTo], and the ranges that
+// have been completed are recorded, along with the expected digest and
+// size, in the sidecar file path+[CheckpointSuffix]. If a checkpoint for
+// the same blob exists when it's called, only the missing ranges are
+// fetched; a checkpoint for any other blob is discarded.
+//
+// When all the content is present, its digest is verified and the partial
+// file is renamed to path. If verification fails, the partial file and
+// checkpoint are removed so the next attempt starts afresh.
+//
+// A nil opts is equivalent to a pointer to zero DownloadOptions.
+func DownloadLargeBlobToFile(ctx context.Context, reg oci.Interface, repo string, dgst oci.Digest, path string, opts *DownloadOptions) (oci.Descriptor, error) {
+	o := opts.withDefaults()
+	desc, err := reg.ResolveBlob(ctx, repo, dgst)
+	if err != nil {
+		return oci.Descriptor{}, fmt.Errorf("failed to resolve blob: %w", err)
+	}
+	partialPath, ckptPath := path+PartialSuffix, path+CheckpointSuffix
+	ckpt, err := readCheckpoint(ckptPath, desc)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	flags := os.O_RDWR | os.O_CREATE
+	if len(ckpt.Completed) == 0 {
+		// Don't trust any content that isn't recorded in a checkpoint.
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(partialPath, flags, 0o666)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	defer f.Close()
+
+	cw := &checkpointWriter{
+		path:     ckptPath,
+		f:        f,
+		ckpt:     ckpt,
+		progress: o.progress(desc.Size),
+	}
+	if n := ckpt.completedSize(); n > 0 {
+		cw.progress(n)
+	}
+	if err := cw.downloadMissing(ctx, reg, repo, dgst, &o); err != nil {
+		return oci.Descriptor{}, err
+	}
+	if err := verifyContent(f, desc); err != nil {
+		f.Close()
+		os.Remove(partialPath)
+		os.Remove(ckptPath)
+		return oci.Descriptor{}, err
+	}
+	if err := f.Close(); err != nil {
+		return oci.Descriptor{}, err
+	}
+	if err := os.Rename(partialPath, path); err != nil {
+		return oci.Descriptor{}, err
+	}
+	if err := os.Remove(ckptPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return oci.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// checkpoint holds the on-disk record of an in-progress download.
+type checkpoint struct {
+	Digest oci.Digest `json:"digest"`
+	Size   int64      `json:"size"`
+	// Completed holds the sorted, non-overlapping and
+	// non-adjacent ranges that have been downloaded,
+	// as [start, end) pairs.
+	Completed [][2]int64 `json:"completed"`
+}
+
+// readCheckpoint reads the checkpoint at path. It returns an
+// empty checkpoint for desc if there's no checkpoint or it's
+// for a different blob or malformed.
+func readCheckpoint(path string, desc oci.Descriptor) (*checkpoint, error) {
+	fresh := &checkpoint{
+		Digest: desc.Digest,
+		Size:   desc.Size,
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fresh, nil
+		}
+		return nil, err
+	}
+	var ckpt checkpoint
+	if err := json.Unmarshal(data, &ckpt); err != nil || ckpt.Digest != desc.Digest || ckpt.Size != desc.Size || !ckpt.valid() {
+		return fresh, nil
+	}
+	return &ckpt, nil
+}
+
+// valid reports whether the completed ranges are well formed.
+func (c *checkpoint) valid() bool {
+	var prev int64 = -1
+	for _, r := range c.Completed {
+		if r[0] <= prev || r[1] <= r[0] || r[1] > c.Size {
+			return false
+		}
+		prev = r[1]
+	}
+	return true
+}
+
+// add records that r has been completed.
+func (c *checkpoint) add(r byteRange) {
+	i := slices.IndexFunc(c.Completed, func(e [2]int64) bool {
+		return e[0] > r.start
+	})
+	if i < 0 {
+		i = len(c.Completed)
+	}
+	c.Completed = slices.Insert(c.Completed, i, [2]int64{r.start, r.end})
+	// Merge overlapping and adjacent ranges.
+	merged := c.Completed[:1]
+	for _, e := range c.Completed[1:] {
+		last := &merged[len(merged)-1]
+		if e[0] <= last[1] {
+			last[1] = max(last[1], e[1])
+			continue
+		}
+		merged = append(merged, e)
+	}
+	c.Completed = merged
+}
+
+// missing returns the ranges that have not been completed.
+func (c *checkpoint) missing() []byteRange {
+	var ranges []byteRange
+	var offset int64
+	for _, r := range c.Completed {
+		if r[0] > offset {
+			ranges = append(ranges, byteRange{offset, r[0]})
+		}
+		offset = r[1]
+	}
+	if offset < c.Size {
+		ranges = append(ranges, byteRange{offset, c.Size})
+	}
+	return ranges
+}
+
+func (c *checkpoint) completedSize() int64 {
+	var n int64
+	for _, r := range c.Completed {
+		n += r[1] - r[0]
+	}
+	return n
+}
+
+// checkpointWriter downloads into a partial file, recording
+// each completed range in the checkpoint.
+type checkpointWriter struct {
+	path     string
+	f        *os.File
+	progress func(n int64)
+
+	mu   sync.Mutex
+	ckpt *checkpoint
+}
+
+// downloadMissing downloads all the ranges missing from the checkpoint.
+func (cw *checkpointWriter) downloadMissing(ctx context.Context, reg oci.Interface, repo string, dgst oci.Digest, opts *DownloadOptions) error {
+	missing := cw.ckpt.missing()
+	if len(missing) == 0 {
+		return nil
+	}
+	// Probe with the start of the first missing range
+	// to derive the chunk size.
+	probe := byteRange{missing[0].start, min(missing[0].start+opts.ProbeSize, missing[0].end)}
+	t0 := time.Now()
+	if err := fetchRangeTo(ctx, reg, repo, dgst, cw.f, probe, opts); err != nil {
+		return fmt.Errorf("bandwidth probe failed: %w", err)
+	}
+	elapsed := time.Since(t0)
+	if err := cw.complete(probe); err != nil {
+		return err
+	}
+	chunkSize := deriveChunkSize(probe.end-probe.start, elapsed, opts)
+	var chunks []byteRange
+	for _, r := range cw.ckpt.missing() {
+		chunks = append(chunks, splitRanges(r.start, r.end, chunkSize)...)
+	}
+	var errOnce sync.Once
+	var ckptErr error
+	err := fetchRangesTo(ctx, reg, repo, dgst, cw.f, chunks, opts, nil, func(r byteRange) {
+		if err := cw.complete(r); err != nil {
+			errOnce.Do(func() {
+				ckptErr = err
+			})
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return ckptErr
+}
+
+// complete records that r has been written to the partial file.
+// The file is synced first so that the checkpoint never records
+// content that might not have reached the disk.
+func (cw *checkpointWriter) complete(r byteRange) error {
+	if err := cw.f.Sync(); err != nil {
+		return err
+	}
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	cw.ckpt.add(r)
+	data, err := json.Marshal(cw.ckpt)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file and rename so that the
+	// checkpoint is replaced atomically.
+	tmp := cw.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o666); err != nil {
+		return fmt.Errorf("cannot write checkpoint: %w", err)
+	}
+	if err := os.Rename(tmp, cw.path); err != nil {
+		return fmt.Errorf("cannot write checkpoint: %w", err)
+	}
+	cw.progress(r.end - r.start)
+	return nil
+}
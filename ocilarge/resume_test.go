@@ -0,0 +1,119 @@
+package ocilarge_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/ocilarge"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadLargeBlobToFileResumes(t *testing.T) {
+	ctx := context.Background()
+	r, data, dg := pushRandomBlob(t, 40*1024)
+	path := filepath.Join(t.TempDir(), "blob")
+	opts := &ocilarge.DownloadOptions{
+		MaxConcurrent: 1,
+		ProbeSize:     1024,
+		MinChunkSize:  4096,
+		MaxChunkSize:  4096,
+		MaxRetries:    1,
+	}
+
+	// The first attempt fails part way through.
+	flaky := &flakyRegistry{Interface: r, failAfter: 4}
+	_, err := ocilarge.DownloadLargeBlobToFile(ctx, flaky, "foo", dg, path, opts)
+	require.ErrorIs(t, err, errFlaky)
+	_, err = os.Stat(path)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	var ckpt struct {
+		Digest    oci.Digest
+		Size      int64
+		Completed [][2]int64
+	}
+	ckptData, err := os.ReadFile(path + ocilarge.CheckpointSuffix)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(ckptData, &ckpt))
+	require.Equal(t, dg, ckpt.Digest)
+	require.Equal(t, int64(len(data)), ckpt.Size)
+	// The probe and three chunks have completed.
+	require.Equal(t, [][2]int64{{0, 1024 + 3*4096}}, ckpt.Completed)
+
+	// The second attempt fetches only the missing content.
+	counting := &countingRegistry{Interface: r}
+	var progress []int64
+	opts.Progress = func(done, total int64) {
+		progress = append(progress, done)
+	}
+	desc, err := ocilarge.DownloadLargeBlobToFile(ctx, counting, "foo", dg, path, opts)
+	require.NoError(t, err)
+	require.Equal(t, dg, desc.Digest)
+	require.Equal(t, int64(len(data)-(1024+3*4096)), counting.bytes)
+	require.Equal(t, int64(1024+3*4096), progress[0])
+	require.Equal(t, int64(len(data)), progress[len(progress)-1])
+
+	got, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+	for _, suffix := range []string{ocilarge.PartialSuffix, ocilarge.CheckpointSuffix} {
+		_, err = os.Stat(path + suffix)
+		require.ErrorIs(t, err, os.ErrNotExist)
+	}
+}
+
+func TestDownloadLargeBlobToFileIgnoresStaleCheckpoint(t *testing.T) {
+	r, data, dg := pushRandomBlob(t, 10*1024)
+	path := filepath.Join(t.TempDir(), "blob")
+	// A checkpoint for another blob claims that everything is present.
+	ckpt, err := json.Marshal(map[string]any{
+		"digest":    digest.FromString("other"),
+		"size":      len(data),
+		"completed": [][2]int64{{0, int64(len(data))}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path+ocilarge.CheckpointSuffix, ckpt, 0o666))
+	require.NoError(t, os.WriteFile(path+ocilarge.PartialSuffix, make([]byte, len(data)), 0o666))
+
+	counting := &countingRegistry{Interface: r}
+	_, err = ocilarge.DownloadLargeBlobToFile(context.Background(), counting, "foo", dg, path, smallChunks)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), counting.bytes)
+	got, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+}
+
+func TestDownloadLargeBlobToFileDigestMismatch(t *testing.T) {
+	r, _, dg := pushRandomBlob(t, 10*1024)
+	path := filepath.Join(t.TempDir(), "blob")
+	flaky := &flakyRegistry{Interface: r, corrupt: true}
+	_, err := ocilarge.DownloadLargeBlobToFile(context.Background(), flaky, "foo", dg, path, smallChunks)
+	require.ErrorContains(t, err, "digest mismatch after download")
+	for _, p := range []string{path, path + ocilarge.PartialSuffix, path + ocilarge.CheckpointSuffix} {
+		_, err = os.Stat(p)
+		require.ErrorIs(t, err, os.ErrNotExist)
+	}
+}
+
+// countingRegistry counts the number of bytes requested
+// with GetBlobRange.
+type countingRegistry struct {
+	oci.Interface
+
+	mu    sync.Mutex
+	bytes int64
+}
+
+func (r *countingRegistry) GetBlobRange(ctx context.Context, repo string, dg oci.Digest, o0, o1 int64) (oci.BlobReader, error) {
+	r.mu.Lock()
+	r.bytes += o1 - o0
+	r.mu.Unlock()
+	return r.Interface.GetBlobRange(ctx, repo, dg, o0, o1)
+}
@@ -0,0 +1,334 @@
+package ocilarge
+
+import (
+	"context"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/jcarter3/oci"
+	"github.com/opencontainers/go-digest"
+)
+
+// UploadState holds the state of an in-progress resumable upload,
+// as recorded by [UploadLargeBlobResumable] after each chunk.
+type UploadState struct {
+	// Repo holds the repository the content is being uploaded to.
+	Repo string `json:"repo"`
+
+	// SourceSize holds the size of the content being uploaded.
+	SourceSize int64 `json:"sourceSize"`
+
+	// Digest holds the digest of the content being uploaded,
+	// if it was known when the upload was started.
+	Digest oci.Digest `json:"digest,omitempty"`
+
+	// ID holds the upload ID as returned by [oci.BlobWriter.ID].
+	ID string `json:"id"`
+
+	// Size holds the number of bytes that have been uploaded,
+	// as returned by [oci.BlobWriter.Size].
+	Size int64 `json:"size"`
+
+	// ChunkSize holds the chunk size in use,
+	// as returned by [oci.BlobWriter.ChunkSize].
+	ChunkSize int `json:"chunkSize"`
+
+	// DigestState holds the marshaled state of the digester after
+	// hashing the first Size bytes of the content. It's empty
+	// if the hash doesn't support marshaling, in which case
+	// the content is hashed again when resuming.
+	DigestState []byte `json:"digestState,omitempty"`
+}
+
+// UploadStateStore persists the state of a resumable upload.
+type UploadStateStore interface {
+	// Load returns the most recently saved state,
+	// or nil if there is none.
+	Load() (*UploadState, error)
+
+	// Save saves the state, replacing any previous state.
+	Save(state *UploadState) error
+
+	// Delete deletes any saved state.
+	Delete() error
+}
+
+// NewFileUploadStateStore returns an [UploadStateStore] that
+// stores the state as JSON in the file at path.
+func NewFileUploadStateStore(path string) UploadStateStore {
+	return fileUploadStateStore(path)
+}
+
+type fileUploadStateStore string
+
+func (path fileUploadStateStore) Load() (*UploadState, error) {
+	data, err := os.ReadFile(string(path))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var state UploadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid upload state in %q: %v", path, err)
+	}
+	return &state, nil
+}
+
+func (path fileUploadStateStore) Save(state *UploadState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file and rename so that the
+	// state is replaced atomically.
+	tmp := string(path) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, string(path))
+}
+
+func (path fileUploadStateStore) Delete() error {
+	if err := os.Remove(string(path)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// maxUploadRetries is the number of consecutive times a chunk
+// upload is attempted before giving up.
+const maxUploadRetries = 3
+
+// UploadLargeBlobResumable uploads the desc.Size bytes of content in
+// src as a blob, in chunks, in a way that can be resumed if the
+// process is interrupted. If desc.Digest is non-empty, the content
+// must match it; otherwise its digest is computed with
+// [digest.Canonical].
+//
+// After each chunk has been uploaded, the upload's ID, size and chunk
+// size, along with the state of the digester, are saved to store. If
+// store holds state when it's called, the upload is resumed from the
+// offset reported by the registry rather than started afresh; if the
+// registry no longer knows about the upload, a new one is started. A
+// chunk that fails to upload is retried from the registry-reported
+// offset. The state is deleted when the upload has been committed.
+//
+// Saved state is only used when it was recorded for the same
+// repository, content size and digest; otherwise a new upload is
+// started. When desc.Digest is empty, content that has changed
+// without changing its size can't be told apart, so resuming with it
+// would upload a blob mixing the old and new content.
+//
+// The chunkSize is a hint as for [oci.Interface.PushBlobChunked];
+// if it's not positive, 100 MB is used.
+func UploadLargeBlobResumable(ctx context.Context, reg oci.Interface, repo string, src io.ReaderAt, desc oci.Descriptor, chunkSize int, store UploadStateStore) (oci.Descriptor, error) {
+	if chunkSize <= 0 {
+		chunkSize = 100 * 1024 * 1024 // 100 MB
+	}
+	alg := digest.Canonical
+	if desc.Digest != "" {
+		if err := desc.Digest.Validate(); err != nil {
+			return oci.Descriptor{}, fmt.Errorf("invalid digest %q: %v", desc.Digest, err)
+		}
+		alg = desc.Digest.Algorithm()
+	}
+	size := desc.Size
+	u := &resumableUpload{
+		reg:    reg,
+		repo:   repo,
+		src:    src,
+		size:   size,
+		digest: desc.Digest,
+		store:  store,
+		h:      alg.Hash(),
+	}
+	bw, err := u.start(ctx, chunkSize)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	var buf []byte
+	failures := 0
+	for {
+		// The writer has just been created, so its ID is valid.
+		if err := u.save(bw); err != nil {
+			return oci.Descriptor{}, err
+		}
+		offset := bw.Size()
+		if offset > size {
+			return oci.Descriptor{}, fmt.Errorf("registry reports upload offset %d beyond content size %d", offset, size)
+		}
+		if offset == size {
+			break
+		}
+		n := min(int64(bw.ChunkSize()), size-offset)
+		if int64(cap(buf)) < n {
+			buf = make([]byte, n)
+		}
+		if m, err := src.ReadAt(buf[:n], offset); int64(m) != n {
+			return oci.Descriptor{}, fmt.Errorf("reading source: %w", err)
+		}
+		_, err := bw.Write(buf[:n])
+		if err == nil {
+			// Close flushes the chunk and makes the ID valid again.
+			err = bw.Close()
+		}
+		if err == nil {
+			failures = 0
+			// Record the chunk before doing anything else, so
+			// that it's not lost if the process is interrupted.
+			if err := u.save(bw); err != nil {
+				return oci.Descriptor{}, err
+			}
+			bw, err = reg.PushBlobChunkedResume(ctx, repo, bw.ID(), bw.Size(), bw.ChunkSize())
+			if err != nil {
+				return oci.Descriptor{}, fmt.Errorf("continuing chunked upload: %w", err)
+			}
+			continue
+		}
+		failures++
+		if failures >= maxUploadRetries {
+			return oci.Descriptor{}, fmt.Errorf("writing chunk: %w", err)
+		}
+		// Find out how much the registry actually received.
+		bw, err = reg.PushBlobChunkedResume(ctx, repo, u.state.ID, -1, u.state.ChunkSize)
+		if err != nil {
+			return oci.Descriptor{}, fmt.Errorf("recovering chunked upload: %w", err)
+		}
+	}
+	dgst := digest.NewDigest(alg, u.h)
+	if desc.Digest != "" && dgst != desc.Digest {
+		// The upload can never be committed, so don't
+		// leave it to be resumed.
+		bw.Cancel()
+		store.Delete()
+		return oci.Descriptor{}, fmt.Errorf("content has digest %s, want %s", dgst, desc.Digest)
+	}
+	desc, err = bw.Commit(dgst)
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	if err := store.Delete(); err != nil {
+		return oci.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+type resumableUpload struct {
+	reg    oci.Interface
+	repo   string
+	src    io.ReaderAt
+	size   int64
+	digest oci.Digest
+	store  UploadStateStore
+
+	// state holds the most recently saved state.
+	state *UploadState
+
+	// h holds the hash of the first hashed bytes of src.
+	h      hash.Hash
+	hashed int64
+}
+
+// start resumes the upload recorded in the store, or starts
+// a new one if there is none or it was recorded for other content.
+func (u *resumableUpload) start(ctx context.Context, chunkSize int) (oci.BlobWriter, error) {
+	state, err := u.store.Load()
+	if err != nil {
+		return nil, fmt.Errorf("cannot load upload state: %w", err)
+	}
+	if state != nil && !u.matches(state) {
+		state = nil
+	}
+	if state != nil {
+		bw, err := u.reg.PushBlobChunkedResume(ctx, u.repo, state.ID, -1, state.ChunkSize)
+		if err == nil {
+			u.state = state
+			if um, ok := u.h.(encoding.BinaryUnmarshaler); ok && len(state.DigestState) > 0 {
+				if err := um.UnmarshalBinary(state.DigestState); err == nil {
+					u.hashed = state.Size
+				} else {
+					u.h.Reset()
+				}
+			}
+			return bw, nil
+		}
+		if !errors.Is(err, oci.ErrBlobUploadUnknown) && !errors.Is(err, oci.ErrBlobUploadInvalid) {
+			return nil, fmt.Errorf("resuming chunked upload: %w", err)
+		}
+		// The registry has forgotten about the upload; start again.
+	}
+	bw, err := u.reg.PushBlobChunked(ctx, u.repo, chunkSize)
+	if err != nil {
+		return nil, fmt.Errorf("starting chunked upload: %w", err)
+	}
+	return bw, nil
+}
+
+// matches reports whether state was recorded
+// for the content being uploaded by u.
+func (u *resumableUpload) matches(state *UploadState) bool {
+	return state.Repo == u.repo &&
+		state.SourceSize == u.size &&
+		state.Digest == u.digest &&
+		state.Size <= u.size
+}
+
+// save hashes the content up to the writer's current size and
+// saves the state of the writer to the store if it has changed.
+func (u *resumableUpload) save(bw oci.BlobWriter) error {
+	if s := u.state; s != nil && s.ID == bw.ID() && s.Size == bw.Size() && s.ChunkSize == bw.ChunkSize() && u.hashed == s.Size {
+		return nil
+	}
+	if err := u.hashTo(bw.Size()); err != nil {
+		return err
+	}
+	state := &UploadState{
+		Repo:       u.repo,
+		SourceSize: u.size,
+		Digest:     u.digest,
+		ID:         bw.ID(),
+		Size:       bw.Size(),
+		ChunkSize:  bw.ChunkSize(),
+	}
+	if m, ok := u.h.(encoding.BinaryMarshaler); ok {
+		data, err := m.MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("cannot marshal digest state: %v", err)
+		}
+		state.DigestState = data
+	}
+	if err := u.store.Save(state); err != nil {
+		return fmt.Errorf("cannot save upload state: %w", err)
+	}
+	u.state = state
+	return nil
+}
+
+// hashTo updates the hash so that it covers exactly the
+// first offset bytes of the source.
+func (u *resumableUpload) hashTo(offset int64) error {
+	if offset < u.hashed {
+		u.h.Reset()
+		u.hashed = 0
+	}
+	if offset == u.hashed {
+		return nil
+	}
+	n, err := io.Copy(u.h, io.NewSectionReader(u.src, u.hashed, offset-u.hashed))
+	u.hashed += n
+	if err != nil {
+		return fmt.Errorf("reading source: %w", err)
+	}
+	if u.hashed != offset {
+		return fmt.Errorf("source is shorter than upload offset %d", offset)
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+package ocilarge_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/ociclient"
+	"github.com/jcarter3/oci/ocilarge"
+	"github.com/jcarter3/oci/ocimem"
+	"github.com/jcarter3/oci/ociserver"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+// uploadChunkSize matches the minimum chunk size of ocimem.
+const uploadChunkSize = 8 * 1024
+
+func TestUploadLargeBlobResumableResumesAfterCrash(t *testing.T) {
+	ctx := context.Background()
+	backend := ocimem.New()
+	srv, patched := newUploadServer(t, backend)
+	data := randomData(10*uploadChunkSize + 100)
+	store := ocilarge.NewFileUploadStateStore(filepath.Join(t.TempDir(), "upload.json"))
+
+	// The first run "crashes" after three chunks have been uploaded.
+	crashing := &faultyRegistry{Interface: newUploadClient(t, srv), crashAfter: 3}
+	_, err := ocilarge.UploadLargeBlobResumable(ctx, crashing, "foo", bytes.NewReader(data), contentDesc(data, true), uploadChunkSize, store)
+	require.ErrorIs(t, err, errCrash)
+	state, err := store.Load()
+	require.NoError(t, err)
+	require.NotNil(t, state)
+	require.Equal(t, int64(3*uploadChunkSize), state.Size)
+	require.Equal(t, uploadChunkSize, state.ChunkSize)
+	require.NotEmpty(t, state.DigestState)
+	require.Equal(t, int64(3*uploadChunkSize), patched.total())
+
+	// The second run carries on where the first left off.
+	desc, err := ocilarge.UploadLargeBlobResumable(ctx, newUploadClient(t, srv), "foo", bytes.NewReader(data), contentDesc(data, true), uploadChunkSize, store)
+	require.NoError(t, err)
+	require.Equal(t, digest.FromBytes(data), desc.Digest)
+	require.Equal(t, int64(len(data)), patched.total())
+	requireBlob(t, backend, data)
+
+	state, err = store.Load()
+	require.NoError(t, err)
+	require.Nil(t, state)
+}
+
+func TestUploadLargeBlobResumableWithoutDigestState(t *testing.T) {
+	ctx := context.Background()
+	backend := ocimem.New()
+	srv, _ := newUploadServer(t, backend)
+	data := randomData(5*uploadChunkSize + 1)
+	store := &memStore{}
+
+	crashing := &faultyRegistry{Interface: newUploadClient(t, srv), crashAfter: 2}
+	_, err := ocilarge.UploadLargeBlobResumable(ctx, crashing, "foo", bytes.NewReader(data), contentDesc(data, false), uploadChunkSize, store)
+	require.ErrorIs(t, err, errCrash)
+
+	// Without the digest state, the prefix is hashed again.
+	store.state.DigestState = nil
+	desc, err := ocilarge.UploadLargeBlobResumable(ctx, newUploadClient(t, srv), "foo", bytes.NewReader(data), contentDesc(data, false), uploadChunkSize, store)
+	require.NoError(t, err)
+	require.Equal(t, digest.FromBytes(data), desc.Digest)
+	requireBlob(t, backend, data)
+}
+
+func TestUploadLargeBlobResumableRetriesFailedChunk(t *testing.T) {
+	ctx := context.Background()
+	backend := ocimem.New()
+	srv, patched := newUploadServer(t, backend)
+	data := randomData(4 * uploadChunkSize)
+
+	faulty := &faultyRegistry{Interface: newUploadClient(t, srv), failClose: 2}
+	desc, err := ocilarge.UploadLargeBlobResumable(ctx, faulty, "foo", bytes.NewReader(data), contentDesc(data, false), uploadChunkSize, &memStore{})
+	require.NoError(t, err)
+	require.Equal(t, digest.FromBytes(data), desc.Digest)
+	require.Equal(t, int64(len(data)), patched.total())
+	requireBlob(t, backend, data)
+}
+
+func TestUploadLargeBlobResumableWithDifferentSource(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range []struct {
+		name    string
+		other   []byte
+		digests bool
+	}{{
+		name:  "DifferentSize",
+		other: randomData(6*uploadChunkSize + 1),
+	}, {
+		name:    "SameSizeDifferentDigest",
+		other:   randomData(5*uploadChunkSize + 1),
+		digests: true,
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			backend := ocimem.New()
+			srv, patched := newUploadServer(t, backend)
+			data := randomData(5*uploadChunkSize + 1)
+			store := &memStore{}
+
+			crashing := &faultyRegistry{Interface: newUploadClient(t, srv), crashAfter: 2}
+			_, err := ocilarge.UploadLargeBlobResumable(ctx, crashing, "foo", bytes.NewReader(data), contentDesc(data, test.digests), uploadChunkSize, store)
+			require.ErrorIs(t, err, errCrash)
+
+			// The saved state is for other content,
+			// so the upload starts afresh.
+			desc, err := ocilarge.UploadLargeBlobResumable(ctx, newUploadClient(t, srv), "foo", bytes.NewReader(test.other), contentDesc(test.other, test.digests), uploadChunkSize, store)
+			require.NoError(t, err)
+			require.Equal(t, digest.FromBytes(test.other), desc.Digest)
+			require.Equal(t, int64(2*uploadChunkSize+len(test.other)), patched.total())
+			requireBlob(t, backend, test.other)
+		})
+	}
+
+	// The saved state is also ignored for another repository.
+	backend := ocimem.New()
+	srv, patched := newUploadServer(t, backend)
+	data := randomData(3 * uploadChunkSize)
+	store := &memStore{}
+	crashing := &faultyRegistry{Interface: newUploadClient(t, srv), crashAfter: 1}
+	_, err := ocilarge.UploadLargeBlobResumable(ctx, crashing, "bar", bytes.NewReader(data), contentDesc(data, false), uploadChunkSize, store)
+	require.ErrorIs(t, err, errCrash)
+	_, err = ocilarge.UploadLargeBlobResumable(ctx, newUploadClient(t, srv), "foo", bytes.NewReader(data), contentDesc(data, false), uploadChunkSize, store)
+	require.NoError(t, err)
+	require.Equal(t, int64(uploadChunkSize+len(data)), patched.total())
+	requireBlob(t, backend, data)
+}
+
+func TestUploadLargeBlobResumableDigestMismatch(t *testing.T) {
+	ctx := context.Background()
+	backend := ocimem.New()
+	srv, _ := newUploadServer(t, backend)
+	data := randomData(2 * uploadChunkSize)
+	store := &memStore{}
+	desc := contentDesc(randomData(len(data)), true)
+	_, err := ocilarge.UploadLargeBlobResumable(ctx, newUploadClient(t, srv), "foo", bytes.NewReader(data), desc, uploadChunkSize, store)
+	require.ErrorContains(t, err, "want "+string(desc.Digest))
+	require.Nil(t, store.state)
+	_, err = backend.ResolveBlob(ctx, "foo", digest.FromBytes(data))
+	require.ErrorIs(t, err, oci.ErrBlobUnknown)
+}
+
+var errCrash = errors.New("simulated crash")
+
+// faultyRegistry wraps a registry to simulate failures
+// during chunked uploads.
+type faultyRegistry struct {
+	oci.Interface
+
+	// crashAfter causes PushBlobChunkedResume with a known
+	// offset to fail after that many chunks have been written.
+	crashAfter int
+	// failClose causes the nth call to BlobWriter.Close
+	// to fail without flushing.
+	failClose int
+
+	mu     sync.Mutex
+	closes int
+}
+
+func (r *faultyRegistry) PushBlobChunkedResume(ctx context.Context, repo, id string, offset int64, chunkSize int) (oci.BlobWriter, error) {
+	if r.crashAfter > 0 && offset >= int64(r.crashAfter*chunkSize) {
+		return nil, errCrash
+	}
+	w, err := r.Interface.PushBlobChunkedResume(ctx, repo, id, offset, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyWriter{BlobWriter: w, r: r}, nil
+}
+
+func (r *faultyRegistry) PushBlobChunked(ctx context.Context, repo string, chunkSize int) (oci.BlobWriter, error) {
+	w, err := r.Interface.PushBlobChunked(ctx, repo, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyWriter{BlobWriter: w, r: r}, nil
+}
+
+type faultyWriter struct {
+	oci.BlobWriter
+	r *faultyRegistry
+}
+
+func (w *faultyWriter) Close() error {
+	w.r.mu.Lock()
+	w.r.closes++
+	fail := w.r.closes == w.r.failClose
+	w.r.mu.Unlock()
+	if fail {
+		return errors.New("simulated network failure")
+	}
+	return w.BlobWriter.Close()
+}
+
+type memStore struct {
+	state *ocilarge.UploadState
+}
+
+func (s *memStore) Load() (*ocilarge.UploadState, error) {
+	return s.state, nil
+}
+
+func (s *memStore) Save(state *ocilarge.UploadState) error {
+	s.state = state
+	return nil
+}
+
+func (s *memStore) Delete() error {
+	s.state = nil
+	return nil
+}
+
+// patchCounter counts the number of bytes in PATCH requests.
+type patchCounter struct {
+	mu sync.Mutex
+	n  int64
+}
+
+func (c *patchCounter) total() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+func newUploadServer(t *testing.T, backend oci.Interface) (*httptest.Server, *patchCounter) {
+	var patched patchCounter
+	handler := ociserver.New(backend, nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "PATCH" {
+			n, _ := strconv.ParseInt(req.Header.Get("Content-Length"), 10, 64)
+			patched.mu.Lock()
+			patched.n += n
+			patched.mu.Unlock()
+		}
+		handler.ServeHTTP(w, req)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &patched
+}
+
+func newUploadClient(t *testing.T, srv *httptest.Server) oci.Interface {
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	client, err := ociclient.New(u.Host, &ociclient.Options{
+		Insecure: true,
+	})
+	require.NoError(t, err)
+	return client
+}
+
+func requireBlob(t *testing.T, r oci.Interface, data []byte) {
+	rd, err := r.GetBlob(context.Background(), "foo", digest.FromBytes(data))
+	require.NoError(t, err)
+	defer rd.Close()
+	got, err := io.ReadAll(rd)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+}
+
+// contentDesc returns a descriptor for data,
+// including its digest only if withDigest is true.
+func contentDesc(data []byte, withDigest bool) oci.Descriptor {
+	desc := oci.Descriptor{Size: int64(len(data))}
+	if withDigest {
+		desc.Digest = digest.FromBytes(data)
+	}
+	return desc
+}
+
+func randomData(n int) []byte {
+	data := make([]byte, n)
+	rand.Read(data)
+	return data
+}
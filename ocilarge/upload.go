@@ -6,6 +6,7 @@ import (
 	"io"
 
 	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/ocitrace"
 	"github.com/opencontainers/go-digest"
 )
 
@@ -23,21 +24,16 @@ func UploadLargeBlob(ctx context.Context, reg oci.Interface, repo string, f io.R
 
 	buf := make([]byte, chunkSize)
 	dgstr := digest.Canonical.Digester()
+	var offset int64
 	for {
 		n, readErr := io.ReadFull(f, buf)
 		if n > 0 {
 			dgstr.Hash().Write(buf[:n])
 
-			var writeErr error
-			for range 3 { // try writing each chunk three times
-				_, writeErr = bw.Write(buf[:n])
-				if writeErr == nil {
-					break
-				}
-			}
-			if writeErr != nil {
+			if writeErr := writeChunk(ctx, bw, buf[:n], offset); writeErr != nil {
 				return oci.Descriptor{}, fmt.Errorf("writing chunk: %w", writeErr)
 			}
+			offset += int64(n)
 		}
 		// io.ReadFull returns io.EOF when zero bytes were read (stream
 		// already at EOF) and io.ErrUnexpectedEOF when it read some bytes
@@ -52,3 +48,26 @@ func UploadLargeBlob(ctx context.Context, reg oci.Interface, repo string, f io.R
 	}
 	return bw.Commit(dgstr.Digest())
 }
+
+// writeChunk writes a single chunk starting at the given offset,
+// trying up to three times. It's reported as a span using any tracer
+// attached to the context with [ocitrace.ContextWithTracer].
+func writeChunk(ctx context.Context, bw oci.BlobWriter, chunk []byte, offset int64) (err error) {
+	_, span := ocitrace.Start(ctx, "ocilarge.WriteChunk",
+		ocitrace.Int64("oci.offset", offset),
+		ocitrace.Int(ocitrace.KeySize, len(chunk)),
+	)
+	attempts := 0
+	defer func() {
+		span.SetAttributes(ocitrace.Int("ocilarge.attempts", attempts))
+		ocitrace.End(span, err)
+	}()
+	for range 3 { // try writing each chunk three times
+		attempts++
+		_, err = bw.Write(chunk)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
@@ -63,6 +63,12 @@ type Buffer struct {
 	committed        bool
 	desc             oci.Descriptor
 	commitErr        error
+
+	// touch and cancel, if non-nil, are called without b.mu held
+	// when data is written to the buffer and when it's canceled,
+	// so that a registry can keep track of its upload sessions.
+	touch  func()
+	cancel func()
 }
 
 // NewBuffer returns a buffer that calls commit with the
@@ -82,8 +88,11 @@ func NewBuffer(commit func(b *Buffer) error, uuid string) *Buffer {
 // Cancel cancels the blob upload and frees associated resources.
 func (b *Buffer) Cancel() error {
 	b.mu.Lock()
-	defer b.mu.Unlock()
 	b.commitErr = fmt.Errorf("upload canceled")
+	b.mu.Unlock()
+	if b.cancel != nil {
+		b.cancel()
+	}
 	return nil
 }
 
@@ -120,8 +129,17 @@ func (b *Buffer) GetBlob() (oci.Descriptor, []byte, error) {
 
 // Write implements io.Writer by writing some data to the blob.
 func (b *Buffer) Write(data []byte) (int, error) {
+	if b.touch != nil {
+		// Note: this can cancel the buffer if its
+		// session has expired, so it must be called
+		// before acquiring the mutex.
+		b.touch()
+	}
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	if b.commitErr != nil {
+		return 0, b.commitErr
+	}
 	if offset := b.checkStartOffset; offset != -1 {
 		// Can't call Buffer.Size, since we are already holding the mutex.
 		if int64(len(b.buf)) != offset {
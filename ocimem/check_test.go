@@ -4,9 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/internal/ocimanifest"
 	"github.com/jcarter3/oci/ocitest"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -125,6 +129,79 @@ var pushManifestTests = []struct {
 		})
 	},
 	// Non-existent subject references are explicitly allowed.
+}, {
+	testName: "DockerManifestNonExistentLayerReference",
+	preload: ocitest.RepoContent{
+		Blobs: map[string]string{
+			"a": "{}",
+		},
+	},
+	mediaType: ocimanifest.MediaTypeDockerManifest,
+	manifestData: func(content ocitest.PushedRepoContent) []byte {
+		return mustJSONMarshal(oci.Manifest{
+			MediaType: ocimanifest.MediaTypeDockerManifest,
+			Config:    content.Blobs["a"],
+			Layers: []oci.Descriptor{{
+				MediaType: "application/vnd.docker.image.rootfs.diff.tar.gzip",
+				Size:      1,
+				Digest:    digest.FromString("b"),
+			}},
+		})
+	},
+	wantError: `invalid manifest: blob for layers\[0\] not found`,
+}, {
+	testName: "DockerManifestForeignLayer",
+	preload: ocitest.RepoContent{
+		Blobs: map[string]string{
+			"a": "{}",
+		},
+	},
+	mediaType: ocimanifest.MediaTypeDockerManifest,
+	manifestData: func(content ocitest.PushedRepoContent) []byte {
+		return mustJSONMarshal(oci.Manifest{
+			MediaType: ocimanifest.MediaTypeDockerManifest,
+			Config:    content.Blobs["a"],
+			Layers: []oci.Descriptor{{
+				MediaType: ocimanifest.MediaTypeDockerForeignLayer,
+				Size:      1,
+				Digest:    digest.FromString("b"),
+				URLs:      []string{"https://example.com/b"},
+			}},
+		})
+	},
+	// Foreign layers aren't expected to be in the registry.
+}, {
+	testName:  "DockerManifestListNonExistentManifestReference",
+	mediaType: ocimanifest.MediaTypeDockerManifestList,
+	manifestData: func(content ocitest.PushedRepoContent) []byte {
+		return mustJSONMarshal(ocispec.Index{
+			MediaType: ocimanifest.MediaTypeDockerManifestList,
+			Manifests: []oci.Descriptor{{
+				MediaType: ocimanifest.MediaTypeDockerManifest,
+				Size:      1,
+				Digest:    digest.FromString("a"),
+			}},
+		})
+	},
+	wantError: `invalid manifest: manifest for manifests\[0\] not found`,
+}, {
+	testName:  "Schema1NonExistentLayerReference",
+	mediaType: ocimanifest.MediaTypeDockerSchema1Signed,
+	manifestData: func(content ocitest.PushedRepoContent) []byte {
+		return []byte(`{"schemaVersion": 1, "fsLayers": [{"blobSum": "` + digest.FromString("a") + `"}]}`)
+	},
+	wantError: `invalid manifest: blob for fsLayers\[0\] not found`,
+}, {
+	testName: "Schema1",
+	preload: ocitest.RepoContent{
+		Blobs: map[string]string{
+			"a": "layer",
+		},
+	},
+	mediaType: ocimanifest.MediaTypeDockerSchema1,
+	manifestData: func(content ocitest.PushedRepoContent) []byte {
+		return []byte(`{"schemaVersion": 1, "fsLayers": [{"blobSum": "` + content.Blobs["a"].Digest + `"}, {"blobSum": "` + content.Blobs["a"].Digest + `"}]}`)
+	},
 }, {
 	testName: "CannotOverwriteTagWhenImmutabilityEnabled",
 	preload: ocitest.RepoContent{
@@ -615,6 +692,45 @@ func TestDeleteTag(t *testing.T) {
 	}
 }
 
+func TestDeleteBlobInDockerManifestList(t *testing.T) {
+	ctx := context.Background()
+	r := ocitest.NewRegistry(t, NewWithConfig(&Config{
+		ImmutableTags: true,
+	}))
+	content := r.MustPushContent(ocitest.RegistryContent{
+		"test": {
+			Blobs: map[string]string{
+				"a": "{}",
+				"b": "layer",
+			},
+			Manifests: map[string]oci.Manifest{
+				"m": {
+					MediaType: ocimanifest.MediaTypeDockerManifest,
+					Config: oci.Descriptor{
+						Digest: "a",
+					},
+					Layers: []oci.Descriptor{{
+						Digest: "b",
+					}},
+				},
+			},
+		},
+	})["test"]
+	_, err := r.R.PushManifest(ctx, "test", mustJSONMarshal(ocispec.Index{
+		MediaType: ocimanifest.MediaTypeDockerManifestList,
+		Manifests: []oci.Descriptor{content.Manifests["m"]},
+	}), ocimanifest.MediaTypeDockerManifestList, &oci.PushManifestParameters{
+		Tags: []string{"sometag"},
+	})
+	require.NoError(t, err)
+
+	// The layer is only referred to by way of the manifest list.
+	err = r.R.DeleteBlob(ctx, "test", content.Blobs["b"].Digest)
+	require.ErrorIs(t, err, oci.ErrDenied)
+	err = r.R.DeleteManifest(ctx, "test", content.Manifests["m"].Digest)
+	require.ErrorIs(t, err, oci.ErrDenied)
+}
+
 func mustJSONMarshal(x any) []byte {
 	data, err := json.Marshal(x)
 	if err != nil {
@@ -623,6 +739,167 @@ func mustJSONMarshal(x any) []byte {
 	return data
 }
 
+func TestPushManifestIfTagDigest(t *testing.T) {
+	ctx := context.Background()
+	r := ocitest.NewRegistry(t, New())
+	content := r.MustPushContent(ocitest.RegistryContent{
+		"test": {
+			Blobs: map[string]string{
+				"a": "{}",
+			},
+			Manifests: map[string]oci.Manifest{
+				"m0": {
+					MediaType: ocispec.MediaTypeImageManifest,
+					Config: oci.Descriptor{
+						Digest: "a",
+					},
+				},
+			},
+			Tags: map[string]string{
+				"stable": "m0",
+			},
+		},
+	})["test"]
+	m0 := content.Manifests["m0"].Digest
+	manifest := func(i int) []byte {
+		return mustJSONMarshal(oci.Manifest{
+			MediaType:   ocispec.MediaTypeImageManifest,
+			Config:      content.Blobs["a"],
+			Annotations: map[string]string{"i": fmt.Sprint(i)},
+		})
+	}
+	push := func(data []byte, tags []string, ifTagDigest oci.Digest) (oci.Descriptor, error) {
+		return r.R.PushManifest(ctx, "test", data, ocispec.MediaTypeImageManifest, &oci.PushManifestParameters{
+			Tags:        tags,
+			IfTagDigest: ifTagDigest,
+		})
+	}
+
+	_, err := push(manifest(0), []string{"other"}, m0)
+	require.ErrorIs(t, err, oci.ErrPreconditionFailed)
+	require.ErrorContains(t, err, `tag "other" does not exist`)
+	_, err = push(manifest(0), []string{"stable", "other"}, m0)
+	require.ErrorIs(t, err, oci.ErrUnsupported)
+
+	// Several pushes race to move the tag from m0;
+	// exactly one of them wins.
+	errs := make([]error, 10)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Go(func() {
+			_, errs[i] = push(manifest(i), []string{"stable"}, m0)
+		})
+	}
+	wg.Wait()
+	winner := -1
+	for i, err := range errs {
+		if err == nil {
+			require.Equal(t, -1, winner, "more than one push succeeded")
+			winner = i
+			continue
+		}
+		require.ErrorIs(t, err, oci.ErrPreconditionFailed)
+		// The losing pushes don't leave their manifests behind.
+		_, err := r.R.ResolveManifest(ctx, "test", digest.FromBytes(manifest(i)))
+		require.ErrorIs(t, err, oci.ErrManifestUnknown)
+	}
+	require.NotEqual(t, -1, winner)
+	desc, err := r.R.ResolveTag(ctx, "test", "stable")
+	require.NoError(t, err)
+	require.Equal(t, digest.FromBytes(manifest(winner)), desc.Digest)
+}
+
+func TestUploadExpiry(t *testing.T) {
+	ctx := context.Background()
+	r := NewWithConfig(&Config{
+		UploadTTL: time.Millisecond,
+	})
+	w, err := r.PushBlobChunked(ctx, "test", 0)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("hello"))
+	require.NoError(t, err)
+	time.Sleep(2 * time.Millisecond)
+
+	_, err = r.PushBlobChunkedResume(ctx, "test", w.ID(), -1, 0)
+	require.ErrorIs(t, err, oci.ErrBlobUploadUnknown)
+	// The abandoned upload can't be committed either.
+	_, err = w.Commit(digest.FromString("hello"))
+	require.ErrorContains(t, err, "upload canceled")
+
+	var ids []string
+	for range 3 {
+		w, err := r.PushBlobChunked(ctx, "test", 0)
+		require.NoError(t, err)
+		ids = append(ids, w.ID())
+	}
+	time.Sleep(2 * time.Millisecond)
+	r.PurgeUploads()
+	require.Zero(t, r.uploads.Len())
+	for _, id := range ids {
+		_, err = r.PushBlobChunkedResume(ctx, "test", id, -1, 0)
+		require.ErrorIs(t, err, oci.ErrBlobUploadUnknown)
+	}
+}
+
+func TestUploadActivity(t *testing.T) {
+	ctx := context.Background()
+	r := NewWithConfig(&Config{
+		UploadTTL: 50 * time.Millisecond,
+	})
+	w, err := r.PushBlobChunked(ctx, "test", 0)
+	require.NoError(t, err)
+	// Writes count as activity, so the upload doesn't expire
+	// even though it's never resumed.
+	for range 4 {
+		time.Sleep(20 * time.Millisecond)
+		_, err = w.Write([]byte("x"))
+		require.NoError(t, err)
+	}
+	require.Zero(t, r.PurgeUploads())
+	_, err = w.Commit(digest.FromString("xxxx"))
+	require.NoError(t, err)
+}
+
+func TestUploadRemovedOnCancel(t *testing.T) {
+	ctx := context.Background()
+	r := New()
+	w, err := r.PushBlobChunked(ctx, "test", 0)
+	require.NoError(t, err)
+	require.NoError(t, w.Cancel())
+	require.Zero(t, r.uploads.Len())
+	_, err = r.PushBlobChunkedResume(ctx, "test", w.ID(), -1, 0)
+	require.ErrorIs(t, err, oci.ErrBlobUploadUnknown)
+	_, err = w.Write([]byte("hello"))
+	require.ErrorContains(t, err, "upload canceled")
+}
+
+func TestUploadRemovedOnCommit(t *testing.T) {
+	ctx := context.Background()
+	r := New()
+	w, err := r.PushBlobChunked(ctx, "test", 0)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	// The upload can be resumed while it's in progress.
+	w1, err := r.PushBlobChunkedResume(ctx, "test", w.ID(), -1, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), w1.Size())
+
+	_, err = w.Commit(digest.FromString("hello"))
+	require.NoError(t, err)
+	_, err = r.PushBlobChunkedResume(ctx, "test", w.ID(), -1, 0)
+	require.ErrorIs(t, err, oci.ErrBlobUploadUnknown)
+	// Nor at the start, which would otherwise begin it afresh.
+	_, err = r.PushBlobChunkedResume(ctx, "test", w.ID(), 0, 0)
+	require.ErrorIs(t, err, oci.ErrBlobUploadUnknown)
+	require.Zero(t, r.PurgeUploads())
+
+	// IDs that were never issued are unknown too.
+	_, err = r.PushBlobChunkedResume(ctx, "test", "MQ", 0, 0)
+	require.ErrorIs(t, err, oci.ErrBlobUploadUnknown)
+}
+
 func TestTagsLimit(t *testing.T) {
 	ctx := context.Background()
 	r := ocitest.NewRegistry(t, New())
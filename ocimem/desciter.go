@@ -7,6 +7,7 @@ import (
 	"iter"
 
 	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/internal/ocimanifest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -16,12 +17,19 @@ const (
 	kindSubjectManifest refKind = iota
 	kindBlob
 	kindManifest
+	// kindForeignBlob is a blob that's stored outside
+	// the registry, such as a Windows base layer.
+	kindForeignBlob
 )
 
 type descInfo struct {
 	name string
 	kind refKind
 	desc oci.Descriptor
+	// unsized is set when the reference holds only a digest,
+	// as in Docker schema1 manifests, so the size and media
+	// type in desc are not meaningful.
+	unsized bool
 }
 
 type manifestInfo struct {
@@ -37,10 +45,15 @@ type manifestInfo struct {
 
 type descIter = iter.Seq[descInfo]
 
-// TODO support other manifest types.
 var manifestInfoByMediaType = map[string]func(data []byte) (manifestInfo, error){
 	ocispec.MediaTypeImageManifest: manifestInfoForType(imageInfo),
 	ocispec.MediaTypeImageIndex:    manifestInfoForType(indexInfo),
+	// The Docker schema2 formats are close enough to their OCI
+	// counterparts to share the same representation.
+	ocimanifest.MediaTypeDockerManifest:      manifestInfoForType(dockerImageInfo),
+	ocimanifest.MediaTypeDockerManifestList:  manifestInfoForType(indexInfo),
+	ocimanifest.MediaTypeDockerSchema1:       manifestInfoForType(schema1Info),
+	ocimanifest.MediaTypeDockerSchema1Signed: manifestInfoForType(schema1Info),
 }
 
 // getManifestInfo returns information on the manifest
@@ -159,3 +172,57 @@ func indexInfo(m ocispec.Index) manifestInfo {
 	}
 	return info
 }
+
+// dockerImageInfo is like imageInfo except that foreign layers,
+// which must have URLs, are not expected to be in the registry.
+func dockerImageInfo(m oci.Manifest) manifestInfo {
+	info := imageInfo(m)
+	descriptors := info.descriptors
+	info.descriptors = func(yield func(descInfo) bool) {
+		for d := range descriptors {
+			if d.kind == kindBlob && isForeignLayer(d.desc) {
+				d.kind = kindForeignBlob
+			}
+			if !yield(d) {
+				return
+			}
+		}
+	}
+	return info
+}
+
+func isForeignLayer(desc oci.Descriptor) bool {
+	switch desc.MediaType {
+	case ocimanifest.MediaTypeDockerForeignLayer, ocimanifest.MediaTypeDockerForeignLayerV2:
+		return len(desc.URLs) > 0
+	}
+	return false
+}
+
+// schema1Manifest holds the parts of a Docker schema1
+// manifest that refer to other content.
+type schema1Manifest struct {
+	FSLayers []struct {
+		BlobSum oci.Digest `json:"blobSum"`
+	} `json:"fsLayers"`
+}
+
+func schema1Info(m schema1Manifest) manifestInfo {
+	var info manifestInfo
+	info.descriptors = func(yield func(descInfo) bool) {
+		for i, layer := range m.FSLayers {
+			if !yield(descInfo{
+				name: fmt.Sprintf("fsLayers[%d]", i),
+				kind: kindBlob,
+				desc: oci.Descriptor{
+					MediaType: "application/octet-stream",
+					Digest:    layer.BlobSum,
+				},
+				unsized: true,
+			}) {
+				return
+			}
+		}
+	}
+	return info
+}
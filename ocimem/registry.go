@@ -19,9 +19,11 @@ package ocimem
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/jcarter3/oci"
 	"github.com/jcarter3/oci/ociref"
+	"github.com/jcarter3/oci/ociupload"
 	"github.com/opencontainers/go-digest"
 )
 
@@ -30,16 +32,22 @@ var _ oci.Interface = (*Registry)(nil)
 // Registry is an in-memory implementation of [oci.Interface].
 type Registry struct {
 	*oci.Funcs
-	cfg   Config
-	mu    sync.Mutex
-	repos map[string]*repository
+	cfg     Config
+	mu      sync.Mutex
+	repos   map[string]*repository
+	uploads *ociupload.Sessions[uploadKey, *Buffer]
 }
 
 type repository struct {
 	tags      map[string]oci.Descriptor
 	manifests map[oci.Digest]*blob
 	blobs     map[oci.Digest]*blob
-	uploads   map[string]*Buffer
+}
+
+// uploadKey identifies a chunked upload in progress.
+type uploadKey struct {
+	repo string
+	id   string
 }
 
 type blob struct {
@@ -74,8 +82,18 @@ func NewWithConfig(cfg0 *Config) *Registry {
 	if cfg0 != nil {
 		cfg = *cfg0
 	}
+	ttl := cfg.UploadTTL
+	if ttl <= 0 {
+		ttl = -1
+	}
 	return &Registry{
 		cfg: cfg,
+		uploads: ociupload.New[uploadKey](&ociupload.Options[*Buffer]{
+			TTL: ttl,
+			OnExpire: func(b *Buffer) {
+				b.Cancel()
+			},
+		}),
 	}
 }
 
@@ -97,6 +115,21 @@ type Config struct {
 	// subject references, because the spec defines those to be always
 	// lax.
 	LaxChildReferences bool
+
+	// UploadTTL holds how long a chunked upload can go without
+	// activity before it's discarded. If it's zero or negative,
+	// uploads are kept until they're committed or canceled.
+	// Long-running registries will usually want to set it,
+	// for example to [ociupload.DefaultTTL].
+	UploadTTL time.Duration
+}
+
+// PurgeUploads discards any chunked uploads that have expired
+// and returns the number discarded. Expired uploads are also
+// discarded from time to time as new uploads are started, so
+// it's only necessary to call this to release memory promptly.
+func (r *Registry) PurgeUploads() int {
+	return r.uploads.Purge()
 }
 
 func (r *Registry) repo(repoName string) (*repository, error) {
@@ -144,7 +177,6 @@ func (r *Registry) makeRepo(repoName string) (*repository, error) {
 		tags:      make(map[string]oci.Descriptor),
 		manifests: make(map[digest.Digest]*blob),
 		blobs:     make(map[digest.Digest]*blob),
-		uploads:   make(map[string]*Buffer),
 	}
 	r.repos[repoName] = repo
 	return repo, nil
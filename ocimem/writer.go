@@ -49,16 +49,13 @@ func (r *Registry) PushBlob(ctx context.Context, repoName string, desc oci.Descr
 
 // PushBlobChunked starts a chunked blob upload to the named repository.
 func (r *Registry) PushBlobChunked(ctx context.Context, repoName string, chunkSize int) (oci.BlobWriter, error) {
-	// TODO(mvdan): Why does the ocimem implementation allow a PATCH on an upload ID which doesn't exist?
-	// The tests in ociserver make this assumption, so they break without this bit of code.
-	//
-	// Ideally they should start a new chunked upload to get a new ID, then use that for PATCH/PUT.
-	// Alternatively, add a new method to ocimem outside of the interface to start a chunked upload with a predefined ID.
-	// Either way, this case should be an error, per the spec.
 	return r.PushBlobChunkedResume(ctx, repoName, "", 0, chunkSize)
 }
 
 // PushBlobChunkedResume resumes a previously started chunked blob upload.
+// It fails with [oci.ErrBlobUploadUnknown] if the upload wasn't
+// started by r, has expired (see [Config.UploadTTL]) or has
+// been committed.
 func (r *Registry) PushBlobChunkedResume(ctx context.Context, repoName, id string, offset int64, chunkSize int) (oci.BlobWriter, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -66,16 +63,29 @@ func (r *Registry) PushBlobChunkedResume(ctx context.Context, repoName, id strin
 	if err != nil {
 		return nil, err
 	}
-	b := repo.uploads[id]
-	if b == nil {
+	b, ok := r.uploads.Get(uploadKey{repoName, id})
+	if !ok {
+		if id != "" {
+			// Only IDs of uploads that are still in progress
+			// are known: any other ID is an error, per the spec.
+			return nil, fmt.Errorf("upload %q in %q: %w", id, repoName, oci.ErrBlobUploadUnknown)
+		}
 		b = NewBuffer(func(b *Buffer) error {
 			r.mu.Lock()
 			defer r.mu.Unlock()
 			desc, data, _ := b.GetBlob()
 			repo.blobs[desc.Digest] = &blob{mediaType: desc.MediaType, data: data}
+			r.uploads.Remove(uploadKey{repoName, b.ID()})
 			return nil
 		}, id)
-		repo.uploads[b.ID()] = b
+		key := uploadKey{repoName, b.ID()}
+		b.touch = func() {
+			r.uploads.Get(key)
+		}
+		b.cancel = func() {
+			r.uploads.Remove(key)
+		}
+		r.uploads.Add(key, b)
 	}
 	b.checkStartOffset = offset
 	return b, nil
@@ -133,6 +143,20 @@ func (r *Registry) PushManifest(ctx context.Context, repoName string, data []byt
 	if params != nil {
 		tags = params.Tags
 	}
+	if params != nil && params.IfTagDigest != "" {
+		// We hold the lock, so nothing can change the
+		// tag between this check and the update below.
+		if len(tags) != 1 {
+			return oci.Descriptor{}, fmt.Errorf("%w: IfTagDigest requires exactly one tag", oci.ErrUnsupported)
+		}
+		currDesc, ok := repo.tags[tags[0]]
+		if !ok {
+			return oci.Descriptor{}, fmt.Errorf("%w: tag %q does not exist", oci.ErrPreconditionFailed, tags[0])
+		}
+		if currDesc.Digest != params.IfTagDigest {
+			return oci.Descriptor{}, fmt.Errorf("%w: tag %q refers to %s", oci.ErrPreconditionFailed, tags[0], currDesc.Digest)
+		}
+	}
 	for _, tag := range tags {
 		if !ociref.IsValidTag(tag) {
 			return oci.Descriptor{}, fmt.Errorf("invalid tag")
@@ -196,7 +220,11 @@ func (r *Registry) checkManifestReferences(repoName string, mediaType string, da
 		return manifestInfo{}, err
 	}
 	for info := range info.descriptors {
-		if err := CheckDescriptor(info.desc, nil); err != nil {
+		if info.unsized {
+			if err := info.desc.Digest.Validate(); err != nil {
+				return manifestInfo{}, fmt.Errorf("bad digest in %s: %v", info.name, err)
+			}
+		} else if err := CheckDescriptor(info.desc, nil); err != nil {
 			return manifestInfo{}, fmt.Errorf("bad descriptor in %s: %v", info.name, err)
 		}
 		switch info.kind {
@@ -211,6 +239,9 @@ func (r *Registry) checkManifestReferences(repoName string, mediaType string, da
 		case kindSubjectManifest:
 			// The standard explicitly specifies that we can have
 			// a dangling subject so don't check that it exists.
+		case kindForeignBlob:
+			// Foreign layers are fetched from their URLs,
+			// so they're not expected to be here.
 		}
 	}
 	return info, nil
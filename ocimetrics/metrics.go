@@ -0,0 +1,262 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ocimetrics provides an OCI registry wrapper that
+// collects metrics on registry operations, and exposes
+// them in the Prometheus text exposition format.
+//
+// It has no dependencies outside the standard library: a [Metrics]
+// value is itself an [http.Handler] that can be registered
+// at a scrape endpoint such as /metrics.
+package ocimetrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets holds the default latency histogram buckets, in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics holds a set of metrics on registry operations. It's
+// safe to use concurrently. The same Metrics value can be shared
+// between several wrappers and servers, in which case their
+// metrics are aggregated.
+//
+// The following metrics are provided:
+//
+//	oci_calls_total{method}                   counter
+//	oci_errors_total{method,code}             counter
+//	oci_call_duration_seconds{method}         histogram
+//	oci_blob_bytes_total{method,direction}    counter
+//	ociserver_requests_total{kind,status}     counter
+//	ociserver_request_duration_seconds{kind}  histogram
+//
+// The method label holds the [oci.Interface] method name (or
+// "BlobWriter.Commit" for blob writer commits), the code label holds
+// the [oci.Error] code of a failed call, or "UNKNOWN" when there is
+// none, and direction is either "read" or "write".
+// The kind label holds the kind of an HTTP request to the server,
+// such as "ManifestGet".
+type Metrics struct {
+	calls       *family
+	errors      *family
+	latency     *family
+	bytes       *family
+	httpReqs    *family
+	httpLatency *family
+}
+
+// NewMetrics returns a new empty set of metrics.
+// If buckets is nil, [DefaultBuckets] will be used
+// for the latency histograms.
+func NewMetrics(buckets []float64) *Metrics {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = slices.Clone(buckets)
+	slices.Sort(buckets)
+	return &Metrics{
+		calls:       newFamily("oci_calls_total", "Number of registry operations.", "counter", nil, "method"),
+		errors:      newFamily("oci_errors_total", "Number of failed registry operations by error code.", "counter", nil, "method", "code"),
+		latency:     newFamily("oci_call_duration_seconds", "Latency of registry operations.", "histogram", buckets, "method"),
+		bytes:       newFamily("oci_blob_bytes_total", "Number of blob bytes transferred.", "counter", nil, "method", "direction"),
+		httpReqs:    newFamily("ociserver_requests_total", "Number of HTTP requests served.", "counter", nil, "kind", "status"),
+		httpLatency: newFamily("ociserver_request_duration_seconds", "Latency of HTTP requests served.", "histogram", buckets, "kind"),
+	}
+}
+
+// ObserveHTTPRequest records an HTTP request of the given kind
+// that completed with the given status after duration d.
+// It's used by [github.com/jcarter3/oci/ociserver].
+func (m *Metrics) ObserveHTTPRequest(kind string, status int, d time.Duration) {
+	m.httpReqs.add(1, kind, strconv.Itoa(status))
+	m.httpLatency.observe(d.Seconds(), kind)
+}
+
+// ServeHTTP implements [http.Handler] by writing all
+// the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes all the metrics to w in the Prometheus
+// text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, f := range []*family{m.calls, m.errors, m.latency, m.bytes, m.httpReqs, m.httpLatency} {
+		f.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// family holds all the series for a single metric name.
+type family struct {
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	// value holds the value of a counter.
+	value float64
+	// For histograms, counts holds the (non-cumulative)
+	// count for each bucket, with the final entry holding
+	// the count of values greater than all bucket bounds.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newFamily(name, help, typ string, buckets []float64, labelNames ...string) *family {
+	return &family{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     make(map[string]*series),
+	}
+}
+
+// get returns the series for the given label values.
+// It must be called with f.mu held.
+func (f *family) get(labelValues []string) *series {
+	key := strings.Join(labelValues, "\x00")
+	s := f.series[key]
+	if s == nil {
+		s = &series{
+			labelValues: slices.Clone(labelValues),
+		}
+		if f.buckets != nil {
+			s.counts = make([]uint64, len(f.buckets)+1)
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (f *family) add(v float64, labelValues ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.get(labelValues).value += v
+}
+
+func (f *family) observe(v float64, labelValues ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := f.get(labelValues)
+	i, _ := slices.BinarySearch(f.buckets, v)
+	s.counts[i]++
+	s.sum += v
+	s.count++
+}
+
+func (f *family) write(w *bufio.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.series) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		s := f.series[k]
+		labels := f.labels(s.labelValues)
+		if f.buckets == nil {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, labels, formatFloat(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range f.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, f.labels(s.labelValues, "le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, f.labels(s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, labels, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, labels, s.count)
+	}
+}
+
+// labels formats the label set for the given values, with
+// any extra name-value pairs appended.
+func (f *family) labels(values []string, extra ...string) string {
+	if len(values) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var buf strings.Builder
+	buf.WriteByte('{')
+	add := func(name, value string) {
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(name)
+		buf.WriteString(`="`)
+		buf.WriteString(labelValueReplacer.Replace(value))
+		buf.WriteByte('"')
+	}
+	for i, v := range values {
+		add(f.labelNames[i], v)
+	}
+	for i := 0; i < len(extra); i += 2 {
+		add(extra[i], extra[i+1])
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(buf []byte) (int, error) {
+	n, err := w.w.Write(buf)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,122 @@
+package ocimetrics_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/ocimem"
+	"github.com/jcarter3/oci/ocimetrics"
+	"github.com/jcarter3/oci/ociserver"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrapper(t *testing.T) {
+	ctx := context.Background()
+	m := ocimetrics.NewMetrics([]float64{1, 10})
+	r := ocimetrics.New(ocimem.New(), m)
+
+	content := "hello"
+	dg := digest.FromString(content)
+	_, err := r.PushBlob(ctx, "foo", oci.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    dg,
+		Size:      int64(len(content)),
+	}, strings.NewReader(content))
+	require.NoError(t, err)
+
+	rd, err := r.GetBlob(ctx, "foo", dg)
+	require.NoError(t, err)
+	_, err = io.ReadAll(rd)
+	require.NoError(t, err)
+	rd.Close()
+
+	w, err := r.PushBlobChunked(ctx, "foo", 0)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("abc"))
+	require.NoError(t, err)
+	_, err = w.Commit(digest.FromString("abc"))
+	require.NoError(t, err)
+
+	_, err = r.GetBlob(ctx, "foo", digest.FromString("nope"))
+	require.Error(t, err)
+	_, err = oci.All(r.Tags(ctx, "bar", nil))
+	require.Error(t, err)
+
+	out := metricsText(t, m)
+	for _, want := range []string{
+		`oci_calls_total{method="GetBlob"} 2`,
+		`oci_calls_total{method="PushBlob"} 1`,
+		`oci_calls_total{method="BlobWriter.Commit"} 1`,
+		`oci_calls_total{method="Tags"} 1`,
+		`oci_errors_total{method="GetBlob",code="BLOB_UNKNOWN"} 1`,
+		`oci_errors_total{method="Tags",code="NAME_UNKNOWN"} 1`,
+		`oci_blob_bytes_total{method="GetBlob",direction="read"} 5`,
+		`oci_blob_bytes_total{method="PushBlob",direction="write"} 5`,
+		`oci_blob_bytes_total{method="PushBlobChunked",direction="write"} 3`,
+		`oci_call_duration_seconds_bucket{method="GetBlob",le="1"} 2`,
+		`oci_call_duration_seconds_bucket{method="GetBlob",le="+Inf"} 2`,
+		`oci_call_duration_seconds_count{method="GetBlob"} 2`,
+		"# TYPE oci_call_duration_seconds histogram\n",
+	} {
+		require.Contains(t, out, want)
+	}
+	require.NotContains(t, out, "ociserver_requests_total")
+}
+
+func TestServerMetrics(t *testing.T) {
+	m := ocimetrics.NewMetrics(nil)
+	srv := httptest.NewServer(ociserver.New(ocimem.New(), &ociserver.Options{
+		Metrics: m,
+	}))
+	defer srv.Close()
+
+	for _, path := range []string{
+		"/v2/",
+		"/v2/foo/manifests/latest",
+		"/v2/foo/manifests/latest",
+		"/bad",
+	} {
+		resp, err := http.Get(srv.URL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	out := metricsText(t, m)
+	for _, want := range []string{
+		`ociserver_requests_total{kind="Ping",status="200"} 1`,
+		`ociserver_requests_total{kind="ManifestGet",status="404"} 2`,
+		`ociserver_requests_total{kind="Unknown",status="404"} 1`,
+		`ociserver_request_duration_seconds_count{kind="ManifestGet"} 2`,
+	} {
+		require.Contains(t, out, want)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	m := ocimetrics.NewMetrics(nil)
+	m.ObserveHTTPRequest("with\"quote", 200, 0)
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, "text/plain; version=0.0.4; charset=utf-8", resp.Header.Get("Content-Type"))
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(data), `ociserver_requests_total{kind="with\"quote",status="200"} 1`)
+}
+
+func metricsText(t *testing.T, m *ocimetrics.Metrics) string {
+	var buf bytes.Buffer
+	_, err := m.WriteTo(&buf)
+	require.NoError(t, err)
+	t.Logf("metrics:\n%s", buf.String())
+	return buf.String()
+}
@@ -0,0 +1,275 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocimetrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"iter"
+	"time"
+
+	"github.com/jcarter3/oci"
+)
+
+// New returns a new [oci.Interface] that wraps r and records
+// metrics for all operations in m.
+func New(r oci.Interface, m *Metrics) oci.Interface {
+	return &metrics{
+		r: r,
+		m: m,
+	}
+}
+
+type metrics struct {
+	r oci.Interface
+	m *Metrics
+	*oci.Funcs
+}
+
+// start records the start of a call to the given method
+// and returns a function that records its completion.
+func (r *metrics) start(method string) func(err error) {
+	start := time.Now()
+	return func(err error) {
+		r.m.calls.add(1, method)
+		r.m.latency.observe(time.Since(start).Seconds(), method)
+		if err != nil {
+			r.m.errors.add(1, method, errorCode(err))
+		}
+	}
+}
+
+func (r *metrics) DeleteBlob(ctx context.Context, repoName string, digest oci.Digest) error {
+	done := r.start("DeleteBlob")
+	err := r.r.DeleteBlob(ctx, repoName, digest)
+	done(err)
+	return err
+}
+
+func (r *metrics) DeleteManifest(ctx context.Context, repoName string, digest oci.Digest) error {
+	done := r.start("DeleteManifest")
+	err := r.r.DeleteManifest(ctx, repoName, digest)
+	done(err)
+	return err
+}
+
+func (r *metrics) DeleteTag(ctx context.Context, repoName string, tagName string) error {
+	done := r.start("DeleteTag")
+	err := r.r.DeleteTag(ctx, repoName, tagName)
+	done(err)
+	return err
+}
+
+func (r *metrics) GetBlob(ctx context.Context, repoName string, dig oci.Digest) (oci.BlobReader, error) {
+	done := r.start("GetBlob")
+	rd, err := r.r.GetBlob(ctx, repoName, dig)
+	done(err)
+	return r.blobReader(rd, "GetBlob"), err
+}
+
+func (r *metrics) GetBlobRange(ctx context.Context, repoName string, dig oci.Digest, o0, o1 int64) (oci.BlobReader, error) {
+	done := r.start("GetBlobRange")
+	rd, err := r.r.GetBlobRange(ctx, repoName, dig, o0, o1)
+	done(err)
+	return r.blobReader(rd, "GetBlobRange"), err
+}
+
+func (r *metrics) GetManifest(ctx context.Context, repoName string, dig oci.Digest) (oci.BlobReader, error) {
+	done := r.start("GetManifest")
+	rd, err := r.r.GetManifest(ctx, repoName, dig)
+	done(err)
+	return r.blobReader(rd, "GetManifest"), err
+}
+
+func (r *metrics) GetTag(ctx context.Context, repoName string, tagName string) (oci.BlobReader, error) {
+	done := r.start("GetTag")
+	rd, err := r.r.GetTag(ctx, repoName, tagName)
+	done(err)
+	return r.blobReader(rd, "GetTag"), err
+}
+
+func (r *metrics) MountBlob(ctx context.Context, fromRepo, toRepo string, dig oci.Digest) (oci.Descriptor, error) {
+	done := r.start("MountBlob")
+	desc, err := r.r.MountBlob(ctx, fromRepo, toRepo, dig)
+	done(err)
+	return desc, err
+}
+
+func (r *metrics) PushBlob(ctx context.Context, repoName string, desc oci.Descriptor, content io.Reader) (oci.Descriptor, error) {
+	done := r.start("PushBlob")
+	desc, err := r.r.PushBlob(ctx, repoName, desc, &countingReader{
+		r:     content,
+		count: r.byteCounter("PushBlob", "write"),
+	})
+	done(err)
+	return desc, err
+}
+
+func (r *metrics) PushBlobChunked(ctx context.Context, repoName string, chunkSize int) (oci.BlobWriter, error) {
+	done := r.start("PushBlobChunked")
+	w, err := r.r.PushBlobChunked(ctx, repoName, chunkSize)
+	done(err)
+	return r.blobWriter(w, "PushBlobChunked"), err
+}
+
+func (r *metrics) PushBlobChunkedResume(ctx context.Context, repoName, id string, offset int64, chunkSize int) (oci.BlobWriter, error) {
+	done := r.start("PushBlobChunkedResume")
+	w, err := r.r.PushBlobChunkedResume(ctx, repoName, id, offset, chunkSize)
+	done(err)
+	return r.blobWriter(w, "PushBlobChunkedResume"), err
+}
+
+func (r *metrics) PushManifest(ctx context.Context, repoName string, data []byte, mediaType string, params *oci.PushManifestParameters) (oci.Descriptor, error) {
+	done := r.start("PushManifest")
+	desc, err := r.r.PushManifest(ctx, repoName, data, mediaType, params)
+	done(err)
+	return desc, err
+}
+
+func (r *metrics) Referrers(ctx context.Context, repoName string, digest oci.Digest, params *oci.ReferrersParameters) iter.Seq2[oci.Descriptor, error] {
+	return metricsIter(r, "Referrers", r.r.Referrers(ctx, repoName, digest, params))
+}
+
+func (r *metrics) Repositories(ctx context.Context, startAfter string) iter.Seq2[string, error] {
+	return metricsIter(r, "Repositories", r.r.Repositories(ctx, startAfter))
+}
+
+func (r *metrics) Tags(ctx context.Context, repoName string, params *oci.TagsParameters) iter.Seq2[string, error] {
+	return metricsIter(r, "Tags", r.r.Tags(ctx, repoName, params))
+}
+
+func (r *metrics) ResolveBlob(ctx context.Context, repoName string, digest oci.Digest) (oci.Descriptor, error) {
+	done := r.start("ResolveBlob")
+	desc, err := r.r.ResolveBlob(ctx, repoName, digest)
+	done(err)
+	return desc, err
+}
+
+func (r *metrics) ResolveManifest(ctx context.Context, repoName string, digest oci.Digest) (oci.Descriptor, error) {
+	done := r.start("ResolveManifest")
+	desc, err := r.r.ResolveManifest(ctx, repoName, digest)
+	done(err)
+	return desc, err
+}
+
+func (r *metrics) ResolveTag(ctx context.Context, repoName string, tagName string) (oci.Descriptor, error) {
+	done := r.start("ResolveTag")
+	desc, err := r.r.ResolveTag(ctx, repoName, tagName)
+	done(err)
+	return desc, err
+}
+
+// byteCounter returns a function that adds to the byte
+// count for the given method and direction.
+func (r *metrics) byteCounter(method, direction string) func(n int) {
+	return func(n int) {
+		if n > 0 {
+			r.m.bytes.add(float64(n), method, direction)
+		}
+	}
+}
+
+func (r *metrics) blobReader(rd oci.BlobReader, method string) oci.BlobReader {
+	if rd == nil {
+		return nil
+	}
+	return blobReader{
+		BlobReader: rd,
+		count:      r.byteCounter(method, "read"),
+	}
+}
+
+func (r *metrics) blobWriter(w oci.BlobWriter, method string) oci.BlobWriter {
+	if w == nil {
+		return nil
+	}
+	return blobWriter{
+		BlobWriter: w,
+		r:          r,
+		count:      r.byteCounter(method, "write"),
+	}
+}
+
+type blobReader struct {
+	oci.BlobReader
+	count func(n int)
+}
+
+func (rd blobReader) Read(buf []byte) (int, error) {
+	n, err := rd.BlobReader.Read(buf)
+	rd.count(n)
+	return n, err
+}
+
+type blobWriter struct {
+	oci.BlobWriter
+	r     *metrics
+	count func(n int)
+}
+
+func (w blobWriter) Write(buf []byte) (int, error) {
+	n, err := w.BlobWriter.Write(buf)
+	w.count(n)
+	return n, err
+}
+
+func (w blobWriter) Commit(digest oci.Digest) (oci.Descriptor, error) {
+	done := w.r.start("BlobWriter.Commit")
+	desc, err := w.BlobWriter.Commit(digest)
+	done(err)
+	return desc, err
+}
+
+type countingReader struct {
+	r     io.Reader
+	count func(n int)
+}
+
+func (r *countingReader) Read(buf []byte) (int, error) {
+	n, err := r.r.Read(buf)
+	r.count(n)
+	return n, err
+}
+
+func metricsIter[T any](r *metrics, method string, it iter.Seq2[T, error]) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		done := r.start(method)
+		var _err error
+		defer func() {
+			done(_err)
+		}()
+		for item, err := range it {
+			if err != nil {
+				_err = err
+				yield(*new(T), err)
+				return
+			}
+			if !yield(item, nil) {
+				return
+			}
+		}
+	}
+}
+
+// errorCode returns the OCI error code for err,
+// or "UNKNOWN" if there is none.
+func errorCode(err error) string {
+	var ociErr oci.Error
+	if errors.As(err, &ociErr) && ociErr.Code() != "" {
+		return ociErr.Code()
+	}
+	return "UNKNOWN"
+}
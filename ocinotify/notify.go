@@ -0,0 +1,295 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ocinotify provides an OCI registry wrapper that sends
+// notification events after content in the registry has changed.
+//
+// Events are delivered to a [Sink]. This package provides sinks
+// that send events to an in-process channel ([Channel]), append
+// them to a JSON-lines file ([JSONLines]) and POST them to a
+// webhook in the docker distribution notification format ([Webhook]).
+package ocinotify
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"time"
+
+	"github.com/jcarter3/oci"
+)
+
+// Action describes what happened to the target of an event.
+type Action string
+
+const (
+	ActionPush   Action = "push"
+	ActionMount  Action = "mount"
+	ActionDelete Action = "delete"
+)
+
+// Kind describes the kind of thing that an event refers to.
+type Kind string
+
+const (
+	KindBlob     Kind = "blob"
+	KindManifest Kind = "manifest"
+	KindTag      Kind = "tag"
+)
+
+// Event describes a single change to a registry.
+type Event struct {
+	// ID uniquely identifies the event.
+	ID string `json:"id"`
+
+	// Time holds when the change was made.
+	Time time.Time `json:"timestamp"`
+
+	Action Action `json:"action"`
+	Kind   Kind   `json:"kind"`
+
+	// Repo holds the repository that was changed.
+	Repo string `json:"repository"`
+
+	// FromRepo holds the source repository of a mounted blob.
+	FromRepo string `json:"fromRepository,omitempty"`
+
+	// Digest holds the digest of the blob or manifest.
+	// For a deleted tag, it holds the digest that the tag
+	// referred to, if that could be determined.
+	Digest oci.Digest `json:"digest,omitempty"`
+
+	MediaType string `json:"mediaType,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+
+	// Tags holds the tags pushed with a manifest,
+	// or the name of a deleted tag.
+	Tags []string `json:"tags,omitempty"`
+
+	// Actor holds the actor responsible for the change.
+	// See [ContextWithActor].
+	Actor string `json:"actor,omitempty"`
+}
+
+// Sink receives events from the registry wrapper.
+//
+// Send is called synchronously after each change has been
+// made, so implementations should not block for long.
+// It may be called concurrently.
+type Sink interface {
+	Send(e Event)
+}
+
+// Options holds options for [New].
+type Options struct {
+	// Actor is used to determine the actor responsible
+	// for a change. By default [ActorFromContext] is used.
+	Actor func(ctx context.Context) string
+
+	// Now returns the current time. By default [time.Now] is used.
+	Now func() time.Time
+}
+
+type actorKey struct{}
+
+// ContextWithActor returns ctx annotated with the given actor,
+// typically the name of an authenticated user, which
+// will be recorded in any events caused by operations
+// using the context.
+func ContextWithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns any actor associated with the context
+// by [ContextWithActor].
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// New returns a new [oci.Interface] that wraps r and sends an
+// event to sink after each successful change to the registry:
+// pushing a manifest or blob (including committing a chunked
+// upload), mounting a blob, and deleting a blob, manifest or tag.
+//
+// No events are sent for failed operations.
+func New(r oci.Interface, sink Sink, opts *Options) oci.Interface {
+	var opts1 Options
+	if opts != nil {
+		opts1 = *opts
+	}
+	if opts1.Actor == nil {
+		opts1.Actor = ActorFromContext
+	}
+	if opts1.Now == nil {
+		opts1.Now = time.Now
+	}
+	return &notifier{
+		Interface: r,
+		sink:      sink,
+		opts:      opts1,
+	}
+}
+
+type notifier struct {
+	oci.Interface
+	sink Sink
+	opts Options
+}
+
+// send fills in the common fields of e and sends it to the sink.
+func (r *notifier) send(ctx context.Context, e Event) {
+	e.ID = newID()
+	e.Time = r.opts.Now()
+	e.Actor = r.opts.Actor(ctx)
+	r.sink.Send(e)
+}
+
+func (r *notifier) PushBlob(ctx context.Context, repoName string, desc oci.Descriptor, content io.Reader) (oci.Descriptor, error) {
+	desc, err := r.Interface.PushBlob(ctx, repoName, desc, content)
+	if err == nil {
+		r.send(ctx, blobEvent(ActionPush, repoName, desc))
+	}
+	return desc, err
+}
+
+func (r *notifier) PushBlobChunked(ctx context.Context, repoName string, chunkSize int) (oci.BlobWriter, error) {
+	w, err := r.Interface.PushBlobChunked(ctx, repoName, chunkSize)
+	return r.blobWriter(ctx, repoName, w), err
+}
+
+func (r *notifier) PushBlobChunkedResume(ctx context.Context, repoName, id string, offset int64, chunkSize int) (oci.BlobWriter, error) {
+	w, err := r.Interface.PushBlobChunkedResume(ctx, repoName, id, offset, chunkSize)
+	return r.blobWriter(ctx, repoName, w), err
+}
+
+func (r *notifier) MountBlob(ctx context.Context, fromRepo, toRepo string, dig oci.Digest) (oci.Descriptor, error) {
+	desc, err := r.Interface.MountBlob(ctx, fromRepo, toRepo, dig)
+	if err == nil {
+		e := blobEvent(ActionMount, toRepo, desc)
+		e.FromRepo = fromRepo
+		r.send(ctx, e)
+	}
+	return desc, err
+}
+
+func (r *notifier) PushManifest(ctx context.Context, repoName string, contents []byte, mediaType string, params *oci.PushManifestParameters) (oci.Descriptor, error) {
+	desc, err := r.Interface.PushManifest(ctx, repoName, contents, mediaType, params)
+	if err == nil {
+		e := Event{
+			Action:    ActionPush,
+			Kind:      KindManifest,
+			Repo:      repoName,
+			Digest:    desc.Digest,
+			MediaType: desc.MediaType,
+			Size:      desc.Size,
+		}
+		if params != nil && len(params.Tags) > 0 {
+			e.Tags = append([]string(nil), params.Tags...)
+		}
+		r.send(ctx, e)
+	}
+	return desc, err
+}
+
+func (r *notifier) DeleteBlob(ctx context.Context, repoName string, digest oci.Digest) error {
+	err := r.Interface.DeleteBlob(ctx, repoName, digest)
+	if err == nil {
+		r.send(ctx, Event{
+			Action: ActionDelete,
+			Kind:   KindBlob,
+			Repo:   repoName,
+			Digest: digest,
+		})
+	}
+	return err
+}
+
+func (r *notifier) DeleteManifest(ctx context.Context, repoName string, digest oci.Digest) error {
+	err := r.Interface.DeleteManifest(ctx, repoName, digest)
+	if err == nil {
+		r.send(ctx, Event{
+			Action: ActionDelete,
+			Kind:   KindManifest,
+			Repo:   repoName,
+			Digest: digest,
+		})
+	}
+	return err
+}
+
+// DeleteTag implements [oci.Interface.DeleteTag]. It resolves the
+// tag before deleting it so that the event can say which
+// manifest the tag referred to.
+func (r *notifier) DeleteTag(ctx context.Context, repoName string, tagName string) error {
+	desc, _ := r.Interface.ResolveTag(ctx, repoName, tagName)
+	err := r.Interface.DeleteTag(ctx, repoName, tagName)
+	if err == nil {
+		r.send(ctx, Event{
+			Action:    ActionDelete,
+			Kind:      KindTag,
+			Repo:      repoName,
+			Digest:    desc.Digest,
+			MediaType: desc.MediaType,
+			Size:      desc.Size,
+			Tags:      []string{tagName},
+		})
+	}
+	return err
+}
+
+func (r *notifier) blobWriter(ctx context.Context, repoName string, w oci.BlobWriter) oci.BlobWriter {
+	if w == nil {
+		return nil
+	}
+	return &blobWriter{
+		BlobWriter: w,
+		r:          r,
+		ctx:        ctx,
+		repo:       repoName,
+	}
+}
+
+type blobWriter struct {
+	oci.BlobWriter
+	r    *notifier
+	ctx  context.Context
+	repo string
+}
+
+func (w *blobWriter) Commit(digest oci.Digest) (oci.Descriptor, error) {
+	desc, err := w.BlobWriter.Commit(digest)
+	if err == nil {
+		w.r.send(w.ctx, blobEvent(ActionPush, w.repo, desc))
+	}
+	return desc, err
+}
+
+func blobEvent(action Action, repo string, desc oci.Descriptor) Event {
+	return Event{
+		Action:    action,
+		Kind:      KindBlob,
+		Repo:      repo,
+		Digest:    desc.Digest,
+		MediaType: desc.MediaType,
+		Size:      desc.Size,
+	}
+}
+
+func newID() string {
+	var buf [16]byte
+	rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
@@ -0,0 +1,319 @@
+package ocinotify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/ocimem"
+	"github.com/jcarter3/oci/ocitest"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+var epoch = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestEvents(t *testing.T) {
+	c := make(chan Event, 100)
+	r := New(ocimem.New(), NewChannel(c), &Options{
+		Now: func() time.Time { return epoch },
+	})
+	ctx := ContextWithActor(context.Background(), "alice")
+
+	// Make the content in a separate registry so that it can be
+	// pushed with the actor in the context.
+	content, err := ocitest.PushRepoContent(ocimem.New(), "foo", ocitest.RepoContent{
+		Blobs: map[string]string{
+			"config": "{}",
+		},
+		Manifests: map[string]oci.Manifest{
+			"m": {
+				MediaType: ocispec.MediaTypeImageManifest,
+				Config:    oci.Descriptor{Digest: "config"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	config := content.Blobs["config"]
+	manifest := content.ManifestData["m"]
+	_, err = r.PushBlob(ctx, "foo", config, strings.NewReader("{}"))
+	require.NoError(t, err)
+	mdesc, err := r.PushManifest(ctx, "foo", manifest, ocispec.MediaTypeImageManifest, &oci.PushManifestParameters{
+		Tags: []string{"v1", "latest"},
+	})
+	require.NoError(t, err)
+
+	w, err := r.PushBlobChunked(ctx, "foo", 0)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("chunked"))
+	require.NoError(t, err)
+	_, err = w.Commit(digest.FromString("chunked"))
+	require.NoError(t, err)
+
+	_, err = r.MountBlob(ctx, "foo", "bar", config.Digest)
+	require.NoError(t, err)
+	require.NoError(t, r.DeleteTag(ctx, "foo", "latest"))
+	require.NoError(t, r.DeleteManifest(ctx, "foo", mdesc.Digest))
+
+	// Failed operations don't send events.
+	require.Error(t, r.DeleteTag(ctx, "foo", "nope"))
+
+	close(c)
+	var events []Event
+	for e := range c {
+		require.NotEmpty(t, e.ID)
+		require.Equal(t, epoch, e.Time)
+		require.Equal(t, "alice", e.Actor)
+		e.ID, e.Time, e.Actor = "", time.Time{}, ""
+		events = append(events, e)
+	}
+	require.Equal(t, []Event{{
+		Action:    ActionPush,
+		Kind:      KindBlob,
+		Repo:      "foo",
+		Digest:    config.Digest,
+		MediaType: config.MediaType,
+		Size:      2,
+	}, {
+		Action:    ActionPush,
+		Kind:      KindManifest,
+		Repo:      "foo",
+		Digest:    mdesc.Digest,
+		MediaType: ocispec.MediaTypeImageManifest,
+		Size:      int64(len(manifest)),
+		Tags:      []string{"v1", "latest"},
+	}, {
+		Action:    ActionPush,
+		Kind:      KindBlob,
+		Repo:      "foo",
+		Digest:    digest.FromString("chunked"),
+		MediaType: "application/octet-stream",
+		Size:      7,
+	}, {
+		Action:    ActionMount,
+		Kind:      KindBlob,
+		Repo:      "bar",
+		FromRepo:  "foo",
+		Digest:    config.Digest,
+		MediaType: config.MediaType,
+		Size:      2,
+	}, {
+		Action:    ActionDelete,
+		Kind:      KindTag,
+		Repo:      "foo",
+		Digest:    mdesc.Digest,
+		MediaType: ocispec.MediaTypeImageManifest,
+		Size:      int64(len(manifest)),
+		Tags:      []string{"latest"},
+	}, {
+		Action: ActionDelete,
+		Kind:   KindManifest,
+		Repo:   "foo",
+		Digest: mdesc.Digest,
+	}}, events)
+}
+
+func TestChannelDrops(t *testing.T) {
+	c := make(chan Event, 1)
+	sink := NewChannel(c)
+	sink.Send(Event{ID: "1"})
+	sink.Send(Event{ID: "2"})
+	require.Equal(t, int64(1), sink.Dropped())
+	require.Equal(t, "1", (<-c).ID)
+}
+
+func TestJSONLines(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewJSONLines(&buf)
+	c := make(chan Event, 10)
+	r := New(ocimem.New(), Multi(sink, NewChannel(c)), nil)
+	ocitest.NewRegistry(t, r).MustPushBlob("foo", []byte("hello"))
+	ocitest.NewRegistry(t, r).MustPushBlob("foo", []byte("world"))
+	require.NoError(t, sink.Err())
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 2)
+	var e Event
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &e))
+	// The same events are sent to both sinks.
+	<-c
+	sent := <-c
+	require.Equal(t, sent.ID, e.ID)
+	require.True(t, sent.Time.Equal(e.Time))
+	require.Equal(t, ActionPush, e.Action)
+	require.Equal(t, digest.FromString("world"), e.Digest)
+	require.Contains(t, lines[0], `"repository":"foo"`)
+
+	sink = NewJSONLines(errorWriter{})
+	sink.Send(Event{})
+	require.ErrorContains(t, sink.Err(), "write failed")
+}
+
+func TestWebhook(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests int
+		got      []map[string]any
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if requests == 1 {
+			// Fail the first request to check that it's retried.
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		require.Equal(t, EnvelopeMediaType, req.Header.Get("Content-Type"))
+		require.Equal(t, "Bearer token", req.Header.Get("Authorization"))
+		var env struct {
+			Events []map[string]any `json:"events"`
+		}
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&env))
+		got = append(got, env.Events...)
+	}))
+	defer srv.Close()
+
+	sink := NewWebhook(srv.URL, &WebhookOptions{
+		Header:  http.Header{"Authorization": {"Bearer token"}},
+		Backoff: time.Millisecond,
+	})
+	sink.Send(Event{
+		ID:        "abc",
+		Time:      epoch,
+		Action:    ActionPush,
+		Kind:      KindManifest,
+		Repo:      "foo",
+		Digest:    "sha256:1234",
+		MediaType: ocispec.MediaTypeImageManifest,
+		Size:      100,
+		Tags:      []string{"v1", "latest"},
+		Actor:     "alice",
+	})
+	require.NoError(t, sink.Close())
+	require.Zero(t, sink.Dropped())
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, 2, requests)
+	require.Equal(t, []map[string]any{{
+		"id":        "abc",
+		"timestamp": "2025-01-01T00:00:00Z",
+		"action":    "push",
+		"target": map[string]any{
+			"mediaType":  ocispec.MediaTypeImageManifest,
+			"size":       100.0,
+			"length":     100.0,
+			"digest":     "sha256:1234",
+			"repository": "foo",
+			"tag":        "v1",
+		},
+		"actor": map[string]any{
+			"name": "alice",
+		},
+	}, {
+		"id":        "abc-1",
+		"timestamp": "2025-01-01T00:00:00Z",
+		"action":    "push",
+		"target": map[string]any{
+			"mediaType":  ocispec.MediaTypeImageManifest,
+			"size":       100.0,
+			"length":     100.0,
+			"digest":     "sha256:1234",
+			"repository": "foo",
+			"tag":        "latest",
+		},
+		"actor": map[string]any{
+			"name": "alice",
+		},
+	}}, got)
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	var requests atomic.Int64
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		<-unblock
+		http.Error(w, "failed", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	sink := NewWebhook(srv.URL, &WebhookOptions{
+		QueueSize:   2,
+		MaxBatch:    1,
+		MaxAttempts: 2,
+		Backoff:     time.Millisecond,
+	})
+	sink.Send(Event{ID: "1"})
+	// Wait for the first event to be taken off
+	// the queue so the test is deterministic.
+	for requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	sink.Send(Event{ID: "2"})
+	sink.Send(Event{ID: "3"})
+	sink.Send(Event{ID: "4"})
+	require.Equal(t, int64(1), sink.Dropped())
+
+	close(unblock)
+	require.NoError(t, sink.Close())
+	// All the other events fail to be delivered after two attempts each.
+	require.Equal(t, int64(4), sink.Dropped())
+	require.Equal(t, int64(6), requests.Load())
+
+	sink.Send(Event{ID: "5"})
+	require.Equal(t, int64(5), sink.Dropped())
+}
+
+type errorWriter struct{}
+
+func (errorWriter) Write([]byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestWebhookUnresponsive(t *testing.T) {
+	var requests atomic.Int64
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		// Don't respond until the test has finished.
+		<-unblock
+	}))
+	defer srv.Close()
+	defer close(unblock)
+
+	// The default client doesn't wait forever.
+	sink := NewWebhook(srv.URL, nil)
+	require.NotZero(t, sink.opts.Client.Timeout)
+	require.NoError(t, sink.Close())
+
+	sink = NewWebhook(srv.URL, &WebhookOptions{
+		Client:       &http.Client{},
+		MaxAttempts:  3,
+		Backoff:      time.Hour,
+		CloseTimeout: 50 * time.Millisecond,
+	})
+	sink.Send(Event{ID: "1"})
+	sink.Send(Event{ID: "2"})
+	for requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// Close gives up on the request in progress
+	// rather than waiting for it or retrying.
+	start := time.Now()
+	require.NoError(t, sink.Close())
+	require.Less(t, time.Since(start), 10*time.Second)
+	require.Equal(t, int64(2), sink.Dropped())
+	require.Equal(t, int64(1), requests.Load())
+}
@@ -0,0 +1,99 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocinotify
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Multi returns a sink that sends each event to all the given sinks in turn.
+func Multi(sinks ...Sink) Sink {
+	return multiSink(sinks)
+}
+
+type multiSink []Sink
+
+func (s multiSink) Send(e Event) {
+	for _, sink := range s {
+		sink.Send(e)
+	}
+}
+
+// Channel is a sink that sends events to a Go channel.
+type Channel struct {
+	c       chan<- Event
+	dropped atomic.Int64
+}
+
+// NewChannel returns a sink that sends events to c. Send never
+// blocks: if c is full, the event is dropped. Use a buffered channel
+// large enough for the expected rate of events.
+func NewChannel(c chan<- Event) *Channel {
+	return &Channel{c: c}
+}
+
+// Send implements [Sink.Send].
+func (s *Channel) Send(e Event) {
+	select {
+	case s.c <- e:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// Dropped returns the number of events that have been
+// dropped because the channel was full.
+func (s *Channel) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// JSONLines is a sink that writes each event as a single line of JSON.
+type JSONLines struct {
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+}
+
+// NewJSONLines returns a sink that writes events to w, which
+// is typically a file opened with [os.O_APPEND].
+// Events are written synchronously, one Write call per event.
+func NewJSONLines(w io.Writer) *JSONLines {
+	return &JSONLines{w: w}
+}
+
+// Send implements [Sink.Send].
+func (s *JSONLines) Send(e Event) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		// Can't happen: all the fields are marshalable.
+		panic(err)
+	}
+	data = append(data, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.w.Write(data); err != nil && s.err == nil {
+		s.err = err
+	}
+}
+
+// Err returns the first error encountered when writing events, if any.
+func (s *JSONLines) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
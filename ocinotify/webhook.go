@@ -0,0 +1,311 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocinotify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jcarter3/oci"
+)
+
+// EnvelopeMediaType is the content type of the
+// webhook request body sent by [Webhook].
+const EnvelopeMediaType = "application/vnd.docker.distribution.events.v1+json"
+
+const (
+	maxBackoff          = time.Minute
+	defaultTimeout      = 30 * time.Second
+	defaultCloseTimeout = 30 * time.Second
+)
+
+// WebhookOptions holds options for [NewWebhook].
+type WebhookOptions struct {
+	// Client is used to make requests. By default a client
+	// with a 30 second timeout is used, so that an endpoint
+	// that never responds can't hold up delivery forever.
+	Client *http.Client
+
+	// Header holds extra headers to send with each
+	// request, for example Authorization.
+	Header http.Header
+
+	// QueueSize holds the maximum number of events waiting to be
+	// sent. When the queue is full, new events are dropped.
+	// By default it's 1000.
+	QueueSize int
+
+	// MaxBatch holds the maximum number of events sent in a
+	// single request. By default it's 100.
+	MaxBatch int
+
+	// MaxAttempts holds the number of times a request is attempted
+	// before its events are dropped. By default it's 5.
+	MaxAttempts int
+
+	// Backoff holds the delay before the first retry. It doubles
+	// for each subsequent retry, up to a minute.
+	// By default it's one second.
+	Backoff time.Duration
+
+	// CloseTimeout holds how long [Webhook.Close] waits for queued
+	// events to be delivered. When it expires, any request in
+	// progress is cancelled and the remaining events are dropped.
+	// By default it's 30 seconds.
+	CloseTimeout time.Duration
+}
+
+// Webhook is a sink that sends events to an HTTP endpoint
+// in the docker distribution notification envelope format.
+// See https://distribution.github.io/distribution/about/notifications/.
+//
+// Events are queued and sent in the background, so Send never blocks.
+type Webhook struct {
+	url     string
+	opts    WebhookOptions
+	mu      sync.Mutex
+	closed  bool
+	queue   chan Event
+	done    chan struct{}
+	dropped atomic.Int64
+
+	// ctx is cancelled to abandon delivery.
+	ctx    context.Context
+	cancel func()
+}
+
+// NewWebhook returns a sink that POSTs events to the given URL.
+// Requests that fail or receive a non-2xx response are retried.
+// [Webhook.Close] must be called to stop the background goroutine.
+func NewWebhook(url string, opts *WebhookOptions) *Webhook {
+	var opts1 WebhookOptions
+	if opts != nil {
+		opts1 = *opts
+	}
+	if opts1.Client == nil {
+		opts1.Client = &http.Client{
+			Timeout: defaultTimeout,
+		}
+	}
+	if opts1.QueueSize <= 0 {
+		opts1.QueueSize = 1000
+	}
+	if opts1.MaxBatch <= 0 {
+		opts1.MaxBatch = 100
+	}
+	if opts1.MaxAttempts <= 0 {
+		opts1.MaxAttempts = 5
+	}
+	if opts1.Backoff <= 0 {
+		opts1.Backoff = time.Second
+	}
+	if opts1.CloseTimeout <= 0 {
+		opts1.CloseTimeout = defaultCloseTimeout
+	}
+	w := &Webhook{
+		url:   url,
+		opts:  opts1,
+		queue: make(chan Event, opts1.QueueSize),
+		done:  make(chan struct{}),
+	}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	go w.run()
+	return w
+}
+
+// Send implements [Sink.Send]. The event is dropped
+// if the queue is full or the sink has been closed.
+func (w *Webhook) Send(e Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		w.dropped.Add(1)
+		return
+	}
+	select {
+	case w.queue <- e:
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+// Close stops accepting new events and waits for any queued
+// events to be delivered or dropped, for at most
+// WebhookOptions.CloseTimeout.
+func (w *Webhook) Close() error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+	timer := time.NewTimer(w.opts.CloseTimeout)
+	defer timer.Stop()
+	select {
+	case <-w.done:
+	case <-timer.C:
+		w.cancel()
+		<-w.done
+	}
+	w.cancel()
+	return nil
+}
+
+// Dropped returns the number of events that have been dropped,
+// either because the queue was full or because they
+// could not be delivered after all attempts.
+func (w *Webhook) Dropped() int64 {
+	return w.dropped.Load()
+}
+
+func (w *Webhook) run() {
+	defer close(w.done)
+	for e := range w.queue {
+		batch := []Event{e}
+	fill:
+		for len(batch) < w.opts.MaxBatch {
+			select {
+			case e, ok := <-w.queue:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, e)
+			default:
+				break fill
+			}
+		}
+		if err := w.deliver(batch); err != nil {
+			w.dropped.Add(int64(len(batch)))
+		}
+	}
+}
+
+// deliver sends a batch of events, retrying with
+// exponential backoff on failure.
+func (w *Webhook) deliver(batch []Event) error {
+	body, err := json.Marshal(envelope(batch))
+	if err != nil {
+		return err
+	}
+	backoff := w.opts.Backoff
+	for attempt := 1; ; attempt++ {
+		err = w.post(body)
+		if err == nil || attempt >= w.opts.MaxAttempts {
+			return err
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-w.ctx.Done():
+			timer.Stop()
+			return w.ctx.Err()
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+func (w *Webhook) post(body []byte) error {
+	req, err := http.NewRequestWithContext(w.ctx, "POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range w.opts.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", EnvelopeMediaType)
+	resp, err := w.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// dockerEnvelope and dockerEvent mirror the notification
+// format used by the docker distribution registry.
+type dockerEnvelope struct {
+	Events []dockerEvent `json:"events"`
+}
+
+type dockerEvent struct {
+	ID        string       `json:"id"`
+	Timestamp time.Time    `json:"timestamp"`
+	Action    Action       `json:"action"`
+	Target    dockerTarget `json:"target"`
+	Actor     dockerActor  `json:"actor"`
+}
+
+type dockerTarget struct {
+	MediaType      string     `json:"mediaType,omitempty"`
+	Size           int64      `json:"size,omitempty"`
+	Digest         oci.Digest `json:"digest,omitempty"`
+	Length         int64      `json:"length,omitempty"`
+	Repository     string     `json:"repository"`
+	FromRepository string     `json:"fromRepository,omitempty"`
+	Tag            string     `json:"tag,omitempty"`
+}
+
+type dockerActor struct {
+	Name string `json:"name,omitempty"`
+}
+
+// envelope converts events to the docker notification format,
+// which has a single tag per event, so an event with several
+// tags becomes several docker events.
+func envelope(events []Event) dockerEnvelope {
+	var env dockerEnvelope
+	for _, e := range events {
+		de := dockerEvent{
+			ID:        e.ID,
+			Timestamp: e.Time,
+			Action:    e.Action,
+			Target: dockerTarget{
+				MediaType:      e.MediaType,
+				Size:           e.Size,
+				Digest:         e.Digest,
+				Length:         e.Size,
+				Repository:     e.Repo,
+				FromRepository: e.FromRepo,
+			},
+			Actor: dockerActor{
+				Name: e.Actor,
+			},
+		}
+		if len(e.Tags) == 0 {
+			env.Events = append(env.Events, de)
+			continue
+		}
+		for i, tag := range e.Tags {
+			tagged := de
+			if i > 0 {
+				tagged.ID = fmt.Sprintf("%s-%d", e.ID, i)
+			}
+			tagged.Target.Tag = tag
+			env.Events = append(env.Events, tagged)
+		}
+	}
+	return env
+}
@@ -0,0 +1,678 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ociretain removes old content from a registry according
+// to retention policies.
+//
+// [Evaluate] applies a set of [Policy] values to the repositories in a
+// registry and returns a [Plan] describing the tags and manifests that
+// should be deleted. The plan can be inspected before calling
+// [Plan.Execute] to carry it out.
+//
+// Only the standard [oci.Interface] methods are used, so it works
+// against any registry, local or remote. As there is no way to list
+// all the manifests in a repository, the only untagged manifests
+// considered for deletion are those that the plan itself leaves untagged
+// and those listed in [Options.Manifests]; other manifests that were
+// already untagged are left alone. A manifest that is still reachable
+// from a remaining tag, for example as an entry in a tagged index or
+// as a referrer of a tagged manifest, is never deleted, and the
+// referrers of a deleted manifest, such as signatures, are deleted
+// with it.
+package ociretain
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/internal/ocimanifest"
+	"github.com/jcarter3/oci/internal/ocipattern"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Order determines how tags are ordered from newest to oldest.
+type Order int
+
+const (
+	// OrderSemver orders tags by semantic version precedence. Tags
+	// that are not semantic versions, with an optional "v" prefix,
+	// are never deleted.
+	OrderSemver Order = iota
+
+	// OrderCreated orders tags by the time held in the
+	// org.opencontainers.image.created annotation of the
+	// manifest they refer to. Tags without a valid annotation are
+	// never deleted.
+	OrderCreated
+)
+
+func (o Order) String() string {
+	switch o {
+	case OrderSemver:
+		return "semver"
+	case OrderCreated:
+		return "created"
+	}
+	return fmt.Sprintf("Order(%d)", int(o))
+}
+
+// Policy describes what to retain in a set of repositories.
+type Policy struct {
+	// Repositories holds a pattern that must match the whole of a
+	// repository name for the policy to apply to it. If it's nil,
+	// the policy applies to all repositories.
+	Repositories *regexp.Regexp
+
+	// Order determines which tags are the newest.
+	Order Order
+
+	// KeepLast holds the number of the newest tags to keep.
+	// Older tags are deleted. If it's zero or less,
+	// no tags are deleted.
+	KeepLast int
+
+	// Protected holds patterns of tags that are never deleted and
+	// don't count towards KeepLast. Each pattern must match the
+	// whole tag.
+	Protected []*regexp.Regexp
+
+	// DeleteNewlyUntagged specifies that manifests that the plan's
+	// own tag deletions leave unreachable from any tag are deleted
+	// too, whatever their age. This includes the entries of indexes
+	// that are left untagged. It has no effect unless KeepLast
+	// is positive, as otherwise no tags are deleted.
+	DeleteNewlyUntagged bool
+
+	// UntaggedOlderThan, if positive, specifies that untagged
+	// manifests whose org.opencontainers.image.created annotation
+	// is at least this old are deleted. That covers the manifests
+	// that the plan's own tag deletions leave unreachable from any
+	// tag, as for DeleteNewlyUntagged, and the manifests listed in
+	// [Options.Manifests] that aren't reachable from any tag. It
+	// doesn't require KeepLast to be set.
+	//
+	// Manifests without a valid annotation are never deleted this
+	// way, and manifests that were already untagged but aren't
+	// listed in [Options.Manifests] can't be found, so are left
+	// alone.
+	UntaggedOlderThan time.Duration
+}
+
+// deletesUntagged reports whether p deletes any
+// untagged manifests.
+func (p *Policy) deletesUntagged() bool {
+	return p.UntaggedOlderThan > 0 || (p.DeleteNewlyUntagged && p.KeepLast > 0)
+}
+
+// Options holds optional parameters for [Evaluate].
+type Options struct {
+	// Repositories holds the repositories to evaluate. If it's
+	// empty, all the repositories in the registry are evaluated.
+	Repositories []string
+
+	// Now holds the current time, used to determine the
+	// age of manifests. If it's zero, time.Now is used.
+	Now time.Time
+
+	// Manifests holds manifests known to be in each repository,
+	// keyed by repository name, for example as recorded from a
+	// registry's push notifications. As there's no way to list
+	// the manifests in a repository, these are the only manifests
+	// that were untagged before the plan was made that
+	// [Policy.UntaggedOlderThan] can delete. Manifests that no
+	// longer exist are ignored.
+	Manifests map[string][]oci.Digest
+}
+
+// ActionKind holds the kind of an [Action].
+type ActionKind int
+
+const (
+	DeleteTag ActionKind = iota
+	DeleteManifest
+)
+
+func (k ActionKind) String() string {
+	switch k {
+	case DeleteTag:
+		return "delete tag"
+	case DeleteManifest:
+		return "delete manifest"
+	}
+	return fmt.Sprintf("ActionKind(%d)", int(k))
+}
+
+// Action describes a single deletion in a [Plan].
+type Action struct {
+	Kind ActionKind
+	Repo string
+
+	// Tag holds the tag to delete, when Kind is DeleteTag.
+	Tag string
+
+	// Digest holds the digest of the manifest to delete, or
+	// that the tag referred to when the plan was made.
+	Digest oci.Digest
+
+	// Reason describes why the action is needed.
+	Reason string
+}
+
+func (a Action) String() string {
+	switch a.Kind {
+	case DeleteTag:
+		return fmt.Sprintf("%s %s:%s (%s): %s", a.Kind, a.Repo, a.Tag, a.Digest, a.Reason)
+	default:
+		return fmt.Sprintf("%s %s@%s: %s", a.Kind, a.Repo, a.Digest, a.Reason)
+	}
+}
+
+// Plan holds the deletions made necessary by a set of policies.
+type Plan struct {
+	// Actions holds the deletions in the order
+	// they'll be made: for each repository in turn,
+	// tags are deleted before manifests.
+	Actions []Action
+}
+
+// String returns a human-readable summary of the plan,
+// one action per line.
+func (p *Plan) String() string {
+	var buf strings.Builder
+	for _, a := range p.Actions {
+		buf.WriteString(a.String())
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+// Evaluate returns the plan that results from applying policies to the
+// repositories in r. Each repository is subject to the first policy
+// whose Repositories pattern matches it; repositories that don't match
+// any policy are left alone. Nothing is deleted until [Plan.Execute]
+// is called.
+func Evaluate(ctx context.Context, r oci.Interface, policies []Policy, opts *Options) (*Plan, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	e := &evaluator{
+		r:         r,
+		policies:  compilePolicies(policies),
+		now:       now,
+		manifests: opts.Manifests,
+		plan:      &Plan{},
+	}
+	if len(opts.Repositories) > 0 {
+		for _, repo := range opts.Repositories {
+			if err := e.evaluateRepo(ctx, repo); err != nil {
+				return nil, err
+			}
+		}
+		return e.plan, nil
+	}
+	for repo, err := range r.Repositories(ctx, "") {
+		if err != nil {
+			return nil, fmt.Errorf("cannot list repositories: %w", err)
+		}
+		if err := e.evaluateRepo(ctx, repo); err != nil {
+			return nil, err
+		}
+	}
+	return e.plan, nil
+}
+
+// Execute carries out the plan against r. Before deleting a tag, it
+// checks that the tag still refers to the digest recorded in the plan,
+// and before deleting a manifest it checks that the manifest isn't
+// reachable from any tag, directly, through an index or as a referrer,
+// so content pushed after the plan was made is not lost. Content that
+// has already been deleted is ignored.
+//
+// Execute carries on after an error and returns
+// all the errors it encountered.
+func (p *Plan) Execute(ctx context.Context, r oci.Interface) error {
+	var errs []error
+	// inUse holds the manifests reachable from the tags in each
+	// repository, computed on demand once all its tags have
+	// been deleted.
+	inUse := make(map[string]map[oci.Digest]bool)
+	for _, a := range p.Actions {
+		switch a.Kind {
+		case DeleteTag:
+			desc, err := r.ResolveTag(ctx, a.Repo, a.Tag)
+			if err != nil {
+				if !isNotFound(err) {
+					errs = append(errs, fmt.Errorf("cannot resolve %s:%s: %w", a.Repo, a.Tag, err))
+				}
+				continue
+			}
+			if desc.Digest != a.Digest {
+				// The tag has been updated since the plan was made.
+				continue
+			}
+			if err := r.DeleteTag(ctx, a.Repo, a.Tag); err != nil && !isNotFound(err) {
+				errs = append(errs, fmt.Errorf("cannot delete %s:%s: %w", a.Repo, a.Tag, err))
+			}
+		case DeleteManifest:
+			digests, ok := inUse[a.Repo]
+			if !ok {
+				var err error
+				digests, err = reachableFromTags(ctx, r, a.Repo)
+				if err != nil {
+					errs = append(errs, err)
+					continue
+				}
+				inUse[a.Repo] = digests
+			}
+			if digests[a.Digest] {
+				continue
+			}
+			if err := r.DeleteManifest(ctx, a.Repo, a.Digest); err != nil && !isNotFound(err) {
+				errs = append(errs, fmt.Errorf("cannot delete %s@%s: %w", a.Repo, a.Digest, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func isNotFound(err error) bool {
+	return errors.Is(err, oci.ErrManifestUnknown) || errors.Is(err, oci.ErrNameUnknown)
+}
+
+// reachableFromTags returns the set of manifests reachable from the
+// tags in the given repository, including their referrers.
+func reachableFromTags(ctx context.Context, r oci.Interface, repo string) (map[oci.Digest]bool, error) {
+	var roots []oci.Digest
+	for tag, err := range r.Tags(ctx, repo, nil) {
+		if err != nil {
+			return nil, fmt.Errorf("cannot list tags in %s: %w", repo, err)
+		}
+		desc, err := r.ResolveTag(ctx, repo, tag)
+		if err != nil {
+			if isNotFound(err) {
+				continue
+			}
+			return nil, fmt.Errorf("cannot resolve %s:%s: %w", repo, tag, err)
+		}
+		roots = append(roots, desc.Digest)
+	}
+	return reachableWithReferrers(ctx, r, repo, roots)
+}
+
+// reachableWithReferrers is like [ocimanifest.Reachable] but also
+// includes the referrers of each reachable manifest, and everything
+// reachable from those in turn.
+func reachableWithReferrers(ctx context.Context, r oci.Interface, repo string, roots []oci.Digest) (map[oci.Digest]bool, error) {
+	reachable, err := ocimanifest.Reachable(ctx, r, repo, roots)
+	if err != nil {
+		return nil, fmt.Errorf("cannot walk manifests in %s: %w", repo, err)
+	}
+	queue := slices.Collect(maps.Keys(reachable))
+	for len(queue) > 0 {
+		dig := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		referrers, err := referrersOf(ctx, r, repo, dig)
+		if err != nil {
+			return nil, err
+		}
+		for _, referrer := range referrers {
+			if reachable[referrer] {
+				continue
+			}
+			more, err := ocimanifest.Reachable(ctx, r, repo, []oci.Digest{referrer})
+			if err != nil {
+				return nil, fmt.Errorf("cannot walk manifests in %s: %w", repo, err)
+			}
+			for d := range more {
+				if !reachable[d] {
+					reachable[d] = true
+					queue = append(queue, d)
+				}
+			}
+		}
+	}
+	return reachable, nil
+}
+
+// referrersOf returns the digests of the referrers of the given
+// manifest. It returns nothing if the registry doesn't
+// support referrers or the manifest doesn't exist.
+func referrersOf(ctx context.Context, r oci.Interface, repo string, dig oci.Digest) ([]oci.Digest, error) {
+	var referrers []oci.Digest
+	for desc, err := range r.Referrers(ctx, repo, dig, nil) {
+		if err != nil {
+			if errors.Is(err, oci.ErrUnsupported) || isNotFound(err) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("cannot list referrers of %s@%s: %w", repo, dig, err)
+		}
+		referrers = append(referrers, desc.Digest)
+	}
+	return referrers, nil
+}
+
+type policy struct {
+	*Policy
+	repositories *regexp.Regexp
+	protected    []*regexp.Regexp
+}
+
+func compilePolicies(policies []Policy) []policy {
+	compiled := make([]policy, len(policies))
+	for i := range policies {
+		p := &policies[i]
+		compiled[i] = policy{
+			Policy:    p,
+			protected: ocipattern.AnchoredAll(p.Protected),
+		}
+		if p.Repositories != nil {
+			compiled[i].repositories = ocipattern.Anchored(p.Repositories)
+		}
+	}
+	return compiled
+}
+
+func (p *policy) isProtected(tag string) bool {
+	return ocipattern.MatchAny(p.protected, tag)
+}
+
+type evaluator struct {
+	r         oci.Interface
+	policies  []policy
+	now       time.Time
+	manifests map[string][]oci.Digest
+	plan      *Plan
+}
+
+// tagInfo holds what's known about a tag in a repository.
+type tagInfo struct {
+	name    string
+	digest  oci.Digest
+	version semver
+	created time.Time
+}
+
+func (e *evaluator) policyFor(repo string) *policy {
+	for i := range e.policies {
+		p := &e.policies[i]
+		if p.repositories == nil || p.repositories.MatchString(repo) {
+			return p
+		}
+	}
+	return nil
+}
+
+func (e *evaluator) evaluateRepo(ctx context.Context, repo string) error {
+	p := e.policyFor(repo)
+	if p == nil {
+		return nil
+	}
+	// created caches the creation time of each manifest;
+	// the zero time means it's unknown.
+	created := make(map[oci.Digest]time.Time)
+	createdTime := func(dig oci.Digest) (time.Time, error) {
+		if t, ok := created[dig]; ok {
+			return t, nil
+		}
+		t, err := manifestCreated(ctx, e.r, repo, dig)
+		if err != nil {
+			return time.Time{}, err
+		}
+		created[dig] = t
+		return t, nil
+	}
+
+	var candidates []tagInfo
+	// refs holds the number of tags referring to each manifest
+	// that will remain after the plan is executed.
+	refs := make(map[oci.Digest]int)
+	for tag, err := range e.r.Tags(ctx, repo, nil) {
+		if err != nil {
+			return fmt.Errorf("cannot list tags in %s: %w", repo, err)
+		}
+		desc, err := e.r.ResolveTag(ctx, repo, tag)
+		if err != nil {
+			if isNotFound(err) {
+				// Deleted concurrently.
+				continue
+			}
+			return fmt.Errorf("cannot resolve %s:%s: %w", repo, tag, err)
+		}
+		refs[desc.Digest]++
+		if p.KeepLast <= 0 || p.isProtected(tag) {
+			continue
+		}
+		info := tagInfo{
+			name:   tag,
+			digest: desc.Digest,
+		}
+		switch p.Order {
+		case OrderSemver:
+			v, ok := parseSemver(tag)
+			if !ok {
+				continue
+			}
+			info.version = v
+		case OrderCreated:
+			t, err := createdTime(desc.Digest)
+			if err != nil {
+				return err
+			}
+			if t.IsZero() {
+				continue
+			}
+			info.created = t
+		}
+		candidates = append(candidates, info)
+	}
+	if len(candidates) > p.KeepLast {
+		e.deleteTags(p, repo, candidates, refs)
+	}
+	if !p.deletesUntagged() {
+		return nil
+	}
+	var known []oci.Digest
+	if p.UntaggedOlderThan > 0 {
+		known = e.manifests[repo]
+	}
+	untagged, keep, err := e.untagged(ctx, repo, refs, known)
+	if err != nil {
+		return err
+	}
+	var deleted []oci.Digest
+	planned := make(map[oci.Digest]bool)
+	for _, dig := range untagged {
+		reason := "untagged"
+		if p.UntaggedOlderThan > 0 {
+			t, err := createdTime(dig)
+			if err != nil {
+				if isNotFound(err) {
+					continue
+				}
+				return err
+			}
+			if t.IsZero() || e.now.Sub(t) < p.UntaggedOlderThan {
+				continue
+			}
+			reason = fmt.Sprintf("untagged and created more than %v ago", p.UntaggedOlderThan)
+		}
+		e.deleteManifest(repo, dig, reason)
+		deleted = append(deleted, dig)
+		planned[dig] = true
+	}
+	// Referrers such as signatures would be left dangling
+	// once their subject has gone, so delete them too.
+	for i := 0; i < len(deleted); i++ {
+		subject := deleted[i]
+		referrers, err := referrersOf(ctx, e.r, repo, subject)
+		if err != nil {
+			return err
+		}
+		slices.Sort(referrers)
+		for _, referrer := range referrers {
+			reachable, err := ocimanifest.Reachable(ctx, e.r, repo, []oci.Digest{referrer})
+			if err != nil {
+				return fmt.Errorf("cannot walk manifests in %s: %w", repo, err)
+			}
+			for _, dig := range slices.Sorted(maps.Keys(reachable)) {
+				if keep[dig] || planned[dig] {
+					continue
+				}
+				e.deleteManifest(repo, dig, fmt.Sprintf("refers to deleted manifest %s", subject))
+				deleted = append(deleted, dig)
+				planned[dig] = true
+			}
+		}
+	}
+	return nil
+}
+
+// deleteTags adds actions to delete the tags in candidates beyond
+// the newest p.KeepLast, and updates refs to match.
+func (e *evaluator) deleteTags(p *policy, repo string, candidates []tagInfo, refs map[oci.Digest]int) {
+	// Sort newest first, breaking ties by name so that
+	// the result is deterministic.
+	slices.SortFunc(candidates, func(a, b tagInfo) int {
+		var c int
+		switch p.Order {
+		case OrderSemver:
+			c = b.version.compare(a.version)
+		case OrderCreated:
+			c = b.created.Compare(a.created)
+		}
+		if c != 0 {
+			return c
+		}
+		return strings.Compare(a.name, b.name)
+	})
+	deleted := candidates[p.KeepLast:]
+	slices.SortFunc(deleted, func(a, b tagInfo) int {
+		return strings.Compare(a.name, b.name)
+	})
+	for _, info := range deleted {
+		e.plan.Actions = append(e.plan.Actions, Action{
+			Kind:   DeleteTag,
+			Repo:   repo,
+			Tag:    info.name,
+			Digest: info.digest,
+			Reason: fmt.Sprintf("not among the newest %d tags by %v", p.KeepLast, p.Order),
+		})
+		refs[info.digest]--
+	}
+}
+
+func (e *evaluator) deleteManifest(repo string, dig oci.Digest, reason string) {
+	e.plan.Actions = append(e.plan.Actions, Action{
+		Kind:   DeleteManifest,
+		Repo:   repo,
+		Digest: dig,
+		Reason: reason,
+	})
+}
+
+// untagged returns the manifests that will be untagged once the
+// plan's tag deletions have been made: first those that are
+// reachable from the tags counted in refs beforehand but not
+// afterwards, then those in known that aren't reachable afterwards.
+// The manifests that the deleted tags referred to directly come
+// first, so that indexes are deleted before their entries.
+//
+// It also returns the manifests that will remain reachable from
+// a tag, including their referrers.
+func (e *evaluator) untagged(ctx context.Context, repo string, refs map[oci.Digest]int, known []oci.Digest) ([]oci.Digest, map[oci.Digest]bool, error) {
+	var before, after []oci.Digest
+	for dig, n := range refs {
+		before = append(before, dig)
+		if n > 0 {
+			after = append(after, dig)
+		}
+	}
+	if len(before) == len(after) && len(known) == 0 {
+		return nil, nil, nil
+	}
+	reachableAfter, err := reachableWithReferrers(ctx, e.r, repo, after)
+	if err != nil {
+		return nil, nil, err
+	}
+	var untagged, entries []oci.Digest
+	if len(before) > len(after) {
+		// The referrers of manifests that are no longer
+		// tagged aren't included here: they're deleted
+		// along with their subject, whatever their age.
+		reachableBefore, err := ocimanifest.Reachable(ctx, e.r, repo, before)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot walk manifests in %s: %w", repo, err)
+		}
+		for dig := range reachableBefore {
+			if reachableAfter[dig] {
+				continue
+			}
+			if _, ok := refs[dig]; ok {
+				untagged = append(untagged, dig)
+			} else {
+				entries = append(entries, dig)
+			}
+		}
+	}
+	slices.Sort(untagged)
+	slices.Sort(entries)
+	untagged = append(untagged, entries...)
+	for _, dig := range slices.Sorted(slices.Values(known)) {
+		if !reachableAfter[dig] && !slices.Contains(untagged, dig) {
+			untagged = append(untagged, dig)
+		}
+	}
+	return untagged, reachableAfter, nil
+}
+
+// manifestCreated returns the time held in the
+// org.opencontainers.image.created annotation of the given manifest,
+// or the zero time if there is no such valid annotation.
+func manifestCreated(ctx context.Context, r oci.Interface, repo string, dig oci.Digest) (time.Time, error) {
+	rd, err := r.GetManifest(ctx, repo, dig)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("cannot get manifest %s@%s: %w", repo, dig, err)
+	}
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("cannot read manifest %s@%s: %w", repo, dig, err)
+	}
+	// Both image manifests and indexes hold their
+	// annotations in the same place.
+	var m struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, m.Annotations[ocispec.AnnotationCreated])
+	if err != nil {
+		return time.Time{}, nil
+	}
+	return t, nil
+}
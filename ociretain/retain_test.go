@@ -0,0 +1,451 @@
+package ociretain
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/ocimem"
+	"github.com/jcarter3/oci/ocitest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+var epoch = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestKeepLastSemver(t *testing.T) {
+	ctx := context.Background()
+	r := ocimem.New()
+	digests := make(map[string]oci.Digest)
+	for i, tag := range []string{"v1.0.0", "v1.10.0", "v1.2.0", "v2.0.0-rc.1", "v2.0.0", "latest", "v0.9.0"} {
+		digests[tag] = pushManifest(t, r, "foo", epoch.Add(time.Duration(i)*time.Hour), tag)
+	}
+	policies := []Policy{{
+		KeepLast:            3,
+		Protected:           []*regexp.Regexp{regexp.MustCompile(`v0\..*`)},
+		DeleteNewlyUntagged: true,
+	}}
+	plan, err := Evaluate(ctx, r, policies, nil)
+	require.NoError(t, err)
+	require.Equal(t, []Action{{
+		Kind:   DeleteTag,
+		Repo:   "foo",
+		Tag:    "v1.0.0",
+		Digest: digests["v1.0.0"],
+		Reason: "not among the newest 3 tags by semver",
+	}, {
+		Kind:   DeleteTag,
+		Repo:   "foo",
+		Tag:    "v1.2.0",
+		Digest: digests["v1.2.0"],
+		Reason: "not among the newest 3 tags by semver",
+	}, {
+		Kind:   DeleteManifest,
+		Repo:   "foo",
+		Digest: digests["v1.0.0"],
+		Reason: "untagged",
+	}, {
+		Kind:   DeleteManifest,
+		Repo:   "foo",
+		Digest: digests["v1.2.0"],
+		Reason: "untagged",
+	}}, sortedManifests(plan.Actions))
+
+	// Nothing is deleted until the plan is executed.
+	require.Equal(t, []string{"latest", "v0.9.0", "v1.0.0", "v1.10.0", "v1.2.0", "v2.0.0", "v2.0.0-rc.1"}, tags(t, r, "foo"))
+	require.NoError(t, plan.Execute(ctx, r))
+	require.Equal(t, []string{"latest", "v0.9.0", "v1.10.0", "v2.0.0", "v2.0.0-rc.1"}, tags(t, r, "foo"))
+	_, err = r.ResolveManifest(ctx, "foo", digests["v1.0.0"])
+	require.ErrorIs(t, err, oci.ErrManifestUnknown)
+	_, err = r.ResolveManifest(ctx, "foo", digests["v1.10.0"])
+	require.NoError(t, err)
+
+	// Evaluating again finds nothing more to do.
+	plan, err = Evaluate(ctx, r, policies, nil)
+	require.NoError(t, err)
+	require.Empty(t, plan.Actions)
+}
+
+func TestKeepLastCreated(t *testing.T) {
+	ctx := context.Background()
+	r := ocimem.New()
+	old := pushManifest(t, r, "ci/app", epoch, "commit-aaa", "stable")
+	older := pushManifest(t, r, "ci/app", epoch.Add(-time.Hour), "commit-bbb")
+	oldest := pushManifest(t, r, "ci/app", epoch.Add(-48*time.Hour), "commit-ccc")
+	pushManifest(t, r, "ci/app", epoch.Add(time.Hour), "commit-ddd")
+	pushManifest(t, r, "other", epoch.Add(-48*time.Hour), "commit-ccc")
+
+	plan, err := Evaluate(ctx, r, []Policy{{
+		Repositories:        regexp.MustCompile(`ci/.*`),
+		Order:               OrderCreated,
+		KeepLast:            1,
+		Protected:           []*regexp.Regexp{regexp.MustCompile(`stable`)},
+		DeleteNewlyUntagged: true,
+		UntaggedOlderThan:   24 * time.Hour,
+	}}, &Options{
+		Now: epoch.Add(2 * time.Hour),
+	})
+	require.NoError(t, err)
+	// The manifest for commit-aaa is still tagged as stable,
+	// and the one for commit-bbb isn't old enough, so only
+	// the manifest for commit-ccc is deleted.
+	require.Equal(t, []Action{{
+		Kind:   DeleteTag,
+		Repo:   "ci/app",
+		Tag:    "commit-aaa",
+		Digest: old,
+		Reason: "not among the newest 1 tags by created",
+	}, {
+		Kind:   DeleteTag,
+		Repo:   "ci/app",
+		Tag:    "commit-bbb",
+		Digest: older,
+		Reason: "not among the newest 1 tags by created",
+	}, {
+		Kind:   DeleteTag,
+		Repo:   "ci/app",
+		Tag:    "commit-ccc",
+		Digest: oldest,
+		Reason: "not among the newest 1 tags by created",
+	}, {
+		Kind:   DeleteManifest,
+		Repo:   "ci/app",
+		Digest: oldest,
+		Reason: "untagged and created more than 24h0m0s ago",
+	}}, plan.Actions)
+	require.Contains(t, plan.String(), "delete tag ci/app:commit-aaa")
+}
+
+func TestExecuteSkipsChangedTags(t *testing.T) {
+	ctx := context.Background()
+	r := ocimem.New()
+	pushManifest(t, r, "foo", epoch, "v1.0.0")
+	pushManifest(t, r, "foo", epoch.Add(time.Hour), "v1.1.0")
+	plan, err := Evaluate(ctx, r, []Policy{{
+		KeepLast:            1,
+		DeleteNewlyUntagged: true,
+	}}, &Options{
+		Repositories: []string{"foo"},
+	})
+	require.NoError(t, err)
+	require.Len(t, plan.Actions, 2)
+
+	// Move the tag after the plan has been made.
+	moved := pushManifest(t, r, "foo", epoch.Add(2*time.Hour), "v1.0.0")
+	// Tag the manifest that was going to be deleted.
+	old := pushManifest(t, r, "foo", epoch, "keep")
+
+	require.NoError(t, plan.Execute(ctx, r))
+	require.Equal(t, []string{"keep", "v1.0.0", "v1.1.0"}, tags(t, r, "foo"))
+	desc, err := r.ResolveTag(ctx, "foo", "v1.0.0")
+	require.NoError(t, err)
+	require.Equal(t, moved, desc.Digest)
+	_, err = r.ResolveManifest(ctx, "foo", old)
+	require.NoError(t, err)
+}
+
+func TestKeepIndexEntries(t *testing.T) {
+	ctx := context.Background()
+	r := ocimem.New()
+	content, err := ocitest.PushRepoContent(r, "foo", ocitest.RepoContent{
+		Blobs: map[string]string{
+			"config": "{}",
+		},
+		Manifests: map[string]oci.Manifest{
+			"m":       createdManifest(epoch),
+			"amd64":   createdManifest(epoch.Add(time.Minute)),
+			"arm64":   createdManifest(epoch.Add(2 * time.Minute)),
+			"current": createdManifest(epoch.Add(time.Hour)),
+		},
+		Indexes: map[string]ocispec.Index{
+			"multi": {
+				MediaType: ocispec.MediaTypeImageIndex,
+				Manifests: []oci.Descriptor{{Digest: "m"}, {Digest: "amd64"}},
+			},
+			"old": {
+				MediaType: ocispec.MediaTypeImageIndex,
+				Manifests: []oci.Descriptor{{Digest: "amd64"}, {Digest: "arm64"}},
+			},
+		},
+		Tags: map[string]string{
+			"v1.0.0": "m",
+			"v1.1.0": "old",
+			"v2.0.0": "current",
+			"multi":  "multi",
+		},
+	})
+	require.NoError(t, err)
+	dig := func(id string) oci.Digest {
+		return content.Manifests[id].Digest
+	}
+	plan, err := Evaluate(ctx, r, []Policy{{
+		KeepLast:            1,
+		DeleteNewlyUntagged: true,
+	}}, nil)
+	require.NoError(t, err)
+	// The manifest tagged as v1.0.0 is still part of the index
+	// tagged as multi, and so is the amd64 entry of the old index,
+	// so only the old index and its arm64 entry are deleted.
+	require.Equal(t, []Action{{
+		Kind:   DeleteTag,
+		Repo:   "foo",
+		Tag:    "v1.0.0",
+		Digest: dig("m"),
+		Reason: "not among the newest 1 tags by semver",
+	}, {
+		Kind:   DeleteTag,
+		Repo:   "foo",
+		Tag:    "v1.1.0",
+		Digest: dig("old"),
+		Reason: "not among the newest 1 tags by semver",
+	}, {
+		Kind:   DeleteManifest,
+		Repo:   "foo",
+		Digest: dig("old"),
+		Reason: "untagged",
+	}, {
+		Kind:   DeleteManifest,
+		Repo:   "foo",
+		Digest: dig("arm64"),
+		Reason: "untagged",
+	}}, plan.Actions)
+
+	// Even when the plan was made without knowing about it,
+	// Execute doesn't delete a manifest that's part of a tagged index.
+	plan = &Plan{
+		Actions: []Action{{
+			Kind:   DeleteManifest,
+			Repo:   "foo",
+			Digest: dig("amd64"),
+		}},
+	}
+	require.NoError(t, plan.Execute(ctx, r))
+	_, err = r.ResolveManifest(ctx, "foo", dig("amd64"))
+	require.NoError(t, err)
+}
+
+func TestUntaggedOlderThanWithoutKeepLast(t *testing.T) {
+	ctx := context.Background()
+	r := ocimem.New()
+	content, err := ocitest.PushRepoContent(r, "foo", ocitest.RepoContent{
+		Blobs: map[string]string{
+			"config": "{}",
+		},
+		Manifests: map[string]oci.Manifest{
+			"old":    createdManifest(epoch),
+			"new":    createdManifest(epoch.Add(47 * time.Hour)),
+			"tagged": createdManifest(epoch.Add(time.Minute)),
+		},
+		Tags: map[string]string{
+			"latest": "tagged",
+		},
+	})
+	require.NoError(t, err)
+	dig := func(id string) oci.Digest {
+		return content.Manifests[id].Digest
+	}
+	missing := oci.Digest("sha256:0000000000000000000000000000000000000000000000000000000000000000")
+	policies := []Policy{{
+		UntaggedOlderThan: 24 * time.Hour,
+	}}
+	opts := &Options{
+		Now: epoch.Add(48 * time.Hour),
+		Manifests: map[string][]oci.Digest{
+			"foo": {dig("tagged"), dig("new"), missing, dig("old")},
+		},
+	}
+	plan, err := Evaluate(ctx, r, policies, opts)
+	require.NoError(t, err)
+	// Only the known manifest that's untagged and
+	// old enough is deleted.
+	require.Equal(t, []Action{{
+		Kind:   DeleteManifest,
+		Repo:   "foo",
+		Digest: dig("old"),
+		Reason: "untagged and created more than 24h0m0s ago",
+	}}, plan.Actions)
+
+	// Without knowing about them, untagged
+	// manifests can't be found.
+	opts.Manifests = nil
+	plan, err = Evaluate(ctx, r, policies, opts)
+	require.NoError(t, err)
+	require.Empty(t, plan.Actions)
+}
+
+func TestDeleteReferrers(t *testing.T) {
+	ctx := context.Background()
+	r := ocimem.New()
+	signature := func(subject, signer string) oci.Manifest {
+		return oci.Manifest{
+			MediaType:    ocispec.MediaTypeImageManifest,
+			ArtifactType: "application/vnd.example.signature",
+			Config:       oci.Descriptor{Digest: "config"},
+			Subject:      &oci.Descriptor{Digest: oci.Digest(subject)},
+			Annotations: map[string]string{
+				"signed-by": signer,
+			},
+		}
+	}
+	content, err := ocitest.PushRepoContent(r, "foo", ocitest.RepoContent{
+		Blobs: map[string]string{
+			"config": "{}",
+		},
+		Manifests: map[string]oci.Manifest{
+			"v1":       createdManifest(epoch),
+			"v2":       createdManifest(epoch.Add(time.Hour)),
+			"v1-sig":   signature("v1", "ci"),
+			"v2-sig":   signature("v2", "ci"),
+			"v1-extra": signature("v1", "release"),
+		},
+		Tags: map[string]string{
+			"v1.0.0": "v1",
+			"v2.0.0": "v2",
+			// A referrer that's tagged itself is kept.
+			"extra": "v1-extra",
+		},
+	})
+	require.NoError(t, err)
+	dig := func(id string) oci.Digest {
+		return content.Manifests[id].Digest
+	}
+	plan, err := Evaluate(ctx, r, []Policy{{
+		KeepLast:            1,
+		DeleteNewlyUntagged: true,
+	}}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []Action{{
+		Kind:   DeleteTag,
+		Repo:   "foo",
+		Tag:    "v1.0.0",
+		Digest: dig("v1"),
+		Reason: "not among the newest 1 tags by semver",
+	}, {
+		Kind:   DeleteManifest,
+		Repo:   "foo",
+		Digest: dig("v1"),
+		Reason: "untagged",
+	}, {
+		Kind:   DeleteManifest,
+		Repo:   "foo",
+		Digest: dig("v1-sig"),
+		Reason: "refers to deleted manifest " + string(dig("v1")),
+	}}, plan.Actions)
+	require.NoError(t, plan.Execute(ctx, r))
+	_, err = r.ResolveManifest(ctx, "foo", dig("v1-sig"))
+	require.ErrorIs(t, err, oci.ErrManifestUnknown)
+	_, err = r.ResolveManifest(ctx, "foo", dig("v1-extra"))
+	require.NoError(t, err)
+
+	// Execute doesn't delete the referrer of a tagged manifest.
+	plan = &Plan{
+		Actions: []Action{{
+			Kind:   DeleteManifest,
+			Repo:   "foo",
+			Digest: dig("v2-sig"),
+		}},
+	}
+	require.NoError(t, plan.Execute(ctx, r))
+	_, err = r.ResolveManifest(ctx, "foo", dig("v2-sig"))
+	require.NoError(t, err)
+}
+
+func TestSemverCompare(t *testing.T) {
+	// In increasing order of precedence, from semver.org.
+	versions := []string{
+		"1.0.0-alpha",
+		"1.0.0-alpha.1",
+		"1.0.0-alpha.beta",
+		"1.0.0-beta",
+		"1.0.0-beta.2",
+		"1.0.0-beta.11",
+		"1.0.0-rc.1",
+		"1.0.0",
+		"v2.0.0",
+		"2.1.0",
+		"2.1.1",
+		"10.0.0",
+	}
+	for i, a := range versions {
+		va, ok := parseSemver(a)
+		require.True(t, ok, "%s", a)
+		for j, b := range versions {
+			vb, _ := parseSemver(b)
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = 1
+			}
+			require.Equal(t, want, va.compare(vb), "%s vs %s", a, b)
+		}
+	}
+	for _, s := range []string{"latest", "1.0", "01.0.0", "1.0.0-", "1.0.0-01", "v1.0.0.0", "commit-abc"} {
+		_, ok := parseSemver(s)
+		require.False(t, ok, "%s", s)
+	}
+}
+
+// pushManifest pushes a manifest created at the
+// given time with the given tags and returns its digest.
+func pushManifest(t *testing.T, r oci.Interface, repo string, created time.Time, tags ...string) oci.Digest {
+	tagMap := make(map[string]string)
+	for _, tag := range tags {
+		tagMap[tag] = "image"
+	}
+	content, err := ocitest.PushRepoContent(r, repo, ocitest.RepoContent{
+		Blobs: map[string]string{
+			"config": "{}",
+		},
+		Manifests: map[string]oci.Manifest{
+			"image": createdManifest(created),
+		},
+		Tags: tagMap,
+	})
+	require.NoError(t, err)
+	return content.Manifests["image"].Digest
+}
+
+func createdManifest(created time.Time) oci.Manifest {
+	return oci.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    oci.Descriptor{Digest: "config"},
+		Annotations: map[string]string{
+			ocispec.AnnotationCreated: created.Format(time.RFC3339),
+		},
+	}
+}
+
+func tags(t *testing.T, r oci.Interface, repo string) []string {
+	tags, err := oci.All(r.Tags(context.Background(), repo, nil))
+	require.NoError(t, err)
+	return tags
+}
+
+// sortedManifests returns actions with the manifest deletions
+// ordered by tag name rather than digest, to make it
+// easier to write the expected results.
+func sortedManifests(actions []Action) []Action {
+	var tagOrder []oci.Digest
+	for _, a := range actions {
+		if a.Kind == DeleteTag {
+			tagOrder = append(tagOrder, a.Digest)
+		}
+	}
+	result := make([]Action, 0, len(actions))
+	for _, a := range actions {
+		if a.Kind == DeleteTag {
+			result = append(result, a)
+		}
+	}
+	for _, dig := range tagOrder {
+		for _, a := range actions {
+			if a.Kind == DeleteManifest && a.Digest == dig {
+				result = append(result, a)
+			}
+		}
+	}
+	return result
+}
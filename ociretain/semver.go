@@ -0,0 +1,134 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociretain
+
+import (
+	"cmp"
+	"strconv"
+	"strings"
+)
+
+// semver holds a parsed semantic version. Build
+// metadata is dropped as it doesn't affect precedence.
+type semver struct {
+	major, minor, patch uint64
+	prerelease          []string
+}
+
+// parseSemver parses a semantic version as defined by
+// https://semver.org, with an optional "v" prefix. Note that
+// tags can't hold "+", so build metadata is rare in practice.
+func parseSemver(s string) (semver, bool) {
+	s = strings.TrimPrefix(s, "v")
+	s, _, _ = strings.Cut(s, "+")
+	s, pre, hasPre := strings.Cut(s, "-")
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return semver{}, false
+	}
+	var nums [3]uint64
+	for i, p := range parts {
+		if !isNumeric(p) {
+			return semver{}, false
+		}
+		n, err := strconv.ParseUint(p, 10, 64)
+		if err != nil {
+			return semver{}, false
+		}
+		nums[i] = n
+	}
+	v := semver{
+		major: nums[0],
+		minor: nums[1],
+		patch: nums[2],
+	}
+	if hasPre {
+		v.prerelease = strings.Split(pre, ".")
+		for _, id := range v.prerelease {
+			if id == "" || (isDigits(id) && !isNumeric(id)) {
+				return semver{}, false
+			}
+		}
+	}
+	return v, true
+}
+
+// isDigits reports whether s is non-empty and holds only digits.
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range []byte(s) {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// isNumeric reports whether s is a numeric identifier:
+// digits without a leading zero.
+func isNumeric(s string) bool {
+	return isDigits(s) && (s == "0" || s[0] != '0')
+}
+
+// compare returns -1, 0 or 1 depending on whether v
+// has lower, equal or higher precedence than w.
+func (v semver) compare(w semver) int {
+	if c := cmp.Compare(v.major, w.major); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(v.minor, w.minor); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(v.patch, w.patch); c != 0 {
+		return c
+	}
+	// A version without a prerelease has higher
+	// precedence than one with.
+	switch {
+	case len(v.prerelease) == 0 && len(w.prerelease) == 0:
+		return 0
+	case len(v.prerelease) == 0:
+		return 1
+	case len(w.prerelease) == 0:
+		return -1
+	}
+	for i := range min(len(v.prerelease), len(w.prerelease)) {
+		if c := comparePrerelease(v.prerelease[i], w.prerelease[i]); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(v.prerelease), len(w.prerelease))
+}
+
+// comparePrerelease compares two prerelease identifiers. Numeric
+// identifiers compare numerically and have lower precedence than
+// alphanumeric ones, which compare lexically.
+func comparePrerelease(a, b string) int {
+	aNum, bNum := isDigits(a), isDigits(b)
+	switch {
+	case aNum && bNum:
+		if c := cmp.Compare(len(a), len(b)); c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	case aNum:
+		return -1
+	case bNum:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
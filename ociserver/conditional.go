@@ -0,0 +1,136 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/internal/ocirequest"
+)
+
+// etag returns the entity tag for content with the given digest.
+// Content is immutable, so its digest makes a strong validator.
+func etag(dig oci.Digest) string {
+	return `"` + string(dig) + `"`
+}
+
+// etagComparison specifies how entity tags are compared,
+// as defined by RFC 9110, section 8.8.3.2.
+type etagComparison int
+
+const (
+	// weakComparison ignores the weakness of the tags
+	// being compared. If-None-Match uses it.
+	weakComparison etagComparison = iota
+
+	// strongComparison never matches a weak tag.
+	// If-Match uses it.
+	strongComparison
+)
+
+// etagMatches reports whether the value of an If-Match or
+// If-None-Match header matches the entity tag for dig, comparing
+// entity tags as specified by cmp.
+func etagMatches(header string, dig oci.Digest, cmp etagComparison) bool {
+	for tag := range strings.SplitSeq(header, ",") {
+		tag = textproto.TrimString(tag)
+		if tag == "*" {
+			return true
+		}
+		if cmp == weakComparison {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == etag(dig) {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified reports whether the If-None-Match header in req
+// matches the content with the given digest. If so, it writes
+// a 304 (Not Modified) response.
+func notModified(resp http.ResponseWriter, req *http.Request, dig oci.Digest) bool {
+	header := req.Header.Get("If-None-Match")
+	if header == "" || !etagMatches(header, dig, weakComparison) {
+		return false
+	}
+	resp.Header().Set("ETag", etag(dig))
+	resp.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// tagPrecondition checks the If-Match and If-None-Match headers of
+// a manifest PUT against the manifest currently referred to by the
+// tag being pushed. If-Match succeeds only when the tag exists and
+// refers to a matching manifest; If-None-Match succeeds only when it
+// doesn't, so "If-None-Match: *" can be used to create a tag that
+// mustn't already exist.
+//
+// The returned digest is to be passed as
+// [oci.PushManifestParameters.IfTagDigest], so that the backend makes
+// the check atomically with the push. An If-Match header holding a
+// single entity tag is passed on as it is. Otherwise, when the tag
+// exists, the digest it was found to refer to is passed on, so the
+// push fails if the tag has moved since it was checked here.
+//
+// The one condition that can't be passed on is that the tag doesn't
+// exist, so a push with If-None-Match to a tag that doesn't exist yet
+// isn't atomic: it can race with another push that creates the tag.
+func (r *registry) tagPrecondition(ctx context.Context, req *http.Request, rreq *ocirequest.Request) (oci.Digest, error) {
+	ifMatch, ifNoneMatch := req.Header.Get("If-Match"), req.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return "", nil
+	}
+	if dig, ok := singleETag(ifMatch); ok && ifNoneMatch == "" {
+		// The backend can make the whole check itself.
+		return dig, nil
+	}
+	desc, err := r.backend.ResolveTag(ctx, rreq.Repo, rreq.Tag)
+	exists := err == nil
+	if err != nil && !errors.Is(err, oci.ErrManifestUnknown) && !errors.Is(err, oci.ErrNameUnknown) {
+		return "", err
+	}
+	if ifMatch != "" && (!exists || !etagMatches(ifMatch, desc.Digest, strongComparison)) {
+		if !exists {
+			return "", fmt.Errorf("%w: tag %q does not exist", oci.ErrPreconditionFailed, rreq.Tag)
+		}
+		return "", fmt.Errorf("%w: tag %q refers to %s", oci.ErrPreconditionFailed, rreq.Tag, desc.Digest)
+	}
+	if ifNoneMatch != "" && exists && etagMatches(ifNoneMatch, desc.Digest, weakComparison) {
+		return "", fmt.Errorf("%w: tag %q already refers to %s", oci.ErrPreconditionFailed, rreq.Tag, desc.Digest)
+	}
+	if !exists {
+		return "", nil
+	}
+	return desc.Digest, nil
+}
+
+// singleETag returns the digest held in header if it holds
+// exactly one strong entity tag. An If-Match header holding
+// only a weak tag can never match, so it's not passed on.
+func singleETag(header string) (oci.Digest, bool) {
+	tag := textproto.TrimString(header)
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' || strings.ContainsAny(tag, ", ") {
+		return "", false
+	}
+	return oci.Digest(tag[1 : len(tag)-1]), true
+}
@@ -0,0 +1,217 @@
+package ociserver_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/ocimem"
+	"github.com/jcarter3/oci/ociserver"
+)
+
+func TestConditionalGet(t *testing.T) {
+	srv := httptest.NewServer(ociserver.New(ocimem.New(), nil))
+	defer srv.Close()
+
+	blob := pushConditionalBlob(t, srv.URL, "{}")
+	manifest := []byte(`{"schemaVersion": 2, "mediaType": "` + ocispec.MediaTypeImageManifest + `", "config": {"mediaType": "application/json", "digest": "` + string(blob) + `", "size": 2}, "layers": []}`)
+	mdig := digest.FromBytes(manifest)
+	resp := doRequest(t, "PUT", srv.URL+"/v2/foo/manifests/latest", map[string]string{
+		"Content-Type": ocispec.MediaTypeImageManifest,
+	}, manifest)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp.Body.Close()
+
+	other := `"` + string(digest.FromString("other")) + `"`
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		ifNoneMatch string
+		wantStatus  int
+		wantETag    string
+	}{
+		{"ManifestGetTag", "GET", "/v2/foo/manifests/latest", "", http.StatusOK, `"` + string(mdig) + `"`},
+		{"ManifestGetTagMatch", "GET", "/v2/foo/manifests/latest", `"` + string(mdig) + `"`, http.StatusNotModified, `"` + string(mdig) + `"`},
+		{"ManifestGetTagNoMatch", "GET", "/v2/foo/manifests/latest", other, http.StatusOK, `"` + string(mdig) + `"`},
+		{"ManifestGetDigestWeakMatch", "GET", "/v2/foo/manifests/" + string(mdig), other + `, W/"` + string(mdig) + `"`, http.StatusNotModified, `"` + string(mdig) + `"`},
+		{"ManifestHeadTagMatch", "HEAD", "/v2/foo/manifests/latest", "*", http.StatusNotModified, `"` + string(mdig) + `"`},
+		{"ManifestHeadTagNoMatch", "HEAD", "/v2/foo/manifests/latest", other, http.StatusOK, `"` + string(mdig) + `"`},
+		{"ManifestGetUnknownTag", "GET", "/v2/foo/manifests/nope", "*", http.StatusNotFound, ""},
+		{"BlobGet", "GET", "/v2/foo/blobs/" + string(blob), "", http.StatusOK, `"` + string(blob) + `"`},
+		{"BlobGetMatch", "GET", "/v2/foo/blobs/" + string(blob), `"` + string(blob) + `"`, http.StatusNotModified, `"` + string(blob) + `"`},
+		{"BlobHeadMatch", "HEAD", "/v2/foo/blobs/" + string(blob), `"` + string(blob) + `"`, http.StatusNotModified, `"` + string(blob) + `"`},
+		{"BlobGetUnknown", "GET", "/v2/foo/blobs/" + string(digest.FromString("other")), other, http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := map[string]string{}
+			if test.ifNoneMatch != "" {
+				header["If-None-Match"] = test.ifNoneMatch
+			}
+			resp := doRequest(t, test.method, srv.URL+test.path, header, nil)
+			body := readBody(t, resp)
+			require.Equal(t, test.wantStatus, resp.StatusCode, "body: %s", body)
+			require.Equal(t, test.wantETag, resp.Header.Get("ETag"))
+			if test.wantStatus == http.StatusNotModified {
+				require.Empty(t, body)
+			}
+		})
+	}
+}
+
+func TestManifestGetETagWithoutDigest(t *testing.T) {
+	srv := httptest.NewServer(ociserver.New(ocimem.New(), &ociserver.Options{
+		OmitDigestFromTagGetResponse: true,
+	}))
+	defer srv.Close()
+
+	blob := pushConditionalBlob(t, srv.URL, "{}")
+	manifest := []byte(`{"schemaVersion": 2, "mediaType": "` + ocispec.MediaTypeImageManifest + `", "config": {"mediaType": "application/json", "digest": "` + string(blob) + `", "size": 2}, "layers": []}`)
+	resp := doRequest(t, "PUT", srv.URL+"/v2/foo/manifests/latest", map[string]string{
+		"Content-Type": ocispec.MediaTypeImageManifest,
+	}, manifest)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp.Body.Close()
+
+	// The entity tag is still set, as it is for HEAD.
+	for _, method := range []string{"GET", "HEAD"} {
+		resp := doRequest(t, method, srv.URL+"/v2/foo/manifests/latest", nil, nil)
+		readBody(t, resp)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, `"`+string(digest.FromBytes(manifest))+`"`, resp.Header.Get("ETag"), method)
+	}
+}
+
+func TestConditionalManifestPut(t *testing.T) {
+	srv := httptest.NewServer(ociserver.New(ocimem.New(), nil))
+	defer srv.Close()
+
+	blob := pushConditionalBlob(t, srv.URL, "{}")
+	manifest := func(artifactType string) []byte {
+		return []byte(`{"schemaVersion": 2, "mediaType": "` + ocispec.MediaTypeImageManifest + `", "artifactType": "` + artifactType + `", "config": {"mediaType": "application/json", "digest": "` + string(blob) + `", "size": 2}, "layers": []}`)
+	}
+	m1, m2, m3 := manifest("application/one"), manifest("application/two"), manifest("application/three")
+	put := func(data []byte, header map[string]string) (int, string) {
+		header["Content-Type"] = ocispec.MediaTypeImageManifest
+		resp := doRequest(t, "PUT", srv.URL+"/v2/foo/manifests/stable", header, data)
+		return resp.StatusCode, readBody(t, resp)
+	}
+	etag := func(data []byte) string {
+		return `"` + string(digest.FromBytes(data)) + `"`
+	}
+
+	// If-Match fails when the tag doesn't exist.
+	status, body := put(m1, map[string]string{"If-Match": "*"})
+	require.Equal(t, http.StatusPreconditionFailed, status)
+	require.Contains(t, body, "PRECONDITION_FAILED")
+	require.Contains(t, body, `tag \"stable\" does not exist`)
+
+	// If-None-Match: * creates the tag only if it doesn't exist.
+	status, body = put(m1, map[string]string{"If-None-Match": "*"})
+	require.Equal(t, http.StatusCreated, status, "body: %s", body)
+	status, _ = put(m2, map[string]string{"If-None-Match": "*"})
+	require.Equal(t, http.StatusPreconditionFailed, status)
+
+	// If-Match moves the tag only if it refers to the expected manifest.
+	status, body = put(m2, map[string]string{"If-Match": etag(m1)})
+	require.Equal(t, http.StatusCreated, status, "body: %s", body)
+	status, body = put(m3, map[string]string{"If-Match": etag(m1)})
+	require.Equal(t, http.StatusPreconditionFailed, status)
+	require.Contains(t, body, "refers to "+string(digest.FromBytes(m2)))
+
+	// If-Match uses strong comparison, so a weak tag never matches,
+	// whereas If-None-Match uses weak comparison.
+	status, _ = put(m3, map[string]string{"If-Match": "W/" + etag(m2)})
+	require.Equal(t, http.StatusPreconditionFailed, status)
+	status, _ = put(m3, map[string]string{"If-Match": etag(m1) + ", W/" + etag(m2)})
+	require.Equal(t, http.StatusPreconditionFailed, status)
+	status, _ = put(m3, map[string]string{"If-None-Match": "W/" + etag(m2)})
+	require.Equal(t, http.StatusPreconditionFailed, status)
+
+	resp := doRequest(t, "HEAD", srv.URL+"/v2/foo/manifests/stable", nil, nil)
+	resp.Body.Close()
+	require.Equal(t, etag(m2), resp.Header.Get("ETag"))
+}
+
+func TestConditionalManifestPutRace(t *testing.T) {
+	mem := ocimem.New()
+	backend := &racingTagRegistry{Interface: mem}
+	srv := httptest.NewServer(ociserver.New(backend, nil))
+	defer srv.Close()
+
+	blob := pushConditionalBlob(t, srv.URL, "{}")
+	manifest := func(artifactType string) []byte {
+		return []byte(`{"schemaVersion": 2, "mediaType": "` + ocispec.MediaTypeImageManifest + `", "artifactType": "` + artifactType + `", "config": {"mediaType": "application/json", "digest": "` + string(blob) + `", "size": 2}, "layers": []}`)
+	}
+	m1, m2, m3 := manifest("application/one"), manifest("application/two"), manifest("application/three")
+	put := func(data []byte, header map[string]string) (int, string) {
+		header["Content-Type"] = ocispec.MediaTypeImageManifest
+		resp := doRequest(t, "PUT", srv.URL+"/v2/foo/manifests/stable", header, data)
+		return resp.StatusCode, readBody(t, resp)
+	}
+	etag := func(data []byte) string {
+		return `"` + string(digest.FromBytes(data)) + `"`
+	}
+	status, body := put(m1, map[string]string{})
+	require.Equal(t, http.StatusCreated, status, "body: %s", body)
+
+	// Another push moves the tag after it's been checked but before
+	// the update is made. The update must fail rather than overwrite
+	// it, whichever form of precondition is used.
+	for _, header := range []map[string]string{
+		{"If-Match": etag(m1) + ", " + etag(m3)},
+		{"If-Match": "*"},
+		{"If-None-Match": etag(m3)},
+	} {
+		require.NoError(t, pushRawManifest(mem, m1))
+		backend.moveTo = m2
+		status, body := put(m3, header)
+		require.Equal(t, http.StatusPreconditionFailed, status, "%v: %s", header, body)
+		desc, err := mem.ResolveTag(context.Background(), "foo", "stable")
+		require.NoError(t, err)
+		require.Equal(t, digest.FromBytes(m2), desc.Digest, "%v", header)
+	}
+}
+
+// racingTagRegistry wraps a registry so that the tag "stable" in
+// repository foo is moved to refer to moveTo, if it's set,
+// straight after it's resolved, simulating a concurrent push.
+type racingTagRegistry struct {
+	oci.Interface
+	moveTo []byte
+}
+
+func (r *racingTagRegistry) ResolveTag(ctx context.Context, repo string, tagName string) (oci.Descriptor, error) {
+	desc, err := r.Interface.ResolveTag(ctx, repo, tagName)
+	if r.moveTo != nil {
+		if err := pushRawManifest(r.Interface, r.moveTo); err != nil {
+			return oci.Descriptor{}, err
+		}
+		r.moveTo = nil
+	}
+	return desc, err
+}
+
+func pushRawManifest(r oci.Interface, data []byte) error {
+	_, err := r.PushManifest(context.Background(), "foo", data, ocispec.MediaTypeImageManifest, &oci.PushManifestParameters{
+		Tags: []string{"stable"},
+	})
+	return err
+}
+
+func pushConditionalBlob(t *testing.T, srvURL string, content string) digest.Digest {
+	dig := digest.FromString(content)
+	resp := doRequest(t, "POST", srvURL+"/v2/foo/blobs/uploads/?digest="+string(dig), map[string]string{
+		"Content-Type": "application/octet-stream",
+	}, []byte(content))
+	require.Equal(t, http.StatusCreated, resp.StatusCode, "body: %s", readBody(t, resp))
+	resp.Body.Close()
+	return dig
+}
@@ -64,6 +64,9 @@ func (r *registry) handleTagsList(ctx context.Context, resp http.ResponseWriter,
 }
 
 func (r *registry) handleCatalogList(ctx context.Context, resp http.ResponseWriter, req *http.Request, rreq *ocirequest.Request) (_err error) {
+	if r.opts.Quirks.DisableCatalog {
+		return withHTTPCode(http.StatusNotFound, fmt.Errorf("catalog API has been disabled"))
+	}
 	repos, link, err := r.nextListResults(req, rreq, r.backend.Repositories(ctx, rreq.ListLast))
 	if err != nil {
 		return err
@@ -0,0 +1,188 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociserver
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jcarter3/oci"
+)
+
+// Quirks describes a set of non-standard behaviors that the server
+// can emulate. It's intended to make it possible to test clients
+// against the behavior of well known registries without
+// access to the network.
+//
+// The predefined profiles (QuirksECR, QuirksGCR and so on)
+// reflect behavior that has been observed in the wild; they are
+// approximations and registries change over time.
+type Quirks struct {
+	// Name holds a human readable name for the set of quirks.
+	Name string
+
+	// MaxListPageSize, if > 0, causes the list endpoints to return an
+	// error if the page size is greater than that.
+	// See [Options.MaxListPageSize].
+	MaxListPageSize int
+
+	// IgnoreListPageSize causes the list endpoints to ignore
+	// the n query parameter and return all the results
+	// in a single page.
+	IgnoreListPageSize bool
+
+	// OmitDigestFromTagGetResponse causes the registry
+	// to omit the Docker-Content-Digest header from a tag
+	// GET response. See [Options.OmitDigestFromTagGetResponse].
+	OmitDigestFromTagGetResponse bool
+
+	// OmitLinkHeaderFromResponses causes the server
+	// to leave out the Link header from list responses.
+	// See [Options.OmitLinkHeaderFromResponses].
+	OmitLinkHeaderFromResponses bool
+
+	// IgnoreRangeRequests causes the server to ignore any
+	// Range header on blob GET requests, returning the
+	// entire blob with a 200 (OK) status instead of
+	// a 206 (Partial Content) status.
+	IgnoreRangeRequests bool
+
+	// DisableChunkedUpload causes the server to reject
+	// PATCH requests to an upload session. Uploads that send
+	// all their content in a single PUT or POST still work.
+	DisableChunkedUpload bool
+
+	// DisableSinglePostUpload causes the registry
+	// to reject uploads with a single POST request.
+	// See [Options.DisableSinglePostUpload].
+	DisableSinglePostUpload bool
+
+	// DisableReferrersAPI causes the registry to behave as if
+	// it does not understand the referrers API.
+	// See [Options.DisableReferrersAPI].
+	DisableReferrersAPI bool
+
+	// DisableCatalog causes the registry to respond to
+	// catalog requests with a 404 (Not Found) status.
+	DisableCatalog bool
+
+	// ErrorCodes maps from standard error codes to the
+	// non-standard codes that are used in their place
+	// in error responses.
+	ErrorCodes map[string]string
+
+	// PlainTextErrors causes error responses to be written
+	// as plain text rather than as JSON.
+	PlainTextErrors bool
+}
+
+// Predefined quirk profiles for some well known registries.
+var (
+	// QuirksECR emulates AWS Elastic Container Registry.
+	QuirksECR = Quirks{
+		Name:                         "ecr",
+		MaxListPageSize:              1000,
+		OmitDigestFromTagGetResponse: true,
+		DisableReferrersAPI:          true,
+	}
+
+	// QuirksGCR emulates Google Container Registry
+	// and Google Artifact Registry.
+	QuirksGCR = Quirks{
+		Name:                        "gcr",
+		IgnoreListPageSize:          true,
+		OmitLinkHeaderFromResponses: true,
+		DisableReferrersAPI:         true,
+	}
+
+	// QuirksGHCR emulates the GitHub Container Registry.
+	QuirksGHCR = Quirks{
+		Name:                 "ghcr",
+		DisableChunkedUpload: true,
+		DisableCatalog:       true,
+		ErrorCodes: map[string]string{
+			oci.ErrNameUnknown.Code(): oci.ErrDenied.Code(),
+		},
+	}
+
+	// QuirksDockerHub emulates Docker Hub.
+	QuirksDockerHub = Quirks{
+		Name:           "dockerhub",
+		DisableCatalog: true,
+	}
+
+	// QuirksHarbor emulates the Harbor registry.
+	QuirksHarbor = Quirks{
+		Name: "harbor",
+		ErrorCodes: map[string]string{
+			oci.ErrBlobUnknown.Code():     "NOT_FOUND",
+			oci.ErrManifestUnknown.Code(): "NOT_FOUND",
+			oci.ErrNameUnknown.Code():     "NOT_FOUND",
+		},
+	}
+
+	// QuirksQuay emulates Quay.
+	QuirksQuay = Quirks{
+		Name:                "quay",
+		IgnoreRangeRequests: true,
+		DisableReferrersAPI: true,
+		PlainTextErrors:     true,
+	}
+)
+
+// applyQuirks merges the quirks in opts.Quirks into the
+// equivalent fields in opts.
+func applyQuirks(opts *Options) {
+	q := &opts.Quirks
+	if opts.MaxListPageSize == 0 {
+		opts.MaxListPageSize = q.MaxListPageSize
+	}
+	opts.OmitDigestFromTagGetResponse = opts.OmitDigestFromTagGetResponse || q.OmitDigestFromTagGetResponse
+	opts.OmitLinkHeaderFromResponses = opts.OmitLinkHeaderFromResponses || q.OmitLinkHeaderFromResponses
+	opts.DisableSinglePostUpload = opts.DisableSinglePostUpload || q.DisableSinglePostUpload
+	opts.DisableReferrersAPI = opts.DisableReferrersAPI || q.DisableReferrersAPI
+}
+
+// writeQuirkError writes err to w in the form dictated by q.
+func writeQuirkError(w http.ResponseWriter, err error, q *Quirks) {
+	data, httpStatus := oci.MarshalError(err)
+	if q.PlainTextErrors {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(httpStatus)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	if len(q.ErrorCodes) > 0 {
+		var werrs oci.WireErrors
+		if err := json.Unmarshal(data, &werrs); err == nil {
+			for i := range werrs.Errors {
+				code, ok := q.ErrorCodes[werrs.Errors[i].Code_]
+				if !ok {
+					continue
+				}
+				werrs.Errors[i].Code_ = code
+				// Keep the HTTP status consistent with the substituted
+				// code when it's a standard one.
+				if _, status := oci.MarshalError(oci.NewError("", code, nil)); status != http.StatusInternalServerError {
+					httpStatus = status
+				}
+			}
+			data, _ = json.Marshal(werrs)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	w.Write(data)
+}
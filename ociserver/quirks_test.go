@@ -0,0 +1,233 @@
+package ociserver_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/ociclient"
+	"github.com/jcarter3/oci/ocimem"
+	"github.com/jcarter3/oci/ociserver"
+	"github.com/jcarter3/oci/ocitest"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+var quirkProfiles = []ociserver.Quirks{
+	ociserver.QuirksECR,
+	ociserver.QuirksGCR,
+	ociserver.QuirksGHCR,
+	ociserver.QuirksDockerHub,
+	ociserver.QuirksHarbor,
+	ociserver.QuirksQuay,
+}
+
+func TestQuirksClientCompatibility(t *testing.T) {
+	// Check that the basic client operations work against all
+	// the quirk profiles.
+	for _, quirks := range quirkProfiles {
+		t.Run(quirks.Name, func(t *testing.T) {
+			ctx := context.Background()
+			client := newQuirksClient(t, ocimem.New(), quirks)
+			content := ocitest.NewRegistry(t, client).MustPushContent(ocitest.RegistryContent{
+				"foo/bar": {
+					Blobs: map[string]string{
+						"scratch": "{}",
+						"b1":      "hello",
+					},
+					Manifests: map[string]oci.Manifest{
+						"m1": {
+							MediaType: ocispec.MediaTypeImageManifest,
+							Config:    oci.Descriptor{Digest: "scratch"},
+							Layers:    []oci.Descriptor{{Digest: "b1"}},
+						},
+					},
+					Tags: map[string]string{
+						"t1": "m1",
+						"t2": "m1",
+						"t3": "m1",
+					},
+				},
+			})["foo/bar"]
+			desc, err := client.ResolveTag(ctx, "foo/bar", "t1")
+			require.NoError(t, err)
+			require.Equal(t, content.Manifests["m1"].Digest, desc.Digest)
+
+			rd, err := client.GetTag(ctx, "foo/bar", "t2")
+			require.NoError(t, err)
+			data, err := io.ReadAll(rd)
+			rd.Close()
+			require.NoError(t, err)
+			require.Equal(t, content.ManifestData["m1"], data)
+
+			tags, err := oci.All(client.Tags(ctx, "foo/bar", nil))
+			require.NoError(t, err)
+			require.Equal(t, []string{"t1", "t2", "t3"}, tags)
+
+			_, err = client.GetBlob(ctx, "foo/bar", digest.FromString("nope"))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestQuirksIgnoreListPageSize(t *testing.T) {
+	srv := newQuirksServer(t, pushTags(t, "t1", "t2", "t3"), ociserver.QuirksGCR)
+	resp := doRequest(t, "GET", srv.URL+"/v2/foo/tags/list?n=1", nil, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Empty(t, resp.Header.Get("Link"))
+	require.JSONEq(t, `{"name":"foo","tags":["t1","t2","t3"]}`, readBody(t, resp))
+}
+
+func TestQuirksMaxListPageSize(t *testing.T) {
+	srv := newQuirksServer(t, pushTags(t, "t1"), ociserver.QuirksECR)
+	resp := doRequest(t, "GET", srv.URL+"/v2/foo/tags/list?n=1001", nil, nil)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.Contains(t, readBody(t, resp), "query parameter n is too large")
+}
+
+func TestQuirksIgnoreRangeRequests(t *testing.T) {
+	r := ocimem.New()
+	content := "0123456789"
+	dg := digest.FromString(content)
+	_, err := r.PushBlob(context.Background(), "foo", oci.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    dg,
+		Size:      int64(len(content)),
+	}, strings.NewReader(content))
+	require.NoError(t, err)
+
+	srv := newQuirksServer(t, r, ociserver.QuirksQuay)
+	resp := doRequest(t, "GET", srv.URL+"/v2/foo/blobs/"+string(dg), map[string]string{
+		"Range": "bytes=2-4",
+	}, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Empty(t, resp.Header.Get("Content-Range"))
+	require.Equal(t, content, readBody(t, resp))
+}
+
+func TestQuirksDisableChunkedUpload(t *testing.T) {
+	srv := newQuirksServer(t, ocimem.New(), ociserver.QuirksGHCR)
+	resp := doRequest(t, "POST", srv.URL+"/v2/foo/blobs/uploads/", nil, nil)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	loc := resp.Header.Get("Location")
+	resp.Body.Close()
+
+	resp = doRequest(t, "PATCH", srv.URL+loc, map[string]string{
+		"Content-Range": "0-4",
+	}, []byte("hello"))
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.Contains(t, readBody(t, resp), "chunked uploads are not supported")
+
+	// A monolithic PUT to the same session still works.
+	resp = doRequest(t, "PUT", srv.URL+loc+"?digest="+digestOf("hello"), nil, []byte("hello"))
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp.Body.Close()
+}
+
+func TestQuirksDisableCatalog(t *testing.T) {
+	srv := newQuirksServer(t, pushTags(t, "t1"), ociserver.QuirksDockerHub)
+	resp := doRequest(t, "GET", srv.URL+"/v2/_catalog", nil, nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp.Body.Close()
+}
+
+func TestQuirksErrorCodes(t *testing.T) {
+	srv := newQuirksServer(t, ocimem.New(), ociserver.QuirksHarbor)
+	resp := doRequest(t, "GET", srv.URL+"/v2/foo/manifests/latest", nil, nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	var werrs oci.WireErrors
+	require.NoError(t, json.Unmarshal([]byte(readBody(t, resp)), &werrs))
+	require.Equal(t, "NOT_FOUND", werrs.Errors[0].Code_)
+
+	// Substituting a standard code also changes the status.
+	srv = newQuirksServer(t, ocimem.New(), ociserver.QuirksGHCR)
+	resp = doRequest(t, "GET", srv.URL+"/v2/foo/manifests/latest", nil, nil)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.Contains(t, readBody(t, resp), `"code":"DENIED"`)
+}
+
+func TestQuirksPlainTextErrors(t *testing.T) {
+	srv := newQuirksServer(t, ocimem.New(), ociserver.QuirksQuay)
+	resp := doRequest(t, "GET", srv.URL+"/v2/foo/manifests/latest", nil, nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+	require.Equal(t, "name unknown: repository name not known to registry\n", readBody(t, resp))
+}
+
+func TestQuirksOptionsTakePrecedence(t *testing.T) {
+	srv := httptest.NewServer(ociserver.New(pushTags(t, "t1", "t2"), &ociserver.Options{
+		Quirks:          ociserver.QuirksECR,
+		MaxListPageSize: 1,
+	}))
+	t.Cleanup(srv.Close)
+	resp := doRequest(t, "GET", srv.URL+"/v2/foo/tags/list?n=2", nil, nil)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.Contains(t, readBody(t, resp), "max=1")
+}
+
+func pushTags(t *testing.T, tags ...string) oci.Interface {
+	r := ocimem.New()
+	tagMap := make(map[string]string)
+	for _, tag := range tags {
+		tagMap[tag] = "m"
+	}
+	ocitest.NewRegistry(t, r).MustPushContent(ocitest.RegistryContent{
+		"foo": {
+			Blobs: map[string]string{"scratch": "{}"},
+			Manifests: map[string]oci.Manifest{
+				"m": {
+					MediaType: ocispec.MediaTypeImageManifest,
+					Config:    oci.Descriptor{Digest: "scratch"},
+				},
+			},
+			Tags: tagMap,
+		},
+	})
+	return r
+}
+
+func newQuirksServer(t *testing.T, r oci.Interface, quirks ociserver.Quirks) *httptest.Server {
+	srv := httptest.NewServer(ociserver.New(r, &ociserver.Options{
+		Quirks: quirks,
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newQuirksClient(t *testing.T, r oci.Interface, quirks ociserver.Quirks) oci.Interface {
+	srv := newQuirksServer(t, r, quirks)
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	client, err := ociclient.New(u.Host, &ociclient.Options{
+		Insecure: true,
+	})
+	require.NoError(t, err)
+	return client
+}
+
+func doRequest(t *testing.T, method, u string, header map[string]string, body []byte) *http.Response {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	require.NoError(t, err)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err, fmt.Sprintf("%s %s", method, u))
+	return resp
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(data)
+}
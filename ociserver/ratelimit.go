@@ -0,0 +1,231 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociserver
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/internal/ocirequest"
+)
+
+// RateLimiter decides whether requests may proceed.
+// See [Options.RateLimiter].
+type RateLimiter interface {
+	// Allow is called once for each request before it's handled.
+	// It must be safe to call concurrently.
+	Allow(req *RateLimitRequest) RateLimitResult
+}
+
+// RateLimitRequest describes a request to a [RateLimiter].
+type RateLimitRequest struct {
+	// Client holds the identity of the client making the request,
+	// as returned by [Options.ClientIdentity].
+	Client string
+
+	// Kind holds the kind of the request, for example "ManifestGet"
+	// or "BlobUploadChunk". See [RequestKinds].
+	Kind string
+
+	// Repo holds the repository named in the request, if any.
+	Repo string
+
+	// Request holds the HTTP request itself.
+	Request *http.Request
+}
+
+// RateLimitResult holds the outcome of a call to [RateLimiter.Allow].
+type RateLimitResult struct {
+	// Allowed reports whether the request may proceed.
+	Allowed bool
+
+	// Limit holds the number of requests permitted in each window.
+	// If it's zero, no RateLimit headers are sent.
+	Limit int
+
+	// Remaining holds the number of requests
+	// remaining in the current window.
+	Remaining int
+
+	// Window holds the length of the window.
+	Window time.Duration
+
+	// RetryAfter holds how long the client should
+	// wait before trying again when the request isn't allowed.
+	RetryAfter time.Duration
+}
+
+// RequestKinds holds the names of all the request kinds
+// that can be passed to a [RateLimiter].
+var RequestKinds = func() []string {
+	var kinds []string
+	for k := ocirequest.ReqPing; k <= ocirequest.ReqCatalogList; k++ {
+		kinds = append(kinds, k.String())
+	}
+	return kinds
+}()
+
+// RateLimit holds a limit of Requests requests every Window.
+// A zero RateLimit is unlimited.
+type RateLimit struct {
+	Requests int
+	Window   time.Duration
+}
+
+// NewRateLimiter returns a [RateLimiter] that limits each client
+// independently for each kind of request. The limit for a kind is taken
+// from perKind, keyed by the names in [RequestKinds], or defaultLimit
+// if it's not present there.
+//
+// Requests are counted with a token bucket per client and kind, which
+// starts full and is refilled continuously, so a client can make
+// a burst of up to limit.Requests requests at once.
+func NewRateLimiter(defaultLimit RateLimit, perKind map[string]RateLimit) RateLimiter {
+	return &rateLimiter{
+		defaultLimit: defaultLimit,
+		perKind:      perKind,
+		buckets:      make(map[rateLimitKey]*bucket),
+	}
+}
+
+type rateLimiter struct {
+	defaultLimit RateLimit
+	perKind      map[string]RateLimit
+
+	mu      sync.Mutex
+	buckets map[rateLimitKey]*bucket
+	calls   int
+}
+
+type rateLimitKey struct {
+	client string
+	kind   string
+}
+
+type bucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens accumulated since the last refill.
+func (b *bucket) refill(now time.Time) {
+	rate := float64(b.limit.Requests) / b.limit.Window.Seconds()
+	b.tokens = min(float64(b.limit.Requests), b.tokens+rate*now.Sub(b.last).Seconds())
+	b.last = now
+}
+
+func (l *rateLimiter) Allow(req *RateLimitRequest) RateLimitResult {
+	limit, ok := l.perKind[req.Kind]
+	if !ok {
+		limit = l.defaultLimit
+	}
+	if limit.Requests <= 0 || limit.Window <= 0 {
+		return RateLimitResult{Allowed: true}
+	}
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.calls++
+	if l.calls%1024 == 0 {
+		l.prune(now)
+	}
+	key := rateLimitKey{req.Client, req.Kind}
+	b := l.buckets[key]
+	if b == nil {
+		b = &bucket{
+			limit:  limit,
+			tokens: float64(limit.Requests),
+			last:   now,
+		}
+		l.buckets[key] = b
+	}
+	b.refill(now)
+	result := RateLimitResult{
+		Limit:  limit.Requests,
+		Window: limit.Window,
+	}
+	if b.tokens < 1 {
+		rate := float64(limit.Requests) / limit.Window.Seconds()
+		result.RetryAfter = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+		return result
+	}
+	b.tokens--
+	result.Allowed = true
+	result.Remaining = int(b.tokens)
+	return result
+}
+
+// prune removes buckets that have refilled completely,
+// as they're indistinguishable from new ones.
+func (l *rateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Requests) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// clientIdentity returns the identity of the client making req,
+// using [Options.ClientIdentity] if set or the remote IP address otherwise.
+func (r *registry) clientIdentity(req *http.Request) string {
+	if r.opts.ClientIdentity != nil {
+		return r.opts.ClientIdentity(req)
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// checkRateLimit consults [Options.RateLimiter] about rreq. It sets
+// the RateLimit headers on manifest GETs and rejected requests, and
+// returns an [oci.ErrTooManyRequests] error if the request isn't allowed.
+func (r *registry) checkRateLimit(resp http.ResponseWriter, req *http.Request, rreq *ocirequest.Request) error {
+	if r.opts.RateLimiter == nil {
+		return nil
+	}
+	result := r.opts.RateLimiter.Allow(&RateLimitRequest{
+		Client:  r.clientIdentity(req),
+		Kind:    rreq.Kind.String(),
+		Repo:    rreq.Repo,
+		Request: req,
+	})
+	if result.Limit > 0 && (!result.Allowed || rreq.Kind == ocirequest.ReqManifestGet) {
+		// Use the same form as Docker Hub, for example "100;w=21600".
+		window := strconv.FormatInt(int64(math.Ceil(result.Window.Seconds())), 10)
+		resp.Header().Set("RateLimit-Limit", fmt.Sprintf("%d;w=%s", result.Limit, window))
+		resp.Header().Set("RateLimit-Remaining", fmt.Sprintf("%d;w=%s", result.Remaining, window))
+	}
+	if result.Allowed {
+		return nil
+	}
+	retryAfter := max(int64(math.Ceil(result.RetryAfter.Seconds())), 1)
+	resp.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	return oci.NewError(
+		fmt.Sprintf("rate limit exceeded for %s requests; retry after %ds", rreq.Kind, retryAfter),
+		oci.ErrTooManyRequests.Code(),
+		nil,
+	)
+}
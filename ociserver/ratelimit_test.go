@@ -0,0 +1,134 @@
+package ociserver_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/ociclient"
+	"github.com/jcarter3/oci/ocimem"
+	"github.com/jcarter3/oci/ociserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitManifestGet(t *testing.T) {
+	r := pushTags(t, "v1")
+	srv := httptest.NewServer(ociserver.New(r, &ociserver.Options{
+		RateLimiter: ociserver.NewRateLimiter(ociserver.RateLimit{}, map[string]ociserver.RateLimit{
+			"ManifestGet": {Requests: 2, Window: time.Hour},
+		}),
+		ClientIdentity: func(req *http.Request) string {
+			return req.Header.Get("X-Client")
+		},
+	}))
+	defer srv.Close()
+
+	get := func(client string) *http.Response {
+		req, err := http.NewRequest("GET", srv.URL+"/v2/foo/manifests/v1", nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Client", client)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	for _, remaining := range []string{"1;w=3600", "0;w=3600"} {
+		resp := get("alice")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "2;w=3600", resp.Header.Get("RateLimit-Limit"))
+		require.Equal(t, remaining, resp.Header.Get("RateLimit-Remaining"))
+		require.Empty(t, resp.Header.Get("Retry-After"))
+	}
+
+	req, err := http.NewRequest("GET", srv.URL+"/v2/foo/manifests/v1", nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Client", "alice")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, "1800", resp.Header.Get("Retry-After"))
+	require.Equal(t, "2;w=3600", resp.Header.Get("RateLimit-Limit"))
+	require.Equal(t, "0;w=3600", resp.Header.Get("RateLimit-Remaining"))
+	var werrs oci.WireErrors
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&werrs))
+	require.Equal(t, "TOOMANYREQUESTS", werrs.Errors[0].Code_)
+
+	// Other clients have their own quota.
+	resp = get("bob")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Other kinds of request aren't limited and don't get the headers.
+	req, err = http.NewRequest("HEAD", srv.URL+"/v2/foo/manifests/v1", nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Client", "alice")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Empty(t, resp.Header.Get("RateLimit-Limit"))
+}
+
+func TestRateLimitClientError(t *testing.T) {
+	ctx := context.Background()
+	r := pushTags(t, "v1")
+	srv := httptest.NewServer(ociserver.New(r, &ociserver.Options{
+		RateLimiter: ociserver.NewRateLimiter(ociserver.RateLimit{Requests: 1, Window: time.Minute}, nil),
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	client, err := ociclient.New(u.Host, &ociclient.Options{
+		Insecure: true,
+	})
+	require.NoError(t, err)
+
+	// Each kind of request has its own quota.
+	_, err = client.ResolveTag(ctx, "foo", "v1")
+	require.NoError(t, err)
+	rd, err := client.GetTag(ctx, "foo", "v1")
+	require.NoError(t, err)
+	rd.Close()
+	_, err = client.GetTag(ctx, "foo", "v1")
+	require.ErrorIs(t, err, oci.ErrTooManyRequests)
+	_, err = client.ResolveTag(ctx, "foo", "v1")
+	require.ErrorIs(t, err, oci.ErrTooManyRequests)
+}
+
+func TestRateLimiterRequest(t *testing.T) {
+	var limiter recordingLimiter
+	srv := httptest.NewServer(ociserver.New(ocimem.New(), &ociserver.Options{
+		RateLimiter: &limiter,
+	}))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/v2/foo/bar/tags/list")
+	require.NoError(t, err)
+	resp.Body.Close()
+	resp, err = http.Get(srv.URL + "/v2/")
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	require.Len(t, limiter.reqs, 2)
+	require.Equal(t, "127.0.0.1", limiter.reqs[0].Client)
+	require.Equal(t, "TagsList", limiter.reqs[0].Kind)
+	require.Equal(t, "foo/bar", limiter.reqs[0].Repo)
+	require.Equal(t, "Ping", limiter.reqs[1].Kind)
+	require.Contains(t, ociserver.RequestKinds, "ManifestGet")
+}
+
+type recordingLimiter struct {
+	mu   sync.Mutex
+	reqs []ociserver.RateLimitRequest
+}
+
+func (l *recordingLimiter) Allow(req *ociserver.RateLimitRequest) ociserver.RateLimitResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reqs = append(l.reqs, *req)
+	return ociserver.RateLimitResult{Allowed: true}
+}
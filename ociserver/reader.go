@@ -29,8 +29,12 @@ func (r *registry) handleBlobHead(ctx context.Context, resp http.ResponseWriter,
 	if err != nil {
 		return err
 	}
+	if notModified(resp, req, desc.Digest) {
+		return nil
+	}
 	resp.Header().Set("Content-Length", fmt.Sprint(desc.Size))
 	resp.Header().Set("Docker-Content-Digest", string(desc.Digest))
+	resp.Header().Set("ETag", etag(desc.Digest))
 	// TODO this is true in theory, but what if the backend doesn't support GetBlobRange ?
 	resp.Header().Set("Accept-Ranges", "bytes")
 	resp.WriteHeader(http.StatusOK)
@@ -38,6 +42,17 @@ func (r *registry) handleBlobHead(ctx context.Context, resp http.ResponseWriter,
 }
 
 func (r *registry) handleBlobGet(ctx context.Context, resp http.ResponseWriter, req *http.Request, rreq *ocirequest.Request) error {
+	if req.Header.Get("If-None-Match") != "" {
+		// Check that the blob exists before telling
+		// the client that its copy is up to date.
+		desc, err := r.backend.ResolveBlob(ctx, rreq.Repo, oci.Digest(rreq.Digest))
+		if err != nil {
+			return err
+		}
+		if notModified(resp, req, desc.Digest) {
+			return nil
+		}
+	}
 	if r.opts.LocationsForDescriptor != nil {
 		// We need to find information on the blob before we can determine
 		// what to pass back, so resolve the blob first so we don't
@@ -66,6 +81,9 @@ func (r *registry) handleBlobGet(ctx context.Context, resp http.ResponseWriter,
 	if err != nil {
 		return withHTTPCode(http.StatusRequestedRangeNotSatisfiable, err)
 	}
+	if r.opts.Quirks.IgnoreRangeRequests {
+		ranges = nil
+	}
 	switch len(ranges) {
 	case 0:
 		blob, err := r.backend.GetBlob(ctx, rreq.Repo, oci.Digest(rreq.Digest))
@@ -77,6 +95,7 @@ func (r *registry) handleBlobGet(ctx context.Context, resp http.ResponseWriter,
 		resp.Header().Set("Content-Type", desc.MediaType)
 		resp.Header().Set("Content-Length", fmt.Sprint(desc.Size))
 		resp.Header().Set("Docker-Content-Digest", rreq.Digest)
+		resp.Header().Set("ETag", etag(oci.Digest(rreq.Digest)))
 		resp.WriteHeader(http.StatusOK)
 
 		io.Copy(resp, blob)
@@ -102,6 +121,7 @@ func (r *registry) handleBlobGet(ctx context.Context, resp http.ResponseWriter,
 		resp.Header().Set("Content-Type", desc.MediaType)
 		resp.Header().Set("Content-Length", fmt.Sprint(rng.end-rng.start))
 		resp.Header().Set("Docker-Content-Digest", rreq.Digest)
+		resp.Header().Set("ETag", etag(oci.Digest(rreq.Digest)))
 		resp.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rng.start, rng.end-1, desc.Size))
 		resp.WriteHeader(http.StatusPartialContent)
 
@@ -115,6 +135,17 @@ func (r *registry) handleBlobGet(ctx context.Context, resp http.ResponseWriter,
 
 func (r *registry) handleManifestGet(ctx context.Context, resp http.ResponseWriter, req *http.Request, rreq *ocirequest.Request) error {
 	// TODO we could do a redirect here too if we thought it was worthwhile.
+	if req.Header.Get("If-None-Match") != "" {
+		// Resolve the manifest first so that we avoid
+		// fetching its content when it's not needed.
+		desc, err := r.resolveManifest(ctx, rreq)
+		if err != nil {
+			return err
+		}
+		if notModified(resp, req, desc.Digest) {
+			return nil
+		}
+	}
 	var mr oci.BlobReader
 	var err error
 	if rreq.Tag != "" {
@@ -129,6 +160,7 @@ func (r *registry) handleManifestGet(ctx context.Context, resp http.ResponseWrit
 	if !r.opts.OmitDigestFromTagGetResponse {
 		resp.Header().Set("Docker-Content-Digest", string(desc.Digest))
 	}
+	resp.Header().Set("ETag", etag(desc.Digest))
 	resp.Header().Set("Content-Type", desc.MediaType)
 	resp.Header().Set("Content-Length", fmt.Sprint(desc.Size))
 	resp.WriteHeader(http.StatusOK)
@@ -137,16 +169,13 @@ func (r *registry) handleManifestGet(ctx context.Context, resp http.ResponseWrit
 }
 
 func (r *registry) handleManifestHead(ctx context.Context, resp http.ResponseWriter, req *http.Request, rreq *ocirequest.Request) error {
-	var desc oci.Descriptor
-	var err error
-	if rreq.Tag != "" {
-		desc, err = r.backend.ResolveTag(ctx, rreq.Repo, rreq.Tag)
-	} else {
-		desc, err = r.backend.ResolveManifest(ctx, rreq.Repo, oci.Digest(rreq.Digest))
-	}
+	desc, err := r.resolveManifest(ctx, rreq)
 	if err != nil {
 		return err
 	}
+	if notModified(resp, req, desc.Digest) {
+		return nil
+	}
 	if !r.opts.OmitDigestFromTagGetResponse || rreq.Tag != "" {
 		// Note: when doing a HEAD of a tag, clients are entitled
 		// to expect that the digest header is set on the response
@@ -154,8 +183,18 @@ func (r *registry) handleManifestHead(ctx context.Context, resp http.ResponseWri
 		// TODO raise an issue on the spec about this.
 		resp.Header().Set("Docker-Content-Digest", string(desc.Digest))
 	}
+	resp.Header().Set("ETag", etag(desc.Digest))
 	resp.Header().Set("Content-Type", desc.MediaType)
 	resp.Header().Set("Content-Length", fmt.Sprint(desc.Size))
 	resp.WriteHeader(http.StatusOK)
 	return nil
 }
+
+// resolveManifest resolves the manifest named by rreq,
+// which may refer to it by tag or by digest.
+func (r *registry) resolveManifest(ctx context.Context, rreq *ocirequest.Request) (oci.Descriptor, error) {
+	if rreq.Tag != "" {
+		return r.backend.ResolveTag(ctx, rreq.Repo, rreq.Tag)
+	}
+	return r.backend.ResolveManifest(ctx, rreq.Repo, oci.Digest(rreq.Digest))
+}
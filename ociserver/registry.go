@@ -22,18 +22,19 @@ package ociserver
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"sync/atomic"
+	"time"
 
 	"github.com/jcarter3/oci"
 	"github.com/jcarter3/oci/internal/ocirequest"
+	"github.com/jcarter3/oci/ocidebug"
+	"github.com/jcarter3/oci/ocimetrics"
+	"github.com/jcarter3/oci/ocitrace"
 	ocispecroot "github.com/opencontainers/image-spec/specs-go"
 )
 
-// debug causes debug messages to be emitted when running the server.
-const debug = false
-
 var v2 = ocispecroot.Versioned{
 	SchemaVersion: 2,
 }
@@ -112,6 +113,69 @@ type Options struct {
 	// isn't always what is wanted?
 	LocationsForDescriptor func(isManifest bool, desc oci.Descriptor) ([]string, error)
 
+	// Quirks holds a set of non-standard behaviors to emulate,
+	// such as [QuirksECR]. Quirks that have an equivalent field
+	// in Options are enabled when either is set.
+	//
+	// When WriteError is nil, errors are written in the
+	// form dictated by the quirks.
+	Quirks Quirks
+
+	// Metrics, if non-nil, is used to record the number of
+	// requests served by request kind and response status, and their
+	// latency. Use [ocimetrics.New] on the backend to record metrics
+	// on the registry operations that the requests make.
+	Metrics *ocimetrics.Metrics
+
+	// Logger, if non-nil, is used to log each request served, at
+	// [slog.LevelInfo], or [slog.LevelError] for responses
+	// with a 5xx status.
+	//
+	// Each request is given an ID, taken from any X-Request-Id
+	// header that holds up to 128 letters, digits, ".", "_" or "-",
+	// or generated from DebugID otherwise, and attached
+	// to the context passed to the backend with
+	// [ocidebug.ContextWithRequestID], so that backend calls
+	// logged by [ocidebug.NewLogger] or by
+	// [github.com/jcarter3/oci/ociclient] can be correlated
+	// with the request that caused them.
+	Logger *slog.Logger
+
+	// Tracer, if non-nil, is used to start a span for each request,
+	// continuing any trace given by the request's traceparent
+	// header. The span is active in the context passed to the
+	// backend, so a backend created by
+	// [github.com/jcarter3/oci/ociclient] will report its
+	// spans as children and propagate the trace upstream.
+	Tracer ocitrace.Tracer
+
+	// RateLimiter, if non-nil, is consulted before each request is
+	// handled. A request that it doesn't allow fails with a 429 (Too
+	// Many Requests) response carrying a Retry-After header. The
+	// RateLimit-Limit and RateLimit-Remaining headers, in the form
+	// used by Docker Hub, are added to that response and to manifest
+	// GET responses. See [NewRateLimiter] for a simple implementation.
+	RateLimiter RateLimiter
+
+	// ClientIdentity returns the identity of the client making a
+	// request, for RateLimiter. It might, for example, return the
+	// subject of the request's credentials. If it's nil, the remote
+	// IP address of the request is used.
+	ClientIdentity func(req *http.Request) string
+
+	// MaxManifestSize, if > 0, causes manifest PUT requests with
+	// a body larger than this many bytes to fail with a
+	// MANIFEST_INVALID error without the whole body being read.
+	MaxManifestSize int64
+
+	// ValidateManifest, if non-nil, is called with the Content-Type
+	// and contents of each manifest PUT request before the manifest
+	// is pushed to the backend. If it returns an error, the request
+	// fails with that error. The Check method of
+	// [github.com/jcarter3/oci/ocifilter.ManifestPolicy] can be
+	// used here.
+	ValidateManifest func(mediaType string, data []byte) error
+
 	DebugID string
 }
 
@@ -145,21 +209,21 @@ func New(backend oci.Interface, opts *Options) http.Handler {
 	if r.opts.DebugID == "" {
 		r.opts.DebugID = fmt.Sprintf("ociserver%d", atomic.AddInt32(&debugID, 1))
 	}
+	applyQuirks(&r.opts)
 	if r.opts.WriteError == nil {
 		r.opts.WriteError = func(w http.ResponseWriter, _ *http.Request, err error) {
-			oci.WriteError(w, err)
+			writeQuirkError(w, err, &r.opts.Quirks)
 		}
 	}
 	return r
 }
 
-func (r *registry) logf(f string, a ...any) {
-	log.Printf("ociserver %s: %s", r.opts.DebugID, fmt.Sprintf(f, a...))
-}
-
 type registry struct {
 	opts    Options
 	backend oci.Interface
+
+	// numRequests is used to generate request IDs.
+	numRequests atomic.Int64
 }
 
 var handlers = []func(r *registry, ctx context.Context, w http.ResponseWriter, req *http.Request, rreq *ocirequest.Request) error{
@@ -183,31 +247,82 @@ var handlers = []func(r *registry, ctx context.Context, w http.ResponseWriter, r
 }
 
 func (r *registry) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	ctx := ocitrace.Extract(req.Context(), req.Header)
+	if ocidebug.RequestIDFromContext(ctx) == "" {
+		id := req.Header.Get("X-Request-Id")
+		if !validRequestID(id) {
+			id = fmt.Sprintf("%s-%d", r.opts.DebugID, r.numRequests.Add(1))
+		}
+		ctx = ocidebug.ContextWithRequestID(ctx, id)
+	}
+	var span ocitrace.Span
+	if r.opts.Tracer != nil {
+		ctx, span = ocitrace.Start(ocitrace.ContextWithTracer(ctx, r.opts.Tracer), "ociserver.ServeHTTP",
+			ocitrace.String("http.request.method", req.Method),
+			ocitrace.String("url.path", req.URL.Path),
+		)
+	}
+	req = req.WithContext(ctx)
+	var rresp *recordingResponseWriter
+	if r.opts.Metrics != nil || r.opts.Logger != nil || span != nil {
+		rresp = &recordingResponseWriter{
+			ResponseWriter: resp,
+		}
+		resp = rresp
+		start := time.Now()
+		defer func() {
+			r.observe(req, rresp, time.Since(start), span)
+		}()
+	}
 	if rerr := r.v2(resp, req); rerr != nil {
+		if rresp != nil {
+			rresp.err = rerr
+		}
 		r.opts.WriteError(resp, req, rerr)
 		return
 	}
 }
 
-// https://docs.docker.com/registry/spec/api/#api-version-check
-// https://github.com/opencontainers/distribution-spec/blob/master/spec.md#api-version-check
-func (r *registry) v2(resp http.ResponseWriter, req *http.Request) (_err error) {
-	if debug {
-		r.logf("registry.v2 %v %s {", req.Method, req.URL)
-		defer func() {
-			if _err != nil {
-				r.logf("} -> %v", _err)
-			} else {
-				r.logf("}")
-			}
-		}()
+// maxRequestIDLen holds the maximum length of a request
+// ID accepted from an X-Request-Id header.
+const maxRequestIDLen = 128
+
+// validRequestID reports whether id is acceptable as a request ID
+// taken from a client. IDs are restricted to a short run of
+// letters, digits and the characters ".", "_" and "-", so that
+// clients can't inject arbitrary content into logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range []byte(id) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '.', c == '_', c == '-':
+		default:
+			return false
+		}
 	}
+	return true
+}
 
+// https://docs.docker.com/registry/spec/api/#api-version-check
+// https://github.com/opencontainers/distribution-spec/blob/master/spec.md#api-version-check
+func (r *registry) v2(resp http.ResponseWriter, req *http.Request) error {
 	rreq, err := ocirequest.Parse(req.Method, req.URL)
 	if err != nil {
 		resp.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
 		return err
 	}
+	if r.opts.Quirks.IgnoreListPageSize {
+		rreq.ListN = -1
+	}
+	if rresp, ok := resp.(*recordingResponseWriter); ok {
+		rresp.rreq = rreq
+	}
+	if err := r.checkRateLimit(resp, req, rreq); err != nil {
+		return err
+	}
 	handle := handlers[rreq.Kind]
 	return handle(r, req.Context(), resp, req, rreq)
 }
@@ -236,3 +351,100 @@ func (r *registry) setLocationHeader(resp http.ResponseWriter, isManifest bool,
 	resp.Header().Set("Docker-Content-Digest", string(desc.Digest))
 	return nil
 }
+
+// observe records a completed request in the configured
+// metrics and logger, and ends its span if it has one.
+func (r *registry) observe(req *http.Request, resp *recordingResponseWriter, d time.Duration, span ocitrace.Span) {
+	kind := "Unknown"
+	if resp.rreq != nil {
+		kind = resp.rreq.Kind.String()
+	}
+	status := resp.statusCode()
+	if span != nil {
+		span.SetAttributes(
+			ocitrace.String("oci.request_kind", kind),
+			ocitrace.Int("http.response.status_code", status),
+		)
+		if resp.rreq != nil && resp.rreq.Repo != "" {
+			span.SetAttributes(ocitrace.String(ocitrace.KeyRepo, resp.rreq.Repo))
+		}
+		ocitrace.End(span, resp.err)
+	}
+	if r.opts.Metrics != nil {
+		r.opts.Metrics.ObserveHTTPRequest(kind, status, d)
+	}
+	if r.opts.Logger == nil {
+		return
+	}
+	ctx := req.Context()
+	level := slog.LevelInfo
+	if status >= 500 {
+		level = slog.LevelError
+	}
+	if !r.opts.Logger.Enabled(ctx, level) {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.String(ocidebug.KeyRequestID, ocidebug.RequestIDFromContext(ctx)),
+		slog.String("server", r.opts.DebugID),
+		slog.String("http_method", req.Method),
+		slog.String("path", req.URL.Path),
+		slog.String("kind", kind),
+	}
+	if rreq := resp.rreq; rreq != nil {
+		if rreq.Repo != "" {
+			attrs = append(attrs, slog.String(ocidebug.KeyRepo, rreq.Repo))
+		}
+		if rreq.Digest != "" {
+			attrs = append(attrs, slog.String(ocidebug.KeyDigest, rreq.Digest))
+		}
+		if rreq.Tag != "" {
+			attrs = append(attrs, slog.String(ocidebug.KeyTag, rreq.Tag))
+		}
+	}
+	attrs = append(attrs,
+		slog.Int("status", status),
+		slog.Int64(ocidebug.KeyBytes, resp.n),
+		slog.Duration(ocidebug.KeyDuration, d),
+	)
+	attrs = append(attrs, ocidebug.ErrorAttrs(resp.err)...)
+	r.opts.Logger.LogAttrs(ctx, level, "ociserver request", attrs...)
+}
+
+// recordingResponseWriter records the response status,
+// size and error, and the parsed request, for
+// [Options.Metrics] and [Options.Logger].
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	rreq   *ocirequest.Request
+	status int
+	n      int64
+	err    error
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(buf []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(buf)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *recordingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *recordingResponseWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
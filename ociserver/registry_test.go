@@ -19,6 +19,7 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"path"
 	"strings"
 	"testing"
 
@@ -63,6 +64,10 @@ func TestCalls(t *testing.T) {
 		BlobStream    map[string]string
 		RequestHeader map[string]string
 
+		// Upload starts a chunked upload before the request.
+		// Its ID replaces {upload} in URL, BlobStream and WantHeader.
+		Upload bool
+
 		// Response
 		WantCode   int
 		WantHeader map[string]string
@@ -233,7 +238,8 @@ func TestCalls(t *testing.T) {
 		{
 			Description: "upload_put_missing_digest",
 			Method:      "PUT",
-			URL:         "/v2/foo/blobs/uploads/MQ",
+			URL:         "/v2/foo/blobs/uploads/{upload}",
+			Upload:      true,
 			WantCode:    http.StatusBadRequest,
 			WantBody:    `{"errors":[{"code":"DIGEST_INVALID","message":"badly formed digest"}]}`,
 		},
@@ -256,7 +262,8 @@ func TestCalls(t *testing.T) {
 		{
 			Description: "upload_good_digest",
 			Method:      "PUT",
-			URL:         "/v2/foo/blobs/uploads/MQ?digest=sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			URL:         "/v2/foo/blobs/uploads/{upload}?digest=sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			Upload:      true,
 			WantCode:    http.StatusCreated,
 			Body:        "foo",
 			WantHeader:  map[string]string{"Docker-Content-Digest": "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"},
@@ -264,7 +271,8 @@ func TestCalls(t *testing.T) {
 		{
 			Description: "upload_bad_digest",
 			Method:      "PUT",
-			URL:         "/v2/foo/blobs/uploads/MQ?digest=sha256:baddigest",
+			URL:         "/v2/foo/blobs/uploads/{upload}?digest=sha256:baddigest",
+			Upload:      true,
 			WantCode:    http.StatusBadRequest,
 			Body:        "foo",
 			WantBody:    `{"errors":[{"code":"DIGEST_INVALID","message":"badly formed digest"}]}`,
@@ -272,7 +280,8 @@ func TestCalls(t *testing.T) {
 		{
 			Description: "stream_upload",
 			Method:      "PATCH",
-			URL:         "/v2/foo/blobs/uploads/MQ",
+			URL:         "/v2/foo/blobs/uploads/{upload}",
+			Upload:      true,
 			WantCode:    http.StatusAccepted,
 			Body:        "foo",
 			RequestHeader: map[string]string{
@@ -280,23 +289,25 @@ func TestCalls(t *testing.T) {
 			},
 			WantHeader: map[string]string{
 				"Range":    "0-2",
-				"Location": "/v2/foo/blobs/uploads/MQ",
+				"Location": "/v2/foo/blobs/uploads/{upload}",
 			},
 		},
 		{
 			skip:        true,
 			Description: "stream_duplicate_upload",
 			Method:      "PATCH",
-			URL:         "/v2/foo/blobs/uploads/MQ",
+			URL:         "/v2/foo/blobs/uploads/{upload}",
+			Upload:      true,
 			WantCode:    http.StatusBadRequest,
 			Body:        "foo",
-			BlobStream:  map[string]string{"MQ": "foo"},
+			BlobStream:  map[string]string{"{upload}": "foo"},
 		},
 		{
 			Description: "stream_finish_upload",
 			Method:      "PUT",
-			URL:         "/v2/foo/blobs/uploads/MQ?digest=sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
-			BlobStream:  map[string]string{"MQ": "foo"},
+			URL:         "/v2/foo/blobs/uploads/{upload}?digest=sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			Upload:      true,
+			BlobStream:  map[string]string{"{upload}": "foo"},
 			WantCode:    http.StatusCreated,
 			WantHeader:  map[string]string{"Docker-Content-Digest": "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"},
 		},
@@ -401,19 +412,21 @@ func TestCalls(t *testing.T) {
 		{
 			Description:   "Chunk_upload_start",
 			Method:        "PATCH",
-			URL:           "/v2/foo/blobs/uploads/MQ",
+			URL:           "/v2/foo/blobs/uploads/{upload}",
+			Upload:        true,
 			RequestHeader: map[string]string{"Content-Range": "0-2"},
 			WantCode:      http.StatusAccepted,
 			Body:          "foo",
 			WantHeader: map[string]string{
 				"Range":    "0-2",
-				"Location": "/v2/foo/blobs/uploads/MQ",
+				"Location": "/v2/foo/blobs/uploads/{upload}",
 			},
 		},
 		{
 			Description:   "Chunk_upload_bad_content_range",
 			Method:        "PATCH",
-			URL:           "/v2/foo/blobs/uploads/MQ",
+			URL:           "/v2/foo/blobs/uploads/{upload}",
+			Upload:        true,
 			RequestHeader: map[string]string{"Content-Range": "0-bar"},
 			// TODO the original had 405 response here. Which is correct?
 			WantCode: http.StatusBadRequest,
@@ -423,8 +436,9 @@ func TestCalls(t *testing.T) {
 		{
 			Description:   "Chunk_upload_overlaps_previous_data",
 			Method:        "PATCH",
-			URL:           "/v2/foo/blobs/uploads/MQ",
-			BlobStream:    map[string]string{"MQ": "foo"},
+			URL:           "/v2/foo/blobs/uploads/{upload}",
+			Upload:        true,
+			BlobStream:    map[string]string{"{upload}": "foo"},
 			RequestHeader: map[string]string{"Content-Range": "2-4"},
 			WantCode:      http.StatusRequestedRangeNotSatisfiable,
 			Body:          "bar",
@@ -433,14 +447,15 @@ func TestCalls(t *testing.T) {
 		{
 			Description:   "Chunk_upload_after_previous_data",
 			Method:        "PATCH",
-			URL:           "/v2/foo/blobs/uploads/MQ",
-			BlobStream:    map[string]string{"MQ": "foo"},
+			URL:           "/v2/foo/blobs/uploads/{upload}",
+			Upload:        true,
+			BlobStream:    map[string]string{"{upload}": "foo"},
 			RequestHeader: map[string]string{"Content-Range": "3-5"},
 			WantCode:      http.StatusAccepted,
 			Body:          "bar",
 			WantHeader: map[string]string{
 				"Range":    "0-5",
-				"Location": "/v2/foo/blobs/uploads/MQ",
+				"Location": "/v2/foo/blobs/uploads/{upload}",
 			},
 		},
 		{
@@ -616,6 +631,31 @@ func TestCalls(t *testing.T) {
 				}
 			}
 
+			if tc.Upload {
+				req, _ := http.NewRequest("POST", s.URL+"/v2/foo/blobs/uploads/", nil)
+				t.Log(req.Method, req.URL)
+				resp, err := s.Client().Do(req)
+				if err != nil {
+					t.Fatalf("Error starting upload: %v", err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusAccepted {
+					t.Fatalf("Error starting upload got status: %d", resp.StatusCode)
+				}
+				id := path.Base(resp.Header.Get("Location"))
+				tc.URL = strings.ReplaceAll(tc.URL, "{upload}", id)
+				blobStream := make(map[string]string)
+				for upload, contents := range tc.BlobStream {
+					blobStream[strings.ReplaceAll(upload, "{upload}", id)] = contents
+				}
+				tc.BlobStream = blobStream
+				wantHeader := make(map[string]string)
+				for k, v := range tc.WantHeader {
+					wantHeader[k] = strings.ReplaceAll(v, "{upload}", id)
+				}
+				tc.WantHeader = wantHeader
+			}
+
 			for upload, contents := range tc.BlobStream {
 				req, err := http.NewRequest(
 					"PATCH",
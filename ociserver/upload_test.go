@@ -0,0 +1,38 @@
+package ociserver_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/jcarter3/oci/ocimem"
+	"github.com/jcarter3/oci/ociserver"
+)
+
+func TestExpiredUpload(t *testing.T) {
+	srv := httptest.NewServer(ociserver.New(ocimem.NewWithConfig(&ocimem.Config{
+		UploadTTL: 50 * time.Millisecond,
+	}), nil))
+	defer srv.Close()
+
+	resp := doRequest(t, "POST", srv.URL+"/v2/foo/blobs/uploads/", nil, nil)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode, "body: %s", readBody(t, resp))
+	resp.Body.Close()
+	location := resp.Header.Get("Location")
+	require.NotEmpty(t, location)
+
+	resp = doRequest(t, "GET", srv.URL+location, nil, nil)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode, "body: %s", readBody(t, resp))
+	resp.Body.Close()
+
+	// Once the session has been inactive for longer than
+	// the TTL, the registry no longer knows about it.
+	time.Sleep(100 * time.Millisecond)
+	resp = doRequest(t, "GET", srv.URL+location, nil, nil)
+	body := readBody(t, resp)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode, "body: %s", body)
+	require.Contains(t, body, "BLOB_UPLOAD_UNKNOWN")
+}
@@ -0,0 +1,40 @@
+package ociserver_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jcarter3/oci/ocifilter"
+	"github.com/jcarter3/oci/ocimem"
+	"github.com/jcarter3/oci/ociserver"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateManifest(t *testing.T) {
+	srv := httptest.NewServer(ociserver.New(ocimem.New(), &ociserver.Options{
+		MaxManifestSize:  100,
+		ValidateManifest: (&ocifilter.ManifestPolicy{}).Check,
+	}))
+	defer srv.Close()
+
+	resp := doRequest(t, "PUT", srv.URL+"/v2/foo/manifests/v1", map[string]string{
+		"Content-Type": ocispec.MediaTypeImageManifest,
+	}, []byte(`{"schemaVersion": 2, "mediaType": "`+ocispec.MediaTypeImageIndex+`", "manifests": []}`))
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.Contains(t, readBody(t, resp), "does not match content type")
+
+	resp = doRequest(t, "PUT", srv.URL+"/v2/foo/manifests/v1", map[string]string{
+		"Content-Type": ocispec.MediaTypeImageIndex,
+	}, []byte(`{"schemaVersion": 2, "manifests": [], "annotations": {"x": "`+strings.Repeat("x", 100)+`"}}`))
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.Contains(t, readBody(t, resp), "manifest exceeds limit of 100 bytes")
+
+	resp = doRequest(t, "PUT", srv.URL+"/v2/foo/manifests/v1", map[string]string{
+		"Content-Type": ocispec.MediaTypeImageIndex,
+	}, []byte(`{"schemaVersion": 2, "manifests": []}`))
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp.Body.Close()
+}
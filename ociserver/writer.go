@@ -87,6 +87,9 @@ func (r *registry) handleBlobUploadInfo(ctx context.Context, resp http.ResponseW
 }
 
 func (r *registry) handleBlobUploadChunk(ctx context.Context, resp http.ResponseWriter, req *http.Request, rreq *ocirequest.Request) error {
+	if r.opts.Quirks.DisableChunkedUpload {
+		return badAPIUseError("chunked uploads are not supported")
+	}
 	// Note that the spec requires chunked upload PATCH requests to include Content-Range,
 	// but the conformance tests do not actually follow that as of the time of writing.
 	// Allow the missing header to result in start=0, meaning we assume it's the first chunk.
@@ -168,16 +171,31 @@ func (r *registry) handleManifestPut(ctx context.Context, resp http.ResponseWrit
 	if mediaType == "" {
 		mediaType = mediaTypeOctetStream
 	}
-	// TODO check that the media type is valid?
-	// TODO size limit
-	data, err := io.ReadAll(req.Body)
+	var body io.Reader = req.Body
+	if r.opts.MaxManifestSize > 0 {
+		body = io.LimitReader(body, r.opts.MaxManifestSize+1)
+	}
+	data, err := io.ReadAll(body)
 	if err != nil {
 		return fmt.Errorf("cannot read content: %v", err)
 	}
+	if r.opts.MaxManifestSize > 0 && int64(len(data)) > r.opts.MaxManifestSize {
+		return fmt.Errorf("%w: manifest exceeds limit of %d bytes", oci.ErrManifestInvalid, r.opts.MaxManifestSize)
+	}
+	if r.opts.ValidateManifest != nil {
+		if err := r.opts.ValidateManifest(mediaType, data); err != nil {
+			return err
+		}
+	}
 	dig := digest.FromBytes(data)
 	params := &oci.PushManifestParameters{}
 	if rreq.Tag != "" {
+		ifTagDigest, err := r.tagPrecondition(ctx, req, rreq)
+		if err != nil {
+			return err
+		}
 		params.Tags = []string{rreq.Tag}
+		params.IfTagDigest = ifTagDigest
 	} else {
 		if oci.Digest(rreq.Digest) != dig {
 			return oci.ErrDigestInvalid
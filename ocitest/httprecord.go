@@ -0,0 +1,565 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocitest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/rogpeppe/go-internal/txtar"
+)
+
+// RecordEnvVar holds the name of the environment variable
+// that causes [NewTestTransport] to record exchanges
+// rather than replay them.
+const RecordEnvVar = "OCITEST_RECORD"
+
+// redacted is used in place of any secret value in a recording.
+const redacted = "REDACTED"
+
+// Request headers that are not recorded because they vary
+// between runs or are added by the client regardless of the request.
+var unrecordedRequestHeaders = []string{
+	"Expect",
+	"User-Agent",
+}
+
+// replayMatchHeaders holds the request headers that must match
+// for a recorded exchange to be chosen when replaying.
+var replayMatchHeaders = []string{
+	"Accept",
+	"Authorization",
+	"Content-Range",
+	"Content-Type",
+	"Range",
+}
+
+// Fields in JSON token responses that hold secrets.
+var secretJSONFields = []string{
+	"access_token",
+	"refresh_token",
+	"token",
+}
+
+// Fields in form-encoded token requests that hold secrets.
+var secretFormFields = []string{
+	"password",
+	"refresh_token",
+}
+
+// Query parameters that hold signatures or credentials in
+// pre-signed URLs, such as the blob redirects issued by S3, GCS
+// and Azure storage. They're compared case-insensitively.
+var secretQueryParams = []string{
+	"sig",
+	"signature",
+	"x-amz-credential",
+	"x-amz-security-token",
+	"x-amz-signature",
+	"x-goog-credential",
+	"x-goog-signature",
+}
+
+// Exchange holds a single recorded HTTP request and its response.
+type Exchange struct {
+	Method         string
+	URL            string
+	RequestHeader  http.Header
+	RequestBody    []byte
+	StatusCode     int
+	ResponseHeader http.Header
+	ResponseBody   []byte
+}
+
+// Recorder is an [http.RoundTripper] that forwards requests to
+// an underlying transport and records the exchanges, including any
+// auth challenges and token requests. Secrets such as Authorization
+// headers, tokens in responses and signatures in pre-signed
+// URLs are redacted.
+//
+// Response bodies are read in full, so a Recorder is not
+// suitable for large blobs.
+type Recorder struct {
+	transport http.RoundTripper
+
+	mu        sync.Mutex
+	exchanges []*Exchange
+}
+
+// NewRecorder returns a Recorder that sends requests to transport.
+// If transport is nil, [http.DefaultTransport] will be used.
+func NewRecorder(transport http.RoundTripper) *Recorder {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &Recorder{
+		transport: transport,
+	}
+}
+
+// RoundTrip implements [http.RoundTripper.RoundTrip].
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		data, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		reqBody = data
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(data))
+	}
+	resp, err := r.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	x := &Exchange{
+		Method:         req.Method,
+		URL:            redactURL(req.URL.String()),
+		RequestHeader:  redactRequestHeader(req.Header),
+		RequestBody:    redactForm(req.Header, reqBody),
+		StatusCode:     resp.StatusCode,
+		ResponseHeader: resp.Header.Clone(),
+		ResponseBody:   redactJSON(resp.Header, respBody),
+	}
+	if len(x.ResponseBody) != len(respBody) && x.ResponseHeader.Get("Content-Length") != "" {
+		x.ResponseHeader.Set("Content-Length", strconv.Itoa(len(x.ResponseBody)))
+	}
+	if x.ResponseHeader.Get("Set-Cookie") != "" {
+		x.ResponseHeader.Set("Set-Cookie", redacted)
+	}
+	if loc := x.ResponseHeader.Get("Location"); loc != "" {
+		x.ResponseHeader.Set("Location", redactURL(loc))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.exchanges = append(r.exchanges, x)
+	return resp, nil
+}
+
+// Exchanges returns all the exchanges recorded so far, in
+// the order that they completed.
+func (r *Recorder) Exchanges() []*Exchange {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.exchanges)
+}
+
+// Archive returns the recorded exchanges in txtar format.
+// Each exchange is represented by two files: one named
+// "request METHOD URL" holding the request headers and body,
+// and one named "response STATUS" holding the response headers and body.
+// The headers and body are separated by an empty line.
+//
+// When a body is not valid UTF-8, or could be confused with
+// the txtar file separator, it is base64-encoded and the file name
+// is suffixed with " base64". When a body does not end with a newline, the
+// file name is suffixed with " noeol".
+func (r *Recorder) Archive() []byte {
+	var ar txtar.Archive
+	ar.Comment = []byte("HTTP exchanges recorded by ocitest.Recorder.\n")
+	for _, x := range r.Exchanges() {
+		ar.Files = append(ar.Files,
+			formatSection("request "+x.Method+" "+x.URL, x.RequestHeader, x.RequestBody),
+			formatSection("response "+strconv.Itoa(x.StatusCode), x.ResponseHeader, x.ResponseBody),
+		)
+	}
+	return txtar.Format(&ar)
+}
+
+// WriteFile writes the recorded exchanges to the given file
+// in the format described by [Recorder.Archive].
+func (r *Recorder) WriteFile(file string) error {
+	return os.WriteFile(file, r.Archive(), 0o666)
+}
+
+// Replayer is an [http.RoundTripper] that answers requests from
+// a set of recorded exchanges without using the network.
+//
+// An incoming request matches a recorded exchange when the method
+// and URL (ignoring any redacted query parameters) are equal and the headers used in content negotiation,
+// ranges and authorization (ignoring the credentials themselves) agree.
+// Each recorded exchange is used at most once, and among
+// matching exchanges the earliest recorded is chosen, so
+// replay is deterministic even when identical requests are
+// made more than once.
+type Replayer struct {
+	mu        sync.Mutex
+	exchanges []*Exchange
+	used      []bool
+}
+
+// NewReplayer returns a Replayer that replays the exchanges in
+// data, which should be in the format produced by [Recorder.Archive].
+func NewReplayer(data []byte) (*Replayer, error) {
+	ar := txtar.Parse(data)
+	if len(ar.Files)%2 != 0 {
+		return nil, fmt.Errorf("odd number of sections in recording")
+	}
+	var exchanges []*Exchange
+	for i := 0; i < len(ar.Files); i += 2 {
+		x, err := parseExchange(ar.Files[i], ar.Files[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("exchange %d: %v", i/2, err)
+		}
+		exchanges = append(exchanges, x)
+	}
+	return &Replayer{
+		exchanges: exchanges,
+		used:      make([]bool, len(exchanges)),
+	}, nil
+}
+
+// ReadReplayer is like [NewReplayer] but reads the
+// recording from the given file.
+func ReadReplayer(file string) (*Replayer, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewReplayer(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return r, nil
+}
+
+// RoundTrip implements [http.RoundTripper.RoundTrip].
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, x := range r.exchanges {
+		if r.used[i] || !x.matches(req) {
+			continue
+		}
+		r.used[i] = true
+		contentLength := int64(len(x.ResponseBody))
+		if cl := x.ResponseHeader.Get("Content-Length"); cl != "" {
+			n, err := strconv.ParseInt(cl, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid recorded Content-Length %q", cl)
+			}
+			contentLength = n
+		}
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", x.StatusCode, http.StatusText(x.StatusCode)),
+			StatusCode:    x.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        x.ResponseHeader.Clone(),
+			Body:          io.NopCloser(bytes.NewReader(x.ResponseBody)),
+			ContentLength: contentLength,
+			Request:       req,
+		}, nil
+	}
+	return nil, fmt.Errorf("ocitest: no recorded response for %s %s", req.Method, req.URL)
+}
+
+// Unused returns all the recorded exchanges that have not
+// yet been replayed.
+func (r *Replayer) Unused() []*Exchange {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var xs []*Exchange
+	for i, x := range r.exchanges {
+		if !r.used[i] {
+			xs = append(xs, x)
+		}
+	}
+	return xs
+}
+
+// NewTestTransport returns a transport for use in the given test.
+//
+// If the [RecordEnvVar] environment variable is non-empty, requests
+// are sent to transport (or [http.DefaultTransport] if that's nil) and
+// the exchanges are written to file when the test completes.
+// Otherwise the exchanges are replayed from file and the
+// test fails if any of them were not used.
+func NewTestTransport(t *testing.T, file string, transport http.RoundTripper) http.RoundTripper {
+	if os.Getenv(RecordEnvVar) != "" {
+		rec := NewRecorder(transport)
+		t.Cleanup(func() {
+			if err := rec.WriteFile(file); err != nil {
+				t.Errorf("cannot write recording: %v", err)
+			}
+		})
+		return rec
+	}
+	rep, err := ReadReplayer(file)
+	if err != nil {
+		t.Fatalf("cannot read recording (set %s=1 to record): %v", RecordEnvVar, err)
+	}
+	t.Cleanup(func() {
+		for _, x := range rep.Unused() {
+			t.Errorf("recorded exchange not replayed: %s %s", x.Method, x.URL)
+		}
+	})
+	return rep
+}
+
+func (x *Exchange) matches(req *http.Request) bool {
+	if req.Method != x.Method || redactURL(req.URL.String()) != x.URL {
+		return false
+	}
+	reqHeader := redactRequestHeader(req.Header)
+	for _, h := range replayMatchHeaders {
+		if !slices.Equal(reqHeader.Values(h), x.RequestHeader.Values(h)) {
+			return false
+		}
+	}
+	return true
+}
+
+func formatSection(name string, h http.Header, body []byte) txtar.File {
+	var buf bytes.Buffer
+	for _, k := range mapKeys(h) {
+		for _, v := range h[k] {
+			fmt.Fprintf(&buf, "%s: %s\n", k, v)
+		}
+	}
+	buf.WriteByte('\n')
+	switch {
+	case len(body) == 0:
+	case !utf8.Valid(body) || bytes.HasPrefix(body, []byte("-- ")) || bytes.Contains(body, []byte("\n-- ")):
+		name += " base64"
+		enc := base64.StdEncoding.EncodeToString(body)
+		for len(enc) > 76 {
+			buf.WriteString(enc[:76])
+			buf.WriteByte('\n')
+			enc = enc[76:]
+		}
+		buf.WriteString(enc)
+		buf.WriteByte('\n')
+	default:
+		buf.Write(body)
+		if body[len(body)-1] != '\n' {
+			name += " noeol"
+			buf.WriteByte('\n')
+		}
+	}
+	return txtar.File{
+		Name: name,
+		Data: buf.Bytes(),
+	}
+}
+
+func parseExchange(reqf, respf txtar.File) (*Exchange, error) {
+	reqFields, reqFlags := splitSectionName(reqf.Name)
+	if len(reqFields) != 3 || reqFields[0] != "request" {
+		return nil, fmt.Errorf("malformed request section name %q", reqf.Name)
+	}
+	respFields, respFlags := splitSectionName(respf.Name)
+	if len(respFields) != 2 || respFields[0] != "response" {
+		return nil, fmt.Errorf("malformed response section name %q", respf.Name)
+	}
+	statusCode, err := strconv.Atoi(respFields[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed status code in %q", respf.Name)
+	}
+	if _, err := url.Parse(reqFields[2]); err != nil {
+		return nil, fmt.Errorf("malformed URL in %q: %v", reqf.Name, err)
+	}
+	reqHeader, reqBody, err := parseSection(reqf.Data, reqFlags)
+	if err != nil {
+		return nil, fmt.Errorf("request: %v", err)
+	}
+	respHeader, respBody, err := parseSection(respf.Data, respFlags)
+	if err != nil {
+		return nil, fmt.Errorf("response: %v", err)
+	}
+	return &Exchange{
+		Method:         reqFields[1],
+		URL:            reqFields[2],
+		RequestHeader:  reqHeader,
+		RequestBody:    reqBody,
+		StatusCode:     statusCode,
+		ResponseHeader: respHeader,
+		ResponseBody:   respBody,
+	}, nil
+}
+
+// splitSectionName splits a section name into its fields,
+// separating out any trailing flags.
+func splitSectionName(name string) (fields []string, flags map[string]bool) {
+	fields = strings.Fields(name)
+	flags = make(map[string]bool)
+	for len(fields) > 0 {
+		switch f := fields[len(fields)-1]; f {
+		case "base64", "noeol":
+			flags[f] = true
+			fields = fields[:len(fields)-1]
+			continue
+		}
+		break
+	}
+	return fields, flags
+}
+
+func parseSection(data []byte, flags map[string]bool) (http.Header, []byte, error) {
+	h := make(http.Header)
+	r := bufio.NewReader(bytes.NewReader(data))
+	for {
+		line, err := r.ReadString('\n')
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			break
+		}
+		k, v, ok := strings.Cut(line, ": ")
+		if !ok {
+			return nil, nil, fmt.Errorf("malformed header line %q", line)
+		}
+		h.Add(k, v)
+		if err != nil {
+			break
+		}
+	}
+	body, _ := io.ReadAll(r)
+	switch {
+	case flags["base64"]:
+		data, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(string(body), "\n", ""))
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid base64 body: %v", err)
+		}
+		body = data
+	case flags["noeol"]:
+		body = bytes.TrimSuffix(body, []byte("\n"))
+	}
+	if len(body) == 0 {
+		body = nil
+	}
+	return h, body, nil
+}
+
+// redactRequestHeader returns a copy of h without the headers
+// that are not recorded and with any credentials
+// in the Authorization header removed.
+func redactRequestHeader(h http.Header) http.Header {
+	h = h.Clone()
+	if h == nil {
+		h = make(http.Header)
+	}
+	for _, k := range unrecordedRequestHeaders {
+		h.Del(k)
+	}
+	if auth := h.Get("Authorization"); auth != "" {
+		scheme, _, _ := strings.Cut(auth, " ")
+		h.Set("Authorization", scheme+" "+redacted)
+	}
+	return h
+}
+
+// redactURL returns u with the values of any query parameters
+// holding signatures or credentials replaced. The order and
+// encoding of the other parameters are left unchanged.
+func redactURL(u string) string {
+	base, query, ok := strings.Cut(u, "?")
+	if !ok {
+		return u
+	}
+	query, fragment, hasFragment := strings.Cut(query, "#")
+	params := strings.Split(query, "&")
+	changed := false
+	for i, param := range params {
+		k, _, _ := strings.Cut(param, "=")
+		if name, err := url.QueryUnescape(k); err == nil && slices.Contains(secretQueryParams, strings.ToLower(name)) {
+			params[i] = k + "=" + redacted
+			changed = true
+		}
+	}
+	if !changed {
+		return u
+	}
+	u = base + "?" + strings.Join(params, "&")
+	if hasFragment {
+		u += "#" + fragment
+	}
+	return u
+}
+
+// redactJSON returns body with any secret token fields
+// replaced when it holds a JSON object.
+func redactJSON(h http.Header, body []byte) []byte {
+	if !strings.Contains(h.Get("Content-Type"), "json") {
+		return body
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(body, &m); err != nil {
+		return body
+	}
+	changed := false
+	for _, k := range secretJSONFields {
+		if _, ok := m[k]; ok {
+			m[k] = json.RawMessage(strconv.Quote(redacted))
+			changed = true
+		}
+	}
+	if !changed {
+		return body
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return body
+	}
+	return data
+}
+
+// redactForm returns body with any secret form fields
+// replaced when it holds a form-encoded request.
+func redactForm(h http.Header, body []byte) []byte {
+	if h.Get("Content-Type") != "application/x-www-form-urlencoded" {
+		return body
+	}
+	v, err := url.ParseQuery(string(body))
+	if err != nil {
+		return body
+	}
+	changed := false
+	for _, k := range secretFormFields {
+		if v.Has(k) {
+			v.Set(k, redacted)
+			changed = true
+		}
+	}
+	if !changed {
+		return body
+	}
+	return []byte(v.Encode())
+}
@@ -0,0 +1,202 @@
+package ocitest_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/ociauth"
+	"github.com/jcarter3/oci/ociclient"
+	"github.com/jcarter3/oci/ocimem"
+	"github.com/jcarter3/oci/ociserver"
+	"github.com/jcarter3/oci/ocitest"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testPassword = "some-password"
+	testToken    = "some-secret-token"
+)
+
+func TestRecordReplay(t *testing.T) {
+	ctx := context.Background()
+	ts := newAuthServer(t)
+
+	// Record a session that pushes and pulls a blob through
+	// the token auth flow.
+	rec := ocitest.NewRecorder(nil)
+	client := newAuthClient(t, ts.URL, rec)
+	content := "hello, world"
+	dg := digest.FromString(content)
+	_, err := client.PushBlob(ctx, "foo/bar", oci.Descriptor{
+		Digest: dg,
+		Size:   int64(len(content)),
+	}, strings.NewReader(content))
+	require.NoError(t, err)
+	require.Equal(t, content, readBlob(t, client, "foo/bar", dg))
+	_, err = client.ResolveTag(ctx, "foo/bar", "notthere")
+	require.ErrorIs(t, err, oci.ErrNameUnknown)
+
+	archive := string(rec.Archive())
+	require.NotContains(t, archive, testPassword)
+	require.NotContains(t, archive, testToken)
+	require.Contains(t, archive, "Www-Authenticate: Bearer ")
+	require.Contains(t, archive, "Authorization: Bearer REDACTED")
+
+	// Then replay the same session with the server gone.
+	ts.Close()
+	file := filepath.Join(t.TempDir(), "recording.txtar")
+	require.NoError(t, rec.WriteFile(file))
+	rep, err := ocitest.ReadReplayer(file)
+	require.NoError(t, err)
+
+	client = newAuthClient(t, ts.URL, rep)
+	_, err = client.PushBlob(ctx, "foo/bar", oci.Descriptor{
+		Digest: dg,
+		Size:   int64(len(content)),
+	}, strings.NewReader(content))
+	require.NoError(t, err)
+	require.Equal(t, content, readBlob(t, client, "foo/bar", dg))
+	_, err = client.ResolveTag(ctx, "foo/bar", "notthere")
+	require.ErrorIs(t, err, oci.ErrNameUnknown)
+	require.Empty(t, rep.Unused())
+
+	// A request that was never recorded fails.
+	_, err = client.ResolveTag(ctx, "foo/bar", "other")
+	require.ErrorContains(t, err, "no recorded response")
+}
+
+func TestReplayBinaryBody(t *testing.T) {
+	body := []byte("\x00\xff-- not a separator --\n")
+	rec := ocitest.NewRecorder(transportFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Type": {"application/octet-stream"}},
+			Body:          io.NopCloser(strings.NewReader(string(body))),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}))
+	req, err := http.NewRequest("GET", "https://example.com/v2/foo/blobs/x", nil)
+	require.NoError(t, err)
+	resp, err := rec.RoundTrip(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	rep, err := ocitest.NewReplayer(rec.Archive())
+	require.NoError(t, err)
+	resp, err = rep.RoundTrip(req)
+	require.NoError(t, err)
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, body, data)
+}
+
+func TestRecordRedactsSignedURLs(t *testing.T) {
+	const (
+		signature  = "0123456789abcdef"
+		credential = "AKIAEXAMPLE%2F20250101%2Fus-east-1%2Fs3%2Faws4_request"
+	)
+	signedURL := "https://bucket.example.com/blob?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Credential=" + credential + "&X-Amz-Signature=" + signature
+	rec := ocitest.NewRecorder(transportFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host == "registry.example.com" {
+			return &http.Response{
+				StatusCode: http.StatusTemporaryRedirect,
+				Header:     http.Header{"Location": {signedURL}},
+				Body:       http.NoBody,
+				Request:    req,
+			}, nil
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader("data")),
+			Request:    req,
+		}, nil
+	}))
+	for _, u := range []string{"https://registry.example.com/v2/foo/blobs/x", signedURL} {
+		req, err := http.NewRequest("GET", u, nil)
+		require.NoError(t, err)
+		resp, err := rec.RoundTrip(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	archive := string(rec.Archive())
+	require.NotContains(t, archive, signature)
+	require.NotContains(t, archive, credential)
+	require.Contains(t, archive, "X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Credential=REDACTED&X-Amz-Signature=REDACTED")
+
+	// The redacted exchanges can still be replayed.
+	rep, err := ocitest.NewReplayer(rec.Archive())
+	require.NoError(t, err)
+	req, err := http.NewRequest("GET", signedURL, nil)
+	require.NoError(t, err)
+	resp, err := rep.RoundTrip(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+// newAuthServer returns a server that serves an in-memory registry
+// that requires a bearer token obtained from its /token endpoint
+// using basic auth.
+func newAuthServer(t *testing.T) *httptest.Server {
+	regHandler := ociserver.New(ocimem.New(), nil)
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/token" {
+			if _, password, _ := req.BasicAuth(); password != testPassword {
+				http.Error(w, "bad password", http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"token":%q,"expires_in":300}`, testToken)
+			return
+		}
+		if req.Header.Get("Authorization") != "Bearer "+testToken {
+			w.Header().Set("Www-Authenticate", fmt.Sprintf("Bearer realm=%q,service=test", ts.URL+"/token"))
+			http.Error(w, "no auth", http.StatusUnauthorized)
+			return
+		}
+		regHandler.ServeHTTP(w, req)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func newAuthClient(t *testing.T, srvURL string, transport http.RoundTripper) oci.Interface {
+	u, err := url.Parse(srvURL)
+	require.NoError(t, err)
+	client, err := ociclient.New(u.Host, &ociclient.Options{
+		Insecure: true,
+		Transport: ociauth.NewStdTransport(ociauth.StdTransportParams{
+			Config:    ociauth.NewStatic("someone", testPassword),
+			Transport: transport,
+		}),
+	})
+	require.NoError(t, err)
+	return client
+}
+
+func readBlob(t *testing.T, r oci.Interface, repo string, dg oci.Digest) string {
+	rd, err := r.GetBlob(context.Background(), repo, dg)
+	require.NoError(t, err)
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	require.NoError(t, err)
+	return string(data)
+}
+
+type transportFunc func(req *http.Request) (*http.Response, error)
+
+func (f transportFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -30,6 +30,7 @@ import (
 
 	"github.com/jcarter3/oci"
 	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/stretchr/testify/require"
 )
 
@@ -62,11 +63,23 @@ type RegistryContent map[string]RepoContent
 // will be replaced by the calculated digest of the manifest or
 // blob with that identifier; the size and media type fields will also be
 // filled in.
+//
+// Manifest and index identifiers share a single namespace, so
+// a subject or an index entry can refer to either kind. Identifiers
+// are resolved in dependency order, so an index can refer to
+// manifests that have subjects which themselves are indexes, and so on.
+// ArtifactType and Annotations fields are pushed as specified;
+// an index entry that does not specify an artifact type inherits the one
+// from the manifest it refers to.
 type RepoContent struct {
 	// Manifests maps from manifest identifier to the contents of the manifest.
-	// TODO support manifest indexes too.
 	Manifests map[string]oci.Manifest
 
+	// Indexes maps from index identifier to the contents of the image index.
+	// The Digest field of each entry in an index's Manifests
+	// names a manifest or index identifier.
+	Indexes map[string]ocispec.Index
+
 	// Blobs maps from blob identifer to the contents of the blob.
 	Blobs map[string]string
 
@@ -174,45 +187,45 @@ type manifestContent struct {
 	id   string
 	data []byte
 	desc oci.Descriptor
+	// artifactType holds the artifact type declared by the manifest, if any.
+	artifactType string
 }
 
-// completedManifests calculates the content of all the manifests and returns
-// them all, keyed by id, and a partially ordered sequence suitable
+// completedManifests calculates the content of all the manifests and indexes
+// and returns them all, keyed by id, and a partially ordered sequence suitable
 // for pushing to a registry in bottom-up order.
 func completedManifests(repoc RepoContent, blobs map[string]oci.Descriptor) (map[string]manifestContent, []manifestContent, error) {
+	for id := range repoc.Indexes {
+		if _, ok := repoc.Manifests[id]; ok {
+			return nil, nil, fmt.Errorf("id %q is used for both a manifest and an index", id)
+		}
+	}
 	manifests := make(map[string]manifestContent)
-	manifestSeq := make([]manifestContent, 0, len(repoc.Manifests))
-	// subject relationships can be arbitrarily deep, so continue iterating until
-	// all the levels are completed. If at any point we can't make progress, we
-	// know there's a problem and panic.
+	manifestSeq := make([]manifestContent, 0, len(repoc.Manifests)+len(repoc.Indexes))
+	// Subject and index relationships can be arbitrarily deep, so continue
+	// iterating until all the levels are completed. If at any point we can't
+	// make progress, we know there's a problem and return an error.
 	required := make(map[string]bool)
 	for {
 		madeProgress := false
 		needMore := false
-		need := func(digest oci.Digest) {
-			needMore = true
-			if !required[string(digest)] {
-				required[string(digest)] = true
-				madeProgress = true
-			}
-		}
-		for id, m := range repoc.Manifests {
-			if _, ok := manifests[id]; ok {
-				continue
-			}
-			m1 := m
-			if m1.Subject != nil {
-				mc, ok := manifests[string(m1.Subject.Digest)]
-				if !ok {
-					need(m1.Subject.Digest)
-					continue
+		// resolve returns the descriptor for the manifest
+		// referred to by d, or false if that hasn't been
+		// calculated yet.
+		resolve := func(d oci.Descriptor) (oci.Descriptor, bool) {
+			mc, ok := manifests[string(d.Digest)]
+			if !ok {
+				needMore = true
+				if !required[string(d.Digest)] {
+					required[string(d.Digest)] = true
+					madeProgress = true
 				}
-				m1.Subject = ref(*m1.Subject)
-				*m1.Subject = mc.desc
-				madeProgress = true
+				return oci.Descriptor{}, false
 			}
-			m1 = fillManifestDescriptors(m1, blobs)
-			data, err := json.Marshal(m1)
+			return mc.desc, true
+		}
+		add := func(id string, x any, mediaType, artifactType string) {
+			data, err := json.Marshal(x)
 			if err != nil {
 				panic(err)
 			}
@@ -222,27 +235,92 @@ func completedManifests(repoc RepoContent, blobs map[string]oci.Descriptor) (map
 				desc: oci.Descriptor{
 					Digest:    digest.FromBytes(data),
 					Size:      int64(len(data)),
-					MediaType: m.MediaType,
+					MediaType: mediaType,
 				},
+				artifactType: artifactType,
 			}
 			manifests[id] = mc
-			madeProgress = true
 			manifestSeq = append(manifestSeq, mc)
+			madeProgress = true
+		}
+		for id, m := range repoc.Manifests {
+			if _, ok := manifests[id]; ok {
+				continue
+			}
+			if m.Subject != nil {
+				desc, ok := resolve(*m.Subject)
+				if !ok {
+					continue
+				}
+				m.Subject = ref(desc)
+			}
+			add(id, fillManifestDescriptors(m, blobs), m.MediaType, m.ArtifactType)
+		}
+	indexes:
+		for id, index := range repoc.Indexes {
+			if _, ok := manifests[id]; ok {
+				continue
+			}
+			if index.Subject != nil {
+				desc, ok := resolve(*index.Subject)
+				if !ok {
+					continue
+				}
+				index.Subject = ref(desc)
+			}
+			index.Manifests = slices.Clone(index.Manifests)
+			for i, entry := range index.Manifests {
+				desc, ok := resolve(entry)
+				if !ok {
+					continue indexes
+				}
+				index.Manifests[i] = fillManifestDescriptor(entry, desc, manifests[string(entry.Digest)].artifactType)
+			}
+			add(id, index, index.MediaType, index.ArtifactType)
 		}
 		if !needMore {
 			return manifests, manifestSeq, nil
 		}
 		if !madeProgress {
-			for m := range required {
-				if _, ok := manifests[m]; ok {
-					delete(required, m)
+			var missing, cyclic []string
+			for _, id := range mapKeys(required) {
+				switch {
+				case manifests[id].data != nil:
+				case isManifestID(repoc, id):
+					cyclic = append(cyclic, id)
+				default:
+					missing = append(missing, id)
 				}
 			}
-			return nil, nil, fmt.Errorf("no manifest found for ids %s", strings.Join(mapKeys(required), ", "))
+			if len(missing) > 0 {
+				return nil, nil, fmt.Errorf("no manifest found for ids %s", strings.Join(missing, ", "))
+			}
+			return nil, nil, fmt.Errorf("cycle in manifest references involving ids %s", strings.Join(cyclic, ", "))
 		}
 	}
 }
 
+func isManifestID(repoc RepoContent, id string) bool {
+	_, ok0 := repoc.Manifests[id]
+	_, ok1 := repoc.Indexes[id]
+	return ok0 || ok1
+}
+
+// fillManifestDescriptor returns the index entry d completed
+// from the pushed manifest descriptor desc, preserving any
+// fields that are already set.
+func fillManifestDescriptor(d, desc oci.Descriptor, artifactType string) oci.Descriptor {
+	d.Digest = desc.Digest
+	d.Size = desc.Size
+	if d.MediaType == "" {
+		d.MediaType = desc.MediaType
+	}
+	if d.ArtifactType == "" {
+		d.ArtifactType = artifactType
+	}
+	return d
+}
+
 func fillManifestDescriptors(m oci.Manifest, blobs map[string]oci.Descriptor) oci.Manifest {
 	m.Config = fillBlobDescriptor(m.Config, blobs)
 	m.Layers = slices.Clone(m.Layers)
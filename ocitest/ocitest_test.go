@@ -0,0 +1,165 @@
+package ocitest_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/ocimem"
+	"github.com/jcarter3/oci/ocitest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushContentWithIndexAndReferrers(t *testing.T) {
+	ctx := context.Background()
+	r := ocitest.NewRegistry(t, ocimem.New())
+	content := r.MustPushContent(ocitest.RegistryContent{
+		"foo/bar": {
+			Blobs: map[string]string{
+				"scratch": "{}",
+				"amd64":   "amd64 layer",
+				"arm64":   "arm64 layer",
+				"sig":     "signature",
+			},
+			Manifests: map[string]oci.Manifest{
+				"amd64": {
+					MediaType: ocispec.MediaTypeImageManifest,
+					Config:    oci.Descriptor{Digest: "scratch"},
+					Layers:    []oci.Descriptor{{Digest: "amd64"}},
+				},
+				"arm64": {
+					MediaType: ocispec.MediaTypeImageManifest,
+					Config:    oci.Descriptor{Digest: "scratch"},
+					Layers:    []oci.Descriptor{{Digest: "arm64"}},
+				},
+				"sig": {
+					MediaType:    ocispec.MediaTypeImageManifest,
+					ArtifactType: "application/vnd.example.signature",
+					Config:       oci.Descriptor{Digest: "scratch", MediaType: ocispec.MediaTypeEmptyJSON},
+					Layers:       []oci.Descriptor{{Digest: "sig"}},
+					Subject:      &oci.Descriptor{Digest: "multi"},
+					Annotations: map[string]string{
+						"signed-by": "someone",
+					},
+				},
+			},
+			Indexes: map[string]ocispec.Index{
+				"multi": {
+					MediaType: ocispec.MediaTypeImageIndex,
+					Manifests: []oci.Descriptor{{
+						Digest:   "amd64",
+						Platform: &ocispec.Platform{OS: "linux", Architecture: "amd64"},
+					}, {
+						Digest:   "arm64",
+						Platform: &ocispec.Platform{OS: "linux", Architecture: "arm64"},
+					}},
+				},
+				"outer": {
+					MediaType: ocispec.MediaTypeImageIndex,
+					Manifests: []oci.Descriptor{{
+						Digest: "multi",
+					}, {
+						Digest: "sig",
+					}},
+				},
+			},
+			Tags: map[string]string{
+				"latest": "multi",
+			},
+		},
+	})["foo/bar"]
+
+	desc, err := r.R.ResolveTag(ctx, "foo/bar", "latest")
+	require.NoError(t, err)
+	require.Equal(t, content.Manifests["multi"].Digest, desc.Digest)
+	require.Equal(t, ocispec.MediaTypeImageIndex, desc.MediaType)
+
+	index := getIndex(t, r.R, "foo/bar", desc.Digest)
+	require.Len(t, index.Manifests, 2)
+	require.Equal(t, content.Manifests["amd64"].Digest, index.Manifests[0].Digest)
+	require.Equal(t, content.Manifests["amd64"].Size, index.Manifests[0].Size)
+	require.Equal(t, ocispec.MediaTypeImageManifest, index.Manifests[0].MediaType)
+	require.Equal(t, "amd64", index.Manifests[0].Platform.Architecture)
+	require.Equal(t, content.Manifests["arm64"].Digest, index.Manifests[1].Digest)
+
+	// Nested indexes resolve to their children, and entries
+	// inherit the artifact type of the manifest they refer to.
+	outer := getIndex(t, r.R, "foo/bar", content.Manifests["outer"].Digest)
+	require.Equal(t, content.Manifests["multi"].Digest, outer.Manifests[0].Digest)
+	require.Equal(t, ocispec.MediaTypeImageIndex, outer.Manifests[0].MediaType)
+	require.Equal(t, content.Manifests["sig"].Digest, outer.Manifests[1].Digest)
+	require.Equal(t, "application/vnd.example.signature", outer.Manifests[1].ArtifactType)
+
+	referrers, err := oci.All(r.R.Referrers(ctx, "foo/bar", desc.Digest, nil))
+	require.NoError(t, err)
+	require.Len(t, referrers, 1)
+	require.Equal(t, content.Manifests["sig"].Digest, referrers[0].Digest)
+	require.Equal(t, "application/vnd.example.signature", referrers[0].ArtifactType)
+	require.Equal(t, map[string]string{"signed-by": "someone"}, referrers[0].Annotations)
+}
+
+func TestPushContentErrors(t *testing.T) {
+	tests := []struct {
+		testName  string
+		content   ocitest.RepoContent
+		wantError string
+	}{{
+		testName: "UnknownIndexEntry",
+		content: ocitest.RepoContent{
+			Indexes: map[string]ocispec.Index{
+				"i": {
+					MediaType: ocispec.MediaTypeImageIndex,
+					Manifests: []oci.Descriptor{{Digest: "nope"}},
+				},
+			},
+		},
+		wantError: `no manifest found for ids nope`,
+	}, {
+		testName: "Cycle",
+		content: ocitest.RepoContent{
+			Indexes: map[string]ocispec.Index{
+				"a": {
+					MediaType: ocispec.MediaTypeImageIndex,
+					Manifests: []oci.Descriptor{{Digest: "b"}},
+				},
+				"b": {
+					MediaType: ocispec.MediaTypeImageIndex,
+					Subject:   &oci.Descriptor{Digest: "a"},
+				},
+			},
+		},
+		wantError: `cycle in manifest references involving ids a, b`,
+	}, {
+		testName: "DuplicateID",
+		content: ocitest.RepoContent{
+			Manifests: map[string]oci.Manifest{
+				"x": {MediaType: ocispec.MediaTypeImageManifest},
+			},
+			Indexes: map[string]ocispec.Index{
+				"x": {MediaType: ocispec.MediaTypeImageIndex},
+			},
+		},
+		wantError: `id "x" is used for both a manifest and an index`,
+	}}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			_, err := ocitest.PushRepoContent(ocimem.New(), "foo", test.content)
+			require.EqualError(t, err, test.wantError)
+		})
+	}
+}
+
+func getIndex(t *testing.T, r oci.Interface, repo string, dg oci.Digest) ocispec.Index {
+	rd, err := r.GetManifest(context.Background(), repo, dg)
+	require.NoError(t, err)
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	require.NoError(t, err)
+	var index ocispec.Index
+	err = json.Unmarshal(data, &index)
+	require.NoError(t, err)
+	return index
+}
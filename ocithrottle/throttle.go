@@ -0,0 +1,410 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ocithrottle limits the bandwidth used by blob transfers.
+//
+// A [Throttle] holds token-bucket limiters for the total bandwidth and
+// for the bandwidth to each host. [New] wraps an [oci.Interface] so that
+// all blob content read or written through it, including the transfers
+// made by the ocilarge package, is subject to a throttle.
+//
+// Each transfer takes bandwidth in turns of a fixed size (the burst size),
+// and limiters grant turns in the order in which they're requested, so
+// concurrent transfers share the available bandwidth fairly rather than
+// one transfer starving the others.
+package ocithrottle
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jcarter3/oci"
+)
+
+// DefaultBurst holds the default maximum number of bytes
+// that can be transferred at once without waiting.
+const DefaultBurst = 64 * 1024
+
+// Schedule returns the permitted bandwidth in bytes per second
+// at the given time. A non-positive value means unlimited.
+//
+// A schedule can vary the limit over time: for example,
+// to restrict bandwidth during working hours.
+type Schedule func(t time.Time) float64
+
+// Constant returns a schedule that always returns bytesPerSecond.
+func Constant(bytesPerSecond float64) Schedule {
+	return func(time.Time) float64 {
+		return bytesPerSecond
+	}
+}
+
+// Limiter is a token-bucket rate limiter. Tokens, each
+// representing one byte, accumulate at the rate given by the
+// schedule, up to the burst size.
+type Limiter struct {
+	schedule Schedule
+	burst    int
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a limiter that permits the bandwidth
+// given by s, with up to burst bytes transferred at once. If s is
+// nil, the bandwidth is unlimited; if burst is not positive,
+// [DefaultBurst] is used.
+func NewLimiter(s Schedule, burst int) *Limiter {
+	if burst <= 0 {
+		burst = DefaultBurst
+	}
+	return &Limiter{
+		schedule: s,
+		burst:    burst,
+		tokens:   float64(burst),
+	}
+}
+
+// Burst returns the maximum number of bytes
+// that can be transferred at once.
+func (l *Limiter) Burst() int {
+	return l.burst
+}
+
+// WaitN blocks until n bytes may be transferred
+// or the context is done.
+//
+// Requests larger than the burst size are split so that
+// concurrent callers are interleaved.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	for n > 0 {
+		chunk := min(n, l.burst)
+		if err := l.wait(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// wait waits for n tokens, where n is no more than the burst size.
+func (l *Limiter) wait(ctx context.Context, n int) error {
+	d := l.reserve(time.Now(), n)
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		// Give back the tokens so that they're
+		// available to other callers.
+		l.refund(n)
+		return context.Cause(ctx)
+	}
+}
+
+// refund returns n unused tokens to the bucket.
+func (l *Limiter) refund(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens = min(float64(l.burst), l.tokens+float64(n))
+}
+
+// reserve takes n tokens and returns how long the caller must wait
+// before using them. The tokens can go negative, which makes later
+// callers wait their turn behind earlier ones.
+func (l *Limiter) reserve(now time.Time, n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var rate float64
+	if l.schedule != nil {
+		rate = l.schedule(now)
+	}
+	if rate <= 0 {
+		l.tokens = float64(l.burst)
+		l.last = now
+		return 0
+	}
+	if !l.last.IsZero() {
+		l.tokens = min(float64(l.burst), l.tokens+rate*now.Sub(l.last).Seconds())
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / rate * float64(time.Second))
+}
+
+// Options holds the limits used by a [Throttle].
+type Options struct {
+	// Global holds the limit on the total bandwidth
+	// across all hosts. If it's nil, there's no global limit.
+	Global Schedule
+
+	// Hosts holds the limit for each host. Hosts not present
+	// use DefaultHost.
+	Hosts map[string]Schedule
+
+	// DefaultHost holds the limit for each host not in Hosts.
+	// If it's nil, there's no per-host limit for those hosts.
+	DefaultHost Schedule
+
+	// Burst holds the maximum number of bytes transferred at once.
+	// Smaller values share bandwidth between concurrent transfers
+	// more evenly, at the cost of more frequent waits.
+	// If it's zero, [DefaultBurst] is used.
+	Burst int
+}
+
+// Throttle limits bandwidth both in total and per host.
+// It's safe to use concurrently.
+type Throttle struct {
+	opts   Options
+	global *Limiter
+
+	mu    sync.Mutex
+	hosts map[string]*Limiter
+}
+
+// NewThrottle returns a throttle that applies the given limits.
+// A nil opts is equivalent to a pointer to zero Options,
+// which doesn't limit bandwidth at all.
+func NewThrottle(opts *Options) *Throttle {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	if o.Burst <= 0 {
+		o.Burst = DefaultBurst
+	}
+	return &Throttle{
+		opts:   o,
+		global: NewLimiter(o.Global, o.Burst),
+		hosts:  make(map[string]*Limiter),
+	}
+}
+
+// hostLimiter returns the limiter for the given host.
+func (t *Throttle) hostLimiter(host string) *Limiter {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l, ok := t.hosts[host]
+	if !ok {
+		s, ok := t.opts.Hosts[host]
+		if !ok {
+			s = t.opts.DefaultHost
+		}
+		l = NewLimiter(s, t.opts.Burst)
+		t.hosts[host] = l
+	}
+	return l
+}
+
+// WaitN blocks until n bytes may be transferred to or
+// from the given host or the context is done.
+//
+// If it returns an error, no bytes may be transferred, so any
+// bandwidth already granted to the call is given back.
+func (t *Throttle) WaitN(ctx context.Context, host string, n int) error {
+	hl := t.hostLimiter(host)
+	granted := 0
+	for n > 0 {
+		chunk := min(n, t.opts.Burst)
+		if err := hl.wait(ctx, chunk); err != nil {
+			t.refund(hl, granted)
+			return err
+		}
+		if err := t.global.wait(ctx, chunk); err != nil {
+			hl.refund(chunk)
+			t.refund(hl, granted)
+			return err
+		}
+		granted += chunk
+		n -= chunk
+	}
+	return nil
+}
+
+// refund returns n unused tokens to both hl and the global limiter.
+func (t *Throttle) refund(hl *Limiter, n int) {
+	if n > 0 {
+		hl.refund(n)
+		t.global.refund(n)
+	}
+}
+
+// Reader returns a reader that reads from r, limited by the
+// bandwidth available for host.
+func (t *Throttle) Reader(ctx context.Context, host string, r io.Reader) io.Reader {
+	return t.reader(ctx, host, r)
+}
+
+func (t *Throttle) reader(ctx context.Context, host string, r io.Reader) *reader {
+	return &reader{
+		r: r,
+		q: quota{ctx: ctx, t: t, host: host},
+	}
+}
+
+// Writer returns a writer that writes to w, limited by the
+// bandwidth available for host.
+//
+// Bandwidth is taken a burst at a time, so some may be left
+// unused when the caller stops writing. Any unused bandwidth
+// is given back when a write fails, or when the returned writer
+// is closed: it implements [io.Closer], but doesn't close w.
+func (t *Throttle) Writer(ctx context.Context, host string, w io.Writer) io.Writer {
+	return t.writer(ctx, host, w)
+}
+
+func (t *Throttle) writer(ctx context.Context, host string, w io.Writer) *writer {
+	return &writer{
+		w: w,
+		q: quota{ctx: ctx, t: t, host: host},
+	}
+}
+
+// quota hands out bandwidth to a single stream. It always waits
+// for a whole burst at a time, so that each turn a stream takes
+// is the same size regardless of how large its reads or writes
+// are, and spends it over subsequent calls.
+type quota struct {
+	ctx    context.Context
+	t      *Throttle
+	host   string
+	credit int
+}
+
+// take returns how many bytes, up to n, may be transferred now,
+// waiting if there's no credit left.
+func (q *quota) take(n int) (int, error) {
+	if q.credit == 0 {
+		if err := q.t.WaitN(q.ctx, q.host, q.t.opts.Burst); err != nil {
+			return 0, err
+		}
+		q.credit = q.t.opts.Burst
+	}
+	return min(n, q.credit), nil
+}
+
+// spend records that n bytes have been transferred.
+func (q *quota) spend(n int) {
+	q.credit -= n
+}
+
+// release returns any unspent credit to the limiters.
+func (q *quota) release() {
+	q.t.refund(q.t.hostLimiter(q.host), q.credit)
+	q.credit = 0
+}
+
+type reader struct {
+	r io.Reader
+	q quota
+}
+
+func (r *reader) Read(buf []byte) (int, error) {
+	if len(buf) == 0 {
+		return r.r.Read(buf)
+	}
+	n, err := r.q.take(len(buf))
+	if err != nil {
+		return 0, err
+	}
+	n, err = r.r.Read(buf[:n])
+	r.q.spend(n)
+	if err != nil {
+		r.q.release()
+	}
+	return n, err
+}
+
+type writer struct {
+	w io.Writer
+	q quota
+}
+
+// Close gives back any unused bandwidth.
+// It doesn't close the underlying writer.
+func (w *writer) Close() error {
+	w.q.release()
+	return nil
+}
+
+func (w *writer) Write(buf []byte) (int, error) {
+	written := 0
+	for len(buf) > 0 {
+		n, err := w.q.take(len(buf))
+		if err != nil {
+			return written, err
+		}
+		n, err = w.w.Write(buf[:n])
+		w.q.spend(n)
+		written += n
+		if err != nil {
+			w.q.release()
+			return written, err
+		}
+		buf = buf[n:]
+	}
+	return written, nil
+}
+
+// blobReader limits the rate at which content is read from a blob.
+type blobReader struct {
+	oci.BlobReader
+	r *reader
+}
+
+func (rd *blobReader) Read(buf []byte) (int, error) {
+	return rd.r.Read(buf)
+}
+
+func (rd *blobReader) Close() error {
+	rd.r.q.release()
+	return rd.BlobReader.Close()
+}
+
+// blobWriter limits the rate at which content is written to a blob.
+// Any unused bandwidth is given back when the upload finishes.
+type blobWriter struct {
+	oci.BlobWriter
+	w *writer
+}
+
+func (w *blobWriter) Write(buf []byte) (int, error) {
+	return w.w.Write(buf)
+}
+
+func (w *blobWriter) Close() error {
+	w.w.Close()
+	return w.BlobWriter.Close()
+}
+
+func (w *blobWriter) Commit(digest oci.Digest) (oci.Descriptor, error) {
+	w.w.Close()
+	return w.BlobWriter.Commit(digest)
+}
+
+func (w *blobWriter) Cancel() error {
+	w.w.Close()
+	return w.BlobWriter.Cancel()
+}
@@ -0,0 +1,260 @@
+package ocithrottle_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/ocilarge"
+	"github.com/jcarter3/oci/ocimem"
+	"github.com/jcarter3/oci/ocithrottle"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	kib   = 1024
+	burst = 4 * kib
+)
+
+func TestLimiterWaitN(t *testing.T) {
+	l := ocithrottle.NewLimiter(ocithrottle.Constant(64*kib), burst)
+	t0 := time.Now()
+	// The first burst is free; the rest takes 28/64 of a second.
+	require.NoError(t, l.WaitN(context.Background(), 32*kib))
+	require.GreaterOrEqual(t, time.Since(t0), 400*time.Millisecond)
+}
+
+func TestLimiterUnlimited(t *testing.T) {
+	l := ocithrottle.NewLimiter(nil, burst)
+	t0 := time.Now()
+	require.NoError(t, l.WaitN(context.Background(), 100*1024*kib))
+	require.Less(t, time.Since(t0), 100*time.Millisecond)
+}
+
+func TestLimiterContextCancelled(t *testing.T) {
+	l := ocithrottle.NewLimiter(ocithrottle.Constant(kib), burst)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := l.WaitN(ctx, 64*kib)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestLimiterSchedule(t *testing.T) {
+	var limited atomic.Bool
+	l := ocithrottle.NewLimiter(func(time.Time) float64 {
+		if limited.Load() {
+			return 16 * kib
+		}
+		return 0
+	}, burst)
+
+	t0 := time.Now()
+	require.NoError(t, l.WaitN(context.Background(), 64*kib))
+	require.Less(t, time.Since(t0), 100*time.Millisecond)
+
+	limited.Store(true)
+	t0 = time.Now()
+	require.NoError(t, l.WaitN(context.Background(), 12*kib))
+	require.GreaterOrEqual(t, time.Since(t0), 450*time.Millisecond)
+}
+
+func TestThrottleSharesBandwidthFairly(t *testing.T) {
+	ctx := context.Background()
+	r, dg, data := pushBlob(t, 16*kib)
+	th := ocithrottle.NewThrottle(&ocithrottle.Options{
+		Global: ocithrottle.Constant(64 * kib),
+		Burst:  burst,
+	})
+	// Two readers on different hosts share the global limit.
+	r1 := ocithrottle.New(r, th, "a.example")
+	r2 := ocithrottle.New(r, th, "b.example")
+
+	t0 := time.Now()
+	var wg sync.WaitGroup
+	elapsed := make([]time.Duration, 2)
+	for i, r := range []oci.Interface{r1, r2} {
+		wg.Go(func() {
+			rd, err := r.GetBlob(ctx, "foo", dg)
+			require.NoError(t, err)
+			defer rd.Close()
+			got, err := io.ReadAll(rd)
+			require.NoError(t, err)
+			require.Equal(t, data, got)
+			elapsed[i] = time.Since(t0)
+		})
+	}
+	wg.Wait()
+	// Transferring 32KiB at 64KiB/s with a 4KiB burst takes about
+	// 440ms. If the bandwidth wasn't shared, one reader would finish
+	// after about 190ms.
+	for _, d := range elapsed {
+		require.GreaterOrEqual(t, d, 350*time.Millisecond)
+	}
+}
+
+func TestThrottlePerHost(t *testing.T) {
+	r, dg, _ := pushBlob(t, 16*kib)
+	th := ocithrottle.NewThrottle(&ocithrottle.Options{
+		Hosts: map[string]ocithrottle.Schedule{
+			"slow.example": ocithrottle.Constant(32 * kib),
+		},
+		Burst: burst,
+	})
+
+	t0 := time.Now()
+	readAll(t, ocithrottle.New(r, th, "fast.example"), dg)
+	require.Less(t, time.Since(t0), 100*time.Millisecond)
+
+	t0 = time.Now()
+	readAll(t, ocithrottle.New(r, th, "slow.example"), dg)
+	require.GreaterOrEqual(t, time.Since(t0), 350*time.Millisecond)
+}
+
+func TestThrottleBlobWriter(t *testing.T) {
+	ctx := context.Background()
+	r := ocimem.New()
+	th := ocithrottle.NewThrottle(&ocithrottle.Options{
+		DefaultHost: ocithrottle.Constant(64 * kib),
+		Burst:       burst,
+	})
+	data := randomData(32 * kib)
+
+	t0 := time.Now()
+	desc, err := ocilarge.UploadLargeBlob(ctx, ocithrottle.New(r, th, "example.com"), "foo", io.NopCloser(bytes.NewReader(data)), 8*kib)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(t0), 400*time.Millisecond)
+	require.Equal(t, digest.FromBytes(data), desc.Digest)
+	readAll(t, r, desc.Digest)
+}
+
+func TestThrottleLargeDownload(t *testing.T) {
+	ctx := context.Background()
+	r, dg, data := pushBlob(t, 32*kib)
+	th := ocithrottle.NewThrottle(&ocithrottle.Options{
+		Global: ocithrottle.Constant(64 * kib),
+		Burst:  burst,
+	})
+
+	var w bytesWriterAt
+	t0 := time.Now()
+	_, err := ocilarge.DownloadLargeBlobTo(ctx, ocithrottle.New(r, th, "example.com"), "foo", dg, &w, &ocilarge.DownloadOptions{
+		ProbeSize:    4 * kib,
+		MinChunkSize: 4 * kib,
+		MaxChunkSize: 4 * kib,
+	})
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(t0), 400*time.Millisecond)
+	require.Equal(t, data, w.buf)
+}
+
+func TestThrottleWaitNRefundsOnError(t *testing.T) {
+	var globalLimited atomic.Bool
+	globalLimited.Store(true)
+	th := ocithrottle.NewThrottle(&ocithrottle.Options{
+		Global: func(time.Time) float64 {
+			if globalLimited.Load() {
+				return kib
+			}
+			return 0
+		},
+		DefaultHost: ocithrottle.Constant(16 * kib),
+		Burst:       burst,
+	})
+	ctx := context.Background()
+	// Use up the global burst through another host.
+	require.NoError(t, th.WaitN(ctx, "other.example", burst))
+
+	// The host has bandwidth available but the global limiter
+	// doesn't, so the wait fails...
+	ctx1, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, th.WaitN(ctx1, "example.com", burst), context.DeadlineExceeded)
+
+	// ... and the host's bandwidth is still available afterwards.
+	globalLimited.Store(false)
+	t0 := time.Now()
+	require.NoError(t, th.WaitN(ctx, "example.com", burst))
+	require.Less(t, time.Since(t0), 100*time.Millisecond)
+}
+
+func TestThrottleWriterReleasesCredit(t *testing.T) {
+	th := ocithrottle.NewThrottle(&ocithrottle.Options{
+		DefaultHost: ocithrottle.Constant(16 * kib),
+		Burst:       burst,
+	})
+	ctx := context.Background()
+
+	// A write takes a whole burst of bandwidth, and
+	// closing the writer gives back what wasn't used.
+	w := th.Writer(ctx, "example.com", io.Discard)
+	_, err := w.Write([]byte("x"))
+	require.NoError(t, err)
+	require.NoError(t, w.(io.Closer).Close())
+
+	// A write that fails gives back its unused bandwidth too.
+	w = th.Writer(ctx, "example.com", failingWriter{})
+	_, err = w.Write([]byte("x"))
+	require.ErrorIs(t, err, errWrite)
+
+	t0 := time.Now()
+	require.NoError(t, th.WaitN(ctx, "example.com", burst-2))
+	require.Less(t, time.Since(t0), 100*time.Millisecond)
+}
+
+var errWrite = errors.New("write failed")
+
+type failingWriter struct{}
+
+func (failingWriter) Write(buf []byte) (int, error) {
+	return 0, errWrite
+}
+
+func pushBlob(t *testing.T, size int) (oci.Interface, oci.Digest, []byte) {
+	r := ocimem.New()
+	data := randomData(size)
+	desc, err := r.PushBlob(context.Background(), "foo", oci.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest.FromBytes(data),
+		Size:      int64(size),
+	}, bytes.NewReader(data))
+	require.NoError(t, err)
+	return r, desc.Digest, data
+}
+
+func readAll(t *testing.T, r oci.Interface, dg oci.Digest) []byte {
+	rd, err := r.GetBlob(context.Background(), "foo", dg)
+	require.NoError(t, err)
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	require.NoError(t, err)
+	return data
+}
+
+func randomData(n int) []byte {
+	data := make([]byte, n)
+	rand.Read(data)
+	return data
+}
+
+type bytesWriterAt struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (w *bytesWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if end := off + int64(len(p)); end > int64(len(w.buf)) {
+		w.buf = append(w.buf, make([]byte, end-int64(len(w.buf)))...)
+	}
+	copy(w.buf[off:], p)
+	return len(p), nil
+}
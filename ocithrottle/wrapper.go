@@ -0,0 +1,85 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocithrottle
+
+import (
+	"context"
+	"io"
+
+	"github.com/jcarter3/oci"
+)
+
+// New returns a new [oci.Interface] that wraps r, limiting the
+// bandwidth used to read and write blob content to that
+// available for host in t.
+//
+// Manifests and other metadata are not limited.
+func New(r oci.Interface, t *Throttle, host string) oci.Interface {
+	return &throttled{
+		Interface: r,
+		t:         t,
+		host:      host,
+	}
+}
+
+type throttled struct {
+	oci.Interface
+	t    *Throttle
+	host string
+}
+
+func (r *throttled) GetBlob(ctx context.Context, repoName string, dig oci.Digest) (oci.BlobReader, error) {
+	rd, err := r.Interface.GetBlob(ctx, repoName, dig)
+	return r.blobReader(ctx, rd), err
+}
+
+func (r *throttled) GetBlobRange(ctx context.Context, repoName string, dig oci.Digest, o0, o1 int64) (oci.BlobReader, error) {
+	rd, err := r.Interface.GetBlobRange(ctx, repoName, dig, o0, o1)
+	return r.blobReader(ctx, rd), err
+}
+
+func (r *throttled) PushBlob(ctx context.Context, repoName string, desc oci.Descriptor, content io.Reader) (oci.Descriptor, error) {
+	return r.Interface.PushBlob(ctx, repoName, desc, r.t.Reader(ctx, r.host, content))
+}
+
+func (r *throttled) PushBlobChunked(ctx context.Context, repoName string, chunkSize int) (oci.BlobWriter, error) {
+	w, err := r.Interface.PushBlobChunked(ctx, repoName, chunkSize)
+	return r.blobWriter(ctx, w), err
+}
+
+func (r *throttled) PushBlobChunkedResume(ctx context.Context, repoName, id string, offset int64, chunkSize int) (oci.BlobWriter, error) {
+	w, err := r.Interface.PushBlobChunkedResume(ctx, repoName, id, offset, chunkSize)
+	return r.blobWriter(ctx, w), err
+}
+
+func (r *throttled) blobReader(ctx context.Context, rd oci.BlobReader) oci.BlobReader {
+	if rd == nil {
+		return nil
+	}
+	return &blobReader{
+		BlobReader: rd,
+		r:          r.t.reader(ctx, r.host, rd),
+	}
+}
+
+func (r *throttled) blobWriter(ctx context.Context, w oci.BlobWriter) oci.BlobWriter {
+	if w == nil {
+		return nil
+	}
+	return &blobWriter{
+		BlobWriter: w,
+		w:          r.t.writer(ctx, r.host, w),
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocitrace
+
+import (
+	"context"
+	"crypto/rand"
+	"sync"
+	"time"
+)
+
+// Recorder is a [Tracer] that records all spans in memory.
+// It's intended for tests and debugging.
+type Recorder struct {
+	mu    sync.Mutex
+	spans []*RecordedSpan
+}
+
+// RecordedSpan holds a span recorded by [Recorder].
+type RecordedSpan struct {
+	Name        string
+	SpanContext SpanContext
+	// Parent holds the span context of the parent span;
+	// it's the zero value for a root span.
+	Parent SpanContext
+	Attrs  []Attr
+	Errors []error
+	Start  time.Time
+	// End holds when the span ended; it's the
+	// zero value if the span has not ended.
+	End time.Time
+}
+
+// Attr returns the value of the last attribute with the given key,
+// or nil if there is none.
+func (s *RecordedSpan) Attr(key string) any {
+	for i := len(s.Attrs) - 1; i >= 0; i-- {
+		if s.Attrs[i].Key == key {
+			return s.Attrs[i].Value
+		}
+	}
+	return nil
+}
+
+// NewRecorder returns a new Recorder with no spans.
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// Start implements [Tracer.Start].
+func (r *Recorder) Start(ctx context.Context, name string, attrs ...Attr) (context.Context, Span) {
+	parent := SpanContextFromContext(ctx)
+	sc := SpanContext{
+		TraceID:    parent.TraceID,
+		TraceFlags: FlagSampled,
+		TraceState: parent.TraceState,
+	}
+	if parent.IsValid() {
+		sc.TraceFlags = parent.TraceFlags
+	} else {
+		parent = SpanContext{}
+		rand.Read(sc.TraceID[:])
+	}
+	rand.Read(sc.SpanID[:])
+	s := &RecordedSpan{
+		Name:        name,
+		SpanContext: sc,
+		Parent:      parent,
+		Attrs:       append([]Attr(nil), attrs...),
+		Start:       time.Now(),
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, s)
+	return ctx, &recordingSpan{r: r, s: s}
+}
+
+// Spans returns a copy of all the spans recorded so far,
+// in the order they were started.
+func (r *Recorder) Spans() []RecordedSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	spans := make([]RecordedSpan, len(r.spans))
+	for i, s := range r.spans {
+		spans[i] = *s
+		spans[i].Attrs = append([]Attr(nil), s.Attrs...)
+		spans[i].Errors = append([]error(nil), s.Errors...)
+	}
+	return spans
+}
+
+type recordingSpan struct {
+	r *Recorder
+	s *RecordedSpan
+}
+
+func (s *recordingSpan) SpanContext() SpanContext {
+	return s.s.SpanContext
+}
+
+func (s *recordingSpan) SetAttributes(attrs ...Attr) {
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+	s.s.Attrs = append(s.s.Attrs, attrs...)
+}
+
+func (s *recordingSpan) RecordError(err error) {
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+	s.s.Errors = append(s.s.Errors, err)
+}
+
+func (s *recordingSpan) End() {
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+	if s.s.End.IsZero() {
+		s.s.End = time.Now()
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ocitrace defines a small tracing interface that's
+// used by the other packages in this module to report spans,
+// and implements W3C trace context propagation over HTTP.
+//
+// The interface is shaped after OpenTelemetry's, so that
+// an adaptor to an OpenTelemetry tracer is straightforward to write,
+// but this package does not depend on OpenTelemetry itself.
+//
+// Spans are started with [Start], which uses the [Tracer] attached
+// to the context with [ContextWithTracer]; when there is none,
+// tracing is a no-op. The following packages report spans:
+//
+//   - [New] wraps an [oci.Interface] with a span for each operation.
+//     [github.com/jcarter3/oci/ociclient] does this when
+//     its Tracer option is set, and also propagates the trace
+//     context to the server in the traceparent header.
+//   - [github.com/jcarter3/oci/ociauth] reports a span for each
+//     token acquisition.
+//   - [github.com/jcarter3/oci/ociserver] reports a span for each
+//     request, continuing any trace in an incoming traceparent header.
+//   - [github.com/jcarter3/oci/ocilarge] reports a span for each chunk.
+package ocitrace
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// Tracer creates spans. It's implemented by an adaptor to the
+// tracing system in use.
+type Tracer interface {
+	// Start starts a new span with the given name and attributes.
+	// The parent of the new span is given by [SpanContextFromContext];
+	// when that's not valid, the new span starts a new trace.
+	//
+	// It returns the span and a context to be used within
+	// it, typically ctx itself.
+	Start(ctx context.Context, name string, attrs ...Attr) (context.Context, Span)
+}
+
+// Span represents a single operation within a trace.
+type Span interface {
+	// SpanContext returns the identifying information for the span.
+	// This is used for propagation to remote servers.
+	SpanContext() SpanContext
+
+	// SetAttributes sets the given attributes on the span.
+	SetAttributes(attrs ...Attr)
+
+	// RecordError records that the operation failed with the given error.
+	RecordError(err error)
+
+	// End marks the span as complete. No methods should be
+	// called on the span after End.
+	End()
+}
+
+// Attr holds a span attribute. Value holds a string,
+// bool, int64 or float64, or a []string.
+type Attr struct {
+	Key   string
+	Value any
+}
+
+// String returns a string-valued attribute.
+func String(key, value string) Attr {
+	return Attr{Key: key, Value: value}
+}
+
+// Int64 returns an integer-valued attribute.
+func Int64(key string, value int64) Attr {
+	return Attr{Key: key, Value: value}
+}
+
+// Int returns an integer-valued attribute.
+func Int(key string, value int) Attr {
+	return Attr{Key: key, Value: int64(value)}
+}
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+// String returns the hex encoding of the ID.
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+// String returns the hex encoding of the ID.
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanContext holds the identifying information of a span
+// that's propagated across process boundaries, as defined
+// by the [W3C trace context] specification.
+//
+// [W3C trace context]: https://www.w3.org/TR/trace-context/
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	TraceFlags byte
+
+	// TraceState holds the contents of any tracestate header.
+	// It's propagated verbatim.
+	TraceState string
+
+	// Remote reports whether the span context was
+	// propagated from a remote parent.
+	Remote bool
+}
+
+// FlagSampled is the trace flag that signifies the trace is sampled.
+const FlagSampled = 0x01
+
+// IsValid reports whether sc holds valid trace and span IDs.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent returns the value of the traceparent header
+// for the span context.
+func (sc SpanContext) Traceparent() string {
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + hex.EncodeToString([]byte{sc.TraceFlags})
+}
+
+// ParseTraceparent parses the value of a traceparent header.
+// It reports whether the value is valid.
+func ParseTraceparent(s string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 {
+		return SpanContext{}, false
+	}
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	// Future versions may add fields, but version 00 has exactly four.
+	if len(version) != 2 || version == "ff" || (version == "00" && len(parts) != 4) {
+		return SpanContext{}, false
+	}
+	var sc SpanContext
+	if !decodeHex(sc.TraceID[:], traceID) || !decodeHex(sc.SpanID[:], spanID) {
+		return SpanContext{}, false
+	}
+	var fl [1]byte
+	if !decodeHex(fl[:], flags) || !decodeHex(make([]byte, 1), version) {
+		return SpanContext{}, false
+	}
+	sc.TraceFlags = fl[0]
+	sc.Remote = true
+	if !sc.IsValid() {
+		return SpanContext{}, false
+	}
+	return sc, true
+}
+
+// decodeHex decodes the lower-case hex string s into dst,
+// reporting whether s has exactly the right length.
+func decodeHex(dst []byte, s string) bool {
+	if len(s) != hex.EncodedLen(len(dst)) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+type tracerKey struct{}
+
+type spanKey struct{}
+
+type remoteKey struct{}
+
+// ContextWithTracer returns ctx annotated with the given tracer,
+// which will be used by [Start] to create spans.
+func ContextWithTracer(ctx context.Context, t Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey{}, t)
+}
+
+// TracerFromContext returns any tracer associated with the context
+// by [ContextWithTracer].
+func TracerFromContext(ctx context.Context) Tracer {
+	t, _ := ctx.Value(tracerKey{}).(Tracer)
+	return t
+}
+
+// ContextWithSpan returns ctx annotated with the given span
+// as the currently active span.
+func ContextWithSpan(ctx context.Context, span Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns the active span associated with the context
+// by [ContextWithSpan], or nil if there is none.
+func SpanFromContext(ctx context.Context) Span {
+	s, _ := ctx.Value(spanKey{}).(Span)
+	return s
+}
+
+// ContextWithRemoteSpanContext returns ctx annotated with
+// a span context propagated from a remote parent.
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// SpanContextFromContext returns the span context of the parent
+// for spans started with ctx: that of the active span if there is one,
+// or any remote span context otherwise.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if s := SpanFromContext(ctx); s != nil {
+		return s.SpanContext()
+	}
+	sc, _ := ctx.Value(remoteKey{}).(SpanContext)
+	return sc
+}
+
+// Start starts a span using the tracer attached to the context.
+// The returned context has the span attached as the active span.
+// If there's no tracer, it returns ctx and a span that does nothing.
+func Start(ctx context.Context, name string, attrs ...Attr) (context.Context, Span) {
+	t := TracerFromContext(ctx)
+	if t == nil {
+		return ctx, noopSpan{sc: SpanContextFromContext(ctx)}
+	}
+	ctx, span := t.Start(ctx, name, attrs...)
+	return ContextWithSpan(ctx, span), span
+}
+
+// End ends the span, first recording err if it's non-nil.
+func End(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+// Inject sets the traceparent and tracestate headers in h
+// from the span context of the active span in ctx.
+// It does nothing if there's no valid span context.
+func Inject(ctx context.Context, h http.Header) {
+	sc := SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return
+	}
+	h.Set("traceparent", sc.Traceparent())
+	if sc.TraceState != "" {
+		h.Set("tracestate", sc.TraceState)
+	} else {
+		h.Del("tracestate")
+	}
+}
+
+// Extract returns ctx annotated with any remote span context
+// found in the traceparent and tracestate headers in h.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	sc, ok := ParseTraceparent(h.Get("traceparent"))
+	if !ok {
+		return ctx
+	}
+	sc.TraceState = strings.Join(h.Values("tracestate"), ",")
+	return ContextWithRemoteSpanContext(ctx, sc)
+}
+
+// noopSpan is used when there's no tracer. It retains
+// any parent span context so that it's still propagated.
+type noopSpan struct {
+	sc SpanContext
+}
+
+func (s noopSpan) SpanContext() SpanContext { return s.sc }
+func (noopSpan) SetAttributes(...Attr)      {}
+func (noopSpan) RecordError(error)          {}
+func (noopSpan) End()                       {}
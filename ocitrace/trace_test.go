@@ -0,0 +1,223 @@
+package ocitrace_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/ociauth"
+	"github.com/jcarter3/oci/ociclient"
+	"github.com/jcarter3/oci/ocilarge"
+	"github.com/jcarter3/oci/ocimem"
+	"github.com/jcarter3/oci/ociserver"
+	"github.com/jcarter3/oci/ocitrace"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+var parseTraceparentTests = []struct {
+	in    string
+	valid bool
+}{
+	{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+	{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true},
+	// Future versions may have extra fields.
+	{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true},
+	{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false},
+	{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+	{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+	{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+	{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false},
+	{"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", false},
+	{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false},
+	{"", false},
+}
+
+func TestParseTraceparent(t *testing.T) {
+	for _, test := range parseTraceparentTests {
+		t.Run(test.in, func(t *testing.T) {
+			sc, ok := ocitrace.ParseTraceparent(test.in)
+			require.Equal(t, test.valid, ok)
+			if !ok {
+				require.False(t, sc.IsValid())
+				return
+			}
+			require.True(t, sc.Remote)
+			if test.in[:2] == "00" {
+				require.Equal(t, test.in, sc.Traceparent())
+			}
+		})
+	}
+}
+
+func TestPropagationThroughProxy(t *testing.T) {
+	// Check that a trace started by a client is followed
+	// through a proxy server to an upstream server.
+	rec := ocitrace.NewRecorder()
+	upstream := httptest.NewServer(ociserver.New(ocimem.New(), &ociserver.Options{
+		Tracer: rec,
+	}))
+	defer upstream.Close()
+	proxy := httptest.NewServer(ociserver.New(newClient(t, upstream.URL, rec, nil), &ociserver.Options{
+		Tracer: rec,
+	}))
+	defer proxy.Close()
+	client := newClient(t, proxy.URL, rec, nil)
+
+	_, err := client.ResolveTag(context.Background(), "foo", "latest")
+	require.Error(t, err)
+
+	spans := rec.Spans()
+	require.Equal(t, []string{
+		"oci.ResolveTag",
+		"ociserver.ServeHTTP",
+		"oci.ResolveTag",
+		"ociserver.ServeHTTP",
+	}, spanNames(spans))
+	for i, span := range spans {
+		require.False(t, span.End.IsZero(), "span %d not ended", i)
+		require.Equal(t, spans[0].SpanContext.TraceID, span.SpanContext.TraceID, "span %d", i)
+		if i == 0 {
+			require.False(t, span.Parent.IsValid())
+			continue
+		}
+		require.Equal(t, spans[i-1].SpanContext.SpanID, span.Parent.SpanID, "span %d", i)
+	}
+	require.True(t, spans[1].Parent.Remote)
+	require.Equal(t, "ManifestHead", spans[1].Attr("oci.request_kind"))
+	require.Equal(t, "foo", spans[1].Attr(ocitrace.KeyRepo))
+	require.Equal(t, int64(http.StatusNotFound), spans[3].Attr("http.response.status_code"))
+	require.Len(t, spans[0].Errors, 1)
+}
+
+func TestServerContinuesIncomingTrace(t *testing.T) {
+	rec := ocitrace.NewRecorder()
+	srv := httptest.NewServer(ociserver.New(ocimem.New(), &ociserver.Options{
+		Tracer: rec,
+	}))
+	defer srv.Close()
+	req, err := http.NewRequest("GET", srv.URL+"/v2/", nil)
+	require.NoError(t, err)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set("tracestate", "vendor=value")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	spans := rec.Spans()
+	require.Len(t, spans, 1)
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[0].SpanContext.TraceID.String())
+	require.Equal(t, "00f067aa0ba902b7", spans[0].Parent.SpanID.String())
+	require.Equal(t, "vendor=value", spans[0].SpanContext.TraceState)
+	require.Equal(t, "Ping", spans[0].Attr("oci.request_kind"))
+}
+
+func TestClientPropagatesWithoutTracer(t *testing.T) {
+	var traceparent string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		traceparent = req.Header.Get("traceparent")
+		http.NotFound(w, req)
+	}))
+	defer srv.Close()
+	client := newClient(t, srv.URL, nil, nil)
+
+	const incoming = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ocitrace.ParseTraceparent(incoming)
+	require.True(t, ok)
+	ctx := ocitrace.ContextWithRemoteSpanContext(context.Background(), sc)
+	client.ResolveTag(ctx, "foo", "latest")
+	require.Equal(t, incoming, traceparent)
+}
+
+func TestAuthTokenSpan(t *testing.T) {
+	const token = "sometoken"
+	regHandler := ociserver.New(ocimem.New(), nil)
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/token" {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"token":%q,"expires_in":300}`, token)
+			return
+		}
+		if req.Header.Get("Authorization") != "Bearer "+token {
+			w.Header().Set("Www-Authenticate", fmt.Sprintf("Bearer realm=%q,service=test", ts.URL+"/token"))
+			http.Error(w, "no auth", http.StatusUnauthorized)
+			return
+		}
+		regHandler.ServeHTTP(w, req)
+	}))
+	defer ts.Close()
+
+	rec := ocitrace.NewRecorder()
+	client := newClient(t, ts.URL, rec, ociauth.NewStdTransport(ociauth.StdTransportParams{
+		Config: ociauth.NewStatic("someone", "password"),
+	}))
+	_, err := oci.All(client.Tags(context.Background(), "foo", nil))
+	require.ErrorIs(t, err, oci.ErrNameUnknown)
+
+	spans := rec.Spans()
+	require.Equal(t, []string{"oci.Tags", "ociauth.AcquireToken"}, spanNames(spans))
+	require.Equal(t, spans[0].SpanContext.SpanID, spans[1].Parent.SpanID)
+	require.Equal(t, "repository:foo:pull", spans[1].Attr("ociauth.scope"))
+	require.Empty(t, spans[1].Errors)
+	require.Equal(t, int64(0), spans[0].Attr("oci.count"))
+}
+
+func TestLargeBlobChunkSpans(t *testing.T) {
+	ctx := context.Background()
+	r := ocimem.New()
+	data := make([]byte, 9*1024*1024)
+	rand.Read(data)
+	dg := digest.FromBytes(data)
+	_, err := r.PushBlob(ctx, "foo", oci.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    dg,
+		Size:      int64(len(data)),
+	}, bytes.NewReader(data))
+	require.NoError(t, err)
+
+	rec := ocitrace.NewRecorder()
+	rd, err := ocilarge.DownloadLargeBlob(ocitrace.ContextWithTracer(ctx, rec), r, "foo", dg)
+	require.NoError(t, err)
+	got, err := io.ReadAll(rd)
+	require.NoError(t, err)
+	rd.Close()
+	require.Equal(t, data, got)
+
+	spans := rec.Spans()
+	require.GreaterOrEqual(t, len(spans), 2)
+	var total int64
+	for _, span := range spans {
+		require.Equal(t, "ocilarge.FetchRange", span.Name)
+		require.Equal(t, int64(1), span.Attr("ocilarge.attempts"))
+		total += span.Attr("oci.range.end").(int64) - span.Attr("oci.range.start").(int64)
+	}
+	require.Equal(t, int64(len(data)), total)
+}
+
+func newClient(t *testing.T, srvURL string, tracer ocitrace.Tracer, transport http.RoundTripper) oci.Interface {
+	u, err := url.Parse(srvURL)
+	require.NoError(t, err)
+	client, err := ociclient.New(u.Host, &ociclient.Options{
+		Insecure:  true,
+		Tracer:    tracer,
+		Transport: transport,
+	})
+	require.NoError(t, err)
+	return client
+}
+
+func spanNames(spans []ocitrace.RecordedSpan) []string {
+	names := make([]string, len(spans))
+	for i, span := range spans {
+		names[i] = span.Name
+	}
+	return names
+}
@@ -0,0 +1,277 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocitrace
+
+import (
+	"context"
+	"io"
+	"iter"
+
+	"github.com/jcarter3/oci"
+)
+
+// Attribute keys used on spans.
+const (
+	KeyRepo      = "oci.repository"
+	KeyDigest    = "oci.digest"
+	KeyTag       = "oci.tag"
+	KeySize      = "oci.size"
+	KeyMediaType = "oci.media_type"
+)
+
+// New returns a new [oci.Interface] that wraps r and starts
+// a span named "oci.<Method>" for each operation, using t. The span's
+// context is passed to r, so any spans started by r are children of it.
+//
+// If t is nil, the tracer attached to the context of each call is used,
+// if any.
+func New(r oci.Interface, t Tracer) oci.Interface {
+	return &tracer{
+		r: r,
+		t: t,
+	}
+}
+
+type tracer struct {
+	r oci.Interface
+	t Tracer
+	*oci.Funcs
+}
+
+func (r *tracer) start(ctx context.Context, method string, attrs ...Attr) (context.Context, Span) {
+	if r.t != nil {
+		ctx = ContextWithTracer(ctx, r.t)
+	}
+	return Start(ctx, "oci."+method, attrs...)
+}
+
+func (r *tracer) DeleteBlob(ctx context.Context, repoName string, digest oci.Digest) error {
+	ctx, span := r.start(ctx, "DeleteBlob", String(KeyRepo, repoName), String(KeyDigest, string(digest)))
+	err := r.r.DeleteBlob(ctx, repoName, digest)
+	End(span, err)
+	return err
+}
+
+func (r *tracer) DeleteManifest(ctx context.Context, repoName string, digest oci.Digest) error {
+	ctx, span := r.start(ctx, "DeleteManifest", String(KeyRepo, repoName), String(KeyDigest, string(digest)))
+	err := r.r.DeleteManifest(ctx, repoName, digest)
+	End(span, err)
+	return err
+}
+
+func (r *tracer) DeleteTag(ctx context.Context, repoName string, tagName string) error {
+	ctx, span := r.start(ctx, "DeleteTag", String(KeyRepo, repoName), String(KeyTag, tagName))
+	err := r.r.DeleteTag(ctx, repoName, tagName)
+	End(span, err)
+	return err
+}
+
+func (r *tracer) GetBlob(ctx context.Context, repoName string, dig oci.Digest) (oci.BlobReader, error) {
+	ctx, span := r.start(ctx, "GetBlob", String(KeyRepo, repoName), String(KeyDigest, string(dig)))
+	rd, err := r.r.GetBlob(ctx, repoName, dig)
+	endWithReader(span, rd, err)
+	return rd, err
+}
+
+func (r *tracer) GetBlobRange(ctx context.Context, repoName string, dig oci.Digest, o0, o1 int64) (oci.BlobReader, error) {
+	ctx, span := r.start(ctx, "GetBlobRange",
+		String(KeyRepo, repoName),
+		String(KeyDigest, string(dig)),
+		Int64("oci.range.start", o0),
+		Int64("oci.range.end", o1),
+	)
+	rd, err := r.r.GetBlobRange(ctx, repoName, dig, o0, o1)
+	endWithReader(span, rd, err)
+	return rd, err
+}
+
+func (r *tracer) GetManifest(ctx context.Context, repoName string, dig oci.Digest) (oci.BlobReader, error) {
+	ctx, span := r.start(ctx, "GetManifest", String(KeyRepo, repoName), String(KeyDigest, string(dig)))
+	rd, err := r.r.GetManifest(ctx, repoName, dig)
+	endWithReader(span, rd, err)
+	return rd, err
+}
+
+func (r *tracer) GetTag(ctx context.Context, repoName string, tagName string) (oci.BlobReader, error) {
+	ctx, span := r.start(ctx, "GetTag", String(KeyRepo, repoName), String(KeyTag, tagName))
+	rd, err := r.r.GetTag(ctx, repoName, tagName)
+	endWithReader(span, rd, err)
+	return rd, err
+}
+
+func (r *tracer) MountBlob(ctx context.Context, fromRepo, toRepo string, dig oci.Digest) (oci.Descriptor, error) {
+	ctx, span := r.start(ctx, "MountBlob",
+		String("oci.from_repository", fromRepo),
+		String(KeyRepo, toRepo),
+		String(KeyDigest, string(dig)),
+	)
+	desc, err := r.r.MountBlob(ctx, fromRepo, toRepo, dig)
+	End(span, err)
+	return desc, err
+}
+
+func (r *tracer) PushBlob(ctx context.Context, repoName string, desc oci.Descriptor, content io.Reader) (oci.Descriptor, error) {
+	ctx, span := r.start(ctx, "PushBlob",
+		String(KeyRepo, repoName),
+		String(KeyDigest, string(desc.Digest)),
+		Int64(KeySize, desc.Size),
+	)
+	desc, err := r.r.PushBlob(ctx, repoName, desc, content)
+	End(span, err)
+	return desc, err
+}
+
+func (r *tracer) PushBlobChunked(ctx context.Context, repoName string, chunkSize int) (oci.BlobWriter, error) {
+	ctx, span := r.start(ctx, "PushBlobChunked", String(KeyRepo, repoName), Int("oci.chunk_size", chunkSize))
+	w, err := r.r.PushBlobChunked(ctx, repoName, chunkSize)
+	End(span, err)
+	return r.blobWriter(ctx, w, repoName), err
+}
+
+func (r *tracer) PushBlobChunkedResume(ctx context.Context, repoName, id string, offset int64, chunkSize int) (oci.BlobWriter, error) {
+	ctx, span := r.start(ctx, "PushBlobChunkedResume",
+		String(KeyRepo, repoName),
+		Int64("oci.offset", offset),
+		Int("oci.chunk_size", chunkSize),
+	)
+	w, err := r.r.PushBlobChunkedResume(ctx, repoName, id, offset, chunkSize)
+	End(span, err)
+	return r.blobWriter(ctx, w, repoName), err
+}
+
+func (r *tracer) PushManifest(ctx context.Context, repoName string, data []byte, mediaType string, params *oci.PushManifestParameters) (oci.Descriptor, error) {
+	attrs := []Attr{
+		String(KeyRepo, repoName),
+		String(KeyMediaType, mediaType),
+		Int(KeySize, len(data)),
+	}
+	if params != nil && len(params.Tags) > 0 {
+		attrs = append(attrs, Attr{Key: "oci.tags", Value: params.Tags})
+	}
+	ctx, span := r.start(ctx, "PushManifest", attrs...)
+	desc, err := r.r.PushManifest(ctx, repoName, data, mediaType, params)
+	if err == nil {
+		span.SetAttributes(String(KeyDigest, string(desc.Digest)))
+	}
+	End(span, err)
+	return desc, err
+}
+
+func (r *tracer) Referrers(ctx context.Context, repoName string, digest oci.Digest, params *oci.ReferrersParameters) iter.Seq2[oci.Descriptor, error] {
+	return traceIter(r, ctx, "Referrers", func(ctx context.Context) iter.Seq2[oci.Descriptor, error] {
+		return r.r.Referrers(ctx, repoName, digest, params)
+	}, String(KeyRepo, repoName), String(KeyDigest, string(digest)))
+}
+
+func (r *tracer) Repositories(ctx context.Context, startAfter string) iter.Seq2[string, error] {
+	return traceIter(r, ctx, "Repositories", func(ctx context.Context) iter.Seq2[string, error] {
+		return r.r.Repositories(ctx, startAfter)
+	})
+}
+
+func (r *tracer) Tags(ctx context.Context, repoName string, params *oci.TagsParameters) iter.Seq2[string, error] {
+	return traceIter(r, ctx, "Tags", func(ctx context.Context) iter.Seq2[string, error] {
+		return r.r.Tags(ctx, repoName, params)
+	}, String(KeyRepo, repoName))
+}
+
+func (r *tracer) ResolveBlob(ctx context.Context, repoName string, digest oci.Digest) (oci.Descriptor, error) {
+	ctx, span := r.start(ctx, "ResolveBlob", String(KeyRepo, repoName), String(KeyDigest, string(digest)))
+	desc, err := r.r.ResolveBlob(ctx, repoName, digest)
+	endWithDescriptor(span, desc, err)
+	return desc, err
+}
+
+func (r *tracer) ResolveManifest(ctx context.Context, repoName string, digest oci.Digest) (oci.Descriptor, error) {
+	ctx, span := r.start(ctx, "ResolveManifest", String(KeyRepo, repoName), String(KeyDigest, string(digest)))
+	desc, err := r.r.ResolveManifest(ctx, repoName, digest)
+	endWithDescriptor(span, desc, err)
+	return desc, err
+}
+
+func (r *tracer) ResolveTag(ctx context.Context, repoName string, tagName string) (oci.Descriptor, error) {
+	ctx, span := r.start(ctx, "ResolveTag", String(KeyRepo, repoName), String(KeyTag, tagName))
+	desc, err := r.r.ResolveTag(ctx, repoName, tagName)
+	endWithDescriptor(span, desc, err)
+	return desc, err
+}
+
+func (r *tracer) blobWriter(ctx context.Context, w oci.BlobWriter, repo string) oci.BlobWriter {
+	if w == nil {
+		return nil
+	}
+	return blobWriter{
+		BlobWriter: w,
+		r:          r,
+		ctx:        ctx,
+		repo:       repo,
+	}
+}
+
+type blobWriter struct {
+	oci.BlobWriter
+	r    *tracer
+	ctx  context.Context
+	repo string
+}
+
+func (w blobWriter) Commit(digest oci.Digest) (oci.Descriptor, error) {
+	_, span := w.r.start(w.ctx, "BlobWriter.Commit", String(KeyRepo, w.repo), String(KeyDigest, string(digest)))
+	desc, err := w.BlobWriter.Commit(digest)
+	endWithDescriptor(span, desc, err)
+	return desc, err
+}
+
+func endWithReader(span Span, rd oci.BlobReader, err error) {
+	if err == nil {
+		desc := rd.Descriptor()
+		span.SetAttributes(String(KeyDigest, string(desc.Digest)), Int64(KeySize, desc.Size))
+	}
+	End(span, err)
+}
+
+func endWithDescriptor(span Span, desc oci.Descriptor, err error) {
+	if err == nil {
+		span.SetAttributes(String(KeyDigest, string(desc.Digest)), Int64(KeySize, desc.Size))
+	}
+	End(span, err)
+}
+
+// traceIter returns an iterator that starts a span when
+// iteration begins and ends it when iteration finishes.
+// The underlying iterator is created by calling newIter
+// with the span's context.
+func traceIter[T any](r *tracer, ctx context.Context, method string, newIter func(ctx context.Context) iter.Seq2[T, error], attrs ...Attr) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		ctx, span := r.start(ctx, method, attrs...)
+		n := 0
+		var _err error
+		defer func() {
+			span.SetAttributes(Int("oci.count", n))
+			End(span, _err)
+		}()
+		for item, err := range newIter(ctx) {
+			if err != nil {
+				_err = err
+				yield(*new(T), err)
+				return
+			}
+			if !yield(item, nil) {
+				return
+			}
+			n++
+		}
+	}
+}
@@ -22,23 +22,20 @@ import (
 
 // Deleter methods
 
-// TODO all these methods should not raise an error if deleting succeeds in one
-// registry but fails due to a not-found error in the other.
-
 func (u unifier) DeleteBlob(ctx context.Context, repo string, digest oci.Digest) error {
-	return bothResults(both(u, func(r oci.Interface, _ int) t1 {
+	return runDelete(u, operation{"DeleteBlob", repo, string(digest)}, func(r oci.Interface, _ int) t1 {
 		return mk1(r.DeleteBlob(ctx, repo, digest))
-	})).err
+	}).err
 }
 
 func (u unifier) DeleteManifest(ctx context.Context, repo string, digest oci.Digest) error {
-	return bothResults(both(u, func(r oci.Interface, _ int) t1 {
+	return runDelete(u, operation{"DeleteManifest", repo, string(digest)}, func(r oci.Interface, _ int) t1 {
 		return mk1(r.DeleteManifest(ctx, repo, digest))
-	})).err
+	}).err
 }
 
 func (u unifier) DeleteTag(ctx context.Context, repo string, name string) error {
-	return bothResults(both(u, func(r oci.Interface, _ int) t1 {
+	return runDelete(u, operation{"DeleteTag", repo, name}, func(r oci.Interface, _ int) t1 {
 		return mk1(r.DeleteTag(ctx, repo, name))
-	})).err
+	}).err
 }
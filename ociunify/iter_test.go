@@ -16,42 +16,145 @@ package ociunify
 
 import (
 	"cmp"
+	"errors"
 	"iter"
+	"strings"
 	"testing"
 
 	"github.com/jcarter3/oci"
 	"github.com/stretchr/testify/require"
 )
 
+var errTest = errors.New("test error")
+
 var mergeIterTests = []struct {
 	testName string
-	it0, it1 iter.Seq2[int, error]
+	its      []iter.Seq2[int, error]
 	want     []int
 	wantErr  error
 }{{
 	testName: "IdenticalContents",
-	it0:      oci.SliceSeq([]int{1, 2, 3}),
-	it1:      oci.SliceSeq([]int{1, 2, 3}),
-	want:     []int{1, 2, 3},
+	its: []iter.Seq2[int, error]{
+		oci.SliceSeq([]int{1, 2, 3}),
+		oci.SliceSeq([]int{1, 2, 3}),
+	},
+	want: []int{1, 2, 3},
 }, {
 	testName: "DifferentContents",
-	it0:      oci.SliceSeq([]int{0, 1, 2, 3}),
-	it1:      oci.SliceSeq([]int{1, 2, 3, 5}),
-	want:     []int{0, 1, 2, 3, 5},
+	its: []iter.Seq2[int, error]{
+		oci.SliceSeq([]int{0, 1, 2, 3}),
+		oci.SliceSeq([]int{1, 2, 3, 5}),
+	},
+	want: []int{0, 1, 2, 3, 5},
 }, {
 	testName: "NoItems",
-	it0:      oci.SliceSeq[int](nil),
-	it1:      oci.SliceSeq[int](nil),
-	want:     []int{},
+	its: []iter.Seq2[int, error]{
+		oci.SliceSeq[int](nil),
+		oci.SliceSeq[int](nil),
+	},
+	want: []int{},
+}, {
+	testName: "ThreeWay",
+	its: []iter.Seq2[int, error]{
+		oci.SliceSeq([]int{1, 4, 7}),
+		oci.SliceSeq([]int{2, 4, 8, 9}),
+		oci.SliceSeq([]int{0, 3, 4, 7}),
+	},
+	want: []int{0, 1, 2, 3, 4, 7, 8, 9},
+}, {
+	testName: "SomeNotFound",
+	its: []iter.Seq2[int, error]{
+		oci.ErrorSeq[int](oci.ErrNameUnknown),
+		oci.SliceSeq([]int{1, 2}),
+	},
+	want: []int{1, 2},
+}, {
+	testName: "AllNotFound",
+	its: []iter.Seq2[int, error]{
+		oci.ErrorSeq[int](oci.ErrNameUnknown),
+		oci.ErrorSeq[int](oci.ErrNameUnknown),
+	},
+	want:    []int{},
+	wantErr: oci.ErrNameUnknown,
+}, {
+	testName: "ErrorAfterItems",
+	its: []iter.Seq2[int, error]{
+		withError(oci.SliceSeq([]int{1, 5}), errTest),
+		oci.SliceSeq([]int{2, 3, 4}),
+	},
+	want:    []int{1, 2, 3, 4, 5},
+	wantErr: errTest,
 }}
 
 func TestMergeIter(t *testing.T) {
 	for _, test := range mergeIterTests {
 		t.Run(test.testName, func(t *testing.T) {
-			it := mergeIter(test.it0, test.it1, cmp.Compare)
-			xs, err := oci.All(it)
+			// Collect the items by hand, as oci.All
+			// discards them when there's an error.
+			xs := []int{}
+			var err error
+			for x, err1 := range mergeIter(test.its, cmp.Compare) {
+				if err1 != nil {
+					err = err1
+					break
+				}
+				xs = append(xs, x)
+			}
 			require.Equal(t, test.want, xs)
 			require.Equal(t, test.wantErr, err)
 		})
 	}
 }
+
+func TestMergeIterLazy(t *testing.T) {
+	// Each iterator counts the items that have been read from it.
+	var n0, n1 int
+	counting := func(n *int, start int) iter.Seq2[int, error] {
+		return func(yield func(int, error) bool) {
+			for i := start; ; i += 2 {
+				*n++
+				if !yield(i, nil) {
+					return
+				}
+			}
+		}
+	}
+	var got []int
+	for x, err := range mergeIter([]iter.Seq2[int, error]{counting(&n0, 0), counting(&n1, 1)}, cmp.Compare) {
+		require.NoError(t, err)
+		got = append(got, x)
+		if len(got) == 5 {
+			break
+		}
+	}
+	require.Equal(t, []int{0, 1, 2, 3, 4}, got)
+	// Each iterator is read at most one item ahead.
+	require.LessOrEqual(t, n0, 4)
+	require.LessOrEqual(t, n1, 4)
+}
+
+func TestMergeSources(t *testing.T) {
+	it := mergeSources([]iter.Seq2[string, error]{
+		oci.SliceSeq([]string{"a", "b"}),
+		oci.SliceSeq([]string{"b", "c"}),
+		oci.SliceSeq([]string{"b"}),
+	}, strings.Compare)
+	ms, err := oci.All(it)
+	require.NoError(t, err)
+	require.Equal(t, []merged[string]{
+		{"a", []int{0}},
+		{"b", []int{0, 1, 2}},
+		{"c", []int{1}},
+	}, ms)
+}
+
+func withError[T any](it iter.Seq2[T, error], err error) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		for x, err := range it {
+			if !yield(x, err) {
+				return
+			}
+		}
+		yield(*new(T), err)
+	}
+}
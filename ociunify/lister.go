@@ -20,25 +20,41 @@ import (
 	"iter"
 	"slices"
 	"strings"
+	"sync"
 
 	"github.com/jcarter3/oci"
 )
 
 func (u unifier) Repositories(ctx context.Context, startAfter string) iter.Seq2[string, error] {
-	r0, r1 := both(u, func(r oci.Interface, _ int) iter.Seq2[string, error] {
+	its := all(u, u.allBackends(), func(r oci.Interface, _ int) iter.Seq2[string, error] {
 		return r.Repositories(ctx, startAfter)
 	})
-	return mergeIter(r0, r1, strings.Compare)
+	return mergeIter(its, strings.Compare)
 }
 
 func (u unifier) Tags(ctx context.Context, repo string, params *oci.TagsParameters) iter.Seq2[string, error] {
-	r0, r1 := both(u, func(r oci.Interface, _ int) iter.Seq2[string, error] {
-		return r.Tags(ctx, repo, params)
-	})
-	it := mergeIter(r0, r1, strings.Compare)
+	omit := u.opts.TagConflictPolicy == TagConflictOmit
 	var limit int
+	backendParams := params
 	if params != nil {
 		limit = params.Limit
+		if omit && limit > 0 {
+			// Conflicting tags are omitted after the results
+			// are merged, so the backends might need to return
+			// more than limit tags between them.
+			p := *params
+			p.Limit = 0
+			backendParams = &p
+		}
+	}
+	its := all(u, u.allBackends(), func(r oci.Interface, _ int) iter.Seq2[string, error] {
+		return r.Tags(ctx, repo, backendParams)
+	})
+	var it iter.Seq2[string, error]
+	if omit {
+		it = u.omitConflicts(ctx, repo, mergeSources(its, strings.Compare))
+	} else {
+		it = mergeIter(its, strings.Compare)
 	}
 	if limit > 0 {
 		return oci.LimitIter(it, limit)
@@ -46,55 +62,186 @@ func (u unifier) Tags(ctx context.Context, repo string, params *oci.TagsParamete
 	return it
 }
 
+// omitConflicts returns an iterator that omits the tags from it
+// that resolve to different manifests in different backends.
+// Only tags found in more than one backend need to be resolved.
+func (u unifier) omitConflicts(ctx context.Context, repo string, it iter.Seq2[merged[string], error]) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		for m, err := range it {
+			if err == nil {
+				readers := slices.DeleteFunc(m.sources, func(i int) bool {
+					return u.backends[i].Role == RoleFallback
+				})
+				if len(readers) > 1 {
+					_, conflict := tagReadGroup(u, readers, m.x, func(r oci.Interface, _ int) t2[oci.Descriptor] {
+						return mk2(r.ResolveTag(ctx, repo, m.x))
+					}, func(desc oci.Descriptor) oci.Digest {
+						return desc.Digest
+					})
+					if conflict {
+						continue
+					}
+				}
+			}
+			if !yield(m.x, err) {
+				return
+			}
+		}
+	}
+}
+
 func (u unifier) Referrers(ctx context.Context, repo string, digest oci.Digest, params *oci.ReferrersParameters) iter.Seq2[oci.Descriptor, error] {
-	r0, r1 := both(u, func(r oci.Interface, _ int) iter.Seq2[oci.Descriptor, error] {
-		return r.Referrers(ctx, repo, digest, params)
+	its := all(u, u.allBackends(), func(r oci.Interface, _ int) iter.Seq2[oci.Descriptor, error] {
+		// Referrers aren't returned in any particular order.
+		return sortedIter(r.Referrers(ctx, repo, digest, params), compareDescriptor)
 	})
-	return mergeIter(r0, r1, compareDescriptor)
+	return mergeIter(its, compareDescriptor)
+}
+
+// allBackends returns the indexes of all the backends.
+func (u unifier) allBackends() []int {
+	idxs := make([]int, len(u.backends))
+	for i := range idxs {
+		idxs[i] = i
+	}
+	return idxs
 }
 
 func compareDescriptor(d0, d1 oci.Descriptor) int {
 	return strings.Compare(string(d0.Digest), string(d1.Digest))
 }
 
-func mergeIter[T any](it0, it1 iter.Seq2[T, error], cmp func(T, T) int) iter.Seq2[T, error] {
-	// TODO streaming merge sort
-	xs0, err0 := oci.All(it0)
-	xs1, err1 := oci.All(it1)
-	if err0 != nil || err1 != nil {
-		notFound0 := errors.Is(err0, oci.ErrNameUnknown)
-		notFound1 := errors.Is(err1, oci.ErrNameUnknown)
-		if notFound0 && notFound1 {
-			return oci.ErrorSeq[T](err0)
-		}
-		if notFound0 {
-			err0 = nil
+// sortedIter returns an iterator that yields the items from it sorted
+// by cmp. Nothing is read from it until the iterator is used.
+func sortedIter[T any](it iter.Seq2[T, error], cmp func(T, T) int) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		xs, err := oci.All(it)
+		slices.SortFunc(xs, cmp)
+		for _, x := range xs {
+			if !yield(x, nil) {
+				return
+			}
 		}
-		if notFound1 {
-			err1 = nil
+		if err != nil {
+			yield(*new(T), err)
 		}
 	}
-	var xs []T
-	if len(xs0)+len(xs1) > 0 {
-		xs = slices.Concat(xs0, xs1)
-		slices.SortFunc(xs, cmp)
-		xs = slices.CompactFunc(xs, func(t1, t2 T) bool {
-			return cmp(t1, t2) == 0
-		})
-	}
-	err := err0
-	if err == nil {
-		err = err1
-	}
-	if err == nil {
-		return oci.SliceSeq(xs)
-	}
+}
+
+// mergeIter returns an iterator over the sorted union of the items
+// in its, each of which must be sorted by cmp. See [mergeSources].
+func mergeIter[T any](its []iter.Seq2[T, error], cmp func(T, T) int) iter.Seq2[T, error] {
 	return func(yield func(T, error) bool) {
-		for _, x := range xs {
-			if !yield(x, nil) {
+		for m, err := range mergeSources(its, cmp) {
+			if !yield(m.x, err) {
 				return
 			}
 		}
-		yield(*new(T), err)
+	}
+}
+
+// merged holds an item produced by [mergeSources].
+type merged[T any] struct {
+	x T
+	// sources holds the indexes of the iterators that produced x.
+	sources []int
+}
+
+// mergeSources returns an iterator over the sorted union of the items
+// in its, each of which must be sorted by cmp, along with the
+// iterators each item came from. Items that compare equal are yielded
+// once.
+//
+// The iterators are read lazily, one item ahead of the
+// merged result, so no more of them is read than is needed.
+//
+// Iterators that fail with [oci.ErrNameUnknown] are treated as finished
+// unless they all fail that way, in which case that error is returned.
+// If an iterator fails with any other error, the merge continues with
+// the others and the first such error is returned at the end.
+func mergeSources[T any](its []iter.Seq2[T, error], cmp func(T, T) int) iter.Seq2[merged[T], error] {
+	return func(yield func(merged[T], error) bool) {
+		type head struct {
+			next func() (T, error, bool)
+			x    T
+			ok   bool
+		}
+		heads := make([]head, len(its))
+		for i, it := range its {
+			next, stop := iter.Pull2(it)
+			defer stop()
+			heads[i].next = next
+		}
+		var err error
+		notFound := 0
+		var notFoundErr error
+		// advance reads the next item from heads[i] and returns any error.
+		advance := func(i int) error {
+			h := &heads[i]
+			x, err, ok := h.next()
+			h.x, h.ok = x, ok && err == nil
+			return err
+		}
+		record := func(err1 error) {
+			switch {
+			case err1 == nil:
+			case errors.Is(err1, oci.ErrNameUnknown):
+				notFound++
+				notFoundErr = err1
+			case err == nil:
+				err = err1
+			}
+		}
+		// Read the first item from each iterator concurrently,
+		// as each one might need a round trip.
+		errs := make([]error, len(heads))
+		var wg sync.WaitGroup
+		for i := range heads {
+			wg.Go(func() {
+				errs[i] = advance(i)
+			})
+		}
+		wg.Wait()
+		for _, err1 := range errs {
+			record(err1)
+		}
+		if len(its) > 0 && notFound == len(its) {
+			yield(merged[T]{}, notFoundErr)
+			return
+		}
+		for {
+			// Find the smallest head and all the
+			// iterators that have it.
+			var m merged[T]
+			for i := range heads {
+				h := &heads[i]
+				if !h.ok {
+					continue
+				}
+				if m.sources != nil {
+					c := cmp(h.x, m.x)
+					if c > 0 {
+						continue
+					}
+					if c == 0 {
+						m.sources = append(m.sources, i)
+						continue
+					}
+				}
+				m.x, m.sources = h.x, []int{i}
+			}
+			if m.sources == nil {
+				break
+			}
+			for _, i := range m.sources {
+				record(advance(i))
+			}
+			if !yield(m, nil) {
+				return
+			}
+		}
+		if err != nil {
+			yield(merged[T]{}, err)
+		}
 	}
 }
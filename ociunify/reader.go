@@ -56,26 +56,11 @@ func (r blobReader) Close() error {
 }
 
 func (u unifier) GetTag(ctx context.Context, repo string, tagName string) (oci.BlobReader, error) {
-	r0, r1 := both(u, func(r oci.Interface, _ int) t2[oci.BlobReader] {
+	return runTagRead(u, tagName, func(r oci.Interface, _ int) t2[oci.BlobReader] {
 		return mk2(r.GetTag(ctx, repo, tagName))
-	})
-	switch {
-	case r0.err == nil && r1.err == nil:
-		if r0.x.Descriptor().Digest == r1.x.Descriptor().Digest {
-			r1.x.Close()
-			return r0.get()
-		}
-		r0.close()
-		r1.close()
-		return nil, fmt.Errorf("conflicting results for tag")
-	case r0.err != nil && r1.err != nil:
-		return r0.get()
-	case r0.err == nil:
-		return r0.get()
-	case r1.err == nil:
-		return r1.get()
-	}
-	panic("unreachable")
+	}, func(r oci.BlobReader) oci.Digest {
+		return r.Descriptor().Digest
+	}).get()
 }
 
 func (u unifier) ResolveBlob(ctx context.Context, repo string, digest oci.Digest) (oci.Descriptor, error) {
@@ -91,23 +76,65 @@ func (u unifier) ResolveManifest(ctx context.Context, repo string, digest oci.Di
 }
 
 func (u unifier) ResolveTag(ctx context.Context, repo string, tagName string) (oci.Descriptor, error) {
-	r0, r1 := both(u, func(r oci.Interface, _ int) t2[oci.Descriptor] {
+	return runTagRead(u, tagName, func(r oci.Interface, _ int) t2[oci.Descriptor] {
 		return mk2(r.ResolveTag(ctx, repo, tagName))
-	})
-	switch {
-	case r0.err == nil && r1.err == nil:
-		if r0.x.Digest == r1.x.Digest {
-			return r0.get()
+	}, func(desc oci.Descriptor) oci.Digest {
+		return desc.Digest
+	}).get()
+}
+
+// runTagRead calls f concurrently on each backend other than the
+// fallbacks and combines the results according to the tag conflict
+// policy. The fallbacks are tried only if none of the other backends
+// has the tag.
+func runTagRead[T any](u unifier, tagName string, f func(r oci.Interface, i int) t2[T], digestOf func(T) oci.Digest) t2[T] {
+	r, conflict := tagReadGroup(u, u.readers, tagName, f, digestOf)
+	if r.err == nil || conflict || len(u.fallbacks) == 0 {
+		return r
+	}
+	r1, _ := tagReadGroup(u, u.fallbacks, tagName, f, digestOf)
+	if r1.err == nil || len(u.readers) == 0 {
+		return r1
+	}
+	return r
+}
+
+// tagReadGroup is like runTagRead but calls only the backends
+// with the given indexes. It also reports whether there was a conflict.
+func tagReadGroup[T any](u unifier, idxs []int, tagName string, f func(r oci.Interface, i int) t2[T], digestOf func(T) oci.Digest) (t2[T], bool) {
+	if len(idxs) == 0 {
+		return mk2(*new(T), fmt.Errorf("no backends to read from: %w", oci.ErrManifestUnknown)), false
+	}
+	rs := all(u, idxs, f)
+	var found []t2[T]
+	for _, r := range rs {
+		if r.err == nil {
+			found = append(found, r)
+		}
+	}
+	if len(found) == 0 {
+		return rs[0], false
+	}
+	first := found[0]
+	conflict := false
+	for _, r := range found[1:] {
+		if digestOf(r.x) != digestOf(first.x) {
+			conflict = true
+		}
+	}
+	if !conflict || u.opts.TagConflictPolicy == TagConflictFirstWins {
+		for _, r := range found[1:] {
+			r.close()
 		}
-		return oci.Descriptor{}, fmt.Errorf("conflicting results for tag")
-	case r0.err != nil && r1.err != nil:
-		return r0.get()
-	case r0.err == nil:
-		return r0.get()
-	case r1.err == nil:
-		return r1.get()
+		return first, false
+	}
+	for _, r := range found {
+		r.close()
+	}
+	if u.opts.TagConflictPolicy == TagConflictOmit {
+		return first.mkErr(fmt.Errorf("conflicting results for tag %q: %w", tagName, oci.ErrManifestUnknown)), true
 	}
-	panic("unreachable")
+	return first.mkErr(fmt.Errorf("conflicting results for tag %q", tagName)), true
 }
 
 func runReadBlobReader(ctx context.Context, u unifier, f func(ctx context.Context, r oci.Interface, i int) t2[oci.BlobReader]) (oci.BlobReader, error) {
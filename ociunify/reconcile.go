@@ -0,0 +1,573 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociunify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/internal/ocimanifest"
+)
+
+// maxDivergences holds the maximum number of divergences
+// recorded. Older divergences are discarded beyond this.
+const maxDivergences = 1000
+
+// Divergence records a write or delete that succeeded on some
+// backends but not others, leaving them out of step.
+type Divergence struct {
+	// Time holds when the operation happened.
+	Time time.Time
+
+	// Op holds the name of the operation, for example
+	// "PushManifest" or "DeleteTag".
+	Op string
+
+	// Repo holds the repository that was written to.
+	Repo string
+
+	// Target holds the digest or tag that was written or deleted.
+	Target string
+
+	// Succeeded and Failed hold the indexes of the backends
+	// on which the operation succeeded and failed.
+	Succeeded []int
+	Failed    []int
+
+	// Err holds the error from the operation.
+	Err error
+}
+
+type divergenceLog struct {
+	mu      sync.Mutex
+	entries []Divergence
+}
+
+func (u unifier) record(op operation, succeeded, failed []int, err error) {
+	d := Divergence{
+		Time:      time.Now(),
+		Op:        op.name,
+		Repo:      op.repo,
+		Target:    op.target,
+		Succeeded: succeeded,
+		Failed:    failed,
+		Err:       err,
+	}
+	u.log.mu.Lock()
+	u.log.entries = append(u.log.entries, d)
+	if n := len(u.log.entries) - maxDivergences; n > 0 {
+		u.log.entries = slices.Delete(u.log.entries, 0, n)
+	}
+	u.log.mu.Unlock()
+	if u.opts.OnDivergence != nil {
+		u.opts.OnDivergence(d)
+	}
+}
+
+// supersededDelete holds, for each kind of write, the kind
+// of delete whose divergences it supersedes.
+var supersededDelete = map[string]string{
+	"PushBlob":        "DeleteBlob",
+	"PushBlobChunked": "DeleteBlob",
+	"MountBlob":       "DeleteBlob",
+	"PushManifest":    "DeleteManifest",
+}
+
+// wrote records that the write described by op has succeeded on at
+// least one backend. Divergences recorded by earlier deletes of the
+// same content, or of any of the given tags, are discarded, as
+// making those deletes again would undo the write.
+func (u unifier) wrote(op operation, tags []string) {
+	del := supersededDelete[op.name]
+	u.log.mu.Lock()
+	defer u.log.mu.Unlock()
+	u.log.entries = slices.DeleteFunc(u.log.entries, func(d Divergence) bool {
+		if d.Repo != op.repo {
+			return false
+		}
+		switch d.Op {
+		case del:
+			return d.Target == op.target
+		case "DeleteTag":
+			return slices.Contains(tags, d.Target)
+		}
+		return false
+	})
+}
+
+// Divergences returns the divergences that have been recorded
+// and not yet repaired by [Registry.Reconcile], oldest first.
+// At most 1000 are kept.
+func (r *Registry) Divergences() []Divergence {
+	r.log.mu.Lock()
+	defer r.log.mu.Unlock()
+	return slices.Clone(r.log.entries)
+}
+
+// ReconcileResult holds the outcome of [Registry.Reconcile].
+type ReconcileResult struct {
+	// Repairs holds the changes made, in order.
+	Repairs []Repair
+
+	// Conflicts holds the tags that resolve to different
+	// manifests in different backends and so could not be
+	// reconciled. With TagConflictFirstWins, conflicting
+	// tags are reconciled to the first backend's value instead.
+	Conflicts []string
+}
+
+// Repair describes a change made by [Registry.Reconcile].
+type Repair struct {
+	// Backend holds the index of the backend that was changed.
+	Backend int
+
+	// Op holds the operation made on the backend: one of
+	// "PushBlob", "PushManifest", "DeleteBlob",
+	// "DeleteManifest" or "DeleteTag".
+	Op string
+
+	// Target holds the digest or tag that was changed.
+	Target string
+}
+
+// Reconcile compares the given repository in each of the backends
+// that can be written to (targets and mirrors) and repairs any
+// differences by copying content from backends that have it to
+// those that don't.
+//
+// First, deletes that were recorded as divergences are made again on
+// the backends where they failed, so that the deleted content isn't
+// copied back. A delete is forgotten once the same content or tag
+// has been written again, so content pushed after it was deleted
+// is kept. Then each tag missing from a backend is copied to it,
+// along with the manifest it refers to and all the content that
+// manifest references. Next, content from other writes recorded as
+// divergences is copied to the backends where it's missing. Finally,
+// the referrers of every manifest found so far, and of the entries of
+// indexes among them, are copied to each backend that holds the
+// manifest but lacks them, as are their referrers in turn. When
+// there are no errors, the divergences recorded for the repository
+// are discarded.
+//
+// Only divergences recorded since the registry was created, and not
+// yet discarded, are known, and backends can't list all their
+// manifests or blobs. So differences in untagged manifests that
+// aren't referrers or index entries of a tagged manifest, and in
+// blobs that no such manifest refers to, are only found when
+// they're recorded as divergences. Deletes that aren't recorded
+// can't be told apart from content missing from a backend, so
+// content deleted from only some of the backends is copied back.
+func (r *Registry) Reconcile(ctx context.Context, repo string) (*ReconcileResult, error) {
+	u := r.unifier
+	rc := &reconciler{
+		u:      u,
+		repo:   repo,
+		result: &ReconcileResult{},
+	}
+	writable := slices.Concat(u.targets, u.mirrors)
+	if len(writable) < 2 {
+		return rc.result, nil
+	}
+	slices.Sort(writable)
+	var divergences []Divergence
+	for _, d := range r.Divergences() {
+		if d.Repo == repo {
+			divergences = append(divergences, d)
+		}
+	}
+
+	var errs []error
+	for _, d := range divergences {
+		if err := rc.redelete(ctx, d, writable); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := rc.reconcileTags(ctx, writable); err != nil {
+		errs = append(errs, err)
+	}
+	for _, d := range divergences {
+		if err := rc.repush(ctx, d, writable); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := rc.reconcileReferrers(ctx, writable); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return rc.result, errors.Join(errs...)
+	}
+	if len(divergences) == 0 {
+		return rc.result, nil
+	}
+	r.log.mu.Lock()
+	r.log.entries = slices.DeleteFunc(r.log.entries, func(d Divergence) bool {
+		return d.Repo == repo && !d.Time.After(divergences[len(divergences)-1].Time)
+	})
+	r.log.mu.Unlock()
+	return rc.result, nil
+}
+
+type reconciler struct {
+	u      unifier
+	repo   string
+	result *ReconcileResult
+
+	// manifests holds the manifests that have been reconciled,
+	// whose referrers are to be reconciled in turn.
+	manifests []oci.Digest
+}
+
+func (rc *reconciler) backend(i int) oci.Interface {
+	return rc.u.backends[i].Registry
+}
+
+func (rc *reconciler) repaired(i int, op, target string) {
+	rc.result.Repairs = append(rc.result.Repairs, Repair{
+		Backend: i,
+		Op:      op,
+		Target:  target,
+	})
+}
+
+// redelete makes the delete recorded in d on all the given backends.
+func (rc *reconciler) redelete(ctx context.Context, d Divergence, backends []int) error {
+	var del func(r oci.Interface) error
+	switch d.Op {
+	case "DeleteTag":
+		del = func(r oci.Interface) error {
+			return r.DeleteTag(ctx, rc.repo, d.Target)
+		}
+	case "DeleteManifest":
+		del = func(r oci.Interface) error {
+			return r.DeleteManifest(ctx, rc.repo, oci.Digest(d.Target))
+		}
+	case "DeleteBlob":
+		del = func(r oci.Interface) error {
+			return r.DeleteBlob(ctx, rc.repo, oci.Digest(d.Target))
+		}
+	default:
+		return nil
+	}
+	var errs []error
+	for _, i := range backends {
+		err := del(rc.backend(i))
+		switch {
+		case err == nil:
+			rc.repaired(i, d.Op, d.Target)
+		case !isNotFound(err):
+			errs = append(errs, fmt.Errorf("backend %d: cannot %s %s: %w", i, d.Op, d.Target, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// repush copies the content written by the operation
+// recorded in d to any of the given backends that lack it.
+func (rc *reconciler) repush(ctx context.Context, d Divergence, backends []int) error {
+	dig := oci.Digest(d.Target)
+	switch d.Op {
+	case "PushManifest":
+		rc.manifests = append(rc.manifests, dig)
+		return rc.copyToAll(backends, func(r oci.Interface) error {
+			_, err := r.ResolveManifest(ctx, rc.repo, dig)
+			return err
+		}, func(src, dst int) error {
+			return rc.copyManifest(ctx, src, dst, dig, nil)
+		})
+	case "PushBlob", "PushBlobChunked", "MountBlob":
+		return rc.copyToAll(backends, func(r oci.Interface) error {
+			_, err := r.ResolveBlob(ctx, rc.repo, dig)
+			return err
+		}, func(src, dst int) error {
+			desc, err := rc.backend(src).ResolveBlob(ctx, rc.repo, dig)
+			if err != nil {
+				return err
+			}
+			return rc.copyBlob(ctx, src, dst, desc)
+		})
+	}
+	return nil
+}
+
+// copyToAll uses resolve to find which of the given backends have some
+// content, and calls copyTo to copy it from the first that has it to
+// each of the others.
+func (rc *reconciler) copyToAll(backends []int, resolve func(r oci.Interface) error, copyTo func(src, dst int) error) error {
+	src := -1
+	var missing []int
+	for _, i := range backends {
+		err := resolve(rc.backend(i))
+		switch {
+		case err == nil:
+			if src == -1 {
+				src = i
+			}
+		case isNotFound(err):
+			missing = append(missing, i)
+		default:
+			return fmt.Errorf("backend %d: %w", i, err)
+		}
+	}
+	if src == -1 {
+		// It's not anywhere, so there's nothing to do.
+		return nil
+	}
+	var errs []error
+	for _, i := range missing {
+		if err := copyTo(src, i); err != nil {
+			errs = append(errs, fmt.Errorf("cannot copy from backend %d to %d: %w", src, i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// reconcileTags makes sure that every tag in
+// any of the given backends is in all of them.
+func (rc *reconciler) reconcileTags(ctx context.Context, backends []int) error {
+	// tags holds the digest of each tag in each backend.
+	tags := make(map[string][]oci.Digest)
+	var names []string
+	for j, i := range backends {
+		for tag, err := range rc.backend(i).Tags(ctx, rc.repo, nil) {
+			if err != nil {
+				if isNotFound(err) {
+					break
+				}
+				return fmt.Errorf("backend %d: cannot list tags: %w", i, err)
+			}
+			desc, err := rc.backend(i).ResolveTag(ctx, rc.repo, tag)
+			if err != nil {
+				if isNotFound(err) {
+					continue
+				}
+				return fmt.Errorf("backend %d: cannot resolve tag %q: %w", i, tag, err)
+			}
+			digests, ok := tags[tag]
+			if !ok {
+				digests = make([]oci.Digest, len(backends))
+				tags[tag] = digests
+				names = append(names, tag)
+			}
+			digests[j] = desc.Digest
+			rc.manifests = append(rc.manifests, desc.Digest)
+		}
+	}
+	slices.Sort(names)
+	var errs []error
+	for _, tag := range names {
+		digests := tags[tag]
+		var want oci.Digest
+		src := -1
+		conflict := false
+		for j, dig := range digests {
+			switch {
+			case dig == "":
+			case src == -1:
+				src, want = backends[j], dig
+			case dig != want:
+				conflict = true
+			}
+		}
+		if conflict && rc.u.opts.TagConflictPolicy != TagConflictFirstWins {
+			rc.result.Conflicts = append(rc.result.Conflicts, tag)
+			continue
+		}
+		for j, dig := range digests {
+			if dig == want {
+				continue
+			}
+			if err := rc.copyManifest(ctx, src, backends[j], want, []string{tag}); err != nil {
+				errs = append(errs, fmt.Errorf("cannot copy tag %q from backend %d to %d: %w", tag, src, backends[j], err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// reconcileReferrers makes sure that each of the given backends that
+// holds one of rc.manifests also holds all of its referrers. The
+// entries of indexes and the referrers themselves are treated in
+// the same way in turn.
+func (rc *reconciler) reconcileReferrers(ctx context.Context, backends []int) error {
+	var errs []error
+	visited := make(map[oci.Digest]bool)
+	queue := slices.Clone(rc.manifests)
+	slices.Sort(queue)
+	for len(queue) > 0 {
+		dig := queue[0]
+		queue = queue[1:]
+		if visited[dig] {
+			continue
+		}
+		visited[dig] = true
+		holders, err := rc.holders(ctx, backends, dig)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if len(holders) == 0 {
+			continue
+		}
+		_, refs, err := ocimanifest.Get(ctx, rc.backend(holders[0]), rc.repo, dig)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("backend %d: cannot get manifest %s: %w", holders[0], dig, err))
+			continue
+		}
+		for _, desc := range refs.Manifests {
+			queue = append(queue, desc.Digest)
+		}
+		// src holds the first backend found to hold each
+		// referrer, and listed holds the referrers that
+		// each backend lists.
+		src := make(map[oci.Digest]int)
+		listed := make(map[int]map[oci.Digest]bool)
+		var referrers []oci.Digest
+		for _, i := range holders {
+			listed[i] = make(map[oci.Digest]bool)
+			for desc, err := range rc.backend(i).Referrers(ctx, rc.repo, dig, nil) {
+				if err != nil {
+					if !errors.Is(err, oci.ErrUnsupported) && !isNotFound(err) {
+						errs = append(errs, fmt.Errorf("backend %d: cannot list referrers of %s: %w", i, dig, err))
+					}
+					break
+				}
+				listed[i][desc.Digest] = true
+				if _, ok := src[desc.Digest]; !ok {
+					src[desc.Digest] = i
+					referrers = append(referrers, desc.Digest)
+				}
+			}
+		}
+		slices.Sort(referrers)
+		for _, referrer := range referrers {
+			queue = append(queue, referrer)
+			for _, i := range holders {
+				if listed[i][referrer] {
+					continue
+				}
+				// The backend might hold the referrer without
+				// listing it, for example if it doesn't
+				// support the referrers API.
+				_, err := rc.backend(i).ResolveManifest(ctx, rc.repo, referrer)
+				if err == nil {
+					continue
+				}
+				if !isNotFound(err) {
+					errs = append(errs, fmt.Errorf("backend %d: %w", i, err))
+					continue
+				}
+				if err := rc.copyManifest(ctx, src[referrer], i, referrer, nil); err != nil {
+					errs = append(errs, fmt.Errorf("cannot copy referrer %s of %s from backend %d to %d: %w", referrer, dig, src[referrer], i, err))
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// holders returns which of the given backends
+// hold the manifest with the given digest.
+func (rc *reconciler) holders(ctx context.Context, backends []int, dig oci.Digest) ([]int, error) {
+	var holders []int
+	for _, i := range backends {
+		_, err := rc.backend(i).ResolveManifest(ctx, rc.repo, dig)
+		switch {
+		case err == nil:
+			holders = append(holders, i)
+		case !isNotFound(err):
+			return nil, fmt.Errorf("backend %d: %w", i, err)
+		}
+	}
+	return holders, nil
+}
+
+// copyManifest copies the manifest with the given digest, and
+// everything it refers to, from backend src to backend dst,
+// giving it the given tags.
+func (rc *reconciler) copyManifest(ctx context.Context, src, dst int, dig oci.Digest, tags []string) error {
+	rd, err := rc.backend(src).GetManifest(ctx, rc.repo, dig)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(rd)
+	mediaType := rd.Descriptor().MediaType
+	rd.Close()
+	if err != nil {
+		return err
+	}
+	// Both image manifests and indexes can be
+	// decoded into this.
+	var m struct {
+		Config    *oci.Descriptor  `json:"config"`
+		Layers    []oci.Descriptor `json:"layers"`
+		Blobs     []oci.Descriptor `json:"blobs"`
+		Manifests []oci.Descriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("cannot decode manifest %s: %v", dig, err)
+	}
+	blobs := slices.Concat(m.Layers, m.Blobs)
+	if m.Config != nil {
+		blobs = append(blobs, *m.Config)
+	}
+	for _, desc := range blobs {
+		if _, err := rc.backend(dst).ResolveBlob(ctx, rc.repo, desc.Digest); err == nil {
+			continue
+		}
+		if err := rc.copyBlob(ctx, src, dst, desc); err != nil {
+			return err
+		}
+	}
+	for _, desc := range m.Manifests {
+		if _, err := rc.backend(dst).ResolveManifest(ctx, rc.repo, desc.Digest); err == nil {
+			continue
+		}
+		if err := rc.copyManifest(ctx, src, dst, desc.Digest, nil); err != nil {
+			return err
+		}
+	}
+	if _, err := rc.backend(dst).PushManifest(ctx, rc.repo, data, mediaType, &oci.PushManifestParameters{
+		Tags: tags,
+	}); err != nil {
+		return err
+	}
+	target := string(dig)
+	if len(tags) > 0 {
+		target = tags[0]
+	}
+	rc.repaired(dst, "PushManifest", target)
+	return nil
+}
+
+// copyBlob copies the given blob from backend src to backend dst.
+func (rc *reconciler) copyBlob(ctx context.Context, src, dst int, desc oci.Descriptor) error {
+	rd, err := rc.backend(src).GetBlob(ctx, rc.repo, desc.Digest)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	if _, err := rc.backend(dst).PushBlob(ctx, rc.repo, desc, rd); err != nil {
+		return err
+	}
+	rc.repaired(dst, "PushBlob", string(desc.Digest))
+	return nil
+}
@@ -0,0 +1,280 @@
+package ociunify
+
+import (
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/ocimem"
+	"github.com/jcarter3/oci/ocitest"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteNotFound(t *testing.T) {
+	ctx := context.Background()
+	r0, r1 := ocimem.New(), ocimem.New()
+	u := NewN([]Backend{{Registry: r0}, {Registry: r1}}, nil)
+	ocitest.NewRegistry(t, r0).MustPushBlob("foo", []byte("hello"))
+
+	// The blob is only in one of the backends,
+	// but that's not a divergence.
+	require.NoError(t, u.DeleteBlob(ctx, "foo", digest.FromString("hello")))
+	requireNoBlob(t, r0, "foo", "hello")
+	require.Empty(t, u.Divergences())
+
+	err := u.DeleteBlob(ctx, "foo", digest.FromString("hello"))
+	require.ErrorIs(t, err, oci.ErrBlobUnknown)
+}
+
+func TestPartialFailurePolicy(t *testing.T) {
+	ctx := context.Background()
+	r0 := ocimem.New()
+	r1 := &flaky{Interface: ocimem.New()}
+	r1.failing.Store(true)
+	backends := []Backend{{Registry: r0}, {Registry: r1}}
+
+	u := NewN(backends, nil)
+	_, err := u.PushBlob(ctx, "foo", oci.Descriptor{MediaType: "application/octet-stream", Digest: digest.FromString("hello"), Size: int64(len("hello"))}, strings.NewReader("hello"))
+	require.ErrorIs(t, err, errFlaky)
+	require.ErrorContains(t, err, "PushBlob succeeded on 1 of 2 backends")
+	requireBlob(t, r0, "foo", "hello")
+	divergences := u.Divergences()
+	require.Len(t, divergences, 1)
+	require.Equal(t, "PushBlob", divergences[0].Op)
+	require.Equal(t, "foo", divergences[0].Repo)
+	require.Equal(t, string(digest.FromString("hello")), divergences[0].Target)
+	require.Equal(t, []int{0}, divergences[0].Succeeded)
+	require.Equal(t, []int{1}, divergences[0].Failed)
+
+	var seen []Divergence
+	u = NewN(backends, &Options{
+		PartialFailurePolicy: PartialFailureTolerate,
+		OnDivergence: func(d Divergence) {
+			seen = append(seen, d)
+		},
+	})
+	// The manifest is pushed once by digest and once to tag it.
+	pushManifest(t, u, "foo", "m", "v1")
+	require.Len(t, seen, 3)
+	require.Equal(t, "PushBlob", seen[0].Op)
+	require.Equal(t, "PushManifest", seen[1].Op)
+	require.Equal(t, "PushManifest", seen[2].Op)
+	require.Equal(t, seen, u.Divergences())
+
+	// Chunked uploads carry on with the backends that succeed.
+	w, err := u.PushBlobChunked(ctx, "foo", 0)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("chunked"))
+	require.NoError(t, err)
+	_, err = w.Commit(digest.FromString("chunked"))
+	require.NoError(t, err)
+	requireBlob(t, r0, "foo", "chunked")
+	require.Len(t, seen, 4)
+	require.Equal(t, "PushBlobChunked", seen[3].Op)
+}
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+	r0 := ocimem.New()
+	r1 := &flaky{Interface: ocimem.New()}
+	u := NewN([]Backend{{Registry: r0}, {Registry: r1}}, &Options{
+		PartialFailurePolicy: PartialFailureTolerate,
+	})
+	// Content that has drifted apart outside the unified registry.
+	dig1 := pushManifest(t, r0, "foo", "1", "v1")
+	dig2 := pushManifest(t, r1, "foo", "2", "v2")
+	pushManifest(t, r0, "foo", "3", "conflict")
+	pushManifest(t, r1, "foo", "4", "conflict")
+	pushManifest(t, u, "foo", "5", "deleted")
+
+	// Writes and deletes made while one backend is failing.
+	r1.failing.Store(true)
+	require.NoError(t, u.DeleteTag(ctx, "foo", "deleted"))
+	untagged := pushManifest(t, u, "foo", "6")
+	ocitest.NewRegistry(t, u).MustPushBlob("foo", []byte("blob"))
+	r1.failing.Store(false)
+	require.Len(t, u.Divergences(), 4)
+
+	result, err := u.Reconcile(ctx, "foo")
+	require.NoError(t, err)
+	require.Equal(t, []string{"conflict"}, result.Conflicts)
+	require.Contains(t, result.Repairs, Repair{Backend: 1, Op: "DeleteTag", Target: "deleted"})
+	require.Contains(t, result.Repairs, Repair{Backend: 1, Op: "PushManifest", Target: "v1"})
+	require.Contains(t, result.Repairs, Repair{Backend: 0, Op: "PushManifest", Target: "v2"})
+	require.Contains(t, result.Repairs, Repair{Backend: 1, Op: "PushManifest", Target: string(untagged)})
+	require.Contains(t, result.Repairs, Repair{Backend: 1, Op: "PushBlob", Target: string(digest.FromString("blob"))})
+	require.Empty(t, u.Divergences())
+
+	for _, r := range []oci.Interface{r0, r1} {
+		require.Equal(t, []string{"conflict", "v1", "v2"}, tags(t, r, "foo"))
+		desc, err := r.ResolveTag(ctx, "foo", "v1")
+		require.NoError(t, err)
+		require.Equal(t, dig1, desc.Digest)
+		desc, err = r.ResolveTag(ctx, "foo", "v2")
+		require.NoError(t, err)
+		require.Equal(t, dig2, desc.Digest)
+		_, err = r.ResolveManifest(ctx, "foo", untagged)
+		require.NoError(t, err)
+		requireBlob(t, r, "foo", "blob")
+	}
+
+	// Nothing more to do.
+	result, err = u.Reconcile(ctx, "foo")
+	require.NoError(t, err)
+	require.Empty(t, result.Repairs)
+}
+
+func TestReconcileAfterRepush(t *testing.T) {
+	ctx := context.Background()
+	r0 := ocimem.New()
+	r1 := &flaky{Interface: ocimem.New()}
+	u := NewN([]Backend{{Registry: r0}, {Registry: r1}}, &Options{
+		PartialFailurePolicy: PartialFailureTolerate,
+	})
+	dig := pushManifest(t, u, "foo", "1", "v1")
+
+	// Delete the tag and the manifest while one backend is failing.
+	r1.failing.Store(true)
+	require.NoError(t, u.DeleteTag(ctx, "foo", "v1"))
+	require.NoError(t, u.DeleteManifest(ctx, "foo", dig))
+	r1.failing.Store(false)
+	require.Len(t, u.Divergences(), 2)
+
+	// Pushing them again supersedes the deletes, so
+	// reconciling doesn't delete them again.
+	require.Equal(t, dig, pushManifest(t, u, "foo", "1", "v1"))
+	require.Empty(t, u.Divergences())
+	_, err := u.Reconcile(ctx, "foo")
+	require.NoError(t, err)
+	for _, r := range []oci.Interface{r0, r1} {
+		desc, err := r.ResolveTag(ctx, "foo", "v1")
+		require.NoError(t, err)
+		require.Equal(t, dig, desc.Digest)
+	}
+}
+
+func TestReconcileReferrers(t *testing.T) {
+	ctx := context.Background()
+	r0, r1 := ocimem.New(), ocimem.New()
+	u := NewN([]Backend{{Registry: r0}, {Registry: r1}}, nil)
+	manifest := func(annotation, subject string) oci.Manifest {
+		m := oci.Manifest{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    oci.Descriptor{Digest: "config"},
+			Annotations: map[string]string{
+				"test": annotation,
+			},
+		}
+		if subject != "" {
+			m.Subject = &oci.Descriptor{Digest: oci.Digest(subject)}
+		}
+		return m
+	}
+	// Both backends hold the tagged content, but its referrers
+	// have drifted apart outside the unified registry.
+	content := func(referrers map[string]oci.Manifest) ocitest.RepoContent {
+		manifests := map[string]oci.Manifest{
+			"m": manifest("m", ""),
+			"e": manifest("e", ""),
+		}
+		maps.Copy(manifests, referrers)
+		return ocitest.RepoContent{
+			Blobs: map[string]string{
+				"config": "{}",
+			},
+			Manifests: manifests,
+			Indexes: map[string]ocispec.Index{
+				"idx": {
+					MediaType: ocispec.MediaTypeImageIndex,
+					Manifests: []oci.Descriptor{{Digest: "e"}},
+				},
+			},
+			Tags: map[string]string{
+				"v1":    "m",
+				"multi": "idx",
+			},
+		}
+	}
+	content0, err := ocitest.PushRepoContent(r0, "foo", content(map[string]oci.Manifest{
+		"sig":        manifest("sig", "m"),
+		"countersig": manifest("countersig", "sig"),
+	}))
+	require.NoError(t, err)
+	content1, err := ocitest.PushRepoContent(r1, "foo", content(map[string]oci.Manifest{
+		"entry-sig": manifest("entry-sig", "e"),
+	}))
+	require.NoError(t, err)
+	referrers := []oci.Digest{
+		content0.Manifests["sig"].Digest,
+		content0.Manifests["countersig"].Digest,
+		content1.Manifests["entry-sig"].Digest,
+	}
+
+	result, err := u.Reconcile(ctx, "foo")
+	require.NoError(t, err)
+	require.Contains(t, result.Repairs, Repair{Backend: 1, Op: "PushManifest", Target: string(referrers[0])})
+	require.Contains(t, result.Repairs, Repair{Backend: 1, Op: "PushManifest", Target: string(referrers[1])})
+	require.Contains(t, result.Repairs, Repair{Backend: 0, Op: "PushManifest", Target: string(referrers[2])})
+	for _, r := range []oci.Interface{r0, r1} {
+		for _, dig := range referrers {
+			_, err := r.ResolveManifest(ctx, "foo", dig)
+			require.NoError(t, err)
+		}
+	}
+
+	// Nothing more to do.
+	result, err = u.Reconcile(ctx, "foo")
+	require.NoError(t, err)
+	require.Empty(t, result.Repairs)
+}
+
+var errFlaky = errors.New("flaky backend failure")
+
+// flaky wraps a registry so that writes and deletes
+// fail while failing is set.
+type flaky struct {
+	oci.Interface
+	failing atomic.Bool
+}
+
+func (r *flaky) PushBlob(ctx context.Context, repo string, desc oci.Descriptor, rd io.Reader) (oci.Descriptor, error) {
+	if r.failing.Load() {
+		return oci.Descriptor{}, errFlaky
+	}
+	return r.Interface.PushBlob(ctx, repo, desc, rd)
+}
+
+func (r *flaky) PushBlobChunked(ctx context.Context, repo string, chunkSize int) (oci.BlobWriter, error) {
+	if r.failing.Load() {
+		return nil, errFlaky
+	}
+	return r.Interface.PushBlobChunked(ctx, repo, chunkSize)
+}
+
+func (r *flaky) PushManifest(ctx context.Context, repo string, contents []byte, mediaType string, params *oci.PushManifestParameters) (oci.Descriptor, error) {
+	if r.failing.Load() {
+		return oci.Descriptor{}, errFlaky
+	}
+	return r.Interface.PushManifest(ctx, repo, contents, mediaType, params)
+}
+
+func (r *flaky) DeleteTag(ctx context.Context, repo string, name string) error {
+	if r.failing.Load() {
+		return errFlaky
+	}
+	return r.Interface.DeleteTag(ctx, repo, name)
+}
+
+func (r *flaky) DeleteManifest(ctx context.Context, repo string, digest oci.Digest) error {
+	if r.failing.Load() {
+		return errFlaky
+	}
+	return r.Interface.DeleteManifest(ctx, repo, digest)
+}
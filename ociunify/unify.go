@@ -12,32 +12,131 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// Package ociunify unifies two OCI registries into one.
+// Package ociunify unifies several OCI registries into one.
 package ociunify
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"slices"
 
 	"github.com/jcarter3/oci"
 )
 
 // Options holds configuration for the unified registry.
 type Options struct {
-	ReadPolicy ReadPolicy
+	ReadPolicy           ReadPolicy
+	WritePolicy          WritePolicy
+	TagConflictPolicy    TagConflictPolicy
+	PartialFailurePolicy PartialFailurePolicy
+
+	// OnDivergence, if non-nil, is called whenever a write or delete
+	// leaves the backends out of step with one another.
+	// See [Registry.Divergences].
+	OnDivergence func(Divergence)
 }
 
-// ReadPolicy determines how the unified registry reads from its two backends.
+// ReadPolicy determines how the unified registry reads from its backends.
 type ReadPolicy int
 
 const (
-	// ReadSequential reads from both backends sequentially.
+	// ReadSequential reads from the backends sequentially.
 	ReadSequential ReadPolicy = iota
-	// ReadConcurrent reads from both backends concurrently.
+	// ReadConcurrent reads from the backends concurrently.
 	ReadConcurrent
 )
 
+// WritePolicy determines which of the backends with role
+// [RoleTarget] are written to.
+type WritePolicy int
+
+const (
+	// WriteAll writes to all the targets. A write
+	// fails unless it succeeds on all of them.
+	//
+	// A conditional write, such as a manifest push with
+	// [oci.PushManifestParameters.IfTagDigest] set, has its
+	// condition checked by the first target only. If that
+	// succeeds, the write is made to the other targets
+	// unconditionally, as it is to the mirrors, so that
+	// they follow the first target.
+	WriteAll WritePolicy = iota
+
+	// WritePrimaryOnly writes only to the first target.
+	WritePrimaryOnly
+
+	// WriteFirstSuccess writes to each target in turn until
+	// one succeeds. Blob content read from an [io.Reader] can
+	// only be written to more than one target if the
+	// reader implements [io.Seeker], and chunked uploads
+	// go to the first target that accepts the upload.
+	// Deletes are made on all the targets and succeed if
+	// any of them succeeds.
+	WriteFirstSuccess
+)
+
+// TagConflictPolicy determines what happens when a tag
+// resolves to different manifests in different backends.
+type TagConflictPolicy int
+
+const (
+	// TagConflictError returns an error when the tag is
+	// read directly. Tag listings still include the tag.
+	TagConflictError TagConflictPolicy = iota
+
+	// TagConflictFirstWins uses the tag from the first
+	// backend that has it.
+	TagConflictFirstWins
+
+	// TagConflictOmit treats the tag as if it did not exist,
+	// both when it's read directly and in tag listings.
+	TagConflictOmit
+)
+
+// PartialFailurePolicy determines what happens when a write or
+// delete succeeds on some of the targets it's made to but not others.
+// Either way, the resulting divergence is recorded so that it
+// can be repaired by [Registry.Reconcile].
+//
+// A delete that fails on some targets because the content
+// isn't there counts as having succeeded on them.
+type PartialFailurePolicy int
+
+const (
+	// PartialFailureError fails the operation.
+	PartialFailureError PartialFailurePolicy = iota
+
+	// PartialFailureTolerate treats the operation
+	// as successful.
+	PartialFailureTolerate
+)
+
+// Role determines how a backend is used by the unified registry.
+type Role int
+
+const (
+	// RoleTarget backends are read from and
+	// written to according to the [WritePolicy].
+	RoleTarget Role = iota
+
+	// RoleFallback backends are read-only. They are only read
+	// from when none of the other backends has the content.
+	RoleFallback
+
+	// RoleMirror backends are read from, and every write that
+	// succeeds on the targets is also made to them. A failure to
+	// write to a mirror does not cause the write to fail.
+	RoleMirror
+)
+
+// Backend holds a registry to be unified and its role.
+type Backend struct {
+	Registry oci.Interface
+	Role     Role
+}
+
 // New returns a registry that unifies the contents from both
 // the given registries. If there's a conflict, (for example a tag resolves
 // to a different thing on both repositories), it returns an error
@@ -46,35 +145,136 @@ const (
 //
 // Writes write to both repositories. Reads of immutable data
 // come from either.
+//
+// It's equivalent to calling [NewN] with two backends of role [RoleTarget].
 func New(r0, r1 oci.Interface, opts *Options) oci.Interface {
+	return NewN([]Backend{{Registry: r0}, {Registry: r1}}, opts)
+}
+
+// NewN returns a registry that unifies the contents of all the
+// given backends. Reads of immutable data come from any of the backends
+// other than fallbacks, or from the fallbacks if none of the others has
+// the data. Writes are made according to opts.WritePolicy, and tag
+// conflicts are resolved according to opts.TagConflictPolicy.
+//
+// Writes fail with [oci.ErrDenied] if there are no backends with role
+// [RoleTarget].
+func NewN(backends []Backend, opts *Options) *Registry {
 	if opts == nil {
 		opts = new(Options)
 	}
-	return unifier{
-		r0:   r0,
-		r1:   r1,
-		opts: *opts,
+	u := unifier{
+		backends: slices.Clone(backends),
+		opts:     *opts,
+		log:      new(divergenceLog),
 	}
+	for i, b := range backends {
+		switch b.Role {
+		case RoleTarget:
+			u.targets = append(u.targets, i)
+			u.readers = append(u.readers, i)
+		case RoleMirror:
+			u.mirrors = append(u.mirrors, i)
+			u.readers = append(u.readers, i)
+		case RoleFallback:
+			u.fallbacks = append(u.fallbacks, i)
+		default:
+			panic(fmt.Errorf("unknown role %d", b.Role))
+		}
+	}
+	return &Registry{u}
+}
+
+// Registry is the unified registry returned by [NewN].
+// It implements [oci.Interface].
+type Registry struct {
+	unifier
 }
 
 type unifier struct {
-	r0, r1 oci.Interface
-	opts   Options
+	backends []Backend
+
+	// The following fields hold indexes into backends.
+
+	// targets holds the backends with role RoleTarget.
+	targets []int
+	// mirrors holds the backends with role RoleMirror.
+	mirrors []int
+	// readers holds the backends that are read before fallbacks.
+	readers []int
+	// fallbacks holds the backends with role RoleFallback.
+	fallbacks []int
+
+	opts Options
+	log  *divergenceLog
 	*oci.Funcs
 }
 
-func bothResults[T result[T]](r0, r1 T) T {
-	if r0.error() == nil && r1.error() == nil {
-		return r0
+// all returns the results from calling f concurrently on each
+// of the backends with the given indexes, in the same order.
+func all[T any](u unifier, idxs []int, f func(r oci.Interface, i int) T) []T {
+	results := make([]T, len(idxs))
+	done := make(chan struct{})
+	for j, i := range idxs {
+		go func() {
+			results[j] = f(u.backends[i].Registry, i)
+			done <- struct{}{}
+		}()
+	}
+	for range idxs {
+		<-done
+	}
+	return results
+}
+
+// operation describes a write or delete for the purposes
+// of recording divergences.
+type operation struct {
+	name   string
+	repo   string
+	target string
+}
+
+// combineWrite combines the results of the write described by op from
+// the backends with the given indexes. It returns the first result if
+// they all succeeded, and an error if they all failed. If some failed
+// and others succeeded, it records the divergence and, unless tolerate
+// is true or the partial failure policy says otherwise, returns an
+// error. A failed precondition is never tolerated, because the
+// write was refused rather than failing.
+func combineWrite[T result[T]](u unifier, op operation, idxs []int, rs []T, tolerate bool) T {
+	var errs []error
+	var firstOK T
+	var succeeded, failed []int
+	for j, r := range rs {
+		if err := r.error(); err != nil {
+			errs = append(errs, fmt.Errorf("backend %d failed: %w", idxs[j], err))
+			failed = append(failed, idxs[j])
+			continue
+		}
+		if len(succeeded) == 0 {
+			firstOK = r
+		}
+		succeeded = append(succeeded, idxs[j])
 	}
 	var zero T
-	if r0.error() != nil && r1.error() != nil {
-		return zero.mkErr(fmt.Errorf("r0 and r1 failed: %w; %w", r0.error(), r1.error()))
+	switch {
+	case len(failed) == 0:
+		return firstOK
+	case len(succeeded) == 0 && len(rs) == 1:
+		return rs[0]
+	case len(succeeded) == 0:
+		return zero.mkErr(errors.Join(errs...))
 	}
-	if r0.error() != nil {
-		return zero.mkErr(fmt.Errorf("r0 failed: %w", r0.error()))
+	err := fmt.Errorf("%s succeeded on %d of %d backends: %w", op.name, len(succeeded), len(rs), errors.Join(errs...))
+	u.record(op, succeeded, failed, err)
+	if errors.Is(err, oci.ErrPreconditionFailed) {
+		return zero.mkErr(err)
+	}
+	if tolerate || u.opts.PartialFailurePolicy == PartialFailureTolerate {
+		return firstOK
 	}
-	return zero.mkErr(fmt.Errorf("r1 failed: %w", r1.error()))
+	return zero.mkErr(err)
 }
 
 type result[T any] interface {
@@ -83,19 +283,7 @@ type result[T any] interface {
 	mkErr(err error) T
 }
 
-// both returns the results from calling f on both registries concurrently.
-func both[T any](u unifier, f func(r oci.Interface, i int) T) (T, T) {
-	c0, c1 := make(chan T), make(chan T)
-	go func() {
-		c0 <- f(u.r0, 0)
-	}()
-	go func() {
-		c1 <- f(u.r1, 1)
-	}()
-	return <-c0, <-c1
-}
-
-// runRead calls f concurrently on each registry.
+// runRead calls f on each registry according to the read policy.
 // It returns the result from the first one that returns without error.
 // This should not be used if the return value is affected by cancelling the context.
 func runRead[T result[T]](ctx context.Context, u unifier, f func(ctx context.Context, r oci.Interface, i int) T) T {
@@ -104,66 +292,194 @@ func runRead[T result[T]](ctx context.Context, u unifier, f func(ctx context.Con
 	return r
 }
 
-// runReadWithCancel calls f concurrently on each registry.
+// runReadWithCancel calls f on each registry according to the read policy,
+// trying the fallbacks only when all the other registries fail.
 // It returns the result from the first one that returns without error
 // and a cancel function that should be called when the returned value is done with.
 func runReadWithCancel[T result[T]](ctx context.Context, u unifier, f func(ctx context.Context, r oci.Interface, i int) T) (T, func()) {
+	r, cancel := runReadGroup(ctx, u, u.readers, f)
+	if r.error() == nil || len(u.fallbacks) == 0 {
+		return r, cancel
+	}
+	cancel()
+	r1, cancel1 := runReadGroup(ctx, u, u.fallbacks, f)
+	if r1.error() == nil || len(u.readers) == 0 {
+		return r1, cancel1
+	}
+	cancel1()
+	return r, func() {}
+}
+
+func runReadGroup[T result[T]](ctx context.Context, u unifier, idxs []int, f func(ctx context.Context, r oci.Interface, i int) T) (T, func()) {
+	if len(idxs) == 0 {
+		return (*new(T)).mkErr(fmt.Errorf("no backends to read from: %w", oci.ErrNameUnknown)), func() {}
+	}
 	switch u.opts.ReadPolicy {
 	case ReadConcurrent:
-		return runReadConcurrent(ctx, u, f)
+		return runReadConcurrent(ctx, u, idxs, f)
 	case ReadSequential:
-		return runReadSequential(ctx, u, f), func() {}
+		return runReadSequential(ctx, u, idxs, f), func() {}
 	default:
 		panic("unreachable")
 	}
 }
 
-func runReadSequential[T result[T]](ctx context.Context, u unifier, f func(ctx context.Context, r oci.Interface, i int) T) T {
-	r := f(ctx, u.r0, 0)
-	if err := r.error(); err == nil {
-		return r
+func runReadSequential[T result[T]](ctx context.Context, u unifier, idxs []int, f func(ctx context.Context, r oci.Interface, i int) T) T {
+	var first T
+	for j, i := range idxs {
+		r := f(ctx, u.backends[i].Registry, i)
+		if err := r.error(); err == nil {
+			return r
+		}
+		if j == 0 {
+			first = r
+		}
 	}
-	return f(ctx, u.r1, 1)
+	return first
 }
 
-func runReadConcurrent[T result[T]](ctx context.Context, u unifier, f func(ctx context.Context, r oci.Interface, i int) T) (T, func()) {
+func runReadConcurrent[T result[T]](ctx context.Context, u unifier, idxs []int, f func(ctx context.Context, r oci.Interface, i int) T) (T, func()) {
 	done := make(chan struct{})
 	defer close(done)
 	type result struct {
 		r      T
+		j      int
 		cancel func()
 	}
 	c := make(chan result)
-	sender := func(f func(context.Context, oci.Interface, int) T, reg oci.Interface, i int) {
+	sender := func(reg oci.Interface, i, j int) {
 		ctx, cancel := context.WithCancel(ctx)
 		r := f(ctx, reg, i)
 		select {
-		case c <- result{r, cancel}:
+		case c <- result{r, j, cancel}:
 		case <-done:
 			r.close()
 			cancel()
 		}
 	}
-	go sender(f, u.r0, 0)
-	go sender(f, u.r1, 1)
-	select {
-	case r := <-c:
-		if r.r.error() == nil {
-			return r.r, r.cancel
+	for j, i := range idxs {
+		go sender(u.backends[i].Registry, i, j)
+	}
+	// When all fail, return the failure from the
+	// earliest backend, for consistency with ReadSequential.
+	var first result
+	first.j = len(idxs)
+	for range idxs {
+		select {
+		case r := <-c:
+			if r.r.error() == nil {
+				return r.r, r.cancel
+			}
+			r.cancel()
+			if r.j < first.j {
+				first = r
+			}
+		case <-ctx.Done():
+			return (*new(T)).mkErr(ctx.Err()), func() {}
 		}
-		r.cancel()
-	case <-ctx.Done():
-		return (*new(T)).mkErr(ctx.Err()), func() {}
 	}
-	// The first result was a failure. Try for the second, which might work.
-	select {
-	case r := <-c:
-		return r.r, r.cancel
-	case <-ctx.Done():
-		return (*new(T)).mkErr(ctx.Err()), func() {}
+	return first.r, func() {}
+}
+
+// runWrite calls f on the targets chosen by the write policy
+// and then, if that succeeds, on the mirrors.
+func runWrite[T result[T]](u unifier, op operation, f func(r oci.Interface, i int) T) T {
+	if len(u.targets) == 0 {
+		return (*new(T)).mkErr(errNoTargets)
+	}
+	var r T
+	switch u.opts.WritePolicy {
+	case WriteAll:
+		r = combineWrite(u, op, u.targets, all(u, u.targets, f), false)
+	case WritePrimaryOnly:
+		i := u.targets[0]
+		r = f(u.backends[i].Registry, i)
+	case WriteFirstSuccess:
+		for j, i := range u.targets {
+			r1 := f(u.backends[i].Registry, i)
+			// A failed precondition is a definitive answer: trying
+			// the next backend would defeat the point of it.
+			final := r1.error() == nil || errors.Is(r1.error(), oci.ErrPreconditionFailed)
+			if j == 0 || final {
+				r = r1
+			}
+			if final {
+				break
+			}
+		}
+	default:
+		panic("unreachable")
 	}
+	if r.error() == nil {
+		// Failures to write to mirrors are ignored.
+		all(u, u.mirrors, f)
+	}
+	return r
+}
+
+// runConditionalWrite is like runWrite, but for writes that only
+// succeed when a precondition holds. With the WriteAll policy, f is
+// called on the first target before any of the others, and the write
+// fails without being made anywhere else if it fails there. f is
+// expected to drop the condition for the other targets, so that they
+// follow the first one.
+func runConditionalWrite[T result[T]](u unifier, op operation, f func(r oci.Interface, i int) T) T {
+	if u.opts.WritePolicy != WriteAll || len(u.targets) < 2 {
+		return runWrite(u, op, f)
+	}
+	primary := u.targets[0]
+	r0 := f(u.backends[primary].Registry, primary)
+	if r0.error() != nil {
+		return r0
+	}
+	rs := append([]T{r0}, all(u, u.targets[1:], f)...)
+	r := combineWrite(u, op, u.targets, rs, false)
+	if r.error() == nil {
+		// Failures to write to mirrors are ignored.
+		all(u, u.mirrors, f)
+	}
+	return r
+}
+
+// runDelete calls f on the targets chosen by the write policy and the mirrors.
+// Unlike runWrite, it calls f on all the targets when the write
+// policy is WriteFirstSuccess, and succeeds if any of them succeeds.
+// A target that fails because the content isn't found counts as
+// having succeeded unless all of them fail that way.
+func runDelete(u unifier, op operation, f func(r oci.Interface, i int) t1) t1 {
+	if len(u.targets) == 0 {
+		return mk1(errNoTargets)
+	}
+	targets := u.targets
+	if u.opts.WritePolicy == WritePrimaryOnly {
+		targets = targets[:1]
+	}
+	rs := all(u, targets, f)
+	if !slices.ContainsFunc(rs, func(r t1) bool { return r.err == nil || !isNotFound(r.err) }) {
+		return rs[0]
+	}
+	for j := range rs {
+		if isNotFound(rs[j].err) {
+			rs[j].err = nil
+		}
+	}
+	r := combineWrite(u, op, targets, rs, u.opts.WritePolicy == WriteFirstSuccess)
+	if r.err == nil {
+		all(u, u.mirrors, f)
+	}
+	return r
 }
 
+// isNotFound reports whether err indicates that
+// the content being operated on doesn't exist.
+func isNotFound(err error) bool {
+	return errors.Is(err, oci.ErrBlobUnknown) ||
+		errors.Is(err, oci.ErrManifestUnknown) ||
+		errors.Is(err, oci.ErrNameUnknown)
+}
+
+var errNoTargets = fmt.Errorf("no backends to write to: %w", oci.ErrDenied)
+
 func mk1(err error) t1 {
 	return t1{err}
 }
@@ -0,0 +1,409 @@
+package ociunify
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/jcarter3/oci"
+	"github.com/jcarter3/oci/ocifilter"
+	"github.com/jcarter3/oci/ocimem"
+	"github.com/jcarter3/oci/ocitest"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoles(t *testing.T) {
+	ctx := context.Background()
+	target0, target1, mirror, fallback := ocimem.New(), ocimem.New(), ocimem.New(), ocimem.New()
+	u := NewN([]Backend{
+		{Registry: target0},
+		{Registry: fallback, Role: RoleFallback},
+		{Registry: mirror, Role: RoleMirror},
+		{Registry: target1},
+	}, nil)
+
+	ocitest.NewRegistry(t, u).MustPushBlob("foo", []byte("hello"))
+	requireBlob(t, target0, "foo", "hello")
+	requireBlob(t, target1, "foo", "hello")
+	requireBlob(t, mirror, "foo", "hello")
+	requireNoBlob(t, fallback, "foo", "hello")
+
+	// Content that's only in the fallback can still be read.
+	ocitest.NewRegistry(t, fallback).MustPushBlob("foo", []byte("fallback"))
+	requireBlob(t, u, "foo", "fallback")
+	pushManifest(t, fallback, "foo", "old", "v0")
+	pushManifest(t, u, "foo", "new", "v1")
+	require.Equal(t, []string{"v0", "v1"}, tags(t, u, "foo"))
+	_, err := u.ResolveTag(ctx, "foo", "v0")
+	require.NoError(t, err)
+
+	// Deletes don't affect the fallback either.
+	require.NoError(t, u.DeleteBlob(ctx, "foo", digest.FromString("hello")))
+	requireNoBlob(t, target0, "foo", "hello")
+	requireNoBlob(t, mirror, "foo", "hello")
+}
+
+func TestMirrorFailure(t *testing.T) {
+	target := ocimem.New()
+	u := NewN([]Backend{
+		{Registry: target},
+		{Registry: ocifilter.ReadOnly(ocimem.New()), Role: RoleMirror},
+	}, nil)
+	ocitest.NewRegistry(t, u).MustPushBlob("foo", []byte("hello"))
+	pushManifest(t, u, "foo", "m", "v1")
+	requireBlob(t, target, "foo", "hello")
+}
+
+func TestNoTargets(t *testing.T) {
+	u := NewN([]Backend{{Registry: ocimem.New(), Role: RoleFallback}}, nil)
+	_, err := u.PushBlob(context.Background(), "foo", oci.Descriptor{MediaType: "application/octet-stream", Digest: digest.FromString("hello"), Size: int64(len("hello"))}, strings.NewReader("hello"))
+	require.ErrorIs(t, err, oci.ErrDenied)
+}
+
+func TestWritePrimaryOnly(t *testing.T) {
+	primary, secondary, mirror := ocimem.New(), ocimem.New(), ocimem.New()
+	u := NewN([]Backend{
+		{Registry: primary},
+		{Registry: secondary},
+		{Registry: mirror, Role: RoleMirror},
+	}, &Options{
+		WritePolicy: WritePrimaryOnly,
+	})
+	ocitest.NewRegistry(t, u).MustPushBlob("foo", []byte("hello"))
+	requireBlob(t, primary, "foo", "hello")
+	requireBlob(t, mirror, "foo", "hello")
+	requireNoBlob(t, secondary, "foo", "hello")
+}
+
+func TestWriteFirstSuccess(t *testing.T) {
+	ctx := context.Background()
+	secondary := ocimem.New()
+	u := NewN([]Backend{
+		{Registry: ocifilter.ReadOnly(ocimem.New())},
+		{Registry: secondary},
+	}, &Options{
+		WritePolicy: WriteFirstSuccess,
+	})
+	// strings.Reader implements io.Seeker so the
+	// content can be pushed again.
+	ocitest.NewRegistry(t, u).MustPushBlob("foo", []byte("hello"))
+	requireBlob(t, secondary, "foo", "hello")
+	pushManifest(t, u, "foo", "m", "v1")
+	_, err := secondary.ResolveTag(ctx, "foo", "v1")
+	require.NoError(t, err)
+
+	// Without a seeker, only the first target can be tried.
+	_, err = u.PushBlob(ctx, "foo", oci.Descriptor{MediaType: "application/octet-stream", Digest: digest.FromString("other"), Size: int64(len("other"))}, io.MultiReader(strings.NewReader("other")))
+	require.ErrorIs(t, err, oci.ErrUnsupported)
+	requireNoBlob(t, secondary, "foo", "other")
+
+	// Chunked uploads go to the first target that accepts them.
+	w, err := u.PushBlobChunked(ctx, "foo", 0)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("chunked"))
+	require.NoError(t, err)
+	_, err = w.Commit(digest.FromString("chunked"))
+	require.NoError(t, err)
+	requireBlob(t, secondary, "foo", "chunked")
+
+	// Deletes succeed if any target succeeds.
+	require.NoError(t, u.DeleteBlob(ctx, "foo", digest.FromString("hello")))
+	requireNoBlob(t, secondary, "foo", "hello")
+}
+
+func TestPushBlobMirrorsFollowTargets(t *testing.T) {
+	ctx := context.Background()
+	secondary, mirror := ocimem.New(), ocimem.New()
+	u := NewN([]Backend{
+		{Registry: ocifilter.ReadOnly(ocimem.New())},
+		{Registry: secondary},
+		{Registry: mirror, Role: RoleMirror},
+	}, &Options{
+		WritePolicy: WriteFirstSuccess,
+	})
+	// When no target accepts the blob, neither does the mirror.
+	_, err := u.PushBlob(ctx, "foo", oci.Descriptor{MediaType: "application/octet-stream", Digest: digest.FromString("other"), Size: int64(len("other"))}, io.MultiReader(strings.NewReader("other")))
+	require.ErrorIs(t, err, oci.ErrUnsupported)
+	requireNoBlob(t, secondary, "foo", "other")
+	requireNoBlob(t, mirror, "foo", "other")
+
+	// When a later target accepts it, the mirror follows.
+	ocitest.NewRegistry(t, u).MustPushBlob("foo", []byte("hello"))
+	requireBlob(t, secondary, "foo", "hello")
+	requireBlob(t, mirror, "foo", "hello")
+
+	// The same applies when all the targets are written to.
+	mirror = ocimem.New()
+	u = NewN([]Backend{
+		{Registry: ocifilter.ReadOnly(ocimem.New())},
+		{Registry: mirror, Role: RoleMirror},
+	}, nil)
+	_, err = u.PushBlob(ctx, "foo", oci.Descriptor{MediaType: "application/octet-stream", Digest: digest.FromString("hello"), Size: int64(len("hello"))}, strings.NewReader("hello"))
+	require.ErrorIs(t, err, oci.ErrUnsupported)
+	requireNoBlob(t, mirror, "foo", "hello")
+}
+
+func TestChunkedCommitMirrorsFollowTargets(t *testing.T) {
+	ctx := context.Background()
+	mirror := ocimem.New()
+	// The target only refuses the blob when it's committed.
+	u := NewN([]Backend{
+		{Registry: ocifilter.Quota(ocimem.New(), []ocifilter.QuotaLimit{{MaxBlobBytes: 1}})},
+		{Registry: mirror, Role: RoleMirror},
+	}, nil)
+	w, err := u.PushBlobChunked(ctx, "foo", 0)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.Commit(digest.FromString("hello"))
+	require.ErrorIs(t, err, oci.ErrDenied)
+	requireNoBlob(t, mirror, "foo", "hello")
+
+	// When the target accepts it, the mirror follows.
+	w, err = u.PushBlobChunked(ctx, "foo", 0)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("h"))
+	require.NoError(t, err)
+	_, err = w.Commit(digest.FromString("h"))
+	require.NoError(t, err)
+	requireBlob(t, mirror, "foo", "h")
+}
+
+func TestPushManifestIfTagDigest(t *testing.T) {
+	ctx := context.Background()
+	target0, target1, mirror := ocimem.New(), ocimem.New(), ocimem.New()
+	u := NewN([]Backend{
+		{Registry: target0},
+		{Registry: target1},
+		{Registry: mirror, Role: RoleMirror},
+	}, nil)
+	old := pushManifest(t, u, "foo", "old", "stable")
+	// The mirror has fallen behind.
+	pushManifest(t, mirror, "foo", "stale", "stable")
+
+	// Push the new manifest untagged so that only
+	// the tag update is conditional.
+	data := ocitest.NewRegistry(t, u).MustPushContent(ocitest.RegistryContent{
+		"foo": annotatedManifest("new"),
+	})["foo"].ManifestData["m"]
+	_, err := u.PushManifest(ctx, "foo", data, ocispec.MediaTypeImageManifest, &oci.PushManifestParameters{
+		Tags:        []string{"stable"},
+		IfTagDigest: old,
+	})
+	require.NoError(t, err)
+	for _, r := range []oci.Interface{target0, target1, mirror} {
+		desc, err := r.ResolveTag(ctx, "foo", "stable")
+		require.NoError(t, err)
+		require.Equal(t, digest.FromBytes(data), desc.Digest)
+	}
+
+	// With WriteAll, the first target checks the condition
+	// and the others follow it even if they've fallen behind.
+	target0, target1 = ocimem.New(), ocimem.New()
+	u = NewN([]Backend{
+		{Registry: target0},
+		{Registry: target1},
+	}, &Options{
+		PartialFailurePolicy: PartialFailureTolerate,
+	})
+	old = pushManifest(t, target0, "foo", "old", "stable")
+	pushManifest(t, target1, "foo", "stale", "stable")
+	_, err = u.PushManifest(ctx, "foo", data, ocispec.MediaTypeImageManifest, &oci.PushManifestParameters{
+		Tags:        []string{"stable"},
+		IfTagDigest: old,
+	})
+	require.NoError(t, err)
+	for _, r := range []oci.Interface{target0, target1} {
+		desc, err := r.ResolveTag(ctx, "foo", "stable")
+		require.NoError(t, err)
+		require.Equal(t, digest.FromBytes(data), desc.Digest)
+	}
+
+	// A failed precondition on the first target fails the write,
+	// even when partial failures are tolerated, and leaves the
+	// other targets alone.
+	target0, target1 = ocimem.New(), ocimem.New()
+	u = NewN([]Backend{
+		{Registry: target0},
+		{Registry: target1},
+	}, &Options{
+		PartialFailurePolicy: PartialFailureTolerate,
+	})
+	pushManifest(t, target0, "foo", "moved", "stable")
+	old = pushManifest(t, target1, "foo", "old", "stable")
+	_, err = u.PushManifest(ctx, "foo", data, ocispec.MediaTypeImageManifest, &oci.PushManifestParameters{
+		Tags:        []string{"stable"},
+		IfTagDigest: old,
+	})
+	require.ErrorIs(t, err, oci.ErrPreconditionFailed)
+	desc, err := target1.ResolveTag(ctx, "foo", "stable")
+	require.NoError(t, err)
+	require.Equal(t, old, desc.Digest)
+	require.Empty(t, u.Divergences())
+
+	// With WriteFirstSuccess, a failed precondition
+	// isn't retried on the next target.
+	target0, target1 = ocimem.New(), ocimem.New()
+	u = NewN([]Backend{
+		{Registry: target0},
+		{Registry: target1},
+	}, &Options{
+		WritePolicy: WriteFirstSuccess,
+	})
+	pushManifest(t, target0, "foo", "moved", "stable")
+	old = pushManifest(t, target1, "foo", "old", "stable")
+	_, err = u.PushManifest(ctx, "foo", data, ocispec.MediaTypeImageManifest, &oci.PushManifestParameters{
+		Tags:        []string{"stable"},
+		IfTagDigest: old,
+	})
+	require.ErrorIs(t, err, oci.ErrPreconditionFailed)
+	desc, err = target1.ResolveTag(ctx, "foo", "stable")
+	require.NoError(t, err)
+	require.Equal(t, old, desc.Digest)
+}
+
+func TestTagConflictPolicy(t *testing.T) {
+	ctx := context.Background()
+	r0, r1 := ocimem.New(), ocimem.New()
+	dig0 := pushManifest(t, r0, "foo", "a", "v1", "same")
+	pushManifest(t, r1, "foo", "b", "v1")
+	pushManifest(t, r1, "foo", "a", "same")
+	backends := []Backend{{Registry: r0}, {Registry: r1}}
+
+	u := NewN(backends, nil)
+	_, err := u.ResolveTag(ctx, "foo", "v1")
+	require.ErrorContains(t, err, "conflicting results")
+	_, err = u.GetTag(ctx, "foo", "v1")
+	require.ErrorContains(t, err, "conflicting results")
+	require.Equal(t, []string{"same", "v1"}, tags(t, u, "foo"))
+
+	u = NewN(backends, &Options{
+		TagConflictPolicy: TagConflictFirstWins,
+	})
+	desc, err := u.ResolveTag(ctx, "foo", "v1")
+	require.NoError(t, err)
+	require.Equal(t, dig0, desc.Digest)
+	rd, err := u.GetTag(ctx, "foo", "v1")
+	require.NoError(t, err)
+	require.Equal(t, dig0, rd.Descriptor().Digest)
+	rd.Close()
+
+	u = NewN(backends, &Options{
+		TagConflictPolicy: TagConflictOmit,
+	})
+	_, err = u.ResolveTag(ctx, "foo", "v1")
+	require.ErrorIs(t, err, oci.ErrManifestUnknown)
+	require.Equal(t, []string{"same"}, tags(t, u, "foo"))
+}
+
+func TestTagsParameters(t *testing.T) {
+	ctx := context.Background()
+	r0, r1 := ocimem.New(), ocimem.New()
+	pushManifest(t, r0, "foo", "a", "a", "c", "e")
+	pushManifest(t, r1, "foo", "a", "b", "c", "d")
+	// "c" conflicts.
+	pushManifest(t, r1, "foo", "b", "c")
+	backends := []Backend{{Registry: r0}, {Registry: r1}}
+
+	params := &oci.TagsParameters{
+		StartAfter: "a",
+		Limit:      3,
+	}
+	got, err := oci.All(NewN(backends, nil).Tags(ctx, "foo", params))
+	require.NoError(t, err)
+	require.Equal(t, []string{"b", "c", "d"}, got)
+
+	// Omitted tags don't count towards the limit.
+	got, err = oci.All(NewN(backends, &Options{
+		TagConflictPolicy: TagConflictOmit,
+	}).Tags(ctx, "foo", params))
+	require.NoError(t, err)
+	require.Equal(t, []string{"b", "d", "e"}, got)
+}
+
+func TestChunkedResume(t *testing.T) {
+	ctx := context.Background()
+	r0, r1, mirror := ocimem.New(), ocimem.New(), ocimem.New()
+	u := NewN([]Backend{
+		{Registry: r0},
+		{Registry: mirror, Role: RoleMirror},
+		{Registry: r1},
+	}, &Options{
+		ReadPolicy: ReadConcurrent,
+	})
+	content := strings.Repeat("x", 100)
+	w, err := u.PushBlobChunked(ctx, "foo", 0)
+	require.NoError(t, err)
+	_, err = w.Write([]byte(content[:50]))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	w, err = u.PushBlobChunkedResume(ctx, "foo", w.ID(), 50, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(50), w.Size())
+	_, err = w.Write([]byte(content[50:]))
+	require.NoError(t, err)
+	desc, err := w.Commit(digest.FromString(content))
+	require.NoError(t, err)
+	require.Equal(t, int64(100), desc.Size)
+	for _, r := range []oci.Interface{r0, r1, mirror, u} {
+		requireBlob(t, r, "foo", content)
+	}
+}
+
+func requireBlob(t *testing.T, r oci.Interface, repo, content string) {
+	rd, err := r.GetBlob(context.Background(), repo, digest.FromString(content))
+	require.NoError(t, err)
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	require.NoError(t, err)
+	require.Equal(t, content, string(data))
+}
+
+func requireNoBlob(t *testing.T, r oci.Interface, repo, content string) {
+	_, err := r.ResolveBlob(context.Background(), repo, digest.FromString(content))
+	require.Error(t, err)
+}
+
+// pushManifest pushes a manifest distinguished by the given
+// annotation with the given tags, and returns its digest.
+func pushManifest(t *testing.T, r oci.Interface, repo, annotation string, tags ...string) oci.Digest {
+	content := ocitest.NewRegistry(t, r).MustPushContent(ocitest.RegistryContent{
+		repo: annotatedManifest(annotation, tags...),
+	})
+	return content[repo].Manifests["m"].Digest
+}
+
+// annotatedManifest returns repository content holding a manifest
+// with identifier "m", distinguished by the given annotation,
+// with the given tags.
+func annotatedManifest(annotation string, tags ...string) ocitest.RepoContent {
+	tagMap := make(map[string]string)
+	for _, tag := range tags {
+		tagMap[tag] = "m"
+	}
+	return ocitest.RepoContent{
+		Blobs: map[string]string{
+			"config": "{}",
+		},
+		Manifests: map[string]oci.Manifest{
+			"m": {
+				MediaType: ocispec.MediaTypeImageManifest,
+				Config:    oci.Descriptor{Digest: "config"},
+				Annotations: map[string]string{
+					"test": annotation,
+				},
+			},
+		},
+		Tags: tagMap,
+	}
+}
+
+func tags(t *testing.T, r oci.Interface, repo string) []string {
+	tags, err := oci.All(r.Tags(context.Background(), repo, nil))
+	require.NoError(t, err)
+	return tags
+}
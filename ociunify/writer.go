@@ -15,64 +15,290 @@
 package ociunify
 
 import (
+	"cmp"
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
 
 	"github.com/jcarter3/oci"
+	"github.com/opencontainers/go-digest"
 )
 
 func (u unifier) PushBlob(ctx context.Context, repo string, desc oci.Descriptor, r io.Reader) (oci.Descriptor, error) {
-	resultc := make(chan t2[oci.Descriptor])
-	onePush := func(ri oci.Interface, r *io.PipeReader) {
-		desc, err := ri.PushBlob(ctx, repo, desc, r)
-		r.CloseWithError(err)
-		resultc <- t2[oci.Descriptor]{desc, err}
-	}
-	pr0, pw0 := io.Pipe()
-	pr1, pw1 := io.Pipe()
-	go onePush(u.r0, pr0)
-	go onePush(u.r1, pr1)
+	if len(u.targets) == 0 {
+		return oci.Descriptor{}, errNoTargets
+	}
+	// With WriteFirstSuccess, the content can be written to
+	// the other targets only if we can read it again.
+	var seeker io.Seeker
+	var start int64
+	if u.opts.WritePolicy == WriteFirstSuccess && len(u.targets) > 1 {
+		if s, ok := r.(io.Seeker); ok {
+			if offset, err := s.Seek(0, io.SeekCurrent); err == nil {
+				seeker, start = s, offset
+			}
+		}
+	}
+	targets := u.targets
+	if u.opts.WritePolicy != WriteAll {
+		targets = targets[:1]
+	}
+	// The content is streamed to the mirrors at the same time as
+	// to the targets, but it's only committed to them once the
+	// targets have accepted it, so a mirror never holds a blob
+	// that no target holds.
+	mirrors := u.mirrorWriters(ctx, repo)
+	rs := u.pushBlob(ctx, repo, desc, r, targets, mirrors)
+	op := operation{"PushBlob", repo, string(desc.Digest)}
+	if slices.ContainsFunc(rs, func(r t2[oci.Descriptor]) bool { return r.err == nil }) {
+		u.wrote(op, nil)
+	}
+	result := combineWrite(u, op, targets, rs, false)
+	if result.err == nil {
+		commitWriters(mirrors, desc.Digest)
+		return result.get()
+	}
+	cancelWriters(mirrors)
+	if seeker == nil {
+		return result.get()
+	}
+	for _, i := range u.targets[1:] {
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			break
+		}
+		if r1 := mk2(u.backends[i].Registry.PushBlob(ctx, repo, desc, r)); r1.err == nil {
+			u.wrote(op, nil)
+			// The mirrors didn't get all the content the first
+			// time round, so push it to them again.
+			if _, err := seeker.Seek(start, io.SeekStart); err == nil && len(u.mirrors) > 0 {
+				u.pushBlob(ctx, repo, desc, r, u.mirrors, nil)
+			}
+			return r1.get()
+		}
+	}
+	return result.get()
+}
+
+// mirrorWriters starts an upload to each of the mirrors,
+// omitting those that fail.
+func (u unifier) mirrorWriters(ctx context.Context, repo string) []oci.BlobWriter {
+	var ws []oci.BlobWriter
+	for _, r := range all(u, u.mirrors, func(r oci.Interface, _ int) t2[oci.BlobWriter] {
+		return mk2(r.PushBlobChunked(ctx, repo, 0))
+	}) {
+		if r.err == nil {
+			ws = append(ws, r.x)
+		}
+	}
+	return ws
+}
+
+// commitWriters commits all of ws concurrently, cancelling any that fail.
+func commitWriters(ws []oci.BlobWriter, digest oci.Digest) {
+	var wg sync.WaitGroup
+	for _, w := range ws {
+		wg.Go(func() {
+			if _, err := w.Commit(digest); err != nil {
+				w.Cancel()
+			}
+		})
+	}
+	wg.Wait()
+}
+
+// cancelWriters cancels all of ws.
+func cancelWriters(ws []oci.BlobWriter) {
+	for _, w := range ws {
+		w.Cancel()
+	}
+}
+
+// pushBlob pushes the content of r to all the backends
+// with the given indexes concurrently, and returns the
+// results in the same order. The content is also written
+// to each of extra, which are dropped if they fail;
+// pushBlob stops writing to them if all the backends fail.
+func (u unifier) pushBlob(ctx context.Context, repo string, desc oci.Descriptor, r io.Reader, idxs []int, extra []oci.BlobWriter) []t2[oci.Descriptor] {
+	results := make([]t2[oci.Descriptor], len(idxs))
+	if len(idxs) == 1 && len(extra) == 0 {
+		results[0] = mk2(u.backends[idxs[0]].Registry.PushBlob(ctx, repo, desc, r))
+		return results
+	}
+	pws := make([]*io.PipeWriter, len(idxs))
+	ws := make([]io.Writer, len(idxs), len(idxs)+len(extra))
+	var wg sync.WaitGroup
+	for j, i := range idxs {
+		pr, pw := io.Pipe()
+		pws[j], ws[j] = pw, pw
+		wg.Go(func() {
+			desc, err := u.backends[i].Registry.PushBlob(ctx, repo, desc, pr)
+			pr.CloseWithError(err)
+			results[j] = t2[oci.Descriptor]{desc, err}
+		})
+	}
+	for _, w := range extra {
+		ws = append(ws, w)
+	}
+	copied := make(chan struct{})
 	go func() {
-		_, err := io.Copy(io.MultiWriter(pw0, pw1), r)
-		pw0.CloseWithError(err)
-		pw1.CloseWithError(err)
+		defer close(copied)
+		_, err := io.Copy(&fanoutWriter{ws: ws, required: len(idxs)}, r)
+		for _, pw := range pws {
+			pw.CloseWithError(err)
+		}
 	}()
-	r0 := <-resultc
-	r1 := <-resultc
-	if (r0.err == nil) == (r1.err == nil) {
-		return r0.get()
+	wg.Wait()
+	if len(extra) > 0 {
+		// Wait until the extra writers are no longer being
+		// written to, so that the caller can commit them.
+		<-copied
 	}
-	return oci.Descriptor{}, fmt.Errorf("one push succeeded where the other failed (TODO better error)")
+	return results
+}
+
+// fanoutWriter writes to all of ws, dropping any writers that
+// fail. It fails only when all the required writers at the start
+// of ws have failed, so that one failing backend doesn't stop
+// the others from receiving the content.
+type fanoutWriter struct {
+	ws       []io.Writer
+	required int
+	err      error
+}
+
+func (w *fanoutWriter) Write(buf []byte) (int, error) {
+	live := w.ws[:0]
+	required := 0
+	for j, w1 := range w.ws {
+		if _, err := w1.Write(buf); err != nil {
+			if w.err == nil {
+				w.err = err
+			}
+			continue
+		}
+		if j < w.required {
+			required++
+		}
+		live = append(live, w1)
+	}
+	w.ws, w.required = live, required
+	if required == 0 {
+		return 0, w.err
+	}
+	return len(buf), nil
 }
 
 func (u unifier) PushManifest(ctx context.Context, repo string, contents []byte, mediaType string, params *oci.PushManifestParameters) (oci.Descriptor, error) {
-	r0, r1 := both(u, func(r oci.Interface, _ int) t2[oci.Descriptor] {
-		return mk2(r.PushManifest(ctx, repo, contents, mediaType, params))
-	})
-	if (r0.err == nil) == (r1.err == nil) {
-		return r0.get()
+	var followParams *oci.PushManifestParameters
+	if params != nil && params.IfTagDigest != "" {
+		// The condition is checked by the first target when writing
+		// to all of them (see [WriteAll]), and by the targets
+		// otherwise. Once that's accepted the update, the other
+		// backends should follow it even if they've fallen behind.
+		p := *params
+		p.IfTagDigest = ""
+		followParams = &p
+	}
+	op := operation{"PushManifest", repo, string(digest.FromBytes(contents))}
+	var written atomic.Bool
+	push := func(r oci.Interface, i int) t2[oci.Descriptor] {
+		p := params
+		if followParams != nil && u.follows(i) {
+			p = followParams
+		}
+		res := mk2(r.PushManifest(ctx, repo, contents, mediaType, p))
+		if res.err == nil {
+			written.Store(true)
+		}
+		return res
+	}
+	var result t2[oci.Descriptor]
+	if followParams != nil {
+		result = runConditionalWrite(u, op, push)
+	} else {
+		result = runWrite(u, op, push)
 	}
-	return oci.Descriptor{}, fmt.Errorf("one push succeeded where the other failed (TODO better error)")
+	if written.Load() {
+		var tags []string
+		if params != nil {
+			tags = params.Tags
+		}
+		u.wrote(op, tags)
+	}
+	return result.get()
+}
+
+// follows reports whether a conditional write to the backend
+// with index i is made unconditionally because the condition
+// has already been checked elsewhere.
+func (u unifier) follows(i int) bool {
+	if u.backends[i].Role == RoleMirror {
+		return true
+	}
+	return u.opts.WritePolicy == WriteAll && i != u.targets[0]
 }
 
 func (u unifier) PushBlobChunked(ctx context.Context, repo string, chunkSize int) (oci.BlobWriter, error) {
-	r0, r1 := both(u, func(r oci.Interface, i int) t2[oci.BlobWriter] {
+	if len(u.targets) == 0 {
+		return nil, errNoTargets
+	}
+	push := func(r oci.Interface, _ int) t2[oci.BlobWriter] {
 		return mk2(r.PushBlobChunked(ctx, repo, chunkSize))
-	})
-	if r0.err != nil || r1.err != nil {
-		r0.close()
-		r1.close()
-		return nil, bothResults(r0, r1).err
 	}
-	w0, w1 := r0.x, r1.x
-	size := w0.Size() // assumed to agree with w1.Size
-	return &unifiedBlobWriter{
-		w:    [2]oci.BlobWriter{w0, w1},
-		size: size,
-	}, nil
+	w := u.newBlobWriter(repo)
+	switch u.opts.WritePolicy {
+	case WriteAll:
+		rs := all(u, u.targets, push)
+		var errs []error
+		for j, i := range u.targets {
+			if err := rs[j].err; err != nil {
+				errs = append(errs, fmt.Errorf("backend %d failed: %w", i, err))
+				continue
+			}
+			w.w[i], w.required[i] = rs[j].x, true
+		}
+		if len(errs) > 0 && (len(errs) == len(rs) || u.opts.PartialFailurePolicy != PartialFailureTolerate) {
+			w.Cancel()
+			if len(rs) == 1 {
+				return nil, rs[0].err
+			}
+			return nil, errors.Join(errs...)
+		}
+		w.err = errors.Join(errs...)
+	case WritePrimaryOnly, WriteFirstSuccess:
+		targets := u.targets
+		if u.opts.WritePolicy == WritePrimaryOnly {
+			targets = targets[:1]
+		}
+		var firstErr error
+		for _, i := range targets {
+			bw, err := u.backends[i].Registry.PushBlobChunked(ctx, repo, chunkSize)
+			if err == nil {
+				w.w[i], w.required[i] = bw, true
+				break
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if !slices.Contains(w.required, true) {
+			return nil, firstErr
+		}
+	default:
+		panic("unreachable")
+	}
+	for j, r := range all(u, u.mirrors, push) {
+		if r.err == nil {
+			w.w[u.mirrors[j]] = r.x
+		}
+	}
+	return w, nil
 }
 
 func (u unifier) PushBlobChunkedResume(ctx context.Context, repo, id string, offset int64, chunkSize int) (oci.BlobWriter, error) {
@@ -84,65 +310,187 @@ func (u unifier) PushBlobChunkedResume(ctx context.Context, repo, id string, off
 	if err := json.Unmarshal(data, &ids); err != nil {
 		return nil, fmt.Errorf("malformed ID %q: %v", id, err)
 	}
-	if len(ids) != 2 {
-		return nil, fmt.Errorf("malformed ID %q (expected two elements)", id)
+	if len(ids) != len(u.backends) {
+		return nil, fmt.Errorf("malformed ID %q (expected %d elements)", id, len(u.backends))
 	}
-	r0, r1 := both(u, func(r oci.Interface, i int) t2[oci.BlobWriter] {
+	var idxs []int
+	for i, id := range ids {
+		if id != "" {
+			idxs = append(idxs, i)
+		}
+	}
+	rs := all(u, idxs, func(r oci.Interface, i int) t2[oci.BlobWriter] {
 		return mk2(r.PushBlobChunkedResume(ctx, repo, ids[i], offset, chunkSize))
 	})
-	if r0.err != nil || r1.err != nil {
-		r0.close()
-		r1.close()
-		return nil, bothResults(r0, r1).err
-	}
-	w0, w1 := r0.x, r1.x
-	size := w0.Size()
-	if w1.Size() != size {
-		r0.close()
-		r1.close()
-		return nil, fmt.Errorf("registries do not agree on upload size; please start upload again")
+	w := u.newBlobWriter(repo)
+	w.size = -1
+	cancelAll := func() {
+		for _, r := range rs {
+			if r.err == nil {
+				r.x.Cancel()
+			}
+		}
 	}
-	return &unifiedBlobWriter{
-		w:    [2]oci.BlobWriter{w0, w1},
-		size: size,
-	}, nil
+	for j, i := range idxs {
+		r := rs[j]
+		if u.backends[i].Role == RoleMirror {
+			continue
+		}
+		if r.err != nil {
+			if u.opts.PartialFailurePolicy == PartialFailureTolerate {
+				w.err = cmp.Or(w.err, r.err)
+				continue
+			}
+			cancelAll()
+			return nil, r.err
+		}
+		if w.size == -1 {
+			w.size = r.x.Size()
+		} else if r.x.Size() != w.size {
+			cancelAll()
+			return nil, fmt.Errorf("registries do not agree on upload size; please start upload again")
+		}
+		w.w[i], w.required[i] = r.x, true
+	}
+	if w.size == -1 {
+		cancelAll()
+		return nil, fmt.Errorf("malformed ID %q (no target upload)", id)
+	}
+	// Mirrors that fail or have got out of step are dropped.
+	for j, i := range idxs {
+		r := rs[j]
+		if u.backends[i].Role != RoleMirror || r.err != nil {
+			continue
+		}
+		if r.x.Size() != w.size {
+			r.x.Cancel()
+			continue
+		}
+		w.w[i] = r.x
+	}
+	return w, nil
 }
 
 func (u unifier) MountBlob(ctx context.Context, fromRepo, toRepo string, digest oci.Digest) (oci.Descriptor, error) {
-	return bothResults(both(u,
-		func(r oci.Interface, _ int) t2[oci.Descriptor] {
-			return mk2(r.MountBlob(ctx, fromRepo, toRepo, digest))
-		},
-	)).get()
+	op := operation{"MountBlob", toRepo, string(digest)}
+	var written atomic.Bool
+	result := runWrite(u, op, func(r oci.Interface, _ int) t2[oci.Descriptor] {
+		res := mk2(r.MountBlob(ctx, fromRepo, toRepo, digest))
+		if res.err == nil {
+			written.Store(true)
+		}
+		return res
+	})
+	if written.Load() {
+		u.wrote(op, nil)
+	}
+	return result.get()
 }
 
+// unifiedBlobWriter writes to a blob writer in each
+// of the backends being written to.
 type unifiedBlobWriter struct {
 	u    unifier
-	w    [2]oci.BlobWriter
+	repo string
+
+	// w holds the writer for each backend, or nil
+	// if the backend isn't being written to.
+	w []oci.BlobWriter
+
+	// required holds whether the upload fails when
+	// the writer for each backend fails. Writers that
+	// aren't required are dropped when they fail.
+	required []bool
+
+	// err holds the first error from a required writer that
+	// has been dropped under PartialFailureTolerate.
+	err error
+
 	size int64
 }
 
+func (u unifier) newBlobWriter(repo string) *unifiedBlobWriter {
+	return &unifiedBlobWriter{
+		u:        u,
+		repo:     repo,
+		w:        make([]oci.BlobWriter, len(u.backends)),
+		required: make([]bool, len(u.backends)),
+	}
+}
+
+// each calls f concurrently on each writer and returns the error
+// from the first required writer that fails. Writers that aren't
+// required are cancelled and dropped when f fails, as are required
+// writers under PartialFailureTolerate as long as another
+// required writer remains.
+func (w *unifiedBlobWriter) each(f func(bw oci.BlobWriter, i int) error) error {
+	errs := make([]error, len(w.w))
+	var wg sync.WaitGroup
+	for i, bw := range w.w {
+		if bw != nil {
+			wg.Go(func() {
+				errs[i] = f(bw, i)
+			})
+		}
+	}
+	wg.Wait()
+	tolerate := w.u.opts.PartialFailurePolicy == PartialFailureTolerate
+	var err error
+	for i, err1 := range errs {
+		switch {
+		case err1 == nil:
+		case w.required[i] && (!tolerate || w.numRequired() == 1):
+			err = cmp.Or(err, err1)
+		default:
+			if w.required[i] {
+				w.required[i] = false
+				w.err = cmp.Or(w.err, err1)
+			}
+			w.w[i].Cancel()
+			w.w[i] = nil
+		}
+	}
+	return err
+}
+
+func (w *unifiedBlobWriter) numRequired() int {
+	n := 0
+	for _, required := range w.required {
+		if required {
+			n++
+		}
+	}
+	return n
+}
+
 func (w *unifiedBlobWriter) Write(buf []byte) (int, error) {
-	r := bothResults(both(w.u, func(_ oci.Interface, i int) t2[int] {
-		return mk2(w.w[i].Write(buf))
-	}))
-	if r.err != nil {
-		return 0, r.err
+	if err := w.each(func(bw oci.BlobWriter, _ int) error {
+		_, err := bw.Write(buf)
+		return err
+	}); err != nil {
+		return 0, err
 	}
 	w.size += int64(len(buf))
 	return len(buf), nil
 }
 
 func (w *unifiedBlobWriter) Close() error {
-	return bothResults(both(w.u, func(_ oci.Interface, i int) t1 {
-		return mk1(w.w[i].Close())
-	})).err
+	return w.each(func(bw oci.BlobWriter, _ int) error {
+		return bw.Close()
+	})
 }
 
 func (w *unifiedBlobWriter) Cancel() error {
-	return bothResults(both(w.u, func(_ oci.Interface, i int) t1 {
-		return mk1(w.w[i].Cancel())
-	})).err
+	var errs []error
+	for i, bw := range w.w {
+		if bw == nil {
+			continue
+		}
+		if err := bw.Cancel(); err != nil && w.required[i] {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
 }
 
 func (w *unifiedBlobWriter) Size() int64 {
@@ -150,18 +498,72 @@ func (w *unifiedBlobWriter) Size() int64 {
 }
 
 func (w *unifiedBlobWriter) ChunkSize() int {
-	// ChunkSize can be derived from the server's required minimum, so take the maximum between both.
-	// ChunkSize is usually a cheap method, so there's no need to call both concurrently.
-	return max(w.w[0].ChunkSize(), w.w[1].ChunkSize())
+	// ChunkSize can be derived from the server's required minimum, so take the maximum.
+	// ChunkSize is usually a cheap method, so there's no need to call them concurrently.
+	chunkSize := 0
+	for _, bw := range w.w {
+		if bw != nil {
+			chunkSize = max(chunkSize, bw.ChunkSize())
+		}
+	}
+	return chunkSize
 }
 
 func (w *unifiedBlobWriter) ID() string {
-	data, _ := json.Marshal([]string{w.w[0].ID(), w.w[1].ID()})
+	ids := make([]string, len(w.w))
+	for i, bw := range w.w {
+		if bw != nil {
+			ids[i] = bw.ID()
+		}
+	}
+	data, _ := json.Marshal(ids)
 	return base64.RawURLEncoding.EncodeToString(data)
 }
 
 func (w *unifiedBlobWriter) Commit(digest oci.Digest) (oci.Descriptor, error) {
-	return bothResults(both(w.u, func(_ oci.Interface, i int) t2[oci.Descriptor] {
-		return mk2(w.w[i].Commit(digest))
-	})).get()
+	// As for PushBlob, the mirrors are only committed once the
+	// targets have accepted the blob, so a mirror never holds
+	// a blob that no target holds.
+	var mirrors []oci.BlobWriter
+	for i, bw := range w.w {
+		if bw != nil && !w.required[i] {
+			mirrors = append(mirrors, bw)
+			w.w[i] = nil
+		}
+	}
+	descs := make([]oci.Descriptor, len(w.w))
+	committed := make([]bool, len(w.w))
+	err := w.each(func(bw oci.BlobWriter, i int) error {
+		desc, err := bw.Commit(digest)
+		descs[i], committed[i] = desc, err == nil
+		return err
+	})
+	op := operation{"PushBlobChunked", w.repo, string(digest)}
+	if slices.Contains(committed, true) {
+		w.u.wrote(op, nil)
+		commitWriters(mirrors, digest)
+	} else {
+		cancelWriters(mirrors)
+	}
+	if w.u.opts.WritePolicy == WriteAll {
+		// Any target that hasn't committed the blob is out of step.
+		var succeeded, failed []int
+		for _, i := range w.u.targets {
+			if committed[i] {
+				succeeded = append(succeeded, i)
+			} else {
+				failed = append(failed, i)
+			}
+		}
+		if len(succeeded) > 0 && len(failed) > 0 {
+			w.u.record(op, succeeded, failed, cmp.Or(err, w.err, errUploadAbandoned))
+		}
+	}
+	if err != nil {
+		return oci.Descriptor{}, err
+	}
+	i := slices.Index(w.required, true)
+	return descs[i], nil
 }
+
+var errUploadAbandoned = fmt.Errorf("upload abandoned")
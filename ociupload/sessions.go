@@ -0,0 +1,194 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ociupload helps registry implementations keep track of
+// in-progress chunked blob uploads, so that uploads abandoned by
+// their clients expire rather than holding on to memory or disk
+// for ever.
+package ociupload
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultTTL holds the default time that an upload
+// session can be inactive before it expires.
+const DefaultTTL = time.Hour
+
+// Options holds options for [New].
+type Options[V any] struct {
+	// TTL holds how long a session can go without activity
+	// before it expires. If it's zero, [DefaultTTL] is used;
+	// if it's negative, sessions never expire.
+	TTL time.Duration
+
+	// OnExpire, if non-nil, is called with the value of each
+	// session that's removed because it has expired, so that any
+	// associated resources, such as temporary files, can be
+	// released. It's not called with any locks held.
+	OnExpire func(v V)
+
+	// Now returns the current time.
+	// By default [time.Now] is used.
+	Now func() time.Time
+}
+
+// Sessions holds a set of upload sessions keyed by K, each holding
+// a value of type V, typically the state of the upload so far.
+// A session's last activity time is updated whenever it's added
+// or retrieved.
+//
+// Expired sessions are removed by [Sessions.Purge], which is also
+// called by [Sessions.Add] when at least TTL has passed since the
+// last purge, so that expired sessions are bounded even if Purge
+// is never called explicitly.
+//
+// It's OK to call methods concurrently on a Sessions value.
+type Sessions[K comparable, V any] struct {
+	opts Options[V]
+
+	mu        sync.Mutex
+	sessions  map[K]*session[V]
+	lastPurge time.Time
+}
+
+type session[V any] struct {
+	value      V
+	lastActive time.Time
+}
+
+// New returns a new empty set of sessions.
+// A nil opts is equivalent to a pointer to zero Options.
+func New[K comparable, V any](opts *Options[V]) *Sessions[K, V] {
+	var opts1 Options[V]
+	if opts != nil {
+		opts1 = *opts
+	}
+	if opts1.TTL == 0 {
+		opts1.TTL = DefaultTTL
+	}
+	if opts1.Now == nil {
+		opts1.Now = time.Now
+	}
+	return &Sessions[K, V]{
+		opts:      opts1,
+		sessions:  make(map[K]*session[V]),
+		lastPurge: opts1.Now(),
+	}
+}
+
+// Add adds a session with the given key and value,
+// replacing any existing session with the same key.
+func (s *Sessions[K, V]) Add(key K, v V) {
+	now := s.opts.Now()
+	s.mu.Lock()
+	s.sessions[key] = &session[V]{
+		value:      v,
+		lastActive: now,
+	}
+	purge := s.opts.TTL > 0 && now.Sub(s.lastPurge) >= s.opts.TTL
+	s.mu.Unlock()
+	if purge {
+		s.Purge()
+	}
+}
+
+// Get returns the value of the session with the given key and
+// records activity on it. It reports false if there's no such
+// session or if it has expired, in which case it's removed.
+func (s *Sessions[K, V]) Get(key K) (V, bool) {
+	now := s.opts.Now()
+	s.mu.Lock()
+	sess, ok := s.sessions[key]
+	if !ok {
+		s.mu.Unlock()
+		return *new(V), false
+	}
+	if s.expired(sess, now) {
+		delete(s.sessions, key)
+		s.mu.Unlock()
+		s.expire(sess.value)
+		return *new(V), false
+	}
+	sess.lastActive = now
+	s.mu.Unlock()
+	return sess.value, true
+}
+
+// Remove removes the session with the given key, for example
+// because the upload has completed or been canceled.
+// It doesn't call OnExpire.
+func (s *Sessions[K, V]) Remove(key K) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, key)
+}
+
+// Len returns the number of sessions, including
+// any expired sessions that have yet to be purged.
+func (s *Sessions[K, V]) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+// Purge removes all the expired sessions and
+// returns the number of sessions removed.
+func (s *Sessions[K, V]) Purge() int {
+	now := s.opts.Now()
+	var expired []V
+	s.mu.Lock()
+	for key, sess := range s.sessions {
+		if s.expired(sess, now) {
+			delete(s.sessions, key)
+			expired = append(expired, sess.value)
+		}
+	}
+	s.lastPurge = now
+	s.mu.Unlock()
+	for _, v := range expired {
+		s.expire(v)
+	}
+	return len(expired)
+}
+
+// PurgeEvery calls [Sessions.Purge] at the given interval
+// until ctx is done. It's intended to be run in its own
+// goroutine by long-running registries.
+func (s *Sessions[K, V]) PurgeEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Purge()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// expired reports whether sess has expired at time now.
+// It's called with s.mu held.
+func (s *Sessions[K, V]) expired(sess *session[V], now time.Time) bool {
+	return s.opts.TTL > 0 && now.Sub(sess.lastActive) >= s.opts.TTL
+}
+
+func (s *Sessions[K, V]) expire(v V) {
+	if s.opts.OnExpire != nil {
+		s.opts.OnExpire(v)
+	}
+}
@@ -0,0 +1,115 @@
+package ociupload
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestSessions(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var expired []string
+	s := New[string, string](&Options[string]{
+		TTL: time.Minute,
+		Now: clock.Now,
+		OnExpire: func(v string) {
+			expired = append(expired, v)
+		},
+	})
+	s.Add("a", "upload a")
+	s.Add("b", "upload b")
+	s.Add("c", "upload c")
+
+	clock.advance(40 * time.Second)
+	// Getting a session counts as activity.
+	v, ok := s.Get("a")
+	require.True(t, ok)
+	require.Equal(t, "upload a", v)
+	s.Remove("c")
+
+	clock.advance(40 * time.Second)
+	require.Equal(t, 2, s.Len())
+	// An expired session is removed when it's retrieved.
+	_, ok = s.Get("b")
+	require.False(t, ok)
+	require.Equal(t, []string{"upload b"}, expired)
+	require.Equal(t, 1, s.Len())
+
+	clock.advance(40 * time.Second)
+	require.Equal(t, 1, s.Purge())
+	require.Equal(t, []string{"upload b", "upload a"}, expired)
+	require.Zero(t, s.Len())
+	_, ok = s.Get("a")
+	require.False(t, ok)
+}
+
+func TestSessionsAddPurges(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := New[int, int](&Options[int]{
+		TTL: time.Minute,
+		Now: clock.Now,
+	})
+	for i := range 10 {
+		s.Add(i, i)
+	}
+	clock.advance(time.Minute)
+	// Adding a session purges the abandoned ones
+	// once a TTL has passed since the last purge.
+	s.Add(10, 10)
+	require.Equal(t, 1, s.Len())
+	clock.advance(time.Second)
+	s.Add(11, 11)
+	require.Equal(t, 2, s.Len())
+}
+
+func TestSessionsNoExpiry(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := New[string, int](&Options[int]{
+		TTL: -1,
+		Now: clock.Now,
+	})
+	s.Add("a", 1)
+	clock.advance(1000 * time.Hour)
+	require.Zero(t, s.Purge())
+	v, ok := s.Get("a")
+	require.True(t, ok)
+	require.Equal(t, 1, v)
+}
+
+func TestPurgeEvery(t *testing.T) {
+	s := New[string, int](&Options[int]{
+		TTL: time.Millisecond,
+	})
+	s.Add("a", 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.PurgeEvery(ctx, time.Millisecond)
+	}()
+	require.Eventually(t, func() bool {
+		return s.Len() == 0
+	}, 5*time.Second, time.Millisecond)
+	cancel()
+	<-done
+}
@@ -0,0 +1,160 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oci
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RateLimitStatus holds the request quota reported by a registry
+// in the headers of a response.
+//
+// It understands the RateLimit-Limit and RateLimit-Remaining headers in
+// the form used by Docker Hub, for example "100;w=21600", the
+// RateLimit-Reset header, and the standard Retry-After header.
+type RateLimitStatus struct {
+	// Limit holds the number of requests permitted in each
+	// window, or -1 if it wasn't reported.
+	Limit int
+
+	// Remaining holds the number of requests remaining in
+	// the current window, or -1 if it wasn't reported.
+	Remaining int
+
+	// Window holds the length of the window,
+	// or zero if it wasn't reported.
+	Window time.Duration
+
+	// Reset holds the time until the quota is replenished,
+	// or zero if it wasn't reported.
+	Reset time.Duration
+
+	// RetryAfter holds how long to wait before making another
+	// request, or zero if it wasn't reported.
+	RetryAfter time.Duration
+
+	// Time holds the time that the response was received.
+	Time time.Time
+}
+
+// ParseRateLimit parses the rate-limit headers in h, received at the
+// given time. It reports false if there are no such headers.
+func ParseRateLimit(h http.Header, now time.Time) (RateLimitStatus, bool) {
+	rl := RateLimitStatus{
+		Limit:     -1,
+		Remaining: -1,
+		Time:      now,
+	}
+	found := false
+	if n, w, ok := parseRateLimitValue(h.Get("RateLimit-Limit")); ok {
+		rl.Limit, rl.Window, found = n, w, true
+	}
+	if n, w, ok := parseRateLimitValue(h.Get("RateLimit-Remaining")); ok {
+		rl.Remaining, found = n, true
+		if rl.Window == 0 {
+			rl.Window = w
+		}
+	}
+	if secs, err := strconv.Atoi(h.Get("RateLimit-Reset")); err == nil && secs >= 0 {
+		rl.Reset, found = time.Duration(secs)*time.Second, true
+	}
+	if d, ok := parseRetryAfter(h.Get("Retry-After"), now); ok {
+		rl.RetryAfter, found = d, true
+	}
+	return rl, found
+}
+
+// parseRateLimitValue parses a value such as "100;w=21600",
+// returning the count and the window, if any.
+func parseRateLimitValue(s string) (int, time.Duration, bool) {
+	if s == "" {
+		return 0, 0, false
+	}
+	// Some registries send a list of policies; the first one is
+	// the one currently in effect.
+	s, _, _ = strings.Cut(s, ",")
+	countStr, params, _ := strings.Cut(s, ";")
+	n, err := strconv.Atoi(strings.TrimSpace(countStr))
+	if err != nil || n < 0 {
+		return 0, 0, false
+	}
+	var window time.Duration
+	for p := range strings.SplitSeq(params, ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		if k != "w" {
+			continue
+		}
+		if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+			window = time.Duration(secs) * time.Second
+		}
+	}
+	return n, window, true
+}
+
+// parseRetryAfter parses a Retry-After header, which
+// holds either a number of seconds or an HTTP date.
+func parseRetryAfter(s string, now time.Time) (time.Duration, bool) {
+	if s == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(s); err == nil {
+		return max(time.Duration(secs)*time.Second, 0), true
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		return max(t.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// Exhausted reports whether the quota is known to have
+// been used up when the response was received.
+func (rl RateLimitStatus) Exhausted() bool {
+	return rl.Remaining == 0
+}
+
+// ReplenishedAt returns the earliest time at which it's worth
+// making another request when the quota has been exhausted.
+// If there's no Retry-After or RateLimit-Reset information,
+// it assumes that the quota is replenished evenly over the window.
+// It returns the zero time if nothing is known.
+func (rl RateLimitStatus) ReplenishedAt() time.Time {
+	switch {
+	case rl.RetryAfter > 0:
+		return rl.Time.Add(rl.RetryAfter)
+	case rl.Reset > 0:
+		return rl.Time.Add(rl.Reset)
+	case rl.Limit > 0 && rl.Window > 0:
+		return rl.Time.Add(rl.Window / time.Duration(rl.Limit))
+	}
+	return time.Time{}
+}
+
+// RateLimitFromError returns the rate-limit state attached to err, which
+// is present when err is an [HTTPError] created by [NewHTTPError] for a
+// 429 (Too Many Requests) response. It reports false if there is none.
+func RateLimitFromError(err error) (RateLimitStatus, bool) {
+	var rlErr interface {
+		error
+		RateLimitStatus() (RateLimitStatus, bool)
+	}
+	if errors.As(err, &rlErr) {
+		return rlErr.RateLimitStatus()
+	}
+	return RateLimitStatus{}, false
+}
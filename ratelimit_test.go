@@ -0,0 +1,109 @@
+package oci
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var parseRateLimitTests = []struct {
+	testName string
+	header   http.Header
+	want     RateLimitStatus
+	wantOK   bool
+}{{
+	testName: "NoHeaders",
+	header:   http.Header{},
+	want:     RateLimitStatus{Limit: -1, Remaining: -1},
+}, {
+	testName: "DockerHub",
+	header: http.Header{
+		"Ratelimit-Limit":     {"100;w=21600"},
+		"Ratelimit-Remaining": {"76;w=21600"},
+	},
+	want:   RateLimitStatus{Limit: 100, Remaining: 76, Window: 6 * time.Hour},
+	wantOK: true,
+}, {
+	testName: "PlainWithReset",
+	header: http.Header{
+		"Ratelimit-Limit":     {"10"},
+		"Ratelimit-Remaining": {"0"},
+		"Ratelimit-Reset":     {"30"},
+	},
+	want:   RateLimitStatus{Limit: 10, Remaining: 0, Reset: 30 * time.Second},
+	wantOK: true,
+}, {
+	testName: "MultiplePolicies",
+	header: http.Header{
+		"Ratelimit-Limit": {"10;w=1, 1000;w=3600"},
+	},
+	want:   RateLimitStatus{Limit: 10, Remaining: -1, Window: time.Second},
+	wantOK: true,
+}, {
+	testName: "RetryAfterSeconds",
+	header: http.Header{
+		"Retry-After": {"120"},
+	},
+	want:   RateLimitStatus{Limit: -1, Remaining: -1, RetryAfter: 2 * time.Minute},
+	wantOK: true,
+}, {
+	testName: "RetryAfterDate",
+	header: http.Header{
+		"Retry-After": {"Sun, 18 Oct 2026 12:01:00 GMT"},
+	},
+	want:   RateLimitStatus{Limit: -1, Remaining: -1, RetryAfter: time.Minute},
+	wantOK: true,
+}, {
+	testName: "Malformed",
+	header: http.Header{
+		"Ratelimit-Limit": {"lots"},
+		"Retry-After":     {"soon"},
+	},
+	want: RateLimitStatus{Limit: -1, Remaining: -1},
+}}
+
+func TestParseRateLimit(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	for _, test := range parseRateLimitTests {
+		t.Run(test.testName, func(t *testing.T) {
+			rl, ok := ParseRateLimit(test.header, now)
+			require.Equal(t, test.wantOK, ok)
+			test.want.Time = now
+			require.Equal(t, test.want, rl)
+		})
+	}
+}
+
+func TestRateLimitReplenishedAt(t *testing.T) {
+	now := time.Now()
+	rl := RateLimitStatus{Limit: 100, Remaining: 0, Window: 100 * time.Second, Time: now}
+	require.True(t, rl.Exhausted())
+	require.Equal(t, now.Add(time.Second), rl.ReplenishedAt())
+	rl.Reset = 5 * time.Second
+	require.Equal(t, now.Add(5*time.Second), rl.ReplenishedAt())
+	rl.RetryAfter = 10 * time.Second
+	require.Equal(t, now.Add(10*time.Second), rl.ReplenishedAt())
+	require.True(t, RateLimitStatus{Limit: -1, Remaining: -1}.ReplenishedAt().IsZero())
+}
+
+func TestRateLimitFromError(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: http.StatusTooManyRequests,
+		Header: http.Header{
+			"Retry-After": {"60"},
+		},
+	}
+	err := NewHTTPError(ErrTooManyRequests, http.StatusTooManyRequests, resp, nil)
+	rl, ok := RateLimitFromError(err)
+	require.True(t, ok)
+	require.Equal(t, time.Minute, rl.RetryAfter)
+	require.True(t, rl.Exhausted())
+
+	_, ok = RateLimitFromError(NewHTTPError(ErrNameUnknown, http.StatusNotFound, &http.Response{}, nil))
+	require.False(t, ok)
+	_, ok = RateLimitFromError(errors.New("other"))
+	require.False(t, ok)
+}